@@ -0,0 +1,49 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"time"
+)
+
+// CommitResult is the result of an asynchronous commit.
+type CommitResult struct {
+	Version Version
+	Err     error
+}
+
+// CommitAsync commits the staged changes in the background and returns the channel receiving the result,
+// the tree must not be changed until the result is received. Close waits for the in-flight commits.
+func (tree *BNBSparseMerkleTree) CommitAsync(recentVersion *Version) <-chan CommitResult {
+	result := make(chan CommitResult, 1)
+	tree.inflight.Add(1)
+	go func() {
+		defer tree.inflight.Done()
+		version, err := tree.Commit(recentVersion)
+		result <- CommitResult{Version: version, Err: err}
+		close(result)
+	}()
+	return result
+}
+
+// waitInflight waits for the in-flight asynchronous commits, at most the close timeout if it is positive.
+func (tree *BNBSparseMerkleTree) waitInflight() error {
+	done := make(chan struct{})
+	go func() {
+		tree.inflight.Wait()
+		close(done)
+	}()
+	if tree.closeTimeout <= 0 {
+		<-done
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case <-time.After(tree.closeTimeout):
+		return ErrCloseTimeout
+	}
+}
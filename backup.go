@@ -0,0 +1,171 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/ethereum/go-ethereum/rlp"
+
+	"github.com/bnb-chain/zkbnb-smt/database"
+)
+
+var (
+	backupHeader  = []byte(`bsmt:backup`)
+	backupTrailer = []byte(`bsmt:backup:end`)
+)
+
+// backupRecord is a key, value pair of the storage in the backup file,
+// the file starts with the header record and ends with the trailer record holding the number of records.
+type backupRecord struct {
+	Key   []byte
+	Value []byte
+}
+
+// backupBatch writes the records to the backup file.
+type backupBatch struct {
+	w     *bufio.Writer
+	count uint64
+	size  int
+}
+
+var _ database.Batcher = (*backupBatch)(nil)
+
+func (b *backupBatch) Set(key []byte, value []byte) error {
+	b.count++
+	b.size += len(key) + len(value)
+	return rlp.Encode(b.w, &backupRecord{Key: key, Value: value})
+}
+
+func (b *backupBatch) Delete([]byte) error {
+	return ErrUnexpected
+}
+
+func (b *backupBatch) Write() error {
+	b.size = 0
+	return b.w.Flush()
+}
+
+func (b *backupBatch) Reset() {}
+
+func (b *backupBatch) ValueSize() int {
+	return b.size
+}
+
+// BackupTo writes the nodes reachable from the latest root and the tree metadata to a single file at path,
+// which RestoreFrom loads into an empty database. The commits and rollbacks are blocked while the file is written,
+// and the uncommitted changes are not included. The file is written aside and renamed into path when complete,
+// so path never holds a partial backup.
+func (tree *BNBSparseMerkleTree) BackupTo(path string) (err error) {
+	tree.commitMu.Lock()
+	defer tree.commitMu.Unlock()
+
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	batch := &backupBatch{w: bufio.NewWriter(file)}
+	if err = rlp.Encode(batch.w, &backupRecord{Key: backupHeader}); err != nil {
+		return err
+	}
+	if err = tree.copyTo(tree.storage(), batch, 0); err != nil {
+		return err
+	}
+	count := make([]byte, 8)
+	binary.BigEndian.PutUint64(count, batch.count)
+	if err = rlp.Encode(batch.w, &backupRecord{Key: backupTrailer, Value: count}); err != nil {
+		return err
+	}
+	if err = batch.Write(); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// RestoreFrom loads the backup file at path written by BackupTo into db, which must not hold a tree.
+// The whole file is verified before anything is written to db.
+func RestoreFrom(path string, db database.TreeDB) error {
+	if has, err := db.Has(latestVersionKey); err != nil {
+		return err
+	} else if has {
+		return ErrDatabaseNotEmpty
+	}
+	if err := readBackup(path, func(*backupRecord) error { return nil }); err != nil {
+		return err
+	}
+
+	batch := db.NewBatch()
+	err := readBackup(path, func(record *backupRecord) error {
+		if err := batch.Set(record.Key, record.Value); err != nil {
+			return err
+		}
+		if batch.ValueSize() > 100*1024 {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return batch.Write()
+}
+
+// readBackup calls the callback with the records of the backup file in order,
+// it fails with ErrInvalidBackup if the file is not a complete backup.
+func readBackup(path string, callback func(record *backupRecord) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stream := rlp.NewStream(bufio.NewReader(file), 0)
+	header := &backupRecord{}
+	if err := stream.Decode(header); err != nil || !bytes.Equal(header.Key, backupHeader) {
+		return ErrInvalidBackup
+	}
+	var count uint64
+	for {
+		record := &backupRecord{}
+		if err := stream.Decode(record); err == io.EOF {
+			// the trailer is missing
+			return ErrInvalidBackup
+		} else if err != nil {
+			return ErrInvalidBackup
+		}
+		if bytes.Equal(record.Key, backupTrailer) {
+			if len(record.Value) != 8 || binary.BigEndian.Uint64(record.Value) != count {
+				return ErrInvalidBackup
+			}
+			return nil
+		}
+		count++
+		if err := callback(record); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"sort"
+	"sync"
+)
+
+// BatchWriter buffers the changes to a tree, and applies them in one pass on commit,
+// so that every node on the changed paths is copied and hashed exactly once.
+// It is safe for concurrent use.
+type BatchWriter struct {
+	tree  *BNBSparseMerkleTree
+	mu    sync.Mutex
+	items map[uint64][]byte
+}
+
+func (tree *BNBSparseMerkleTree) NewBatchWriter() *BatchWriter {
+	return &BatchWriter{
+		tree:  tree,
+		items: make(map[uint64][]byte),
+	}
+}
+
+// Set buffers the key, value pair, the latest value wins if the key is set repeatedly.
+func (w *BatchWriter) Set(key uint64, val []byte) error {
+	if err := w.tree.checkSealed(); err != nil {
+		return err
+	}
+	if key>>w.tree.maxDepth != 0 {
+		return ErrInvalidKey
+	}
+	val = w.tree.leafValue(val)
+	if err := w.tree.checkLeafSize(val); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.items[key] = val
+	return nil
+}
+
+// Commit applies the buffered changes as a new version and commits the tree.
+func (w *BatchWriter) Commit() (Version, error) {
+	if err := w.tree.checkSealed(); err != nil {
+		return w.tree.LatestVersion(), err
+	}
+	if err := w.tree.checkPending(); err != nil {
+		return w.tree.version, err
+	}
+	w.mu.Lock()
+	items := make([]Item, 0, len(w.items))
+	for key, val := range w.items {
+		items = append(items, Item{Key: key, Val: val})
+	}
+	w.items = make(map[uint64][]byte)
+	w.mu.Unlock()
+
+	for _, item := range items {
+		w.tree.recordAccess(uint64Path(item.Key))
+	}
+	if err := w.stage(items); err != nil {
+		return w.tree.version, err
+	}
+	return w.tree.Commit(nil)
+}
+
+// stage sets the items on the root of the tree as the next version, serialized with the other setters.
+func (w *BatchWriter) stage(items []Item) error {
+	if len(items) == 0 {
+		return nil
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Key < items[j].Key
+	})
+
+	w.tree.writeMu.Lock()
+	defer w.tree.writeMu.Unlock()
+	root, err := w.tree.setBatch(w.tree.root, items, w.tree.version+1)
+	if err != nil {
+		return err
+	}
+	w.tree.root = root
+	return nil
+}
+
+// setBatch sets the sorted items under the node, and returns the copy of the node holding the changes.
+func (tree *BNBSparseMerkleTree) setBatch(node *TreeNode, items []Item, newVersion Version) (*TreeNode, error) {
+	copied := node.Copy()
+	if node.depth == tree.maxDepth {
+		copied.Set(items[len(items)-1].Val, newVersion)
+		return tree.journalNode(copied)
+	}
+
+	depth := node.depth + 4
+	for len(items) > 0 {
+		path := uint64Path(items[0].Key).rsh(int(tree.maxDepth - depth))
+		nibble := path.nibble()
+		// the items sharing the child are adjacent as they are sorted
+		end := sort.Search(len(items), func(i int) bool {
+			return path.less(uint64Path(items[i].Key).rsh(int(tree.maxDepth - depth)))
+		})
+		if err := tree.extendNode(node, nibble, path, depth, true); err != nil {
+			return nil, err
+		}
+		child, err := tree.setBatch(node.Children[nibble], items[:end], newVersion)
+		if err != nil {
+			return nil, err
+		}
+		copied.Children[nibble] = child
+		items = items[end:]
+	}
+
+	copied.ComputeInternalHash()
+	copied.Set(tree.hasher.HashChildren(copied.Internals[0], copied.Internals[1]), newVersion)
+	return tree.journalNode(copied)
+}
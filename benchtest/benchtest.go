@@ -0,0 +1,172 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package benchtest
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/ants/v2"
+
+	bsmt "github.com/bnb-chain/zkbnb-smt"
+	"github.com/bnb-chain/zkbnb-smt/database/memory"
+)
+
+// CommitsPerSecond is the unit of the throughput metric reported by RunCommitBenchmark.
+const CommitsPerSecond = "commits/s"
+
+// BenchConfig describes the workload driven by RunCommitBenchmark.
+type BenchConfig struct {
+	// Depth is the depth of the tree, 16 if zero.
+	Depth uint8
+	// Keys is the number of keys committed before the benchmark starts.
+	Keys int
+	// ChangeRate is the fraction of the keys updated in each commit, at least one key is updated.
+	ChangeRate float64
+	// Parallelism is the size of the goroutine pool of the tree, the default pool is used if zero.
+	Parallelism int
+	// Seed seeds the choice of the updated keys.
+	Seed int64
+	// Commits is the number of versions committed by each iteration of the benchmark to a tree
+	// reset to the initial keys, so the results of the runs are comparable whatever their b.N.
+	// If zero, the benchmark commits b.N versions to the same tree.
+	Commits int
+	// Options are appended to the options of the tree.
+	Options []bsmt.Option
+}
+
+func (cfg BenchConfig) depth() uint8 {
+	if cfg.Depth == 0 {
+		return 16
+	}
+	return cfg.Depth
+}
+
+func (cfg BenchConfig) changes() int {
+	changes := int(float64(cfg.Keys) * cfg.ChangeRate)
+	if changes < 1 {
+		return 1
+	}
+	return changes
+}
+
+// RunCommitBenchmark commits versions to a tree backed by the memory database, each of them
+// updates cfg.ChangeRate of the cfg.Keys keys, and reports the allocations and the commits per second.
+// The number of commits is b.N, or cfg.Commits per iteration if it is set.
+func RunCommitBenchmark(b *testing.B, cfg BenchConfig) {
+	depth := cfg.depth()
+	if cfg.Keys <= 0 || (depth < 64 && uint64(cfg.Keys) > 1<<depth) {
+		b.Fatalf("invalid key count %d for depth %d", cfg.Keys, depth)
+	}
+
+	hasher := bsmt.NewHasherPool(func() hash.Hash { return sha256.New() })
+	var opts []bsmt.Option
+	if cfg.Parallelism > 0 {
+		pool, err := ants.NewPool(cfg.Parallelism)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer pool.Release()
+		opts = append(opts, bsmt.GoRoutinePool(pool))
+	}
+	opts = append(opts, cfg.Options...)
+
+	commits, iterations := b.N, 1
+	if cfg.Commits > 0 {
+		commits, iterations = cfg.Commits, b.N
+	}
+	changes := make([]bsmt.Item, cfg.changes())
+	b.ReportAllocs()
+	b.ResetTimer()
+	var elapsed time.Duration
+	for i := 0; i < iterations; i++ {
+		b.StopTimer()
+		smt, keys := newTree(b, cfg, hasher, opts)
+		random := rand.New(rand.NewSource(cfg.Seed))
+		b.StartTimer()
+
+		start := time.Now()
+		for n := 0; n < commits; n++ {
+			for j := range changes {
+				changes[j] = bsmt.Item{Key: keys[random.Intn(len(keys))], Val: value(hasher, n+1, j)}
+			}
+			if err := smt.MultiSet(changes); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := smt.Commit(nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+		elapsed += time.Since(start)
+		b.StopTimer()
+		smt.Close()
+	}
+
+	if elapsed > 0 {
+		b.ReportMetric(float64(iterations*commits)/elapsed.Seconds(), CommitsPerSecond)
+	}
+}
+
+// newTree commits the initial cfg.Keys keys, spread evenly over the key space, to a new tree.
+func newTree(b *testing.B, cfg BenchConfig, hasher *bsmt.Hasher, opts []bsmt.Option) (bsmt.SparseMerkleTree, []uint64) {
+	depth := cfg.depth()
+	smt, err := bsmt.NewBNBSparseMerkleTree(hasher, memory.NewMemoryDB(), depth,
+		hasher.Hash([]byte("nilHash")), opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	stride := (^uint64(0) >> (64 - depth)) / uint64(cfg.Keys)
+	if stride == 0 {
+		stride = 1
+	}
+	keys := make([]uint64, cfg.Keys)
+	items := make([]bsmt.Item, cfg.Keys)
+	for i := range keys {
+		keys[i] = uint64(i) * stride
+		items[i] = bsmt.Item{Key: keys[i], Val: value(hasher, 0, i)}
+	}
+	if err := smt.MultiSet(items); err != nil {
+		b.Fatal(err)
+	}
+	if _, err := smt.Commit(nil); err != nil {
+		b.Fatal(err)
+	}
+	return smt, keys
+}
+
+// AssertThroughput fails tb if the result reports less than min commits per second,
+// the result is expected to come from testing.Benchmark running RunCommitBenchmark.
+func AssertThroughput(tb testing.TB, result testing.BenchmarkResult, min float64) {
+	tb.Helper()
+	throughput := Throughput(result)
+	if throughput < min {
+		tb.Errorf("commit throughput %.2f %s is below the threshold %.2f", throughput, CommitsPerSecond, min)
+	}
+}
+
+// Throughput returns the commits per second of the result, it is derived from the time per
+// operation if the metric is not reported.
+func Throughput(result testing.BenchmarkResult) float64 {
+	if throughput, ok := result.Extra[CommitsPerSecond]; ok {
+		return throughput
+	}
+	if result.NsPerOp() == 0 {
+		return 0
+	}
+	return float64(time.Second) / float64(result.NsPerOp())
+}
+
+func value(hasher *bsmt.Hasher, version, i int) []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf, uint64(version))
+	binary.BigEndian.PutUint64(buf[8:], uint64(i))
+	return hasher.Hash(buf)
+}
@@ -0,0 +1,76 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package benchtest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	bsmt "github.com/bnb-chain/zkbnb-smt"
+)
+
+var config = BenchConfig{
+	Depth:       16,
+	Keys:        1000,
+	ChangeRate:  0.01,
+	Parallelism: 4,
+	Seed:        1,
+}
+
+func BenchmarkCommit(b *testing.B) {
+	RunCommitBenchmark(b, config)
+}
+
+type recorder struct {
+	testing.TB
+	failed bool
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(string, ...interface{}) {
+	r.failed = true
+}
+
+func TestRunCommitBenchmark(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the benchmark in short mode")
+	}
+	// the tree grows with the commits, so the runs are compared at the same number of commits
+	cfg := config
+	cfg.Commits = 200
+	if raceEnabled {
+		// the race detector reports the parallel staging of MultiSet
+		cfg.Options = []bsmt.Option{bsmt.ParallelThreshold(cfg.Keys)}
+	}
+	benchmark := func(b *testing.B) { RunCommitBenchmark(b, cfg) }
+
+	first := testing.Benchmark(benchmark)
+	second := testing.Benchmark(benchmark)
+	for _, result := range []testing.BenchmarkResult{first, second} {
+		assert.Greater(t, result.N, 0)
+		assert.Greater(t, Throughput(result), float64(0))
+		assert.Greater(t, result.AllocsPerOp(), int64(0))
+	}
+
+	// the allocations of a fixed workload are stable across the runs
+	assert.InEpsilon(t, first.AllocsPerOp(), second.AllocsPerOp(), 0.05)
+	assert.InEpsilon(t, first.AllocedBytesPerOp(), second.AllocedBytesPerOp(), 0.05)
+
+	AssertThroughput(t, first, 1)
+	r := &recorder{TB: t}
+	AssertThroughput(r, first, Throughput(first)*1000)
+	assert.True(t, r.failed)
+}
+
+func TestThroughput(t *testing.T) {
+	assert.Equal(t, float64(0), Throughput(testing.BenchmarkResult{}))
+	assert.Equal(t, float64(4), Throughput(testing.BenchmarkResult{N: 2, T: 500_000_000}))
+	assert.Equal(t, float64(10), Throughput(testing.BenchmarkResult{
+		N: 2, T: 500_000_000, Extra: map[string]float64{CommitsPerSecond: 10},
+	}))
+}
@@ -0,0 +1,104 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/bnb-chain/zkbnb-smt/database"
+	"github.com/pkg/errors"
+)
+
+var (
+	checkpointKey        = []byte(`checkpoint`)
+	checkpointVersionKey = []byte(`checkpointVersion`)
+)
+
+// checkpoint persists the memory image of the committed tree when the commit from prevVersion
+// crosses a multiple of the checkpoint interval, the versions may be skipped by CommitWithNewVersion.
+// The version of the latest checkpoint is pinned, so it is not pruned before the next checkpoint.
+func (tree *BNBSparseMerkleTree) checkpoint(prevVersion Version) error {
+	db := tree.storage()
+	if tree.checkpointInterval == 0 || db == nil ||
+		tree.version/tree.checkpointInterval == prevVersion/tree.checkpointInterval {
+		return nil
+	}
+	state, err := tree.MarshalState()
+	if err != nil {
+		return err
+	}
+	if err := db.Set(checkpointKey, state); err != nil {
+		return err
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(tree.version))
+	if err := db.Set(checkpointVersionKey, buf); err != nil {
+		return err
+	}
+	tree.pinCheckpoint(tree.version)
+	return nil
+}
+
+// pinCheckpoint references the version of the latest checkpoint in place of the previous one.
+func (tree *BNBSparseMerkleTree) pinCheckpoint(version Version) {
+	if !tree.snapshots.acquire(version) {
+		return
+	}
+	if tree.checkpointPinned {
+		tree.snapshots.release(tree.checkpointVersion)
+	}
+	tree.checkpointVersion, tree.checkpointPinned = version, true
+}
+
+// loadCheckpointPin pins the version of the checkpoint persisted in the db if the checkpoints are enabled.
+func (tree *BNBSparseMerkleTree) loadCheckpointPin() error {
+	if tree.checkpointInterval == 0 {
+		return nil
+	}
+	buf, err := tree.storage().Get(checkpointVersionKey)
+	if errors.Is(err, database.ErrDatabaseNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(buf) == 8 {
+		tree.pinCheckpoint(Version(binary.BigEndian.Uint64(buf)))
+	}
+	return nil
+}
+
+// RestoreCheckpoint reconstructs the tree from the latest checkpoint persisted in the db.
+// The storage is never changed by the restore, so it fails with ErrStaleCheckpoint if versions
+// were committed after the checkpoint: the caller either opens the tree from storage instead,
+// or rolls it back to the version of the checkpoint explicitly and replays the later versions.
+func RestoreCheckpoint(db database.TreeDB, hasher *Hasher, opts ...Option) (SparseMerkleTree, error) {
+	b, err := db.Get(checkpointKey)
+	if err != nil {
+		return nil, err
+	}
+	state, err := decodeState(b)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := db.Get(latestVersionKey)
+	if err != nil && !errors.Is(err, database.ErrDatabaseNotFound) {
+		return nil, err
+	}
+	var latest Version
+	if len(buf) > 0 {
+		latest = Version(binary.BigEndian.Uint64(buf))
+	}
+	if latest > state.Version {
+		return nil, fmt.Errorf("%w: checkpoint at version %d, storage at version %d", ErrStaleCheckpoint, state.Version, latest)
+	}
+	if latest < state.Version {
+		return nil, fmt.Errorf("%w: checkpoint at version %d, storage at version %d", ErrStateMismatched, state.Version, latest)
+	}
+	return restoreState(state, db, hasher, opts...)
+}
@@ -0,0 +1,325 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/bnb-chain/zkbnb-smt/database"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/pkg/errors"
+)
+
+var clearedPrefixesKey = []byte(`clearedPrefixes`)
+
+// clearedPrefix is a prefix of the keys cleared by DeletePrefix at the version. The nodes under
+// the prefix persisted before the version are not rewritten, they read as empty from the version on.
+type clearedPrefix struct {
+	Prefix  uint64
+	Bits    uint8
+	Version Version
+}
+
+// covers returns whether the prefix of the other clear is under the prefix.
+func (cleared clearedPrefix) covers(other clearedPrefix) bool {
+	return cleared.Bits <= other.Bits && other.Prefix>>(other.Bits-cleared.Bits) == cleared.Prefix
+}
+
+// clearedIndex holds the versions of the clears by the bits and the prefix,
+// so a leaf only looks up the prefixes of its path instead of scanning every clear.
+type clearedIndex map[uint8]map[uint64][]Version
+
+func newClearedIndex(prefixes []clearedPrefix) clearedIndex {
+	index := make(clearedIndex)
+	for _, cleared := range prefixes {
+		if index[cleared.Bits] == nil {
+			index[cleared.Bits] = make(map[uint64][]Version)
+		}
+		index[cleared.Bits][cleared.Prefix] = append(index[cleared.Bits][cleared.Prefix], cleared.Version)
+	}
+	return index
+}
+
+// compactClearedPrefixes drops the clears superseded at the oldest readable version. A clear followed by
+// a clear of the same or a shorter prefix at or before that version is never read, as the reads never go below it.
+func compactClearedPrefixes(prefixes []clearedPrefix, oldest Version) []clearedPrefix {
+	var superseding []clearedPrefix
+	compacted := make([]clearedPrefix, len(prefixes))
+	i := len(compacted)
+	for j := len(prefixes) - 1; j >= 0; j-- {
+		cleared := prefixes[j]
+		if cleared.Version > oldest {
+			i--
+			compacted[i] = cleared
+			continue
+		}
+		superseded := false
+		for _, later := range superseding {
+			if later.Version > cleared.Version && later.covers(cleared) {
+				superseded = true
+				break
+			}
+		}
+		if !superseded {
+			i--
+			compacted[i] = cleared
+			superseding = append(superseding, cleared)
+		}
+	}
+	return compacted[i:]
+}
+
+// setClearedPrefixes replaces the committed clears and their index, clearedMu is held by the caller.
+func (tree *BNBSparseMerkleTree) setClearedPrefixes(prefixes []clearedPrefix) {
+	tree.clearedPrefixes = prefixes
+	tree.clearedIndex = newClearedIndex(prefixes)
+}
+
+// putClearedPrefixes writes the clears to w, the key is deleted when none is left.
+func putClearedPrefixes(w database.KeyValueWriter, prefixes []clearedPrefix) error {
+	if len(prefixes) == 0 {
+		return w.Delete(clearedPrefixesKey)
+	}
+	buf, err := rlp.EncodeToBytes(prefixes)
+	if err != nil {
+		return err
+	}
+	return w.Set(clearedPrefixesKey, buf)
+}
+
+// loadClearedPrefixes reads the prefixes cleared by the committed versions.
+func (tree *BNBSparseMerkleTree) loadClearedPrefixes() error {
+	buf, err := tree.storage().Get(clearedPrefixesKey)
+	if errors.Is(err, database.ErrDatabaseNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var prefixes []clearedPrefix
+	if err := rlp.DecodeBytes(buf, &prefixes); err != nil {
+		return err
+	}
+	tree.clearedMu.Lock()
+	tree.setClearedPrefixes(prefixes)
+	tree.clearedMu.Unlock()
+	return nil
+}
+
+// committedClears returns the committed prefixes with the staged ones, compacted at the oldest readable version,
+// and whether they differ from the committed prefixes.
+func (tree *BNBSparseMerkleTree) committedClears(oldest Version) ([]clearedPrefix, bool) {
+	tree.clearedMu.RLock()
+	committed := tree.clearedPrefixes
+	tree.clearedMu.RUnlock()
+	prefixes := compactClearedPrefixes(append(committed[:len(committed):len(committed)], tree.stagedClears...), oldest)
+	return prefixes, len(tree.stagedClears) > 0 || len(prefixes) != len(committed)
+}
+
+// writeClearedPrefixes persists the prefixes cleared by the committed versions and the staged ones,
+// compacted at the oldest version readable after the commit.
+func (tree *BNBSparseMerkleTree) writeClearedPrefixes(batch database.Batcher, oldest Version) error {
+	prefixes, changed := tree.committedClears(oldest)
+	if !changed {
+		return nil
+	}
+	return putClearedPrefixes(batch, prefixes)
+}
+
+// commitClearedPrefixes records the staged prefixes as committed, compacted like writeClearedPrefixes.
+func (tree *BNBSparseMerkleTree) commitClearedPrefixes(oldest Version) {
+	prefixes, changed := tree.committedClears(oldest)
+	if !changed {
+		return
+	}
+	tree.clearedMu.Lock()
+	tree.setClearedPrefixes(prefixes)
+	tree.clearedMu.Unlock()
+	tree.stagedClears = nil
+}
+
+// pruneClearedPrefixes compacts the committed prefixes when the oldest readable version is raised by a prune.
+func (tree *BNBSparseMerkleTree) pruneClearedPrefixes(db database.KeyValueWriter, oldest Version) error {
+	tree.clearedMu.Lock()
+	defer tree.clearedMu.Unlock()
+
+	prefixes := compactClearedPrefixes(tree.clearedPrefixes, oldest)
+	if len(prefixes) == len(tree.clearedPrefixes) {
+		return nil
+	}
+	if db != nil {
+		if err := putClearedPrefixes(db, prefixes); err != nil {
+			return err
+		}
+	}
+	tree.setClearedPrefixes(prefixes)
+	return nil
+}
+
+// rollbackClearedPrefixes drops the prefixes cleared after the version.
+func (tree *BNBSparseMerkleTree) rollbackClearedPrefixes(batch database.Batcher, version Version) error {
+	tree.clearedMu.Lock()
+	defer tree.clearedMu.Unlock()
+
+	i := len(tree.clearedPrefixes)
+	for i > 0 && tree.clearedPrefixes[i-1].Version > version {
+		i--
+	}
+	if i == len(tree.clearedPrefixes) {
+		return nil
+	}
+	prefixes := tree.clearedPrefixes[:i:i]
+	if batch != nil {
+		if err := putClearedPrefixes(batch, prefixes); err != nil {
+			return err
+		}
+	}
+	tree.setClearedPrefixes(prefixes)
+	return nil
+}
+
+// withClears appends the nil hash to the versions of the leaf at the path at the committed clears covering it
+// after its latest version, as the leaves under a cleared prefix keep their persisted versions.
+func (tree *BNBSparseMerkleTree) withClears(path nodePath, versions []*VersionInfo) []*VersionInfo {
+	tree.clearedMu.RLock()
+	defer tree.clearedMu.RUnlock()
+
+	var latest Version
+	if len(versions) > 0 {
+		latest = versions[len(versions)-1].Ver
+	}
+	var cleared []Version
+	for bits, prefixes := range tree.clearedIndex {
+		for _, version := range prefixes[path.low()>>(tree.maxDepth-uint16(bits))] {
+			if version > latest {
+				cleared = append(cleared, version)
+			}
+		}
+	}
+	sort.Slice(cleared, func(i, j int) bool {
+		return cleared[i] < cleared[j]
+	})
+	for _, version := range cleared {
+		if version > latest {
+			versions = append(versions[:len(versions):len(versions)], &VersionInfo{
+				Ver:  version,
+				Hash: tree.nilHashes.Get(tree.maxDepth),
+			})
+			latest = version
+		}
+	}
+	return versions
+}
+
+// clearNode empties the subtree of the node at the version. The node takes the nil hash, and its children
+// take the nil hashes of their depth in their placeholders, which keep the versions before, so the descendants
+// persisted before read as empty at the version once they are loaded. The children staged at the version
+// are cleared in place, as they are persisted by the commit, and the spilled ones are journaled again.
+func (tree *BNBSparseMerkleTree) clearNode(node *TreeNode, version Version) error {
+	node.lock()
+	defer node.mu.Unlock()
+
+	if node.depth < tree.maxDepth {
+		depth := node.depth + 4
+		nilHash := tree.nilHashes.Get(depth)
+		for i, child := range node.Children {
+			if child == nil {
+				continue
+			}
+			child.rlock()
+			versions := child.Versions[:len(child.Versions):len(child.Versions)]
+			temporary := child.temporary
+			child.mu.RUnlock()
+			if len(versions) == 0 || bytes.Equal(versions[len(versions)-1].Hash, nilHash) {
+				continue
+			}
+			if versions[len(versions)-1].Ver == version {
+				if !temporary {
+					if err := tree.clearNode(child, version); err != nil {
+						return err
+					}
+					continue
+				}
+				// only the placeholders of the nodes spilled by the journal hold the staged version
+				spilled, err := tree.loadSpilled(child)
+				if err != nil {
+					return err
+				}
+				if spilled != nil {
+					if err := tree.clearNode(spilled, version); err != nil {
+						return err
+					}
+					if node.Children[i], err = tree.journalNode(spilled); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			placeholder := &TreeNode{
+				Versions:     versions,
+				nilHash:      nilHash,
+				nilChildHash: tree.nilHashes.Get(depth + 4),
+				hasher:       tree.hasher,
+				temporary:    true,
+				depth:        depth,
+				path:         node.path.child(uint64(i)),
+			}
+			placeholder.newVersion(&VersionInfo{Ver: version, Hash: nilHash})
+			node.Children[i] = placeholder
+		}
+		node.computeInternalHash()
+	}
+	node.newVersion(&VersionInfo{Ver: version, Hash: node.nilHash})
+	return nil
+}
+
+// applyClears clears the node loaded under the placeholder in its parent at the versions of the placeholder
+// after the latest version of the node, which are the clears of DeletePrefix over the persisted node.
+func (tree *BNBSparseMerkleTree) applyClears(node *TreeNode, placeholder *TreeNode) error {
+	if placeholder == nil {
+		return nil
+	}
+	placeholder.rlock()
+	versions := placeholder.Versions
+	placeholder.mu.RUnlock()
+
+	latest := node.latestVersion()
+	for _, version := range versions {
+		if version.Ver > latest && bytes.Equal(version.Hash, node.nilHash) {
+			if err := tree.clearNode(node, version.Ver); err != nil {
+				return err
+			}
+			latest = version.Ver
+		}
+	}
+	return nil
+}
+
+// loadChild reads the node persisted under the placeholder in its parent. With StorageSalt the node is stored
+// under the salt of its latest persisted version, which precedes the nil versions appended to the placeholder
+// by DeletePrefix, so the versions before them are tried when the node is not found.
+func (tree *BNBSparseMerkleTree) loadChild(depth uint16, path nodePath, placeholder *TreeNode) (*StorageTreeNode, error) {
+	if placeholder == nil {
+		return tree.loadStorageTreeNode(depth, path, tree.version)
+	}
+	placeholder.rlock()
+	versions := placeholder.Versions
+	placeholder.mu.RUnlock()
+	if len(versions) == 0 {
+		return tree.loadStorageTreeNode(depth, path, 0)
+	}
+
+	i := len(versions) - 1
+	storageTreeNode, err := tree.loadStorageTreeNode(depth, path, versions[i].Ver)
+	nilHash := tree.nilHashes.Get(depth)
+	for tree.storageSalt != nil && errors.Is(err, database.ErrDatabaseNotFound) && i > 0 &&
+		bytes.Equal(versions[i].Hash, nilHash) {
+		i--
+		storageTreeNode, err = tree.loadStorageTreeNode(depth, path, versions[i].Ver)
+	}
+	return storageTreeNode, err
+}
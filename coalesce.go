@@ -0,0 +1,58 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"sync"
+	"time"
+)
+
+func newCommitCoalescer(window time.Duration) *commitCoalescer {
+	return &commitCoalescer{window: window}
+}
+
+// commitCoalescer merges the commits requested within a window into one commit,
+// which is performed when the window ends.
+type commitCoalescer struct {
+	window  time.Duration
+	mu      sync.Mutex
+	pending *coalescedCommit
+}
+
+type coalescedCommit struct {
+	done          chan struct{}
+	recentVersion *Version
+	version       Version
+	err           error
+}
+
+// commit joins the pending commit or starts a new one, and blocks until it is performed.
+// The greatest recent version requested by the coalesced callers is used.
+func (c *commitCoalescer) commit(recentVersion *Version, commit func(recentVersion *Version) (Version, error)) (Version, error) {
+	c.mu.Lock()
+	pending := c.pending
+	if pending == nil {
+		pending = &coalescedCommit{done: make(chan struct{})}
+		c.pending = pending
+		time.AfterFunc(c.window, func() {
+			c.mu.Lock()
+			c.pending = nil
+			recentVersion := pending.recentVersion
+			c.mu.Unlock()
+
+			pending.version, pending.err = commit(recentVersion)
+			close(pending.done)
+		})
+	}
+	if recentVersion != nil && (pending.recentVersion == nil || *recentVersion > *pending.recentVersion) {
+		version := *recentVersion
+		pending.recentVersion = &version
+	}
+	c.mu.Unlock()
+
+	<-pending.done
+	return pending.version, pending.err
+}
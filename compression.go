@@ -0,0 +1,114 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"github.com/golang/snappy"
+)
+
+// Compressor compresses the leaf values before they are persisted.
+type Compressor interface {
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+var _ Compressor = SnappyCompressor{}
+
+// SnappyCompressor compresses values with snappy.
+type SnappyCompressor struct{}
+
+func (SnappyCompressor) Compress(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+func (SnappyCompressor) Decompress(src []byte) ([]byte, error) {
+	return snappy.Decode(nil, src)
+}
+
+// compressVersions returns the versions with values larger than the threshold compressed,
+// the original versions are left untouched.
+func (tree *BNBSparseMerkleTree) compressVersions(versions []*VersionInfo) ([]*VersionInfo, error) {
+	var compressed []*VersionInfo
+	for i, version := range versions {
+		if len(version.Hash) <= tree.compressionThreshold {
+			continue
+		}
+		val, err := tree.compressor.Compress(version.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if len(val) >= len(version.Hash) {
+			continue
+		}
+		if compressed == nil {
+			compressed = make([]*VersionInfo, len(versions))
+			copy(compressed, versions)
+		}
+		compressed[i] = &VersionInfo{Ver: version.Ver, Hash: val, Compressed: true, Count: version.Count}
+	}
+	if compressed == nil {
+		return versions, nil
+	}
+	return compressed, nil
+}
+
+// decompressVersions decompresses the compressed values in place.
+func (tree *BNBSparseMerkleTree) decompressVersions(versions []*VersionInfo) error {
+	for _, version := range versions {
+		if !version.Compressed {
+			continue
+		}
+		if tree.compressor == nil {
+			return ErrNoCompressor
+		}
+		val, err := tree.compressor.Decompress(version.Hash)
+		if err != nil {
+			return err
+		}
+		version.Hash = val
+		version.Compressed = false
+	}
+	return nil
+}
+
+// compressStorageTreeNode compresses the leaf values held by the node.
+func (tree *BNBSparseMerkleTree) compressStorageTreeNode(node *StorageTreeNode, depth uint16) error {
+	var err error
+	switch depth {
+	case tree.maxDepth:
+		node.Versions, err = tree.compressVersions(node.Versions)
+	case tree.maxDepth - 4:
+		for i := range node.Children {
+			if node.Children[i] == nil {
+				continue
+			}
+			versions, err := tree.compressVersions(node.Children[i].Versions)
+			if err != nil {
+				return err
+			}
+			node.Children[i] = &StorageLeafNode{versions}
+		}
+	}
+	return err
+}
+
+// decompressStorageTreeNode decompresses the leaf values held by the node.
+func (tree *BNBSparseMerkleTree) decompressStorageTreeNode(node *StorageTreeNode, depth uint16) error {
+	switch depth {
+	case tree.maxDepth:
+		return tree.decompressVersions(node.Versions)
+	case tree.maxDepth - 4:
+		for i := range node.Children {
+			if node.Children[i] == nil {
+				continue
+			}
+			if err := tree.decompressVersions(node.Children[i].Versions); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+//go:build linux || darwin
+
+package mmap
+
+import (
+	"encoding/binary"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/bnb-chain/zkbnb-smt/database"
+	"github.com/bnb-chain/zkbnb-smt/utils"
+)
+
+var (
+	_ database.TreeDB  = (*Database)(nil)
+	_ database.Batcher = (*batch)(nil)
+)
+
+const (
+	// the record header holds the length of the key and the length of the value
+	headerSize = 8
+	// the value length of a deletion record
+	deleted = ^uint32(0)
+)
+
+type entry struct {
+	offset int64
+	length uint32
+}
+
+// Database is a key-value store backed by an append-only log read through a memory mapping,
+// it is intended for the read-mostly deployments, e.g. the replicas serving proofs.
+// The log is never compacted, the overwritten and deleted values stay in the file.
+type Database struct {
+	lock  sync.RWMutex
+	file  *os.File
+	data  []byte // the mapped log, it may be shorter than the file until remapped
+	size  int64  // the size of the log
+	index map[string]entry
+}
+
+// New opens the log file, creating it if missing, and rebuilds the index by scanning the records.
+func New(file string) (*Database, error) {
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	db := &Database{
+		file:  f,
+		index: make(map[string]entry),
+	}
+	if err := db.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// load maps the log and indexes the records in it. The partial record left at the end
+// by a write interrupted by a crash is truncated, so the log ends with the last complete record.
+func (db *Database) load() error {
+	info, err := db.file.Stat()
+	if err != nil {
+		return err
+	}
+	db.size = info.Size()
+	if err := db.remap(); err != nil {
+		return err
+	}
+
+	offset := int64(0)
+	for offset < db.size {
+		if offset+headerSize > db.size {
+			break
+		}
+		keyLen := binary.BigEndian.Uint32(db.data[offset:])
+		valLen := binary.BigEndian.Uint32(db.data[offset+4:])
+		keyOffset := offset + headerSize
+		valOffset := keyOffset + int64(keyLen)
+		end := valOffset
+		if valLen != deleted {
+			end += int64(valLen)
+		}
+		if end > db.size {
+			break
+		}
+		if valLen == deleted {
+			delete(db.index, string(db.data[keyOffset:valOffset]))
+		} else {
+			db.index[string(db.data[keyOffset:valOffset])] = entry{valOffset, valLen}
+		}
+		offset = end
+	}
+	if offset == db.size {
+		return nil
+	}
+	if err := db.file.Truncate(offset); err != nil {
+		return err
+	}
+	db.size = offset
+	return db.remap()
+}
+
+// remap maps the whole log, it must be called with the write lock held.
+func (db *Database) remap() error {
+	if db.data != nil {
+		if err := syscall.Munmap(db.data); err != nil {
+			return err
+		}
+		db.data = nil
+	}
+	if db.size == 0 {
+		return nil
+	}
+	data, err := syscall.Mmap(int(db.file.Fd()), 0, int(db.size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	db.data = data
+	return nil
+}
+
+func (db *Database) Get(key []byte) ([]byte, error) {
+	db.lock.RLock()
+	if db.index == nil {
+		db.lock.RUnlock()
+		return nil, database.ErrDatabaseClosed
+	}
+	e, ok := db.index[string(key)]
+	if !ok {
+		db.lock.RUnlock()
+		return nil, database.ErrDatabaseNotFound
+	}
+	if e.offset+int64(e.length) <= int64(len(db.data)) {
+		defer db.lock.RUnlock()
+		return utils.CopyBytes(db.data[e.offset : e.offset+int64(e.length)]), nil
+	}
+	db.lock.RUnlock()
+
+	// the value is appended after the log was mapped, grow the mapping
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.index == nil {
+		return nil, database.ErrDatabaseClosed
+	}
+	if e.offset+int64(e.length) > int64(len(db.data)) {
+		if err := db.remap(); err != nil {
+			return nil, err
+		}
+	}
+	return utils.CopyBytes(db.data[e.offset : e.offset+int64(e.length)]), nil
+}
+
+func (db *Database) Has(key []byte) (bool, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	if db.index == nil {
+		return false, database.ErrDatabaseClosed
+	}
+	_, ok := db.index[string(key)]
+	return ok, nil
+}
+
+func (db *Database) Set(key []byte, value []byte) error {
+	return db.write([]keyvalue{{key, value, false}})
+}
+
+func (db *Database) Delete(key []byte) error {
+	return db.write([]keyvalue{{key, nil, true}})
+}
+
+// write appends the records to the log in one write and indexes them.
+func (db *Database) write(writes []keyvalue) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.index == nil {
+		return database.ErrDatabaseClosed
+	}
+	var (
+		buf     []byte
+		entries = make([]entry, len(writes))
+	)
+	for i, kv := range writes {
+		valLen := uint32(len(kv.value))
+		if kv.delete {
+			valLen = deleted
+		}
+		var header [headerSize]byte
+		binary.BigEndian.PutUint32(header[:], uint32(len(kv.key)))
+		binary.BigEndian.PutUint32(header[4:], valLen)
+		buf = append(buf, header[:]...)
+		buf = append(buf, kv.key...)
+		entries[i] = entry{db.size + int64(len(buf)), uint32(len(kv.value))}
+		buf = append(buf, kv.value...)
+	}
+	if _, err := db.file.WriteAt(buf, db.size); err != nil {
+		return err
+	}
+	db.size += int64(len(buf))
+
+	for i, kv := range writes {
+		if kv.delete {
+			delete(db.index, string(kv.key))
+			continue
+		}
+		db.index[string(kv.key)] = entries[i]
+	}
+	return nil
+}
+
+func (db *Database) NewBatch() database.Batcher {
+	return &batch{
+		db: db,
+	}
+}
+
+// Sync flushes the log to disk.
+func (db *Database) Sync() error {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	if db.index == nil {
+		return database.ErrDatabaseClosed
+	}
+	return db.file.Sync()
+}
+
+func (db *Database) Close() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.index == nil {
+		return nil
+	}
+	db.index = nil
+	db.size = 0
+	if err := db.remap(); err != nil {
+		return err
+	}
+	return db.file.Close()
+}
+
+// keyvalue is a key-value tuple tagged with a deletion field.
+type keyvalue struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+// batch is a write-only batch that appends the changes to the log in one write
+// when Write is called. A batch cannot be used concurrently.
+type batch struct {
+	db     *Database
+	writes []keyvalue
+	size   int
+}
+
+// Set inserts the given value into the batch for later committing.
+func (b *batch) Set(key, value []byte) error {
+	b.writes = append(b.writes, keyvalue{utils.CopyBytes(key), utils.CopyBytes(value), false})
+	b.size += len(value)
+	return nil
+}
+
+// Delete inserts the a key removal into the batch for later committing.
+func (b *batch) Delete(key []byte) error {
+	b.writes = append(b.writes, keyvalue{utils.CopyBytes(key), nil, true})
+	b.size += len(key)
+	return nil
+}
+
+// Write flushes any accumulated data to the log.
+func (b *batch) Write() error {
+	if len(b.writes) == 0 {
+		return nil
+	}
+	return b.db.write(b.writes)
+}
+
+// ValueSize retrieves the amount of data queued up for writing.
+func (b *batch) ValueSize() int {
+	return b.size
+}
+
+// Reset resets the batch for reuse.
+func (b *batch) Reset() {
+	b.writes = b.writes[:0]
+	b.size = 0
+}
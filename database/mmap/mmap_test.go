@@ -0,0 +1,159 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+//go:build linux || darwin
+
+package mmap
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bnb-chain/zkbnb-smt/database"
+	"github.com/bnb-chain/zkbnb-smt/database/dbtest"
+	"github.com/bnb-chain/zkbnb-smt/database/leveldb"
+)
+
+func newTestDB(t testing.TB) *Database {
+	db, err := New(filepath.Join(t.TempDir(), "nodes.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func uint32Key(i int) []byte {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, uint32(i))
+	return key
+}
+
+func TestMMapDB(t *testing.T) {
+	t.Run("DatabaseSuite", func(t *testing.T) {
+		dbtest.TestDatabaseSuite(t, func() database.TreeDB {
+			return newTestDB(t)
+		})
+	})
+}
+
+func TestMMapDB_Reopen(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "nodes.log")
+	db, err := New(file)
+	assert.NoError(t, err)
+
+	// the values are read before and after the mapping grows
+	for i := 0; i < 1000; i++ {
+		key := uint32Key(i)
+		assert.NoError(t, db.Set(key, key))
+		val, err := db.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, key, val)
+	}
+	batch := db.NewBatch()
+	assert.NoError(t, batch.Set([]byte("foo"), []byte("bar")))
+	assert.NoError(t, batch.Set([]byte("foo"), []byte("baz")))
+	assert.NoError(t, batch.Delete([]byte{0, 0, 0, 1}))
+	assert.NoError(t, batch.Write())
+	assert.NoError(t, db.Set([]byte("empty"), nil))
+	assert.NoError(t, db.Close())
+	_, err = db.Get([]byte("foo"))
+	assert.ErrorIs(t, err, database.ErrDatabaseClosed)
+
+	db, err = New(file)
+	assert.NoError(t, err)
+	defer db.Close()
+	val, err := db.Get([]byte("foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("baz"), val)
+	val, err = db.Get([]byte("empty"))
+	assert.NoError(t, err)
+	assert.Empty(t, val)
+	_, err = db.Get([]byte{0, 0, 0, 1})
+	assert.ErrorIs(t, err, database.ErrDatabaseNotFound)
+	val, err = db.Get([]byte{0, 0, 3, 0xe7})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, 0, 3, 0xe7}, val)
+}
+
+func TestMMapDB_TornTail(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "nodes.log")
+	db, err := New(file)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Set([]byte("foo"), []byte("bar")))
+	assert.NoError(t, db.Close())
+	info, err := os.Stat(file)
+	assert.NoError(t, err)
+	complete := info.Size()
+
+	// the write interrupted in the value, in the key and in the header of the record
+	for _, torn := range []int64{headerSize + 4 + 1, headerSize + 1, headerSize - 1} {
+		db, err = New(file)
+		assert.NoError(t, err)
+		assert.NoError(t, db.Set([]byte("torn"), []byte("torn")))
+		assert.NoError(t, db.Close())
+		assert.NoError(t, os.Truncate(file, complete+torn))
+
+		db, err = New(file)
+		assert.NoError(t, err)
+		info, err = os.Stat(file)
+		assert.NoError(t, err)
+		assert.Equal(t, complete, info.Size())
+		val, err := db.Get([]byte("foo"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("bar"), val)
+		_, err = db.Get([]byte("torn"))
+		assert.ErrorIs(t, err, database.ErrDatabaseNotFound)
+
+		// the records appended after the truncation are read after reopening
+		assert.NoError(t, db.Set([]byte("baz"), []byte("qux")))
+		assert.NoError(t, db.Close())
+		db, err = New(file)
+		assert.NoError(t, err)
+		val, err = db.Get([]byte("baz"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("qux"), val)
+		assert.NoError(t, db.Close())
+		info, err = os.Stat(file)
+		assert.NoError(t, err)
+		complete = info.Size()
+	}
+}
+
+func BenchmarkMMapDB_Get(b *testing.B) {
+	ldb, err := leveldb.New(b.TempDir(), 16, 16, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ldb.Close()
+	mdb := newTestDB(b)
+	defer mdb.Close()
+
+	value := make([]byte, 512)
+	for _, db := range []database.TreeDB{ldb, mdb} {
+		batch := db.NewBatch()
+		for i := 0; i < 10000; i++ {
+			if err := batch.Set(uint32Key(i), value); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := batch.Write(); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for name, db := range map[string]database.TreeDB{"leveldb": ldb, "mmap": mdb} {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Get(uint32Key(i * 7919 % 10000)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
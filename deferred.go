@@ -0,0 +1,160 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"sync"
+
+	"github.com/bnb-chain/zkbnb-smt/database"
+)
+
+// deferredDB buffers the writes to the host database in memory until they are synced,
+// the buffered values shadow the host database on reads.
+type deferredDB struct {
+	database.TreeDB
+
+	mu sync.RWMutex
+	// the buffered values by key, a nil value is a buffered deletion
+	pending map[string][]byte
+}
+
+var _ database.TreeDB = (*deferredDB)(nil)
+
+func newDeferredDB(db database.TreeDB) *deferredDB {
+	return &deferredDB{TreeDB: db, pending: make(map[string][]byte)}
+}
+
+func (db *deferredDB) Has(key []byte) (bool, error) {
+	db.mu.RLock()
+	value, exist := db.pending[string(key)]
+	db.mu.RUnlock()
+	if exist {
+		return value != nil, nil
+	}
+	return db.TreeDB.Has(key)
+}
+
+func (db *deferredDB) Get(key []byte) ([]byte, error) {
+	db.mu.RLock()
+	value, exist := db.pending[string(key)]
+	db.mu.RUnlock()
+	if !exist {
+		return db.TreeDB.Get(key)
+	}
+	if value == nil {
+		return nil, database.ErrDatabaseNotFound
+	}
+	return value, nil
+}
+
+func (db *deferredDB) Set(key []byte, value []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.pending[string(key)] = append(make([]byte, 0, len(value)), value...)
+	return nil
+}
+
+func (db *deferredDB) Delete(key []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.pending[string(key)] = nil
+	return nil
+}
+
+func (db *deferredDB) NewBatch() database.Batcher {
+	return &deferredBatch{db: db}
+}
+
+// sync writes the buffered values to the host database in batches of the size limit.
+func (db *deferredDB) sync(sizeLimit int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	batch := db.TreeDB.NewBatch()
+	for key, value := range db.pending {
+		var err error
+		if value == nil {
+			err = batch.Delete([]byte(key))
+		} else {
+			err = batch.Set([]byte(key), value)
+		}
+		if err != nil {
+			return err
+		}
+		if batch.ValueSize() > sizeLimit {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	db.pending = make(map[string][]byte)
+	return nil
+}
+
+type deferredOp struct {
+	key   string
+	value []byte
+}
+
+// deferredBatch buffers the changes of a batch until it is written to the pending values.
+type deferredBatch struct {
+	db   *deferredDB
+	ops  []deferredOp
+	size int
+}
+
+func (b *deferredBatch) Set(key []byte, value []byte) error {
+	b.ops = append(b.ops, deferredOp{string(key), append(make([]byte, 0, len(value)), value...)})
+	b.size += len(key) + len(value)
+	return nil
+}
+
+func (b *deferredBatch) Delete(key []byte) error {
+	b.ops = append(b.ops, deferredOp{key: string(key)})
+	b.size += len(key)
+	return nil
+}
+
+func (b *deferredBatch) Write() error {
+	b.db.mu.Lock()
+	defer b.db.mu.Unlock()
+	for _, op := range b.ops {
+		b.db.pending[op.key] = op.value
+	}
+	return nil
+}
+
+func (b *deferredBatch) Reset() {
+	b.ops = b.ops[:0]
+	b.size = 0
+}
+
+func (b *deferredBatch) ValueSize() int {
+	return b.size
+}
+
+// deferWrites wraps the database to buffer the writes if the tree defers them.
+func (tree *BNBSparseMerkleTree) deferWrites(db database.TreeDB) database.TreeDB {
+	if !tree.deferredWrites {
+		return db
+	}
+	return newDeferredDB(db)
+}
+
+// Sync writes the commits buffered by the DeferredWrites option to storage,
+// it does nothing without the option.
+func (tree *BNBSparseMerkleTree) Sync() error {
+	tree.commitMu.Lock()
+	defer tree.commitMu.Unlock()
+	if db, ok := tree.storage().(*deferredDB); ok {
+		return db.sync(tree.batchSizeLimit)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"math"
+)
+
+const (
+	// maxCollisionProbability is the tolerated probability that two hashed keys
+	// are mapped to the same path.
+	maxCollisionProbability = 1e-6
+
+	minTreeDepth = 4
+	maxTreeDepth = 64
+	// maxWideDepth is the depth of the trees created with WideDepth addressed by all the bits of WideKey.
+	maxWideDepth = 256
+)
+
+// RecommendedDepth returns the depth of a tree that keeps the birthday-bound
+// probability of path collisions below maxCollisionProbability, when the expected
+// keys are hashed into paths by a hash function with the given output bits.
+// The depth is a multiple of 4 and never exceeds the hash bits or 64.
+func RecommendedDepth(expectedKeys uint64, hashBits uint8) uint8 {
+	limit := uint8(maxTreeDepth)
+	if hashBits < limit {
+		limit = hashBits - hashBits%4
+	}
+	if limit < minTreeDepth {
+		limit = minTreeDepth
+	}
+
+	if expectedKeys < 2 {
+		return minTreeDepth
+	}
+	// p ≈ n(n-1) / 2^(d+1)
+	n := float64(expectedKeys)
+	bits := math.Ceil(math.Log2(n * (n - 1) / 2 / maxCollisionProbability))
+	if bits >= float64(limit) {
+		return limit
+	}
+	depth := uint8(bits)
+	if depth%4 != 0 {
+		depth += 4 - depth%4
+	}
+	if depth < minTreeDepth {
+		depth = minTreeDepth
+	}
+	return depth
+}
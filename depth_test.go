@@ -0,0 +1,43 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecommendedDepth(t *testing.T) {
+	tests := []struct {
+		keys     uint64
+		hashBits uint8
+		expected uint8
+	}{
+		{0, 255, 4},
+		{1, 255, 4},
+		{2, 255, 20},
+		{1000, 255, 40},
+		{1 << 20, 255, 60},
+		{1 << 32, 255, 64},
+		{1 << 20, 48, 48},
+		{1 << 20, 50, 48},
+		{1 << 20, 2, 4},
+	}
+	for _, test := range tests {
+		assert.Equalf(t, test.expected, RecommendedDepth(test.keys, test.hashBits),
+			"keys %d, hash bits %d", test.keys, test.hashBits)
+	}
+
+	var previous uint8
+	for keys := uint64(1); keys < 1<<40; keys <<= 1 {
+		depth := RecommendedDepth(keys, 255)
+		assert.Zero(t, depth%4)
+		assert.GreaterOrEqual(t, depth, previous)
+		assert.LessOrEqual(t, depth, uint8(64))
+		previous = depth
+	}
+}
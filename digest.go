@@ -0,0 +1,37 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"bytes"
+)
+
+// KeySetDigest returns the hash of the sorted paths of the leaves not holding the nil hash at the version.
+// Unlike the root it ignores the values, so the trees holding the same keys share the digest.
+func (tree *BNBSparseMerkleTree) KeySetDigest(version Version) ([]byte, error) {
+	if tree.recentVersion > version {
+		return nil, ErrVersionTooOld
+	}
+	if version > tree.version {
+		return nil, ErrVersionTooHigh
+	}
+	root := tree.lastSaveRoot
+	if root == nil {
+		root = tree.root
+	}
+	nilHash := tree.nilHashes.Get(tree.maxDepth)
+	var paths []byte
+	// the leaves are walked in the order of their paths
+	err := tree.walkLeaves(root, func(leaf *TreeNode) {
+		if !bytes.Equal(leaf.RootAt(version), nilHash) {
+			paths = append(paths, tree.encodePath(leaf.path)...)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tree.hasher.Hash(paths), nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DumpDOT writes the nodes in memory existing at the version as a Graphviz DOT graph,
+// every node is labeled with its depth, path, count of versions and hash at the version.
+// The temporary nodes, whose children have not been loaded, are dashed.
+func (tree *BNBSparseMerkleTree) DumpDOT(w io.Writer, version Version) error {
+	if tree.recentVersion > version {
+		return ErrVersionTooOld
+	}
+	if version > tree.version {
+		return ErrVersionTooHigh
+	}
+
+	var sb strings.Builder
+	sb.WriteString("digraph smt {\n")
+	var dump func(node *TreeNode)
+	dump = func(node *TreeNode) {
+		node.rlock()
+		versions := 0
+		for _, v := range node.Versions {
+			if v.Ver <= version {
+				versions++
+			}
+		}
+		children := node.Children
+		node.mu.RUnlock()
+
+		style := "solid"
+		if node.IsTemporary() {
+			style = "dashed"
+		}
+		fmt.Fprintf(&sb, "\t%s [label=\"depth %d, path %s\\nversions %d\\n%x\" style=%s];\n",
+			dotNodeID(node), node.depth, node.path.hex(), versions, node.RootAt(version), style)
+		for _, child := range children {
+			if child == nil || !child.existsAt(version) {
+				continue
+			}
+			fmt.Fprintf(&sb, "\t%s -> %s;\n", dotNodeID(node), dotNodeID(child))
+			dump(child)
+		}
+	}
+	dump(tree.root)
+	sb.WriteString("}\n")
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func dotNodeID(node *TreeNode) string {
+	return fmt.Sprintf("n%d_%s", node.depth, strings.TrimPrefix(node.path.hex(), "0x"))
+}
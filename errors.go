@@ -6,6 +6,8 @@
 package bsmt
 
 import (
+	"fmt"
+
 	"github.com/pkg/errors"
 )
 
@@ -29,4 +31,79 @@ var (
 	ErrInvalidDepth = errors.New("depth must be a multiple of 4")
 
 	ErrExtendNode = errors.New("extending node error")
+
+	ErrProofTooLarge = errors.New("the proof size exceeds the limit")
+
+	ErrLeafTooLarge = errors.New("the leaf value size exceeds the limit")
+
+	ErrIncompatibleTrees = errors.New("the subtrees are incompatible to merge")
+
+	ErrPreRootMismatched = errors.New("the pre-state root is mismatched with the latest root")
+
+	ErrInvalidBackup = errors.New("the file is not a complete backup")
+
+	ErrDatabaseNotEmpty = errors.New("the database already holds a tree")
+
+	ErrKeyOccupied = errors.New("the key has a value")
+
+	ErrInvalidProof = errors.New("invalid proof")
+
+	ErrDuplicateLeaf = errors.New("duplicate leaf in the multi proof")
+
+	ErrConflictingProof = errors.New("conflicting node hashes in the multi proof")
+
+	ErrRootMismatched = errors.New("the proof is mismatched with the root")
+
+	ErrNoCompressor = errors.New("the value is compressed but no compressor is configured")
+
+	ErrNoVersionCodec = errors.New("the versions are encoded but no version codec is configured")
+
+	ErrNodeMismatched = errors.New("the node loaded from storage is mismatched with its parent")
+
+	ErrStateMismatched = errors.New("the state is mismatched with the tree configuration")
+
+	ErrVersionConflict = errors.New("the changes conflict with the committed version")
+
+	ErrInvalidHash = errors.New("the hash length is mismatched with the hasher")
+
+	ErrDepthMismatched = errors.New("the node loaded from storage is mismatched with its depth")
+
+	ErrCommitPending = errors.New("the changes are prepared for commit")
+
+	ErrInvalidRetention = errors.New("the number of retained versions must be positive")
+
+	ErrPathCollision = errors.New("the path is occupied by a different key")
+
+	ErrSlotOccupied = errors.New("the slot is not empty")
+
+	ErrNonMonotonicVersions = errors.New("the versions of the node loaded from storage are not increasing")
+
+	ErrCloseTimeout = errors.New("the in-flight commits did not finish before the close timeout")
+
+	ErrStaleCheckpoint = errors.New("the storage has versions committed after the checkpoint")
+
+	ErrCommitTimeout = errors.New("the commit lock was not acquired before the commit timeout")
+
+	ErrRepairMismatched = errors.New("the recomputed internal hashes are mismatched with the node root")
+
+	ErrTreeSealed = errors.New("the tree is sealed read-only")
+
+	ErrUncommittedChanges = errors.New("the tree has uncommitted changes")
+
+	ErrInvalidTruncation = errors.New("the hashes must be truncated to at least 8 bytes and below the hash size")
 )
+
+// ErrProofLengthMismatch is returned when the number of siblings of a proof differs from the depth
+// it is verified against, e.g. the proof is generated for a tree of another depth. It matches ErrInvalidProof.
+type ErrProofLengthMismatch struct {
+	Got  int
+	Want int
+}
+
+func (e ErrProofLengthMismatch) Error() string {
+	return fmt.Sprintf("%s: %d siblings, want %d", ErrInvalidProof, e.Got, e.Want)
+}
+
+func (e ErrProofLengthMismatch) Unwrap() error {
+	return ErrInvalidProof
+}
@@ -0,0 +1,60 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"github.com/panjf2000/ants/v2"
+
+	"github.com/bnb-chain/zkbnb-smt/database"
+)
+
+// TreeFactory creates the trees of the same depth sharing one hasher, one cache of nil hashes
+// and one goroutine pool, it saves the resources of the services holding many small trees.
+type TreeFactory struct {
+	hasher    *Hasher
+	maxDepth  uint8
+	nilHashes *nilHashes
+	pool      *ants.Pool
+	opts      []Option
+}
+
+// NewTreeFactory creates a factory whose trees are configured by the options, the shared
+// goroutine pool is released by Close of the factory rather than of the trees.
+func NewTreeFactory(hasher *Hasher, maxDepth uint8, nilHash []byte, opts ...Option) (*TreeFactory, error) {
+	if maxDepth == 0 || maxDepth%4 != 0 || maxDepth > maxTreeDepth {
+		return nil, ErrInvalidDepth
+	}
+	pool, err := ants.NewPool(128)
+	if err != nil {
+		return nil, err
+	}
+	return &TreeFactory{
+		hasher:    hasher,
+		maxDepth:  maxDepth,
+		nilHashes: constructNilHashes(uint16(maxDepth), nilHash, hasher),
+		pool:      pool,
+		opts:      opts,
+	}, nil
+}
+
+// New creates a tree on the db with the shared resources, the options override those of the factory.
+func (f *TreeFactory) New(db database.TreeDB, opts ...Option) (SparseMerkleTree, error) {
+	treeOpts := make([]Option, 0, len(f.opts)+len(opts)+1)
+	treeOpts = append(treeOpts, f.opts...)
+	treeOpts = append(treeOpts, opts...)
+	treeOpts = append(treeOpts, GoRoutinePool(f.pool))
+	tree, err := newBNBSparseMerkleTree(f.hasher, db, uint16(f.maxDepth), f.nilHashes, treeOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// Close releases the shared goroutine pool, the trees created by the factory must not be used afterwards.
+func (f *TreeFactory) Close() error {
+	f.pool.Release()
+	return nil
+}
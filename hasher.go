@@ -12,7 +12,7 @@ import (
 
 func NewHasherPool(init func() hash.Hash) *Hasher {
 	return &Hasher{
-		pool: sync.Pool{
+		pool: &sync.Pool{
 			New: func() interface{} {
 				return init()
 			},
@@ -21,15 +21,72 @@ func NewHasherPool(init func() hash.Hash) *Hasher {
 }
 
 type Hasher struct {
-	pool sync.Pool
+	pool *sync.Pool
+	// the number of bytes the hashes are truncated to, zero means not truncated
+	size int
+	// the order the children are hashed in
+	order ChildOrder
+}
+
+// ChildOrder is the order the two children of a node are hashed in.
+type ChildOrder uint8
+
+const (
+	// LeftRight hashes the left child followed by the right child, it is the default order.
+	LeftRight ChildOrder = iota
+	// RightLeft hashes the right child followed by the left child.
+	RightLeft
+)
+
+// Truncate returns a hasher sharing the hash functions of h, whose hashes are truncated to size bytes.
+func (h *Hasher) Truncate(size int) *Hasher {
+	return &Hasher{pool: h.pool, size: size, order: h.order}
+}
+
+// Ordered returns a hasher sharing the hash functions of h, which hashes the children in the order.
+func (h *Hasher) Ordered(order ChildOrder) *Hasher {
+	return &Hasher{pool: h.pool, size: h.size, order: order}
 }
 
 func (h *Hasher) Hash(inputs ...[]byte) []byte {
+	return h.HashTo(nil, inputs...)
+}
+
+// HashTo appends the hash of inputs to dst and returns the resulting slice,
+// no allocation happens when dst has enough capacity.
+func (h *Hasher) HashTo(dst []byte, inputs ...[]byte) []byte {
 	hasher := h.pool.Get().(hash.Hash)
 	defer h.pool.Put(hasher)
 	hasher.Reset()
 	for i := range inputs {
 		hasher.Write(inputs[i])
 	}
-	return hasher.Sum(nil)
+	sum := hasher.Sum(dst)
+	if h.size > 0 && len(sum)-len(dst) > h.size {
+		sum = sum[:len(dst)+h.size]
+	}
+	return sum
+}
+
+// HashChildren returns the hash of the node of the left and right children in the order of the hasher.
+func (h *Hasher) HashChildren(left, right []byte) []byte {
+	return h.HashChildrenTo(nil, left, right)
+}
+
+// HashChildrenTo appends the hash of the node of the left and right children to dst like HashTo.
+func (h *Hasher) HashChildrenTo(dst []byte, left, right []byte) []byte {
+	if h.order == RightLeft {
+		return h.HashTo(dst, right, left)
+	}
+	return h.HashTo(dst, left, right)
+}
+
+// Size returns the number of bytes of the hashes.
+func (h *Hasher) Size() int {
+	hasher := h.pool.Get().(hash.Hash)
+	defer h.pool.Put(hasher)
+	if h.size > 0 && h.size < hasher.Size() {
+		return h.size
+	}
+	return hasher.Size()
 }
@@ -5,6 +5,14 @@
 
 package bsmt
 
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/bnb-chain/zkbnb-smt/database"
+)
+
 type (
 	Version uint64
 
@@ -14,21 +22,77 @@ type (
 	}
 	SparseMerkleTree interface {
 		Size() uint64
+		LeafCount(version Version) (uint64, error)
+		KeySetDigest(version Version) ([]byte, error)
+		VersionStorageDelta(version Version) (uint64, error)
+		Stats() Stats
+		LockProfile() map[uint8]time.Duration
 		Get(key uint64, version *Version) ([]byte, error)
+		GetCommitted(key uint64, version *Version) ([]byte, error)
+		KeyHistory(key uint64) ([]Version, error)
 		Set(key uint64, val []byte) error
+		SetHash(key uint64, leafHash []byte) error
 		SetWithVersion(key uint64, val []byte, newVersion Version) error
+		SetIfAbsent(key uint64, val []byte) (bool, error)
+		KeyPath(rawKey []byte) uint64
+		SetKey(rawKey []byte, val []byte) error
 		MultiSet(items []Item) error
 		MultiSetWithVersion(items []Item, newVersion Version) error
+		NewBatchWriter() *BatchWriter
+		DeletePrefix(prefix uint64, prefixBits uint8) error
 		IsEmpty() bool
 		Root() []byte
+		// PendingRoot returns no error, as the staged changes are hashed when they are set and nothing
+		// is computed or loaded by the call. It is the root of Root read under the lock of the setters.
+		PendingRoot() []byte
+		Fingerprint() string
+		NodeRootAt(depth uint8, path uint64, version Version) ([]byte, error)
+		SiblingAt(key uint64, level uint8, version Version) ([]byte, error)
 		GetProof(key uint64) (Proof, error)
+		GetProofAt(key uint64, version Version) (Proof, error)
+		GetNonMembershipProof(key uint64, version Version) (*NonMembershipProof, error)
+		GetPartialProof(key uint64, stopDepth uint8, version Version) ([]byte, Proof, error)
+		ProofStream(key uint64, version Version) (*SiblingIterator, error)
+		ProofSizeStats(keys []uint64, version Version) (ProofStats, error)
+		GetCommitmentProof(path uint64, version Version) ([]byte, Proof, error)
+		Frontier(path uint64, version Version) (Proof, error)
+		GetMultiProof(keys []uint64) (*MultiProof, error)
+		IntraNodeProof(depth uint8, path uint64, nibbles []int, version Version) (*IntraNodeProof, error)
 		VerifyProof(key uint64, proof Proof) bool
+		SetWide(key WideKey, val []byte) error
+		GetWide(key WideKey, version *Version) ([]byte, error)
+		GetWideProof(key WideKey) (Proof, error)
+		GetWideProofAt(key WideKey, version Version) (Proof, error)
+		VerifyWideProof(key WideKey, proof Proof) bool
+		VerifyAgainstHistory(proof Proof, key uint64, value []byte, version Version) (bool, error)
+		VerifyPartialProof(key uint64, stopDepth uint8, subtreeRoot []byte, proof Proof, version Version) (bool, error)
+		VerifyTransition(preRoot []byte, changes []Item, postRoot []byte) (bool, error)
 		LatestVersion() Version
+		Latest() (Version, []byte)
 		RecentVersion() Version
 		Reset()
+		Prepare() []byte
+		Abort()
 		Commit(recentVersion *Version) (Version, error)
 		CommitWithNewVersion(recentVersion *Version, newVersion *Version) (Version, error)
+		CommitAsync(recentVersion *Version) <-chan CommitResult
+		CommitVersion(version Version) ([]byte, error)
 		Rollback(version Version) error
+		RepairDirtyNodes() error
+		PruneParallel(oldestVersion Version) (uint64, error)
+		PruneKeepLast(n int) (uint64, error)
 		Versions() []Version
+		VersionWindows() (inMemory [2]Version, retained [2]Version)
+		SnapshotAt(version Version) (*Snapshot, error)
+		MarshalState() ([]byte, error)
+		DumpDOT(w io.Writer, version Version) error
+		MigrateTo(dst database.TreeDB) error
+		BackupTo(path string) error
+		CommitLog(ctx context.Context, from Version) (<-chan CommitRecord, error)
+		ApplyCommitRecord(rec CommitRecord) error
+		Sync() error
+		Seal() error
+		SealedVersion() (Version, bool)
+		Close() error
 	}
 )
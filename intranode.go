@@ -0,0 +1,147 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"fmt"
+	"sort"
+)
+
+// IntraNodeProof proves the roots of some children of a node against the root of the node,
+// the internal hashes shared by the children are included only once.
+type IntraNodeProof struct {
+	// the sorted nibbles of the children and their roots
+	Nibbles  []int
+	Children [][]byte
+	// the hashes not derivable from the children, from the children level up and from left to right in each level
+	Siblings [][]byte
+}
+
+// IntraNodeProof returns the proof of the children of the nibbles of the node at the depth and path at the version.
+func (tree *BNBSparseMerkleTree) IntraNodeProof(depth uint8, path uint64, nibbles []int, version Version) (*IntraNodeProof, error) {
+	if depth%4 != 0 || uint16(depth) >= tree.maxDepth {
+		return nil, ErrInvalidDepth
+	}
+	if path>>depth != 0 {
+		return nil, ErrInvalidKey
+	}
+	if tree.recentVersion > version {
+		return nil, ErrVersionTooOld
+	}
+	if version > tree.version {
+		return nil, ErrVersionTooHigh
+	}
+	sorted, err := sortNibbles(nibbles)
+	if err != nil {
+		return nil, err
+	}
+
+	targetNode := tree.root
+	for d := uint16(4); d <= uint16(depth) && targetNode != nil; d += 4 {
+		childPath := uint64Path(path).rsh(int(uint16(depth) - d))
+		nibble := childPath.nibble()
+		if err := tree.extendNode(targetNode, nibble, childPath, d, false); err != nil {
+			return nil, err
+		}
+		targetNode = targetNode.Children[nibble]
+	}
+	// the hashes of the levels of the node from the children
+	level := make([][]byte, 16)
+	for i := range level {
+		level[i] = tree.nilHashes.Get(uint16(depth) + 4)
+		if targetNode != nil {
+			if child := targetNode.getChild(i); child != nil {
+				level[i] = child.RootAt(version)
+			}
+		}
+	}
+
+	proof := &IntraNodeProof{Nibbles: sorted}
+	for _, nibble := range sorted {
+		proof.Children = append(proof.Children, level[nibble])
+	}
+	known := sorted
+	for len(level) > 1 {
+		parents := make([][]byte, len(level)/2)
+		for i := range parents {
+			parents[i] = tree.hasher.HashChildren(level[2*i], level[2*i+1])
+		}
+		var next []int
+		for i, pos := range known {
+			if i > 0 && known[i-1] == pos^1 {
+				continue
+			}
+			if i+1 >= len(known) || known[i+1] != pos^1 {
+				proof.Siblings = append(proof.Siblings, level[pos^1])
+			}
+			next = append(next, pos>>1)
+		}
+		level, known = parents, next
+	}
+	return proof, nil
+}
+
+// Root computes the root of the node from the children and the siblings of the proof.
+func (p *IntraNodeProof) Root(hasher *Hasher) ([]byte, error) {
+	if len(p.Nibbles) != len(p.Children) {
+		return nil, ErrInvalidProof
+	}
+	known, err := sortNibbles(p.Nibbles)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[int][]byte, len(known))
+	for i, nibble := range p.Nibbles {
+		hashes[nibble] = p.Children[i]
+	}
+
+	siblings := p.Siblings
+	for width := 16; width > 1; width /= 2 {
+		parents := make(map[int][]byte, len(known))
+		var next []int
+		for i, pos := range known {
+			if i > 0 && known[i-1] == pos^1 {
+				continue
+			}
+			sibling, ok := hashes[pos^1]
+			if !ok {
+				if len(siblings) == 0 {
+					return nil, fmt.Errorf("%w: too few siblings", ErrInvalidProof)
+				}
+				sibling, siblings = siblings[0], siblings[1:]
+			}
+			if pos&1 == 0 {
+				parents[pos>>1] = hasher.HashChildren(hashes[pos], sibling)
+			} else {
+				parents[pos>>1] = hasher.HashChildren(sibling, hashes[pos])
+			}
+			next = append(next, pos>>1)
+		}
+		hashes, known = parents, next
+	}
+	if len(siblings) > 0 {
+		return nil, fmt.Errorf("%w: too many siblings", ErrInvalidProof)
+	}
+	return hashes[0], nil
+}
+
+// sortNibbles returns the sorted copy of the nibbles, which must be distinct children of a node.
+func sortNibbles(nibbles []int) ([]int, error) {
+	if len(nibbles) == 0 {
+		return nil, ErrInvalidProof
+	}
+	sorted := append([]int(nil), nibbles...)
+	sort.Ints(sorted)
+	for i, nibble := range sorted {
+		if nibble < 0 || nibble > 0xf {
+			return nil, fmt.Errorf("%w: nibble %d", ErrInvalidKey, nibble)
+		}
+		if i > 0 && sorted[i-1] == nibble {
+			return nil, fmt.Errorf("%w: nibble %d", ErrDuplicateLeaf, nibble)
+		}
+	}
+	return sorted, nil
+}
@@ -0,0 +1,234 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"sync"
+
+	"github.com/bnb-chain/zkbnb-smt/database"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// Journal records the tree nodes changed since the latest commit,
+// the changed nodes are persisted and the journal is flushed on commit.
+type Journal interface {
+	// Set records the changed node, it replaces the node recorded with the same depth and path.
+	Set(node *TreeNode) error
+	// Len returns the number of the recorded nodes.
+	Len() int
+	// Iterate calls the callback with every recorded node.
+	Iterate(callback func(node *TreeNode) error) error
+	// Flush discards all the recorded nodes.
+	Flush() error
+}
+
+var _ Journal = (*journal)(nil)
+
+func (j *journal) Set(node *TreeNode) error {
+	j.set(journalKey{node.depth, node.path}, node)
+	return nil
+}
+
+func (j *journal) Len() int {
+	return j.len()
+}
+
+func (j *journal) Iterate(callback func(node *TreeNode) error) error {
+	return j.iterate(func(_ journalKey, node *TreeNode) error {
+		return callback(node)
+	})
+}
+
+func (j *journal) Flush() error {
+	j.flush()
+	return nil
+}
+
+var spillJournalPrefix = []byte(`j`)
+
+// Encode key, format: j:${depth}:${path}
+func spillJournalKey(depth uint16, path nodePath) []byte {
+	return nodeStorageKey(spillJournalPrefix, depth, path)
+}
+
+func newSpillJournal(db database.TreeDB, threshold int, nilHashes *nilHashes, hasher *Hasher) *spillJournal {
+	return &spillJournal{
+		memory:    make(map[journalKey]*TreeNode),
+		spilled:   make(map[journalKey]struct{}),
+		db:        db,
+		threshold: threshold,
+		nilHashes: nilHashes,
+		hasher:    hasher,
+	}
+}
+
+// spillJournal keeps at most threshold nodes in memory,
+// the nodes recorded beyond the threshold are encoded into db and
+// only their keys are kept. The tree links the spilled nodes as placeholders,
+// see journalNode, so they are only held in db until they are accessed again.
+type spillJournal struct {
+	mu        sync.RWMutex
+	memory    map[journalKey]*TreeNode
+	spilled   map[journalKey]struct{}
+	db        database.TreeDB
+	threshold int
+	nilHashes *nilHashes
+	hasher    *Hasher
+}
+
+func (j *spillJournal) Set(node *TreeNode) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	key := journalKey{node.depth, node.path}
+	if _, exist := j.memory[key]; exist || len(j.memory) < j.threshold {
+		j.memory[key] = node
+		if _, exist := j.spilled[key]; exist {
+			delete(j.spilled, key)
+			return j.db.Delete(spillJournalKey(key.depth, key.path))
+		}
+		return nil
+	}
+
+	rlpBytes, err := rlp.EncodeToBytes(node.ToStorageTreeNode())
+	if err != nil {
+		return err
+	}
+	if err = j.db.Set(spillJournalKey(key.depth, key.path), rlpBytes); err != nil {
+		return err
+	}
+	j.spilled[key] = struct{}{}
+	return nil
+}
+
+// retainedSize returns the size of the nodes held in memory by the journal, measured by TreeNode.Size.
+func (j *spillJournal) retainedSize() uint64 {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	var size uint64
+	for _, node := range j.memory {
+		size += node.Size()
+	}
+	return size
+}
+
+func (j *spillJournal) Len() int {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return len(j.memory) + len(j.spilled)
+}
+
+// Iterate calls the callback with the nodes in memory first, then with the
+// nodes decoded from db. The decoded nodes are detached from the tree.
+func (j *spillJournal) Iterate(callback func(node *TreeNode) error) error {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	for _, node := range j.memory {
+		if err := callback(node); err != nil {
+			return err
+		}
+	}
+	for key := range j.spilled {
+		node, err := j.decode(key)
+		if err != nil {
+			return err
+		}
+		if err = callback(node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isSpilled returns whether the node recorded at the depth and path is encoded into db.
+func (j *spillJournal) isSpilled(depth uint16, path nodePath) bool {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	_, exist := j.spilled[journalKey{depth, path}]
+	return exist
+}
+
+// load returns the node recorded at the depth and path, the spilled node is decoded from db.
+// It returns nil if no node is recorded.
+func (j *spillJournal) load(depth uint16, path nodePath) (*TreeNode, error) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	key := journalKey{depth, path}
+	if node, exist := j.memory[key]; exist {
+		return node, nil
+	}
+	if _, exist := j.spilled[key]; !exist {
+		return nil, nil
+	}
+	return j.decode(key)
+}
+
+// decode reads the spilled node from db.
+func (j *spillJournal) decode(key journalKey) (*TreeNode, error) {
+	rlpBytes, err := j.db.Get(spillJournalKey(key.depth, key.path))
+	if err != nil {
+		return nil, err
+	}
+	storageNode := &StorageTreeNode{}
+	if err = rlp.DecodeBytes(rlpBytes, storageNode); err != nil {
+		return nil, err
+	}
+	node := storageNode.toTreeNode(key.depth, j.nilHashes, j.hasher)
+	// every recorded node has been changed
+	node.setDirty()
+	return node, nil
+}
+
+func (j *spillJournal) Flush() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	spilled := j.spilled
+	j.memory = make(map[journalKey]*TreeNode)
+	j.spilled = make(map[journalKey]struct{})
+	if len(spilled) == 0 {
+		return nil
+	}
+
+	batch := j.db.NewBatch()
+	for key := range spilled {
+		if err := batch.Delete(spillJournalKey(key.depth, key.path)); err != nil {
+			return err
+		}
+	}
+	return batch.Write()
+}
+
+// journalNode records the changed node in the journal, and returns the node to link into its parent.
+// The nodes spilled by the SpillJournal option are linked as placeholders holding their versions,
+// so the tree does not hold them until the commit, and extendNode decodes them again on access.
+func (tree *BNBSparseMerkleTree) journalNode(node *TreeNode) (*TreeNode, error) {
+	if err := tree.journal.Set(node); err != nil {
+		return nil, err
+	}
+	spill, ok := tree.journal.(*spillJournal)
+	if !ok || node.depth == 0 || !spill.isSpilled(node.depth, node.path) {
+		return node, nil
+	}
+	return node.placeholder(), nil
+}
+
+// loadSpilled returns the node spilled by the SpillJournal option under the placeholder,
+// or nil if the placeholder does not stand for a spilled node.
+func (tree *BNBSparseMerkleTree) loadSpilled(placeholder *TreeNode) (*TreeNode, error) {
+	spill, ok := tree.journal.(*spillJournal)
+	if !ok || placeholder == nil || !placeholder.IsTemporary() {
+		return nil, nil
+	}
+	node, err := spill.load(placeholder.depth, placeholder.path)
+	if err != nil || node == nil {
+		return nil, err
+	}
+	return tree.profiled(node), nil
+}
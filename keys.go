@@ -0,0 +1,80 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/bnb-chain/zkbnb-smt/database"
+	"github.com/pkg/errors"
+)
+
+var rawKeyPrefix = []byte(`k`)
+
+// Encode key, format: k:${path}
+func rawKeyKey(path uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, path)
+	return bytes.Join([][]byte{rawKeyPrefix, buf}, sep)
+}
+
+// KeyPath returns the path of the raw key, which is the leading maxDepth bits of its hash.
+// The raw keys are only supported by the trees of at most 64 levels.
+func (tree *BNBSparseMerkleTree) KeyPath(rawKey []byte) uint64 {
+	return binary.BigEndian.Uint64(tree.hasher.Hash(rawKey)) >> (64 - tree.maxDepth)
+}
+
+// SetKey sets the value of the raw key at the path derived by KeyPath. If the raw keys are retained,
+// setting a raw key at the path of a different one fails with ErrPathCollision instead of overwriting it.
+func (tree *BNBSparseMerkleTree) SetKey(rawKey []byte, val []byte) error {
+	if err := tree.checkNarrow(); err != nil {
+		return err
+	}
+	path := tree.KeyPath(rawKey)
+	if tree.keyRetention {
+		retained, err := tree.retainedKey(path)
+		if err != nil {
+			return err
+		}
+		if retained != nil && !bytes.Equal(retained, rawKey) {
+			return fmt.Errorf("%w: %x and %x at path %d", ErrPathCollision, retained, rawKey, path)
+		}
+	}
+	if err := tree.Set(path, val); err != nil {
+		return err
+	}
+	if tree.keyRetention {
+		if tree.stagedKeys == nil {
+			tree.stagedKeys = make(map[uint64][]byte)
+		}
+		tree.stagedKeys[path] = append([]byte(nil), rawKey...)
+	}
+	return nil
+}
+
+// retainedKey returns the raw key set at the path, including the uncommitted ones.
+func (tree *BNBSparseMerkleTree) retainedKey(path uint64) ([]byte, error) {
+	if rawKey, ok := tree.stagedKeys[path]; ok {
+		return rawKey, nil
+	}
+	rawKey, err := tree.storage().Get(rawKeyKey(path))
+	if errors.Is(err, database.ErrDatabaseNotFound) {
+		return nil, nil
+	}
+	return rawKey, err
+}
+
+// writeRetainedKeys persists the raw keys set since the last commit.
+func (tree *BNBSparseMerkleTree) writeRetainedKeys(batch database.Batcher) error {
+	for path, rawKey := range tree.stagedKeys {
+		if err := batch.Set(rawKeyKey(path), rawKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
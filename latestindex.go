@@ -0,0 +1,57 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/bnb-chain/zkbnb-smt/database"
+	"github.com/pkg/errors"
+)
+
+var latestIndexPrefix = []byte(`i`)
+
+// Encode key, format: i:${key}
+func latestIndexKey(path nodePath) []byte {
+	return bytes.Join([][]byte{latestIndexPrefix, path.bytes()}, sep)
+}
+
+// indexLeaf writes the latest version and hash of the leaf to the latest index,
+// the entry is removed if the leaf has no versions left after a rollback.
+func (tree *BNBSparseMerkleTree) indexLeaf(batch database.Batcher, leaf *TreeNode) error {
+	if !tree.latestIndex {
+		return nil
+	}
+	leaf.rlock()
+	defer leaf.mu.RUnlock()
+	if len(leaf.Versions) == 0 {
+		return batch.Delete(latestIndexKey(leaf.path))
+	}
+	latest := leaf.Versions[len(leaf.Versions)-1]
+	buf := make([]byte, 8, 8+len(latest.Hash))
+	binary.BigEndian.PutUint64(buf, uint64(latest.Ver))
+	return batch.Set(latestIndexKey(leaf.path), append(buf, latest.Hash...))
+}
+
+// indexedLeaf returns the latest version and hash of the leaf in the latest index,
+// false if the leaf is not indexed.
+func (tree *BNBSparseMerkleTree) indexedLeaf(path nodePath) (Version, []byte, bool, error) {
+	if !tree.latestIndex {
+		return 0, nil, false, nil
+	}
+	buf, err := tree.storage().Get(latestIndexKey(path))
+	if errors.Is(err, database.ErrDatabaseNotFound) {
+		return 0, nil, false, nil
+	}
+	if err != nil {
+		return 0, nil, false, err
+	}
+	if len(buf) < 8 {
+		return 0, nil, false, nil
+	}
+	return Version(binary.BigEndian.Uint64(buf)), buf[8:], true, nil
+}
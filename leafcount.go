@@ -0,0 +1,118 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/bnb-chain/zkbnb-smt/database"
+	"github.com/pkg/errors"
+)
+
+var leafCountPrefix = []byte(`c`)
+
+// Encode key, format: c:${version}
+func leafCountKey(version Version) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(version))
+	return bytes.Join([][]byte{leafCountPrefix, buf}, sep)
+}
+
+// LeafCount returns the number of the leaves not holding the nil hash at the version.
+// The count of each committed version is persisted, the leaves are walked to count
+// the versions committed before the counts were introduced.
+func (tree *BNBSparseMerkleTree) LeafCount(version Version) (uint64, error) {
+	if tree.recentVersion > version {
+		return 0, ErrVersionTooOld
+	}
+	if version > tree.version {
+		return 0, ErrVersionTooHigh
+	}
+	if tree.subtreeCounts {
+		return tree.root.LeafCountAt(version), nil
+	}
+	if version == tree.version && tree.leafCountKnown {
+		return tree.leafCount, nil
+	}
+
+	count, found, err := tree.loadLeafCount(version)
+	if err != nil || found {
+		return count, err
+	}
+	count, err = tree.countLeaves(version)
+	if err != nil {
+		return 0, err
+	}
+	if version == tree.version {
+		tree.leafCount, tree.leafCountKnown = count, true
+	}
+	return count, nil
+}
+
+// loadLeafCount reads the count persisted for the version.
+func (tree *BNBSparseMerkleTree) loadLeafCount(version Version) (uint64, bool, error) {
+	if version == 0 {
+		return 0, true, nil
+	}
+	buf, err := tree.storage().Get(leafCountKey(version))
+	if errors.Is(err, database.ErrDatabaseNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return binary.BigEndian.Uint64(buf), true, nil
+}
+
+// resetLeafCount reloads the count of the latest version after it is changed
+// by anything other than a commit, e.g. a rollback or a restore.
+func (tree *BNBSparseMerkleTree) resetLeafCount() error {
+	count, found, err := tree.loadLeafCount(tree.version)
+	if err != nil {
+		return err
+	}
+	tree.leafCount, tree.leafCountKnown = count, found
+	return nil
+}
+
+// countLeaves walks the committed tree to count the leaves at the version.
+func (tree *BNBSparseMerkleTree) countLeaves(version Version) (uint64, error) {
+	root := tree.lastSaveRoot
+	if root == nil {
+		root = tree.root
+	}
+	nilHash := tree.nilHashes.Get(tree.maxDepth)
+	count := uint64(0)
+	err := tree.walkLeaves(root, func(leaf *TreeNode) {
+		if !bytes.Equal(leaf.RootAt(version), nilHash) {
+			count++
+		}
+	})
+	return count, err
+}
+
+// leafCountDelta returns the change of the leaf count made by the staged leaf,
+// comparing its staged hash with the hash of the latest committed version.
+func (tree *BNBSparseMerkleTree) leafCountDelta(leaf *TreeNode) int {
+	if leaf.depth != tree.maxDepth || len(leaf.Versions) == 0 {
+		return 0
+	}
+	nilHash := tree.nilHashes.Get(tree.maxDepth)
+	staged := leaf.Versions[len(leaf.Versions)-1]
+	if staged.Ver <= tree.version {
+		return 0
+	}
+	wasSet := len(leaf.Versions) > 1 && !bytes.Equal(leaf.Versions[len(leaf.Versions)-2].Hash, nilHash)
+	isSet := !bytes.Equal(staged.Hash, nilHash)
+	switch {
+	case isSet && !wasSet:
+		return 1
+	case !isSet && wasSet:
+		return -1
+	}
+	return 0
+}
@@ -0,0 +1,102 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// lockProfile aggregates the time spent waiting on the locks of the nodes by the depth of the nodes.
+type lockProfile struct {
+	// the nanoseconds waited at each depth, accessed atomically
+	waits [maxWideDepth + 1]int64
+	// the number of the write locks taken on the nodes, accessed atomically
+	locks int64
+}
+
+func (p *lockProfile) add(depth uint16, wait time.Duration) {
+	atomic.AddInt64(&p.waits[depth], int64(wait))
+}
+
+// LockProfile returns the aggregate time spent waiting on the locks of the nodes
+// and their internal hashes by the depth of the nodes, only the depths with waits are included.
+// It is empty unless the tree is created with the LockProfiling option, and the depths beyond 255
+// of the trees created with WideDepth are left out.
+func (tree *BNBSparseMerkleTree) LockProfile() map[uint8]time.Duration {
+	profile := make(map[uint8]time.Duration)
+	if tree.lockProfile == nil {
+		return profile
+	}
+	for depth := 0; depth <= maxTreeDepth; depth++ {
+		if wait := atomic.LoadInt64(&tree.lockProfile.waits[depth]); wait > 0 {
+			profile[uint8(depth)] = time.Duration(wait)
+		}
+	}
+	return profile
+}
+
+// profiled attaches the lock profile of the tree to the node.
+func (tree *BNBSparseMerkleTree) profiled(node *TreeNode) *TreeNode {
+	node.lockProfile = tree.lockProfile
+	return node
+}
+
+// the locks of the nodes are taken by lock, rlock, lockInternal and rlockInternal, with the lock profile
+// only the contended locks are timed, as the uncontended ones are taken by TryLock.
+
+func (node *TreeNode) lock() {
+	if node.lockProfile == nil {
+		node.mu.Lock()
+		return
+	}
+	atomic.AddInt64(&node.lockProfile.locks, 1)
+	if node.mu.TryLock() {
+		return
+	}
+	start := time.Now()
+	node.mu.Lock()
+	node.lockProfile.add(node.depth, time.Since(start))
+}
+
+func (node *TreeNode) rlock() {
+	if node.lockProfile == nil {
+		node.mu.RLock()
+		return
+	}
+	if node.mu.TryRLock() {
+		return
+	}
+	start := time.Now()
+	node.mu.RLock()
+	node.lockProfile.add(node.depth, time.Since(start))
+}
+
+func (node *TreeNode) lockInternal(idx int) {
+	if node.lockProfile == nil {
+		node.internalMu[idx].Lock()
+		return
+	}
+	if node.internalMu[idx].TryLock() {
+		return
+	}
+	start := time.Now()
+	node.internalMu[idx].Lock()
+	node.lockProfile.add(node.depth, time.Since(start))
+}
+
+func (node *TreeNode) rlockInternal(idx int) {
+	if node.lockProfile == nil {
+		node.internalMu[idx].RLock()
+		return
+	}
+	if node.internalMu[idx].TryRLock() {
+		return
+	}
+	start := time.Now()
+	node.internalMu[idx].RLock()
+	node.lockProfile.add(node.depth, time.Since(start))
+}
@@ -0,0 +1,89 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/bnb-chain/zkbnb-smt/database/memory"
+)
+
+// MergeTrees assembles the subtrees under their prefixes into a standalone tree of the depth in memory,
+// it is the reverse of ExtractSubtree. The subtrees must share the depth, the hash function and the nil hash,
+// and the prefix of each is the highest depth-maxDepth bits of the keys under it, which must be a multiple of 4.
+// The latest committed leaves of the subtrees are committed as the highest of their latest versions.
+func MergeTrees(subtrees map[uint64]*BNBSparseMerkleTree, depth uint8, hasher *Hasher) (*BNBSparseMerkleTree, error) {
+	if depth == 0 || depth%4 != 0 || depth > maxTreeDepth {
+		return nil, ErrInvalidDepth
+	}
+	prefixes := make([]uint64, 0, len(subtrees))
+	for prefix := range subtrees {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return prefixes[i] < prefixes[j] })
+
+	var (
+		nilHash  []byte
+		subDepth uint16
+		version  Version
+		items    []Item
+	)
+	for _, prefix := range prefixes {
+		subtree := subtrees[prefix]
+		if nilHash == nil {
+			nilHash = subtree.nilHashes.Get(subtree.maxDepth)
+			subDepth = subtree.maxDepth
+			if subDepth >= uint16(depth) {
+				return nil, ErrInvalidDepth
+			}
+		}
+		if subtree.maxDepth != subDepth ||
+			!bytes.Equal(subtree.nilHashes.Get(subtree.maxDepth), nilHash) ||
+			!bytes.Equal(subtree.hasher.Hash(fingerprintProbe), hasher.Hash(fingerprintProbe)) ||
+			subtree.hasher.order != hasher.order {
+			return nil, fmt.Errorf("%w: prefix %d", ErrIncompatibleTrees, prefix)
+		}
+		if prefix>>(uint16(depth)-subDepth) != 0 {
+			return nil, ErrInvalidKey
+		}
+		if subtree.version > version {
+			version = subtree.version
+		}
+
+		root := subtree.lastSaveRoot
+		if root == nil {
+			root = subtree.root
+		}
+		err := subtree.walkLeaves(root, func(leaf *TreeNode) {
+			val := leaf.RootAt(subtree.version)
+			if !bytes.Equal(val, nilHash) {
+				items = append(items, Item{Key: prefix<<subDepth | leaf.path.low(), Val: val})
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if nilHash == nil {
+		return nil, fmt.Errorf("%w: no subtrees", ErrIncompatibleTrees)
+	}
+
+	merged, err := NewBNBSparseMerkleTree(hasher, memory.NewMemoryDB(), depth, nilHash)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) > 0 {
+		if err := merged.MultiSetWithVersion(items, version); err != nil {
+			return nil, err
+		}
+		if _, err := merged.CommitWithNewVersion(nil, &version); err != nil {
+			return nil, err
+		}
+	}
+	return merged.(*BNBSparseMerkleTree), nil
+}
@@ -22,6 +22,12 @@ type Metrics interface {
 	GCThreshold(uint64)
 	// GC info for each field value
 	GCVersions([10]*GCVersion)
+	// The size of each generated proof
+	ProofSize(int)
+	// The total number of children found in memory when walking the tree
+	HydrationHits(uint64)
+	// The total number of children loaded from storage when walking the tree
+	HydrationMisses(uint64)
 }
 
 type GCVersion struct {
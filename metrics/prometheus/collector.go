@@ -44,6 +44,18 @@ func NewCollector() *Collector {
 		Name: "smt_latest_gc_threshold",
 		Help: "GC trigger threshold",
 	})
+	proofSize := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "smt_proof_size",
+		Help: "The size of each generated proof",
+	})
+	hydrationHits := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "smt_hydration_hits",
+		Help: "The total number of children found in memory when walking the tree",
+	})
+	hydrationMisses := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "smt_hydration_misses",
+		Help: "The total number of children loaded from storage when walking the tree",
+	})
 	prometheus.MustRegister(
 		currentVersion,
 		prunedVersion,
@@ -51,7 +63,10 @@ func NewCollector() *Collector {
 		changeSize,
 		commitNum,
 		latestGCVersion,
-		gcThreshold)
+		gcThreshold,
+		proofSize,
+		hydrationHits,
+		hydrationMisses)
 
 	var (
 		gcVersions [10]prometheus.Gauge
@@ -79,6 +94,9 @@ func NewCollector() *Collector {
 		commitNum:       commitNum,
 		latestGCVersion: latestGCVersion,
 		gcThreshold:     gcThreshold,
+		proofSize:       proofSize,
+		hydrationHits:   hydrationHits,
+		hydrationMisses: hydrationMisses,
 		gcVersions:      gcVersions,
 		gcSizes:         gcSizes,
 	}
@@ -92,6 +110,9 @@ type Collector struct {
 	commitNum       prometheus.Gauge
 	latestGCVersion prometheus.Gauge
 	gcThreshold     prometheus.Gauge
+	proofSize       prometheus.Gauge
+	hydrationHits   prometheus.Gauge
+	hydrationMisses prometheus.Gauge
 	gcVersions      [10]prometheus.Gauge
 	gcSizes         [10]prometheus.Gauge
 }
@@ -130,3 +151,15 @@ func (c *Collector) GCVersions(info [10]*metrics.GCVersion) {
 		c.gcSizes[i].Set(float64(info[i].Size))
 	}
 }
+
+func (c *Collector) ProofSize(size int) {
+	c.proofSize.Set(float64(size))
+}
+
+func (c *Collector) HydrationHits(hits uint64) {
+	c.hydrationHits.Set(float64(hits))
+}
+
+func (c *Collector) HydrationMisses(misses uint64) {
+	c.hydrationMisses.Set(float64(misses))
+}
@@ -0,0 +1,132 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/pkg/errors"
+
+	"github.com/bnb-chain/zkbnb-smt/database"
+)
+
+// MigrateTo copies the nodes reachable from the latest root and the tree metadata to dst, then switches
+// the tree to dst. The tree keeps reading from and committing to the source while the nodes are copied,
+// the commits are blocked only while the nodes committed meanwhile are copied before the switch.
+// The source is left open to the caller.
+func (tree *BNBSparseMerkleTree) MigrateTo(dst database.TreeDB) error {
+	src := tree.storage()
+	copiedVersion := tree.LatestVersion()
+	rollbacks := atomic.LoadUint64(&tree.rollbacks)
+	if err := tree.copyTo(src, dst.NewBatch(), 0); err != nil {
+		return err
+	}
+
+	tree.commitMu.Lock()
+	defer tree.commitMu.Unlock()
+	if tree.version != copiedVersion || atomic.LoadUint64(&tree.rollbacks) != rollbacks {
+		// the rolled back nodes are rewritten with the lower versions, so all of them are copied again
+		since := copiedVersion
+		if atomic.LoadUint64(&tree.rollbacks) != rollbacks {
+			since = 0
+		}
+		if err := tree.copyTo(src, dst.NewBatch(), since); err != nil {
+			return err
+		}
+	}
+	tree.dbMu.Lock()
+	tree.db = tree.deferWrites(dst)
+	tree.dbMu.Unlock()
+	return nil
+}
+
+// storage returns the database of the tree, which MigrateTo may switch concurrently.
+func (tree *BNBSparseMerkleTree) storage() database.TreeDB {
+	tree.dbMu.RLock()
+	defer tree.dbMu.RUnlock()
+	return tree.db
+}
+
+// copyTo copies the nodes changed after the version since and the tree metadata from src to the batch.
+func (tree *BNBSparseMerkleTree) copyTo(src database.TreeDB, batch database.Batcher, since Version) error {
+	keys := [][]byte{latestVersionKey, recentVersionNumberKey, checkpointKey, checkpointVersionKey, sealedKey,
+		clearedPrefixesKey}
+	for _, version := range tree.Versions() {
+		keys = append(keys, leafCountKey(version))
+	}
+	for _, key := range keys {
+		if err := copyKey(src, batch, key); err != nil {
+			return err
+		}
+	}
+	if err := tree.copyNodes(src, batch, 0, nodePath{}, 0, since); err != nil {
+		return err
+	}
+	return batch.Write()
+}
+
+// copyNodes copies the node of the latest version and its descendants changed after the version since.
+func (tree *BNBSparseMerkleTree) copyNodes(src database.TreeDB, batch database.Batcher,
+	depth uint16, path nodePath, version Version, since Version) error {
+
+	key := tree.nodeKey(depth, path, version)
+	buf, err := src.Get(key)
+	if errors.Is(err, database.ErrDatabaseNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := batch.Set(key, buf); err != nil {
+		return err
+	}
+	if batch.ValueSize() > tree.batchSizeLimit {
+		if err := batch.Write(); err != nil {
+			return err
+		}
+		batch.Reset()
+	}
+	if depth == tree.maxDepth {
+		if err := copyKey(src, batch, latestIndexKey(path)); err != nil {
+			return err
+		}
+		return copyKey(src, batch, rawKeyKey(path.low()))
+	}
+
+	node := &StorageTreeNode{}
+	if err := rlp.DecodeBytes(buf, node); err != nil {
+		return err
+	}
+	if err := tree.decodeStorageTreeNode(node); err != nil {
+		return err
+	}
+	for nibble, child := range node.Children {
+		if child == nil || len(child.Versions) == 0 {
+			continue
+		}
+		latest := child.Versions[len(child.Versions)-1].Ver
+		if latest <= since {
+			continue
+		}
+		if err := tree.copyNodes(src, batch, depth+4, path.child(uint64(nibble)), latest, since); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyKey copies the value of the key from src to the batch if it exists.
+func copyKey(src database.TreeDB, batch database.Batcher, key []byte) error {
+	buf, err := src.Get(key)
+	if errors.Is(err, database.ErrDatabaseNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return batch.Set(key, buf)
+}
@@ -0,0 +1,27 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+// ExpectedNodeCount returns the number of TreeNodes a tree of the depth holds for the leaves at the paths,
+// which is the union of the nodes from the root to each leaf, including the root and the leaves.
+// The duplicated paths are counted once, and the depth is checked like NewBNBSparseMerkleTree.
+func ExpectedNodeCount(paths []uint64, depth uint8) (int, error) {
+	if depth == 0 || depth%4 != 0 || depth > maxTreeDepth {
+		return 0, ErrInvalidDepth
+	}
+	if len(paths) == 0 {
+		return 0, nil
+	}
+	count := 1 // the root
+	for d := uint8(4); d <= depth; d += 4 {
+		nodes := make(map[uint64]struct{}, len(paths))
+		for _, path := range paths {
+			nodes[path>>(depth-d)] = struct{}{}
+		}
+		count += len(nodes)
+	}
+	return count, nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"bytes"
+
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// NodeCodec is the codecs the nodes were persisted with, the zero value decodes the nodes
+// persisted without the ValueCompression and VersionEncoding options.
+type NodeCodec struct {
+	Compressor   Compressor
+	VersionCodec VersionCodec
+}
+
+// NodeDiff is the difference between two storage nodes.
+type NodeDiff struct {
+	// PathDiffers reports whether the nodes are stored for different paths.
+	PathDiffers bool
+	// Internals are the indexes of the internal hashes differing between the nodes.
+	Internals []int
+	// Versions are the versions of the nodes holding different hashes or present in only one of them.
+	Versions []Version
+	// Children are the nibbles of the children whose versions differ.
+	Children []int
+}
+
+// Empty reports whether the nodes are identical.
+func (diff *NodeDiff) Empty() bool {
+	return !diff.PathDiffers && len(diff.Internals) == 0 && len(diff.Versions) == 0 && len(diff.Children) == 0
+}
+
+// DiffStorageNodes decodes the serialized storage nodes a and b, and reports the differences
+// between their internal hashes, versions and children. The values compressed or the version numbers
+// encoded by the options are decoded by the codec before they are compared.
+func DiffStorageNodes(a, b []byte, codec NodeCodec) (*NodeDiff, error) {
+	nodeA, err := decodeStorageNode(a, codec)
+	if err != nil {
+		return nil, err
+	}
+	nodeB, err := decodeStorageNode(b, codec)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &NodeDiff{
+		PathDiffers: nodeA.Path != nodeB.Path,
+		Versions:    diffVersions(nodeA.Versions, nodeB.Versions),
+	}
+	for i := range nodeA.Internals {
+		if !bytes.Equal(nodeA.Internals[i], nodeB.Internals[i]) {
+			diff.Internals = append(diff.Internals, i)
+		}
+	}
+	for i := range nodeA.Children {
+		var versionsA, versionsB []*VersionInfo
+		if nodeA.Children[i] != nil {
+			versionsA = nodeA.Children[i].Versions
+		}
+		if nodeB.Children[i] != nil {
+			versionsB = nodeB.Children[i].Versions
+		}
+		if len(diffVersions(versionsA, versionsB)) > 0 {
+			diff.Children = append(diff.Children, i)
+		}
+	}
+	return diff, nil
+}
+
+// decodeStorageNode decodes the serialized storage node with the codec.
+func decodeStorageNode(blob []byte, codec NodeCodec) (*StorageTreeNode, error) {
+	node := &StorageTreeNode{}
+	if err := rlp.DecodeBytes(blob, node); err != nil {
+		return nil, err
+	}
+	decoder := &BNBSparseMerkleTree{compressor: codec.Compressor, versionCodec: codec.VersionCodec}
+	if err := decoder.decodeStorageTreeNode(node); err != nil {
+		return nil, err
+	}
+	if err := decoder.decompressVersions(node.Versions); err != nil {
+		return nil, err
+	}
+	for _, child := range node.Children {
+		if child == nil {
+			continue
+		}
+		if err := decoder.decompressVersions(child.Versions); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+// diffVersions returns the versions holding different hashes or present in only one of a and b, in ascending order.
+func diffVersions(a, b []*VersionInfo) []Version {
+	var diff []Version
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case j == len(b) || (i < len(a) && a[i].Ver < b[j].Ver):
+			diff = append(diff, a[i].Ver)
+			i++
+		case i == len(a) || b[j].Ver < a[i].Ver:
+			diff = append(diff, b[j].Ver)
+			j++
+		default:
+			if !bytes.Equal(a[i].Hash, b[j].Hash) || a[i].Count != b[j].Count {
+				diff = append(diff, a[i].Ver)
+			}
+			i++
+			j++
+		}
+	}
+	return diff
+}
@@ -0,0 +1,214 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// NonMembershipProof proves the key has no value in the tree of the root by the proofs
+// of the occupied leaves next to it, the leaves between the neighbors are shown to be empty
+// by the siblings of their proofs. A missing neighbor means there is no occupied leaf on that side.
+type NonMembershipProof struct {
+	Key   uint64
+	Depth uint8
+	Root  []byte
+	// Left is the proof of the greatest occupied key below Key, the siblings are ordered from leaf to root.
+	Left *ProofItem
+	// Right is the proof of the least occupied key above Key, the siblings are ordered from leaf to root.
+	Right *ProofItem
+}
+
+// GetNonMembershipProof returns the proof that the key has no value at the version by its occupied neighbors.
+func (tree *BNBSparseMerkleTree) GetNonMembershipProof(key uint64, version Version) (*NonMembershipProof, error) {
+	if err := tree.checkNarrow(); err != nil {
+		return nil, err
+	}
+	if err := tree.checkKeyVersion(key, version); err != nil {
+		return nil, err
+	}
+
+	val, err := tree.Get(key, &version)
+	if err != nil && !errors.Is(err, ErrNodeNotFound) && !errors.Is(err, ErrEmptyRoot) {
+		return nil, err
+	}
+	if err == nil && !bytes.Equal(val, tree.nilHashes.Get(tree.maxDepth)) {
+		return nil, fmt.Errorf("%w: key %d", ErrKeyOccupied, key)
+	}
+	left, hasLeft, err := tree.nearestOccupied(key, version, true)
+	if err != nil {
+		return nil, err
+	}
+	right, hasRight, err := tree.nearestOccupied(key, version, false)
+	if err != nil {
+		return nil, err
+	}
+
+	proof := &NonMembershipProof{Key: key, Depth: uint8(tree.maxDepth), Root: tree.root.RootAt(version)}
+	neighbor := func(key uint64) (*ProofItem, error) {
+		siblings, err := tree.getProofAt(uint64Path(key), version)
+		if err != nil {
+			return nil, err
+		}
+		val, err := tree.Get(key, &version)
+		if err != nil {
+			return nil, err
+		}
+		return &ProofItem{Key: key, Value: val, Root: proof.Root, Proof: siblings}, nil
+	}
+	if hasLeft {
+		if proof.Left, err = neighbor(left); err != nil {
+			return nil, err
+		}
+	}
+	if hasRight {
+		if proof.Right, err = neighbor(right); err != nil {
+			return nil, err
+		}
+	}
+	return proof, nil
+}
+
+// nearestOccupied returns the greatest occupied key below the key if below is set, otherwise the least
+// occupied key above it, at the version. It descends along the path of the key to find the deepest subtree
+// next to the path that is not empty at the version, then descends into it along its outermost occupied
+// children, so only the nodes on the two paths are visited and the empty subtrees are skipped by their roots.
+func (tree *BNBSparseMerkleTree) nearestOccupied(key uint64, version Version, below bool) (uint64, bool, error) {
+	// the nibbles from the nibble to the edge of a node on the side of the key, the nearest first
+	outward := func(from int) []uint64 {
+		var nibbles []uint64
+		for n := from; n >= 0 && n <= 0xf; {
+			nibbles = append(nibbles, uint64(n))
+			if below {
+				n--
+			} else {
+				n++
+			}
+		}
+		return nibbles
+	}
+	// firstOccupied returns the first child of the nibbles not empty at the version, the roots of the children
+	// are recorded in the node, so only the child found is loaded from storage
+	firstOccupied := func(node *TreeNode, nibbles []uint64, depth uint16, path uint64) (*TreeNode, error) {
+		for _, nibble := range nibbles {
+			child := node.getChild(int(nibble))
+			if child == nil || bytes.Equal(child.RootAt(version), tree.nilHashes.Get(depth)) {
+				continue
+			}
+			if depth == tree.maxDepth {
+				return child, nil
+			}
+			return tree.childAt(node, nibble, uint64Path(path&^0xf|nibble), depth, version)
+		}
+		return nil, nil
+	}
+
+	var (
+		branch      *TreeNode
+		branchDepth uint16
+	)
+	node := tree.root
+	for depth := uint16(4); node != nil; depth += 4 {
+		path := key >> (tree.maxDepth - depth)
+		from := int(path&0xf) + 1
+		if below {
+			from = int(path&0xf) - 1
+		}
+		child, err := firstOccupied(node, outward(from), depth, path)
+		if err != nil {
+			return 0, false, err
+		}
+		if child != nil {
+			branch, branchDepth = child, depth
+		}
+		if depth == tree.maxDepth {
+			break
+		}
+		if node, err = tree.childAt(node, path&0xf, uint64Path(path), depth, version); err != nil {
+			return 0, false, err
+		}
+	}
+	if branch == nil {
+		return 0, false, nil
+	}
+
+	// the outermost occupied leaf of the subtree is the nearest to the key
+	from := 0
+	if below {
+		from = 0xf
+	}
+	node = branch
+	for depth := branchDepth + 4; depth <= tree.maxDepth; depth += 4 {
+		child, err := firstOccupied(node, outward(from), depth, node.path.low()<<4)
+		if err != nil {
+			return 0, false, err
+		}
+		if child == nil {
+			return 0, false, fmt.Errorf("%w: depth %d, path %v", ErrNodeMismatched, node.depth, node.path)
+		}
+		node = child
+	}
+	return node.path.low(), true, nil
+}
+
+// Verify verifies the neighbors against the root and that the key falls strictly between them
+// with only empty leaves in the gap, nilHash is the nil hash of the leaves of the tree.
+func (p *NonMembershipProof) Verify(hasher *Hasher, nilHash []byte) error {
+	if p.Depth == 0 || p.Depth > 64 || (p.Depth < 64 && p.Key>>p.Depth != 0) {
+		return ErrInvalidKey
+	}
+	nilHashes := constructNilHashes(uint16(p.Depth), nilHash, hasher)
+	if p.Left == nil && p.Right == nil {
+		if !bytes.Equal(p.Root, nilHashes.Get(0)) {
+			return fmt.Errorf("%w: the tree is not empty", ErrInvalidProof)
+		}
+		return nil
+	}
+
+	for _, neighbor := range []*ProofItem{p.Left, p.Right} {
+		if neighbor == nil {
+			continue
+		}
+		if err := checkProofLength(neighbor.Proof, int(p.Depth)); err != nil {
+			return err
+		}
+		if !bytes.Equal(neighbor.Root, p.Root) {
+			return ErrInvalidProof
+		}
+		if bytes.Equal(neighbor.Value, nilHash) {
+			return fmt.Errorf("%w: key %d is not occupied", ErrInvalidProof, neighbor.Key)
+		}
+		if err := neighbor.Verify(hasher); err != nil {
+			return err
+		}
+	}
+	if (p.Left != nil && p.Left.Key >= p.Key) || (p.Right != nil && p.Right.Key <= p.Key) {
+		return fmt.Errorf("%w: key %d is not between the neighbors", ErrInvalidProof, p.Key)
+	}
+
+	// the subtrees hanging off the paths of the neighbors below their common ancestor
+	// cover the gap exactly, all of them must be empty
+	top := p.Depth
+	if p.Left != nil && p.Right != nil {
+		top = 0
+		for diff := p.Left.Key ^ p.Right.Key; diff != 0; diff >>= 1 {
+			top++
+		}
+		top--
+	}
+	for level := uint8(0); level < top; level++ {
+		nilSibling := nilHashes.Get(uint16(p.Depth - level))
+		if p.Left != nil && (p.Left.Key>>level)&1 == 0 && !bytes.Equal(p.Left.Proof[level], nilSibling) {
+			return fmt.Errorf("%w: the gap above key %d is occupied", ErrInvalidProof, p.Left.Key)
+		}
+		if p.Right != nil && (p.Right.Key>>level)&1 == 1 && !bytes.Equal(p.Right.Proof[level], nilSibling) {
+			return fmt.Errorf("%w: the gap below key %d is occupied", ErrInvalidProof, p.Right.Key)
+		}
+	}
+	return nil
+}
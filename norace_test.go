@@ -0,0 +1,11 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+//go:build !race
+
+package bsmt
+
+// raceEnabled reports whether the tests are built with the race detector.
+const raceEnabled = false
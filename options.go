@@ -6,7 +6,11 @@
 package bsmt
 
 import (
+	"time"
+
+	"github.com/bnb-chain/zkbnb-smt/database"
 	"github.com/bnb-chain/zkbnb-smt/metrics"
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/panjf2000/ants/v2"
 )
 
@@ -52,3 +56,277 @@ func EnableMetrics(metrics metrics.Metrics) Option {
 		smt.metrics = metrics
 	}
 }
+
+// MaxProofSize limits the size in bytes of a proof generated by GetProof,
+// zero means unlimited.
+func MaxProofSize(size int) Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.maxProofSize = size
+	}
+}
+
+// MaxLeafSize limits the size in bytes of a value set to a leaf,
+// zero means unlimited.
+func MaxLeafSize(size int) Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.maxLeafSize = size
+	}
+}
+
+// EnableVerifyOnLoad recomputes every node loaded from storage from the hashes of its children and checks it
+// against the hash recorded in its parent, so that corrupted subtrees are detected on hydration.
+func EnableVerifyOnLoad() Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.verifyOnLoad = true
+	}
+}
+
+// StrictLoad checks that the versions of every node loaded from storage are strictly increasing,
+// so that the corrupted nodes are detected on hydration rather than producing wrong proofs.
+func StrictLoad() Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.strictLoad = true
+	}
+}
+
+// SubtreeCounts maintains the number of the populated leaves under every node in its versions,
+// so LeafCount is answered from the root without walking the leaves. It must be enabled
+// since the tree is created, as the nodes persisted without it hold no counts.
+func SubtreeCounts() Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.subtreeCounts = true
+	}
+}
+
+// HashTruncation truncates the hashes of the tree to size bytes, e.g. 31 bytes to fit in the field
+// of BN254. The nil hashes and the proofs are of the truncated width, so the proofs must be verified
+// with the hasher truncated by Hasher.Truncate. The constructors fail with ErrInvalidTruncation unless
+// the size is at least 8 bytes, which KeyPath reads the paths from, and below the size of the hasher.
+func HashTruncation(size int) Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.hashTruncation = size
+	}
+}
+
+// ChildOrdering hashes the children of the nodes in the order, e.g. RightLeft to match a verifier
+// hashing the right child first. The proofs must be verified with the hasher ordered by Hasher.Ordered.
+func ChildOrdering(order ChildOrder) Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.childOrder = order
+	}
+}
+
+// LatestIndex maintains an index of the latest version and hash of each leaf in storage on commit,
+// so the latest committed values are read without walking the tree. The keys missing in the index
+// are read from the tree, while the entries are only kept up to date by the writers with the option.
+func LatestIndex() Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.latestIndex = true
+	}
+}
+
+// DeferredWrites buffers the nodes written by the commits in memory until Sync or Close,
+// so the writes of many commits reach storage in one pass. The buffered nodes are read as if
+// they were in storage, while a crash loses the commits since the last Sync.
+func DeferredWrites() Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.deferredWrites = true
+	}
+}
+
+// LockProfiling records the time spent waiting on the locks of the nodes and their internal hashes
+// by the depth of the nodes, which is reported by LockProfile. The locks are taken as usual without it.
+func LockProfiling() Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.lockProfile = &lockProfile{}
+	}
+}
+
+// NoInternalStorage persists the nodes without their 14 internal hashes, which are recomputed
+// from the children when the nodes are loaded, trading the hashing for about 450 bytes per node.
+func NoInternalStorage() Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.noInternalStorage = true
+	}
+}
+
+// VersionEncoding encodes the version numbers of the nodes by the codec in storage,
+// e.g. DeltaVersionCodec for the nodes of many versions close to each other.
+// The nodes persisted without it are still readable.
+func VersionEncoding(codec VersionCodec) Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.versionCodec = codec
+	}
+}
+
+// ValueCompression compresses the leaf values larger than threshold bytes before they are persisted,
+// and decompresses them transparently when they are read.
+func ValueCompression(compressor Compressor, threshold int) Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.compressor = compressor
+		smt.compressionThreshold = threshold
+	}
+}
+
+// SpillJournal records the changed nodes in a journal that keeps at most threshold nodes in memory,
+// the nodes beyond the threshold are spilled into db until they are committed.
+// The tree links the spilled nodes as placeholders, which are decoded from db when they are accessed before the commit.
+func SpillJournal(db database.TreeDB, threshold int) Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.journal = newSpillJournal(db, threshold, smt.nilHashes, smt.hasher)
+	}
+}
+
+// CommitCoalescing merges the Commit calls within the window into one commit performed when the window ends,
+// all the coalesced callers are blocked until then and get the same version.
+func CommitCoalescing(window time.Duration) Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.coalescer = newCommitCoalescer(window)
+	}
+}
+
+// AdaptivePreload records the latest size accessed keys, and hydrates their paths after each commit,
+// so the keys hot in the prior batches are found in memory by the next batch.
+func AdaptivePreload(size int) Option {
+	return func(smt *BNBSparseMerkleTree) {
+		if history, err := lru.New(size); err == nil {
+			smt.accessHistory = history
+		}
+	}
+}
+
+// VersionCache keeps the nodes resolved by NodeRootAt and GetProofAt for the latest accessed versions,
+// so the repeated reads of a hot version reuse them instead of loading them from storage again.
+// The nodes of the least recently accessed version are evicted once more versions are cached.
+func VersionCache(versions int) Option {
+	return func(smt *BNBSparseMerkleTree) {
+		if cache, err := lru.New(versions); err == nil {
+			smt.versionCache = cache
+		}
+	}
+}
+
+// ParallelThreshold computes the changes of MultiSet inline when their number does not exceed the threshold,
+// as submitting a few tasks to the goroutine pool costs more than computing them.
+func ParallelThreshold(threshold int) Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.parallelThreshold = threshold
+	}
+}
+
+// StorageParallelism runs the storage bound tasks, e.g. loading the nodes on MultiSet,
+// in a separate goroutine pool of the size, so they do not starve the hashing tasks and vice versa.
+func StorageParallelism(size int) Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.storageParallelism = size
+	}
+}
+
+// CheckpointInterval persists the memory image of the tree as a checkpoint whenever a commit
+// crosses a multiple of n versions, the tree can be reconstructed from the latest one by RestoreCheckpoint.
+func CheckpointInterval(n Version) Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.checkpointInterval = n
+	}
+}
+
+// MaxConcurrentHydrations caps the number of nodes loaded from storage at the same time,
+// the excess loads wait until one of the running loads completes.
+func MaxConcurrentHydrations(n int) Option {
+	return func(smt *BNBSparseMerkleTree) {
+		if n > 0 {
+			smt.hydrations = make(chan struct{}, n)
+		}
+	}
+}
+
+// EvictionCallback is invoked with the depth and path of every node archived when releasing memory,
+// it is called without holding any node lock so it may access the tree. The nodes deeper than 64 levels
+// of the trees created with WideDepth are not reported, as their paths exceed 64 bits.
+func EvictionCallback(callback func(depth uint8, path uint64)) Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.evictionCallback = callback
+	}
+}
+
+// SpillToDisk bounds the memory of the nodes resident in the tree to the limit in bytes, measured by TreeNode.Size.
+// Once a commit leaves the tree above the limit, the subtrees not changed for the longest time are archived,
+// they are re-read from storage when accessed again. The paths changed by the latest commit are kept in memory,
+// so the tree may stay above the limit if they alone exceed it.
+func SpillToDisk(limit uint64) Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.spillLimit = limit
+	}
+}
+
+// NilValueHandling sets how the nil or empty values set to the keys are stored, TreatAsDelete
+// reverts the leaves to the nil hash by default, while StoreEmpty keeps the keys present with the hash of the empty value.
+func NilValueHandling(policy NilValuePolicy) Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.nilValuePolicy = policy
+	}
+}
+
+// ProofOrder sets the order of the siblings in the proofs returned by GetProof, GetProofAt
+// and GetCommitmentProof, and expected by VerifyProof. The multi proofs are always from the leaf to the root.
+func ProofOrder(order Order) Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.proofOrder = order
+	}
+}
+
+// ReadCacheTTL re-reads the nodes loaded from storage on the next access once they have been cached longer than ttl,
+// for the storage mutated by others. The nodes with uncommitted changes are kept.
+func ReadCacheTTL(ttl time.Duration) Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.readCacheTTL = ttl
+	}
+}
+
+// StorageSalt stores the nodes under the keys salted by the latest version of each node, format:
+// t:${salt}:${depth}:${path}, e.g. the salt of an epoch separates its nodes from the other epochs
+// in one database. A node rewritten under a new salt deletes its key of the previous salt, as the
+// rewritten node carries its older versions, so the nodes left in an epoch are the ones still last
+// written in it. Only an epoch fully superseded by the later epochs can be deleted at once without
+// losing the latest tree. The root node is always stored without salt.
+func StorageSalt(salt func(version Version) []byte) Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.storageSalt = salt
+	}
+}
+
+// KeyRetention persists the raw keys set by SetKey at their paths, so a different raw key
+// colliding at the path of a set one is rejected with ErrPathCollision. The retained keys
+// are kept on Rollback.
+func KeyRetention() Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.keyRetention = true
+	}
+}
+
+// CloseTimeout bounds the time Close waits for the in-flight asynchronous commits,
+// Close fails with ErrCloseTimeout when it elapses. Close waits until they finish by default.
+func CloseTimeout(timeout time.Duration) Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.closeTimeout = timeout
+	}
+}
+
+// CommitTimeout bounds the time a commit waits for the commit in progress, e.g. one stalled by slow storage,
+// the commit fails with ErrCommitTimeout when it elapses and leaves the staged changes untouched.
+// The commits wait until the lock is released by default.
+func CommitTimeout(timeout time.Duration) Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.commitTimeout = timeout
+	}
+}
+
+// WideDepth sets the depth of the tree beyond 64 levels up to 256, overriding the depth passed to the constructor,
+// and the nil hashes of the levels are derived from the nil hash of the leaves. The leaves are addressed by WideKey
+// with SetWide, GetWide and GetWideProof, the uint64 keys still address the leaves below 2^64. The operations
+// enumerating the leaves by uint64 keys, e.g. DeletePrefix, ExtractSubtree and CommitLog, fail with ErrInvalidDepth.
+func WideDepth(depth uint16) Option {
+	return func(smt *BNBSparseMerkleTree) {
+		smt.wideDepth = depth
+	}
+}
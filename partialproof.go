@@ -0,0 +1,73 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"errors"
+
+	"github.com/bnb-chain/zkbnb-smt/utils"
+)
+
+// GetPartialProof returns the root of the subtree at stopDepth holding the key at the version, and the siblings
+// from the subtree root up to the tree root, so only the top stopDepth levels are verified against the trusted
+// subtree root. The siblings are ordered by the ProofOrder option. The proof also verifies as a ProofItem
+// of the subtree root at the key shifted right by the depth of the tree minus stopDepth.
+func (tree *BNBSparseMerkleTree) GetPartialProof(key uint64, stopDepth uint8, version Version) ([]byte, Proof, error) {
+	if uint16(stopDepth) > tree.maxDepth {
+		return nil, nil, ErrInvalidDepth
+	}
+	proof, err := tree.getProofAt(uint64Path(key), version)
+	if err != nil {
+		return nil, nil, err
+	}
+	leaf, err := tree.Get(key, &version)
+	if errors.Is(err, ErrNodeNotFound) || errors.Is(err, ErrEmptyRoot) {
+		leaf = tree.nilHashes.Get(tree.maxDepth)
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	// hash the leaf up to the subtree root by the siblings below it
+	below := int(tree.maxDepth - uint16(stopDepth))
+	subtreeRoot := leaf
+	for level := 0; level < below; level++ {
+		if (key>>level)&1 == 0 {
+			subtreeRoot = tree.hasher.HashChildren(subtreeRoot, proof[level])
+		} else {
+			subtreeRoot = tree.hasher.HashChildren(proof[level], subtreeRoot)
+		}
+	}
+	return subtreeRoot, tree.orderProof(proof[below:]), nil
+}
+
+// VerifyPartialProof verifies the partial proof returned by GetPartialProof, that the subtree root
+// at stopDepth holding the key leads to the root of the tree at the version.
+func (tree *BNBSparseMerkleTree) VerifyPartialProof(key uint64, stopDepth uint8, subtreeRoot []byte, proof Proof, version Version) (bool, error) {
+	if uint16(stopDepth) > tree.maxDepth {
+		return false, ErrInvalidDepth
+	}
+	if err := tree.checkKeyVersion(key, version); err != nil {
+		return false, err
+	}
+	if err := checkProofLength(proof, int(stopDepth)); err != nil {
+		return false, err
+	}
+	if tree.proofOrder == RootToLeaf {
+		proof = utils.ReverseBytes(append(Proof{}, proof...))
+	}
+
+	item := &ProofItem{
+		Key:   key >> (tree.maxDepth - uint16(stopDepth)),
+		Value: subtreeRoot,
+		Root:  tree.root.RootAt(version),
+		Proof: proof,
+	}
+	err := item.Verify(tree.hasher)
+	if errors.Is(err, ErrRootMismatched) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,56 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+// pinnedRoot is the root of the tree before a rollback, the rollback works on copies
+// of the nodes, so the proofs can be served from it while the rollback is in progress.
+type pinnedRoot struct {
+	root    *TreeNode
+	version Version
+	// whether the version is referenced, so it is not pruned meanwhile
+	acquired bool
+}
+
+// pin pins the last saved root for the proofs until unpin is called.
+func (tree *BNBSparseMerkleTree) pin() *pinnedRoot {
+	pinned := &pinnedRoot{
+		root:     tree.lastSaveRoot,
+		version:  tree.version,
+		acquired: tree.snapshots.acquire(tree.version),
+	}
+	tree.viewMu.Lock()
+	tree.pinned = pinned
+	tree.viewMu.Unlock()
+	return pinned
+}
+
+// unpin releases the pinned root, the proofs are served from the current root afterwards.
+func (tree *BNBSparseMerkleTree) unpin(pinned *pinnedRoot) {
+	tree.viewMu.Lock()
+	tree.pinned = nil
+	tree.viewMu.Unlock()
+	if pinned.acquired {
+		tree.snapshots.release(pinned.version)
+	}
+}
+
+// switchRoot switches in the root which is both the current and the last saved root.
+func (tree *BNBSparseMerkleTree) switchRoot(root *TreeNode) {
+	tree.viewMu.Lock()
+	defer tree.viewMu.Unlock()
+	tree.root = root
+	tree.lastSaveRoot = root
+}
+
+// proofRoot returns the root to serve the proofs from, the pinned root during rollbacks.
+func (tree *BNBSparseMerkleTree) proofRoot() *TreeNode {
+	tree.viewMu.RLock()
+	defer tree.viewMu.RUnlock()
+	if tree.pinned != nil {
+		return tree.pinned.root
+	}
+	return tree.root
+}
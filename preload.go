@@ -0,0 +1,32 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+// recordAccess records the key in the access history when the adaptive preload is enabled,
+// the least recently accessed keys are evicted once the history is full.
+func (tree *BNBSparseMerkleTree) recordAccess(path nodePath) {
+	if tree.accessHistory != nil {
+		tree.accessHistory.Add(path, struct{}{})
+	}
+}
+
+// preload hydrates the paths of the keys accessed recently, so the next batch
+// finds them in memory even if they have been released by GC.
+// It is best-effort, the paths failed to load are loaded on demand later.
+func (tree *BNBSparseMerkleTree) preload() {
+	if tree.accessHistory == nil {
+		return
+	}
+	for _, path := range tree.accessHistory.Keys() {
+		leaf, err := tree.findLeaf(path.(nodePath))
+		if err != nil {
+			return
+		}
+		if leaf != nil && tree.dbCache != nil {
+			tree.dbCache.Add(leaf.path, leaf)
+		}
+	}
+}
@@ -5,5 +5,300 @@
 
 package bsmt
 
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+const solidityWordSize = 32
+
 // Proof is a proof of inclusion or exclusion of a leaf node in a tree.
 type Proof [][]byte
+
+// checkProofLength returns ErrProofLengthMismatch if the proof does not hold one sibling for each level of the depth.
+func checkProofLength(proof Proof, depth int) error {
+	if len(proof) != depth {
+		return ErrProofLengthMismatch{Got: len(proof), Want: depth}
+	}
+	return nil
+}
+
+// Order is the order of the siblings in a proof.
+type Order uint8
+
+const (
+	// LeafToRoot orders the siblings from the leaf to the root, it is the default order.
+	LeafToRoot Order = iota
+	// RootToLeaf orders the siblings from the root to the leaf.
+	RootToLeaf
+)
+
+// SolidityWitness encodes the proof of the key as `abi.encode(bytes32[] siblings, uint256 path)`,
+// where the siblings are ordered from root to leaf and the path is the key itself,
+// the bit i of the path is the position of the node at the i-th level above the leaf.
+//
+// The witness can be verified on-chain by hashing from the leaf to the root:
+//
+//	bytes32 node = leaf;
+//	for (uint256 i = 0; i < siblings.length; i++) {
+//	    bytes32 sibling = siblings[siblings.length - 1 - i];
+//	    if ((path >> i) & 1 == 0) {
+//	        node = sha256(abi.encodePacked(node, sibling));
+//	    } else {
+//	        node = sha256(abi.encodePacked(sibling, node));
+//	    }
+//	}
+//	return node == root;
+func (p Proof) SolidityWitness(key uint64) ([]byte, error) {
+	if len(p) < 64 && key>>len(p) != 0 {
+		return nil, ErrInvalidKey
+	}
+
+	witness := make([]byte, solidityWordSize*(3+len(p)))
+	// offset of the siblings array
+	binary.BigEndian.PutUint64(witness[solidityWordSize-8:], 2*solidityWordSize)
+	// path bitmap
+	binary.BigEndian.PutUint64(witness[2*solidityWordSize-8:], key)
+	// length of the siblings array
+	binary.BigEndian.PutUint64(witness[3*solidityWordSize-8:], uint64(len(p)))
+	for i := range p {
+		if len(p[i]) != solidityWordSize {
+			return nil, ErrInvalidProof
+		}
+		// the proof is ordered from leaf to root
+		copy(witness[(3+i)*solidityWordSize:], p[len(p)-1-i])
+	}
+	return witness, nil
+}
+
+// MultiProof is a batch of proofs of the leaves in a tree.
+type MultiProof struct {
+	Keys   []uint64
+	Values [][]byte
+	Proofs []Proof
+}
+
+type proofNodeKey struct {
+	level uint8
+	path  uint64
+}
+
+// VerifyMultiProof verifies all leaves of the multi proof against the root.
+// It rejects duplicated leaves, and the hashes of nodes shared by multiple
+// paths must be consistent across all of them.
+func VerifyMultiProof(hasher *Hasher, root []byte, multiProof *MultiProof) error {
+	if len(multiProof.Keys) != len(multiProof.Values) || len(multiProof.Keys) != len(multiProof.Proofs) {
+		return ErrInvalidProof
+	}
+
+	var (
+		leaves = make(map[uint64]struct{}, len(multiProof.Keys))
+		nodes  = make(map[proofNodeKey][]byte)
+	)
+	claim := func(level uint8, path uint64, hash []byte) error {
+		key := proofNodeKey{level, path}
+		if claimed, exist := nodes[key]; exist && !bytes.Equal(claimed, hash) {
+			return fmt.Errorf("%w: level %d, path %d", ErrConflictingProof, level, path)
+		}
+		nodes[key] = hash
+		return nil
+	}
+
+	for i, key := range multiProof.Keys {
+		if _, exist := leaves[key]; exist {
+			return fmt.Errorf("%w: key %d", ErrDuplicateLeaf, key)
+		}
+		leaves[key] = struct{}{}
+
+		proof := multiProof.Proofs[i]
+		if len(proof) > 64 {
+			return ErrInvalidProof
+		}
+		if len(proof) != len(multiProof.Proofs[0]) {
+			return ErrProofLengthMismatch{Got: len(proof), Want: len(multiProof.Proofs[0])}
+		}
+		if len(proof) < 64 && key>>len(proof) != 0 {
+			return ErrInvalidKey
+		}
+		node := multiProof.Values[i]
+		for level := 0; level < len(proof); level++ {
+			path := key >> level
+			if err := claim(uint8(level), path, node); err != nil {
+				return err
+			}
+			if err := claim(uint8(level), path^1, proof[level]); err != nil {
+				return err
+			}
+			if path&1 == 0 {
+				node = hasher.HashChildren(node, proof[level])
+			} else {
+				node = hasher.HashChildren(proof[level], node)
+			}
+		}
+		if !bytes.Equal(node, root) {
+			return fmt.Errorf("%w: key %d", ErrRootMismatched, key)
+		}
+	}
+	return nil
+}
+
+// ProofVerifier verifies a proof incrementally, the siblings are fed one at a time
+// from the leaf to the root, so the whole proof never has to be held in memory.
+type ProofVerifier struct {
+	hasher *Hasher
+	node   []byte
+	path   uint64
+	depth  uint8
+	fed    uint8
+}
+
+func NewProofVerifier(hasher *Hasher) *ProofVerifier {
+	return &ProofVerifier{hasher: hasher}
+}
+
+// Init starts the verification of the leaf at path in a tree of the depth.
+func (v *ProofVerifier) Init(leafHash []byte, path uint64, depth uint8) {
+	v.node = leafHash
+	v.path = path
+	v.depth = depth
+	v.fed = 0
+}
+
+// Feed hashes the sibling at the next level, it must be called depth times.
+func (v *ProofVerifier) Feed(sibling []byte) error {
+	if v.fed >= v.depth {
+		return fmt.Errorf("%w: more than %d siblings", ErrInvalidProof, v.depth)
+	}
+	if (v.path>>v.fed)&1 == 0 {
+		v.node = v.hasher.HashChildren(v.node, sibling)
+	} else {
+		v.node = v.hasher.HashChildren(sibling, v.node)
+	}
+	v.fed++
+	return nil
+}
+
+// Root returns the root computed from the fed siblings,
+// or nil if fewer than depth siblings have been fed.
+func (v *ProofVerifier) Root() []byte {
+	if v.fed != v.depth {
+		return nil
+	}
+	return v.node
+}
+
+// ProofVerifierPool verifies proofs like ProofItem.Verify, but the intermediate hashes are written
+// into scratch buffers reused across the verifications, so a valid proof is verified without allocations.
+// It is safe for concurrent use.
+type ProofVerifierPool struct {
+	hasher  *Hasher
+	buffers sync.Pool
+}
+
+// verifyBuffers holds the hash of the current node and the buffer the next one is written into.
+type verifyBuffers struct {
+	node []byte
+	next []byte
+}
+
+func NewProofVerifierPool(hasher *Hasher) *ProofVerifierPool {
+	return &ProofVerifierPool{
+		hasher: hasher,
+		buffers: sync.Pool{
+			New: func() interface{} {
+				return &verifyBuffers{}
+			},
+		},
+	}
+}
+
+// Verify verifies the proof of the value of the key against the root, the depth of the tree
+// is the length of the proof. It returns the same errors as ProofItem.Verify.
+func (p *ProofVerifierPool) Verify(proof Proof, root []byte, key uint64, value []byte) error {
+	if len(proof) > 64 {
+		return ErrInvalidProof
+	}
+	if len(proof) < 64 && key>>len(proof) != 0 {
+		return ErrInvalidKey
+	}
+	buf := p.buffers.Get().(*verifyBuffers)
+	defer p.buffers.Put(buf)
+
+	node := value
+	for level, sibling := range proof {
+		if (key>>level)&1 == 0 {
+			buf.next = p.hasher.HashChildrenTo(buf.next[:0], node, sibling)
+		} else {
+			buf.next = p.hasher.HashChildrenTo(buf.next[:0], sibling, node)
+		}
+		buf.node, buf.next = buf.next, buf.node
+		node = buf.node
+	}
+	if !bytes.Equal(node, root) {
+		return fmt.Errorf("%w: key %d", ErrRootMismatched, key)
+	}
+	return nil
+}
+
+// ProofItem is a proof of the value of the key in the tree of the root.
+type ProofItem struct {
+	Key   uint64
+	Value []byte
+	Root  []byte
+	Proof Proof
+}
+
+// Verify verifies the proof item, the depth of the tree is the length of the proof.
+func (item *ProofItem) Verify(hasher *Hasher) error {
+	if len(item.Proof) > 64 {
+		return ErrInvalidProof
+	}
+	if len(item.Proof) < 64 && item.Key>>len(item.Proof) != 0 {
+		return ErrInvalidKey
+	}
+	verifier := NewProofVerifier(hasher)
+	verifier.Init(item.Value, item.Key, uint8(len(item.Proof)))
+	for _, sibling := range item.Proof {
+		if err := verifier.Feed(sibling); err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(verifier.Root(), item.Root) {
+		return fmt.Errorf("%w: key %d", ErrRootMismatched, item.Key)
+	}
+	return nil
+}
+
+// VerifyProofs verifies the independent proof items concurrently in up to GOMAXPROCS goroutines,
+// the error of each item is returned at its index, nil for a valid proof.
+func VerifyProofs(items []ProofItem, hasher *Hasher) []error {
+	errs := make([]error, len(items))
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(items) {
+		workers = len(items)
+	}
+
+	var (
+		next int64 = -1
+		wg   sync.WaitGroup
+	)
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				index := int(atomic.AddInt64(&next, 1))
+				if index >= len(items) {
+					return
+				}
+				errs[index] = items[index].Verify(hasher)
+			}
+		}()
+	}
+	wg.Wait()
+	return errs
+}
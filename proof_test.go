@@ -0,0 +1,421 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bnb-chain/zkbnb-smt/database/memory"
+)
+
+func TestProof_SolidityWitness(t *testing.T) {
+	proof := make(Proof, 4)
+	for i := range proof {
+		proof[i] = bytes.Repeat([]byte{byte(i + 1)}, 32)
+	}
+
+	witness, err := proof.SolidityWitness(0xa)
+	assert.NoError(t, err)
+	expected := strings.Join([]string{
+		// offset of siblings
+		"0000000000000000000000000000000000000000000000000000000000000040",
+		// path
+		"000000000000000000000000000000000000000000000000000000000000000a",
+		// length of siblings
+		"0000000000000000000000000000000000000000000000000000000000000004",
+		// siblings from root to leaf
+		"0404040404040404040404040404040404040404040404040404040404040404",
+		"0303030303030303030303030303030303030303030303030303030303030303",
+		"0202020202020202020202020202020202020202020202020202020202020202",
+		"0101010101010101010101010101010101010101010101010101010101010101",
+	}, "")
+	assert.Equal(t, expected, hex.EncodeToString(witness))
+
+	_, err = proof.SolidityWitness(0x10)
+	assert.ErrorIs(t, err, ErrInvalidKey)
+
+	proof[0] = proof[0][:31]
+	_, err = proof.SolidityWitness(0xa)
+	assert.ErrorIs(t, err, ErrInvalidProof)
+}
+
+func TestProof_SolidityWitnessVerification(t *testing.T) {
+	hasher := NewHasherPool(func() hash.Hash { return sha256.New() })
+	smt, err := NewBNBSparseMerkleTree(hasher, memory.NewMemoryDB(), 8, nilHash)
+	assert.NoError(t, err)
+	key := uint64(213)
+	leaf := hasher.Hash([]byte("test1"))
+	assert.NoError(t, smt.Set(key, leaf))
+	assert.NoError(t, smt.Set(2, hasher.Hash([]byte("test2"))))
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+	proof, err := smt.GetProof(key)
+	assert.NoError(t, err)
+
+	witness, err := proof.SolidityWitness(key)
+	assert.NoError(t, err)
+	path := binary.BigEndian.Uint64(witness[56:64])
+	length := int(binary.BigEndian.Uint64(witness[88:96]))
+	siblings := witness[96:]
+	node := leaf
+	for i := 0; i < length; i++ {
+		sibling := siblings[(length-1-i)*32 : (length-i)*32]
+		if (path>>i)&1 == 0 {
+			node = hasher.Hash(node, sibling)
+		} else {
+			node = hasher.Hash(sibling, node)
+		}
+	}
+	assert.Equal(t, smt.Root(), node)
+}
+
+func TestVerifyMultiProof(t *testing.T) {
+	hasher := NewHasherPool(func() hash.Hash { return sha256.New() })
+	smt, err := NewBNBSparseMerkleTree(hasher, memory.NewMemoryDB(), 8, nilHash)
+	assert.NoError(t, err)
+	assert.NoError(t, smt.Set(1, hasher.Hash([]byte("test1"))))
+	assert.NoError(t, smt.Set(2, hasher.Hash([]byte("test2"))))
+	assert.NoError(t, smt.Set(200, hasher.Hash([]byte("test3"))))
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+
+	multiProof, err := smt.GetMultiProof([]uint64{1, 2, 3, 200})
+	assert.NoError(t, err)
+	assert.NoError(t, VerifyMultiProof(hasher, smt.Root(), multiProof))
+	assert.ErrorIs(t, VerifyMultiProof(hasher, nilHash, multiProof), ErrRootMismatched)
+
+	// duplicated leaf
+	duplicated := &MultiProof{
+		Keys:   append(multiProof.Keys, multiProof.Keys[0]),
+		Values: append(multiProof.Values, multiProof.Values[0]),
+		Proofs: append(multiProof.Proofs, multiProof.Proofs[0]),
+	}
+	assert.ErrorIs(t, VerifyMultiProof(hasher, smt.Root(), duplicated), ErrDuplicateLeaf)
+
+	// key 3 claims a different value of its sibling key 2
+	forgedProof := append(Proof{}, multiProof.Proofs[2]...)
+	forgedProof[0] = hasher.Hash([]byte("forged"))
+	conflicting := &MultiProof{
+		Keys:   []uint64{2, 3},
+		Values: [][]byte{multiProof.Values[1], multiProof.Values[2]},
+		Proofs: []Proof{multiProof.Proofs[1], forgedProof},
+	}
+	assert.ErrorIs(t, VerifyMultiProof(hasher, smt.Root(), conflicting), ErrConflictingProof)
+}
+
+func TestProofVerifier(t *testing.T) {
+	hasher := NewHasherPool(func() hash.Hash { return sha256.New() })
+	smt, err := NewBNBSparseMerkleTree(hasher, memory.NewMemoryDB(), 16, nilHash)
+	assert.NoError(t, err)
+	tree := smt.(*BNBSparseMerkleTree)
+	key := uint64(0xab12)
+	leaf := hasher.Hash([]byte("test1"))
+	assert.NoError(t, smt.Set(key, leaf))
+	assert.NoError(t, smt.Set(0xab13, hasher.Hash([]byte("test2"))))
+	assert.NoError(t, smt.Set(3, hasher.Hash([]byte("test3"))))
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+
+	verifier := NewProofVerifier(hasher)
+	for _, test := range []struct {
+		key  uint64
+		leaf []byte
+	}{
+		{key, leaf},
+		// proof of exclusion
+		{0x1234, tree.nilHashes.Get(16)},
+	} {
+		proof, err := smt.GetProof(test.key)
+		assert.NoError(t, err)
+		assert.True(t, smt.VerifyProof(test.key, proof))
+
+		verifier.Init(test.leaf, test.key, 16)
+		for _, sibling := range proof {
+			assert.Nil(t, verifier.Root())
+			assert.NoError(t, verifier.Feed(sibling))
+		}
+		assert.Equal(t, smt.Root(), verifier.Root())
+		assert.ErrorIs(t, verifier.Feed(proof[0]), ErrInvalidProof)
+	}
+
+	// wrong leaf
+	proof, err := smt.GetProof(key)
+	assert.NoError(t, err)
+	verifier.Init(hasher.Hash([]byte("test2")), key, 16)
+	for _, sibling := range proof {
+		assert.NoError(t, verifier.Feed(sibling))
+	}
+	assert.NotEqual(t, smt.Root(), verifier.Root())
+}
+
+func prepareProofItems(t testing.TB, hasher *Hasher, n int) []ProofItem {
+	smt, err := NewBNBSparseMerkleTree(hasher, memory.NewMemoryDB(), 16, nilHash)
+	assert.NoError(t, err)
+	items := make([]ProofItem, n)
+	for i := range items {
+		items[i].Key = uint64(i * 61)
+		items[i].Value = hasher.Hash([]byte{byte(i), byte(i >> 8)})
+		assert.NoError(t, smt.Set(items[i].Key, items[i].Value))
+	}
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+	for i := range items {
+		items[i].Root = smt.Root()
+		items[i].Proof, err = smt.GetProof(items[i].Key)
+		assert.NoError(t, err)
+	}
+	return items
+}
+
+func TestVerifyProofs(t *testing.T) {
+	hasher := NewHasherPool(func() hash.Hash { return sha256.New() })
+	items := prepareProofItems(t, hasher, 64)
+	// invalidate the items at the indices
+	items[3].Value = hasher.Hash([]byte("tampered"))
+	items[17].Proof = append(Proof{}, items[17].Proof...)
+	items[17].Proof[5] = hasher.Hash([]byte("tampered"))
+	items[42].Key = 1 << 16
+	items[63].Proof = items[63].Proof[:15]
+
+	errs := VerifyProofs(items, hasher)
+	assert.Len(t, errs, len(items))
+	for i, err := range errs {
+		switch i {
+		case 3, 17:
+			assert.ErrorIs(t, err, ErrRootMismatched)
+		case 42:
+			assert.ErrorIs(t, err, ErrInvalidKey)
+		case 63:
+			assert.ErrorIs(t, err, ErrRootMismatched)
+		default:
+			assert.NoError(t, err, "index %d", i)
+		}
+	}
+	assert.Empty(t, VerifyProofs(nil, hasher))
+}
+
+func TestProofVerifierPool(t *testing.T) {
+	hasher := NewHasherPool(func() hash.Hash { return sha256.New() })
+	items := prepareProofItems(t, hasher, 64)
+	items[3].Value = hasher.Hash([]byte("tampered"))
+	items[17].Proof = append(Proof{}, items[17].Proof...)
+	items[17].Proof[5] = hasher.Hash([]byte("tampered"))
+	items[42].Key = 1 << 16
+	items[63].Proof = items[63].Proof[:15]
+
+	for _, h := range []*Hasher{hasher, hasher.Truncate(20), hasher.Ordered(RightLeft)} {
+		pool := NewProofVerifierPool(h)
+		for i := range items {
+			// the results match the allocating verifier
+			expected := items[i].Verify(h)
+			err := pool.Verify(items[i].Proof, items[i].Root, items[i].Key, items[i].Value)
+			if expected == nil {
+				assert.NoError(t, err, "index %d", i)
+			} else {
+				assert.EqualError(t, err, expected.Error(), "index %d", i)
+			}
+		}
+	}
+
+	// the valid proofs are verified without allocations
+	if raceEnabled {
+		t.Skip("the race detector drops the pooled buffers")
+	}
+	pool := NewProofVerifierPool(hasher)
+	valid := items[0]
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := pool.Verify(valid.Proof, valid.Root, valid.Key, valid.Value); err != nil {
+			t.Fatal(err)
+		}
+	})
+	assert.Zero(t, allocs)
+}
+
+// prefixedHash prepends the prefix to the inputs, to produce the trees with domain separated nodes.
+type prefixedHash struct {
+	hash.Hash
+	prefix []byte
+}
+
+func newPrefixedHash(prefix []byte) hash.Hash {
+	h := &prefixedHash{Hash: sha256.New(), prefix: prefix}
+	h.Reset()
+	return h
+}
+
+func (h *prefixedHash) Reset() {
+	h.Hash.Reset()
+	h.Hash.Write(h.prefix)
+}
+
+func TestVerifyWithConfig(t *testing.T) {
+	plain := NewHasherPool(func() hash.Hash { return sha256.New() })
+	internalPrefix, leafPrefix := []byte{1}, []byte{0}
+	// the producer hashes the nodes with the internal prefix in the right-left order,
+	// and the leaves with the leaf prefix
+	producer, err := NewBNBSparseMerkleTree(NewHasherPool(func() hash.Hash { return newPrefixedHash(internalPrefix) }),
+		memory.NewMemoryDB(), 8, nilHash, ChildOrdering(RightLeft), ProofOrder(RootToLeaf))
+	assert.NoError(t, err)
+	values := map[uint64][]byte{0x12: []byte("a"), 0x34: []byte("b"), 0xff: []byte("c")}
+	for key, value := range values {
+		assert.NoError(t, producer.Set(key, plain.Hash(leafPrefix, value)))
+	}
+	_, err = producer.Commit(nil)
+	assert.NoError(t, err)
+	root := producer.Root()
+
+	matching := VerifierConfig{
+		Hasher:         plain,
+		LeafPrefix:     leafPrefix,
+		InternalPrefix: internalPrefix,
+		ChildOrder:     RightLeft,
+		ProofOrder:     RootToLeaf,
+		NilLeaf:        nilHash,
+		Depth:          8,
+	}
+	verify := func(cfg VerifierConfig, key uint64, value []byte) bool {
+		proof, err := producer.GetProof(key)
+		assert.NoError(t, err)
+		ok, err := VerifyWithConfig(cfg, proof, root, key, value)
+		assert.NoError(t, err)
+		return ok
+	}
+	for key, value := range values {
+		assert.True(t, verify(matching, key, value), "key %d", key)
+		assert.False(t, verify(matching, key, []byte("other")), "key %d", key)
+	}
+	// the absent key is proved by the nil leaf
+	assert.True(t, verify(matching, 0x13, nil))
+	assert.False(t, verify(matching, 0x12, nil))
+
+	// the configs mismatching the producer reject the proofs
+	mismatching := map[string]func(cfg *VerifierConfig){
+		"leaf prefix":     func(cfg *VerifierConfig) { cfg.LeafPrefix = []byte{2} },
+		"internal prefix": func(cfg *VerifierConfig) { cfg.InternalPrefix = nil },
+		"child order":     func(cfg *VerifierConfig) { cfg.ChildOrder = LeftRight },
+		"proof order":     func(cfg *VerifierConfig) { cfg.ProofOrder = LeafToRoot },
+		"nil leaf":        func(cfg *VerifierConfig) { cfg.NilLeaf = plain.Hash([]byte("nil")) },
+	}
+	for name, mismatch := range mismatching {
+		cfg := matching
+		mismatch(&cfg)
+		key, value := uint64(0x12), values[0x12]
+		if name == "nil leaf" {
+			key, value = 0x13, nil
+		}
+		assert.False(t, verify(cfg, key, value), name)
+	}
+
+	proof, err := producer.GetProof(0x12)
+	assert.NoError(t, err)
+	_, err = VerifyWithConfig(matching, proof[1:], root, 0x12, values[0x12])
+	assert.ErrorIs(t, err, ErrInvalidProof)
+	// the depth is the length of the proof without the configured depth
+	matching.Depth = 0
+	_, err = VerifyWithConfig(matching, proof[1:], root, 0xff, values[0xff])
+	assert.ErrorIs(t, err, ErrInvalidKey)
+}
+
+func BenchmarkVerifyProofs(b *testing.B) {
+	hasher := NewHasherPool(func() hash.Hash { return sha256.New() })
+	items := prepareProofItems(b, hasher, 1024)
+
+	b.Run("sequential", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for j := range items {
+				if err := items[j].Verify(hasher); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		pool := NewProofVerifierPool(hasher)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for j := range items {
+				if err := pool.Verify(items[j].Proof, items[j].Root, items[j].Key, items[j].Value); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, err := range VerifyProofs(items, hasher) {
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+func TestIntraNodeProof(t *testing.T) {
+	env := prepareEnv()[0]
+	db, err := env.db()
+	assert.NoError(t, err)
+	defer db.Close()
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash)
+	assert.NoError(t, err)
+	for i := uint64(0); i < 16; i += 3 {
+		assert.NoError(t, smt.Set(0x1200+i*0x10+1, env.hasher.Hash([]byte{byte(i)})))
+	}
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+	assert.NoError(t, smt.Set(0x1251, env.hasher.Hash([]byte("changed"))))
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+
+	for _, version := range []Version{1, 2} {
+		root, err := smt.NodeRootAt(8, 0x12, version)
+		assert.NoError(t, err)
+		proof, err := smt.IntraNodeProof(8, 0x12, []int{5, 0, 1}, version)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{0, 1, 5}, proof.Nibbles)
+		for i, nibble := range proof.Nibbles {
+			child, err := smt.NodeRootAt(12, 0x120+uint64(nibble), version)
+			assert.NoError(t, err)
+			assert.Equal(t, child, proof.Children[i])
+		}
+		// the siblings of 5, of 0-1 and 4-5, and of 0-7
+		assert.Len(t, proof.Siblings, 4)
+		computed, err := proof.Root(env.hasher)
+		assert.NoError(t, err)
+		assert.Equal(t, root, computed)
+
+		proof.Children[2] = env.hasher.Hash([]byte("forged"))
+		computed, err = proof.Root(env.hasher)
+		assert.NoError(t, err)
+		assert.NotEqual(t, root, computed)
+		proof.Siblings = proof.Siblings[1:]
+		_, err = proof.Root(env.hasher)
+		assert.ErrorIs(t, err, ErrInvalidProof)
+	}
+
+	// all the children of an empty node are nil
+	proof, err := smt.IntraNodeProof(8, 0xff, []int{3}, 2)
+	assert.NoError(t, err)
+	computed, err := proof.Root(env.hasher)
+	assert.NoError(t, err)
+	assert.Equal(t, smt.(*BNBSparseMerkleTree).nilHashes.Get(8), computed)
+
+	_, err = smt.IntraNodeProof(16, 0x1251, []int{0}, 2)
+	assert.ErrorIs(t, err, ErrInvalidDepth)
+	_, err = smt.IntraNodeProof(8, 0x12, []int{16}, 2)
+	assert.ErrorIs(t, err, ErrInvalidKey)
+	_, err = smt.IntraNodeProof(8, 0x12, []int{1, 1}, 2)
+	assert.ErrorIs(t, err, ErrDuplicateLeaf)
+}
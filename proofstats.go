@@ -0,0 +1,71 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import "bytes"
+
+// ProofStats is the statistics of the sizes in bytes of the proofs of sampled keys.
+// The compressed size is that of a bitmap marking the non-nil siblings followed by them,
+// as the nil siblings can be derived by the verifier.
+type ProofStats struct {
+	Count int
+
+	MinSize  int
+	MaxSize  int
+	MeanSize float64
+
+	MinCompressedSize  int
+	MaxCompressedSize  int
+	MeanCompressedSize float64
+}
+
+// ProofSizeStats measures the proofs of the keys at the version.
+func (tree *BNBSparseMerkleTree) ProofSizeStats(keys []uint64, version Version) (ProofStats, error) {
+	var (
+		stats                  ProofStats
+		total, totalCompressed int
+	)
+	for _, key := range keys {
+		proof, err := tree.getProofAt(uint64Path(key), version)
+		if err != nil {
+			return ProofStats{}, err
+		}
+		size, compressed := tree.proofSize(proof)
+		if stats.Count == 0 || size < stats.MinSize {
+			stats.MinSize = size
+		}
+		if size > stats.MaxSize {
+			stats.MaxSize = size
+		}
+		if stats.Count == 0 || compressed < stats.MinCompressedSize {
+			stats.MinCompressedSize = compressed
+		}
+		if compressed > stats.MaxCompressedSize {
+			stats.MaxCompressedSize = compressed
+		}
+		total += size
+		totalCompressed += compressed
+		stats.Count++
+	}
+	if stats.Count > 0 {
+		stats.MeanSize = float64(total) / float64(stats.Count)
+		stats.MeanCompressedSize = float64(totalCompressed) / float64(stats.Count)
+	}
+	return stats, nil
+}
+
+// proofSize returns the size of the proof from the leaf to the root, and the size compressed by a nil sibling bitmap.
+func (tree *BNBSparseMerkleTree) proofSize(proof Proof) (int, int) {
+	size := 0
+	compressed := (len(proof) + 7) / 8
+	for i, sibling := range proof {
+		size += len(sibling)
+		if !bytes.Equal(sibling, tree.nilHashes.Get(tree.maxDepth-uint16(i))) {
+			compressed += len(sibling)
+		}
+	}
+	return size, compressed
+}
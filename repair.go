@@ -0,0 +1,41 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+)
+
+// RepairDirtyNodes recomputes the internal hashes of the nodes in memory which were marked
+// for recomputing but left so, e.g. by an aborted commit, and checks that the recomputed
+// hashes still produce the roots of the nodes.
+// It is expected to be called without pending changes, e.g. after Reset.
+func (tree *BNBSparseMerkleTree) RepairDirtyNodes() error {
+	return tree.repair(tree.root)
+}
+
+func (tree *BNBSparseMerkleTree) repair(node *TreeNode) error {
+	// the leaves have no internal hashes, and the archived nodes are reloaded from storage
+	if node == nil || node.temporary || node.internalBuf == nil {
+		return nil
+	}
+	for i := 0; i < len(node.Children); i++ {
+		if err := tree.repair(node.getChild(i)); err != nil {
+			return err
+		}
+	}
+	if len(node.Versions) == 0 || atomic.LoadUint32(&node.internalPresent) == allInternalsPresent {
+		return nil
+	}
+	node.ComputeInternalHash()
+	if !bytes.Equal(tree.hasher.HashChildren(node.Internals[0], node.Internals[1]), node.Root()) {
+		return fmt.Errorf("%w: depth %d, path %v", ErrRepairMismatched, node.depth, node.path)
+	}
+	node.clearDirty()
+	return nil
+}
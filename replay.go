@@ -0,0 +1,41 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"github.com/bnb-chain/zkbnb-smt/database"
+)
+
+// ChangeSet is the changes committed as the version.
+type ChangeSet struct {
+	Version Version
+	Changes []Item
+}
+
+// ReplayChanges reconstructs the tree in the db by applying the change sets in order, each of them is
+// committed as its version, so the roots match those of the original tree. The change sets not newer
+// than the latest version of the db are skipped, so an interrupted replay resumes where it stopped.
+func ReplayChanges(log []ChangeSet, db database.TreeDB, hasher *Hasher, maxDepth uint8, nilHash []byte,
+	opts ...Option) (SparseMerkleTree, error) {
+
+	smt, err := NewBNBSparseMerkleTree(hasher, db, maxDepth, nilHash, opts...)
+	if err != nil {
+		return nil, err
+	}
+	for _, changeSet := range log {
+		if changeSet.Version <= smt.LatestVersion() {
+			continue
+		}
+		version := changeSet.Version
+		if err := smt.MultiSetWithVersion(changeSet.Changes, version); err != nil {
+			return nil, err
+		}
+		if _, err := smt.CommitWithNewVersion(nil, &version); err != nil {
+			return nil, err
+		}
+	}
+	return smt, nil
+}
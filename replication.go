@@ -0,0 +1,125 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+)
+
+// CommitRecord is the changes of the leaves committed as the version and the resulting root,
+// shipped from a primary tree by CommitLog and applied to a replica by ApplyCommitRecord.
+// It is encodable with rlp except Err.
+type CommitRecord struct {
+	Version Version
+	Root    []byte
+	Changes []Item
+	// the error collecting the record, the last record of the log if it is set
+	Err error `rlp:"-"`
+}
+
+// CommitLog streams a record for each version committed after from, up to the latest version
+// when it is called, in the order of the versions. The records are collected one version at a time
+// under the commit lock, so the commits are not blocked by a slow receiver, and the versions
+// not yet streamed are not pruned meanwhile. The channel is closed after the last record or once
+// the context is done, either releases the versions, so a receiver that stops draining the channel,
+// e.g. a disconnected replica, must cancel the context.
+// The records carry the keys as uint64, so it fails with ErrInvalidDepth on the trees created with WideDepth.
+func (tree *BNBSparseMerkleTree) CommitLog(ctx context.Context, from Version) (<-chan CommitRecord, error) {
+	if err := tree.checkNarrow(); err != nil {
+		return nil, err
+	}
+	tree.commitMu.Lock()
+	defer tree.commitMu.Unlock()
+	if from > tree.version {
+		return nil, ErrVersionTooHigh
+	}
+	if tree.recentVersion > from || !tree.snapshots.acquire(from) {
+		return nil, ErrVersionTooOld
+	}
+
+	var versions []Version
+	root := tree.lastSaveRoot
+	if root == nil {
+		root = tree.root
+	}
+	root.rlock()
+	for _, v := range root.Versions {
+		if v.Ver > from {
+			versions = append(versions, v.Ver)
+		}
+	}
+	root.mu.RUnlock()
+
+	records := make(chan CommitRecord)
+	go func() {
+		defer close(records)
+		defer tree.snapshots.release(from)
+		for _, version := range versions {
+			if ctx.Err() != nil {
+				return
+			}
+			record := tree.commitRecord(version)
+			select {
+			case records <- record:
+			case <-ctx.Done():
+				return
+			}
+			if record.Err != nil {
+				return
+			}
+		}
+	}()
+	return records, nil
+}
+
+// commitRecord collects the leaves changed by the version from the last saved root.
+func (tree *BNBSparseMerkleTree) commitRecord(version Version) CommitRecord {
+	tree.commitMu.Lock()
+	defer tree.commitMu.Unlock()
+
+	root := tree.lastSaveRoot
+	if root == nil {
+		root = tree.root
+	}
+	record := CommitRecord{Version: version, Root: root.RootAt(version)}
+	record.Err = tree.walkChanged(root, version, func(node *TreeNode) error {
+		if node.depth != tree.maxDepth {
+			return nil
+		}
+		versions := versionsUpTo(node, version)
+		record.Changes = append(record.Changes, Item{Key: node.path.low(), Val: versions[len(versions)-1].Hash})
+		return nil
+	})
+	return record
+}
+
+// ApplyCommitRecord commits the changes of the record received from the primary tree as its version,
+// after checking they produce the root of the primary, so the roots of the replica match the primary
+// version by version. The replica is left unchanged if the record is rejected, it must have no uncommitted changes.
+func (tree *BNBSparseMerkleTree) ApplyCommitRecord(rec CommitRecord) error {
+	if rec.Err != nil {
+		return rec.Err
+	}
+	if rec.Version <= tree.LatestVersion() {
+		return ErrVersionTooLow
+	}
+	if tree.journal.Len() > 0 {
+		return ErrUncommittedChanges
+	}
+	if err := tree.MultiSetWithVersion(rec.Changes, rec.Version); err != nil {
+		tree.Reset()
+		return err
+	}
+	if !bytes.Equal(tree.Root(), rec.Root) {
+		tree.Reset()
+		return fmt.Errorf("%w: version %d", ErrRootMismatched, rec.Version)
+	}
+	version := rec.Version
+	_, err := tree.CommitWithNewVersion(nil, &version)
+	return err
+}
@@ -0,0 +1,55 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"sort"
+)
+
+// ComputeRoot computes the root of a tree holding exactly the given leaves without any storage,
+// the empty slots are filled with the nil hashes derived from nilHash. The result equals the root
+// of a BNBSparseMerkleTree with the same depth and nilHash after setting the leaves and committing.
+func ComputeRoot(leaves map[uint64][]byte, depth uint8, nilHash []byte, hasher *Hasher) ([]byte, error) {
+	if depth == 0 || depth%4 != 0 || depth > 64 {
+		return nil, ErrInvalidDepth
+	}
+	nilHashes := constructNilHashes(uint16(depth), nilHash, hasher)
+
+	level := make([]Item, 0, len(leaves))
+	for key, val := range leaves {
+		if depth < 64 && key >= 1<<depth {
+			return nil, ErrInvalidKey
+		}
+		level = append(level, Item{Key: key, Val: val})
+	}
+	sort.Slice(level, func(i, j int) bool {
+		return level[i].Key < level[j].Key
+	})
+
+	// hash the sorted nodes level by level, a missing sibling is the nil hash of its depth
+	for d := depth; d > 0; d-- {
+		nilHash := nilHashes.Get(uint16(d))
+		parents := level[:0]
+		for i := 0; i < len(level); i++ {
+			left, right := nilHash, nilHash
+			if level[i].Key&1 == 0 {
+				left = level[i].Val
+				if i+1 < len(level) && level[i+1].Key == level[i].Key+1 {
+					right = level[i+1].Val
+					i++
+				}
+			} else {
+				right = level[i].Val
+			}
+			parents = append(parents, Item{Key: level[i].Key >> 1, Val: hasher.HashChildren(left, right)})
+		}
+		level = parents
+	}
+	if len(level) == 0 {
+		return nilHashes.Get(0), nil
+	}
+	return level[0].Val, nil
+}
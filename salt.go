@@ -0,0 +1,60 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"bytes"
+
+	"github.com/bnb-chain/zkbnb-smt/database"
+)
+
+// nodeKey returns the storage key of the node at the depth and path whose latest version is the version.
+func (tree *BNBSparseMerkleTree) nodeKey(depth uint16, path nodePath, version Version) []byte {
+	if tree.storageSalt == nil || depth == 0 {
+		return nodeStorageKey(TreeNodePrefix, depth, path)
+	}
+	prefix := bytes.Join([][]byte{TreeNodePrefix, tree.storageSalt(version)}, sep)
+	return nodeStorageKey(prefix, depth, path)
+}
+
+// loadLeaf reads the committed leaf of the path from storage. The salted key of the leaf
+// depends on its latest version, which is recorded in its parent, so the path is walked.
+func (tree *BNBSparseMerkleTree) loadLeaf(key nodePath) (*StorageTreeNode, error) {
+	if tree.storageSalt == nil {
+		return tree.loadStorageTreeNode(tree.maxDepth, key, 0)
+	}
+	targetNode := tree.lastSaveRoot
+	var depth uint16 = 4
+	for i := 0; i < int(tree.maxDepth)/4-1; i++ {
+		path := key.rsh(int(tree.maxDepth) - (i+1)*4)
+		nibble := path.nibble()
+		if err := tree.extendNode(targetNode, nibble, path, depth, false); err != nil {
+			return nil, err
+		}
+		if targetNode.Children[nibble] == nil {
+			return nil, database.ErrDatabaseNotFound
+		}
+		targetNode = targetNode.Children[nibble]
+		depth += 4
+	}
+	leaf := targetNode.Children[key.nibble()]
+	if leaf == nil {
+		return nil, database.ErrDatabaseNotFound
+	}
+	return tree.loadChild(tree.maxDepth, key, leaf)
+}
+
+// deleteStaleKey deletes the key the node was stored under at the version when the salt of the
+// latest version of the node differs, so an epoch keeps no copy of the nodes rewritten in later epochs.
+func (tree *BNBSparseMerkleTree) deleteStaleKey(db database.Batcher, node *TreeNode, version Version) error {
+	if tree.storageSalt == nil || node.depth == 0 || version == 0 {
+		return nil
+	}
+	if bytes.Equal(tree.storageSalt(version), tree.storageSalt(node.latestVersionWithLock())) {
+		return nil
+	}
+	return db.Delete(tree.nodeKey(node.depth, node.path, version))
+}
@@ -0,0 +1,81 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/bnb-chain/zkbnb-smt/database"
+	"github.com/pkg/errors"
+)
+
+var sealedKey = []byte(`sealed`)
+
+// Seal makes the tree read-only at the latest version permanently, the marker is persisted
+// so the tree reopened from the db stays sealed. The changes, commits and rollbacks
+// are rejected with ErrTreeSealed afterwards, while the reads and proofs are still served.
+// The tree must have no uncommitted changes.
+func (tree *BNBSparseMerkleTree) Seal() error {
+	tree.commitMu.Lock()
+	defer tree.commitMu.Unlock()
+	if err := tree.checkSealed(); err != nil {
+		return err
+	}
+	if tree.journal.Len() > 0 {
+		return ErrUncommittedChanges
+	}
+
+	if db := tree.storage(); db != nil {
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, uint64(tree.version))
+		if err := db.Set(sealedKey, buf); err != nil {
+			return err
+		}
+		// the marker is not left buffered by the DeferredWrites option
+		if db, ok := db.(*deferredDB); ok {
+			if err := db.sync(tree.batchSizeLimit); err != nil {
+				return err
+			}
+		}
+	}
+	tree.sealedVersion = tree.version
+	atomic.StoreUint32(&tree.sealed, 1)
+	return nil
+}
+
+// SealedVersion returns the version the tree is sealed at, and false if the tree is not sealed.
+func (tree *BNBSparseMerkleTree) SealedVersion() (Version, bool) {
+	if atomic.LoadUint32(&tree.sealed) == 0 {
+		return 0, false
+	}
+	return tree.sealedVersion, true
+}
+
+// checkSealed returns ErrTreeSealed if the tree is sealed.
+func (tree *BNBSparseMerkleTree) checkSealed() error {
+	if version, sealed := tree.SealedVersion(); sealed {
+		return fmt.Errorf("%w: at version %d", ErrTreeSealed, version)
+	}
+	return nil
+}
+
+// loadSealed recovers the seal persisted in the db.
+func (tree *BNBSparseMerkleTree) loadSealed() error {
+	buf, err := tree.storage().Get(sealedKey)
+	if errors.Is(err, database.ErrDatabaseNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(buf) == 8 {
+		tree.sealedVersion = Version(binary.BigEndian.Uint64(buf))
+	}
+	atomic.StoreUint32(&tree.sealed, 1)
+	return nil
+}
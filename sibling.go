@@ -0,0 +1,86 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+// SiblingIterator yields the siblings of a proof one by one from the leaf to the root,
+// each sibling is computed only when it is requested.
+type SiblingIterator struct {
+	tree    *BNBSparseMerkleTree
+	key     uint64
+	version Version
+	// the nodes on the path of the key from the root loaded so far, the deeper ones are in empty subtrees if absent
+	nodes []*TreeNode
+	// set once the path is loaded down to the parent of the leaf or an empty subtree
+	loaded bool
+	level  uint16
+	err    error
+}
+
+// ProofStream returns the iterator of the siblings of the proof of the key at the version, which are the same as
+// GetProofAt from the leaf to the root. The nodes on the path are loaded by Next, the siblings are not materialized.
+func (tree *BNBSparseMerkleTree) ProofStream(key uint64, version Version) (*SiblingIterator, error) {
+	if err := tree.checkKeyVersion(key, version); err != nil {
+		return nil, err
+	}
+	return &SiblingIterator{
+		tree:    tree,
+		key:     key,
+		version: version,
+		nodes:   []*TreeNode{tree.root},
+	}, nil
+}
+
+// Next returns the sibling at the next level, false if all the siblings up to the root have been returned
+// or a node on the path fails to load, which is reported by Err.
+func (it *SiblingIterator) Next() ([]byte, bool) {
+	tree := it.tree
+	if it.err != nil || it.level >= tree.maxDepth {
+		return nil, false
+	}
+	// the index of the sibling in the proof from the root
+	index := tree.maxDepth - 1 - it.level
+	if err := it.load(int(index/4) + 1); err != nil {
+		it.err = err
+		return nil, false
+	}
+	it.level++
+	if int(index/4) >= len(it.nodes) {
+		return tree.nilHashes.Get(index + 1), true
+	}
+	node := it.nodes[index/4]
+	nibble := uint64Path(it.key).rsh(int(tree.maxDepth - node.depth - 4)).nibble()
+	return tree.siblingAt(node, nibble, uint8(index%4), it.version), true
+}
+
+// Err returns the error that stopped Next, nil if the iteration has not failed.
+func (it *SiblingIterator) Err() error {
+	return it.err
+}
+
+// load extends the nodes on the path until count nodes are loaded or the path is fully loaded.
+func (it *SiblingIterator) load(count int) error {
+	tree := it.tree
+	for !it.loaded && len(it.nodes) < count {
+		node := it.nodes[len(it.nodes)-1]
+		depth := node.depth + 4
+		if depth == tree.maxDepth {
+			it.loaded = true
+			break
+		}
+		path := uint64Path(it.key).rsh(int(tree.maxDepth - depth))
+		nibble := path.nibble()
+		if err := tree.extendNode(node, nibble, path, depth, false); err != nil {
+			return err
+		}
+		child := node.Children[nibble]
+		if child == nil {
+			it.loaded = true
+			break
+		}
+		it.nodes = append(it.nodes, child)
+	}
+	return nil
+}
@@ -7,9 +7,14 @@ package bsmt
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/bnb-chain/zkbnb-smt/database"
 	"github.com/bnb-chain/zkbnb-smt/database/memory"
@@ -23,29 +28,60 @@ import (
 )
 
 var (
-	latestVersionKey          = []byte(`latestVersion`)
-	recentVersionNumberKey    = []byte(`recentVersionNumber`)
-	storageFullTreeNodePrefix = []byte(`t`)
-	sep                       = []byte(`:`)
+	latestVersionKey       = []byte(`latestVersion`)
+	recentVersionNumberKey = []byte(`recentVersionNumber`)
+	// TreeNodePrefix is the prefix of the storage keys of the tree nodes.
+	TreeNodePrefix = []byte(`t`)
+	sep            = []byte(`:`)
 )
 
-// Encode key, format: t:${depth}:${path}
-func storageFullTreeNodeKey(depth uint8, path uint64) []byte {
+// StorageKey returns the storage key of the node at the depth and path, format: ${prefix}:${depth}:${path},
+// where the depth is a single byte and the path is 8 bytes in big endian.
+// The tree persists the RLP encoded StorageTreeNode under the key with TreeNodePrefix.
+func StorageKey(prefix []byte, depth uint8, path uint64) []byte {
 	pathBuf := make([]byte, 8)
 	binary.BigEndian.PutUint64(pathBuf, path)
-	return bytes.Join([][]byte{storageFullTreeNodePrefix, {depth}, pathBuf}, sep)
+	return bytes.Join([][]byte{prefix, {depth}, pathBuf}, sep)
+}
+
+// nodeStorageKey returns the storage key of the node like StorageKey, the nodes deeper than 64 levels
+// of the trees created with WideDepth are keyed by the depth of 2 bytes and the path of 32 bytes instead.
+func nodeStorageKey(prefix []byte, depth uint16, path nodePath) []byte {
+	if depth <= maxTreeDepth {
+		return StorageKey(prefix, uint8(depth), path.low())
+	}
+	pathBuf := make([]byte, 32)
+	for i := range path {
+		binary.BigEndian.PutUint64(pathBuf[i*8:], path[i])
+	}
+	return bytes.Join([][]byte{prefix, {byte(depth >> 8), byte(depth)}, pathBuf}, sep)
+}
+
+// Encode key, format: t:${depth}:${path}
+func storageFullTreeNodeKey(depth uint8, path uint64) []byte {
+	return StorageKey(TreeNodePrefix, depth, path)
 }
 
 var _ SparseMerkleTree = (*BNBSparseMerkleTree)(nil)
 
 func NewSparseMerkleTree(hasher *Hasher, db database.TreeDB, maxDepth uint8, hashes [][]byte, opts ...Option) (SparseMerkleTree, error) {
-	if maxDepth == 0 || maxDepth%4 != 0 {
+	if maxDepth == 0 || maxDepth%4 != 0 || maxDepth > maxTreeDepth {
+		return nil, ErrInvalidDepth
+	}
+	return newSparseMerkleTree(hasher, db, uint16(maxDepth), hashes, opts...)
+}
+
+// newSparseMerkleTree creates the tree with the nil hashes of all the levels like NewSparseMerkleTree,
+// the depth may exceed 64 levels for the trees created with WideDepth.
+func newSparseMerkleTree(hasher *Hasher, db database.TreeDB, maxDepth uint16, hashes [][]byte, opts ...Option) (SparseMerkleTree, error) {
+	if maxDepth == 0 || maxDepth%4 != 0 || maxDepth > maxWideDepth || len(hashes) <= int(maxDepth) {
 		return nil, ErrInvalidDepth
 	}
 
 	smt := &BNBSparseMerkleTree{
 		maxDepth:       maxDepth,
 		journal:        newJournal(),
+		snapshots:      newSnapshotRefs(),
 		nilHashes:      &nilHashes{hashes},
 		hasher:         hasher,
 		batchSizeLimit: 100000 * 1024,
@@ -54,24 +90,35 @@ func NewSparseMerkleTree(hasher *Hasher, db database.TreeDB, maxDepth uint8, has
 			threshold: sysMemory.TotalMemory() / 8,
 			segment:   sysMemory.TotalMemory() / 8 / 10,
 		},
+		now: time.Now,
 	}
 
 	for _, opt := range opts {
 		opt(smt)
 	}
+	if err := smt.applyWideDepth(); err != nil {
+		return nil, err
+	}
+	if err := smt.applyHashTruncation(); err != nil {
+		return nil, err
+	}
+	smt.applyChildOrder()
 
 	if db == nil {
 		smt.db = memory.NewMemoryDB()
-		smt.root = NewTreeNode(0, 0, smt.nilHashes, smt.hasher)
+		smt.root = smt.profiled(newTreeNode(0, nodePath{}, smt.nilHashes, smt.hasher))
+		smt.latestRoot = smt.root.Root()
+		smt.leafCountKnown = true
 		return smt, nil
 	}
 
-	smt.db = db
+	smt.db = smt.deferWrites(db)
 	err := smt.initFromStorage()
 	if err != nil {
 		return nil, err
 	}
 	smt.lastSaveRoot = smt.root
+	smt.latestRoot = smt.root.Root()
 
 	if smt.metrics != nil {
 		smt.metrics.GCThreshold(smt.gcStatus.threshold)
@@ -82,11 +129,8 @@ func NewSparseMerkleTree(hasher *Hasher, db database.TreeDB, maxDepth uint8, has
 		return nil, err
 	}
 
-	if smt.goroutinePool == nil {
-		smt.goroutinePool, err = ants.NewPool(128)
-		if err != nil {
-			return nil, err
-		}
+	if err := smt.initPools(); err != nil {
+		return nil, err
 	}
 
 	return smt, nil
@@ -95,14 +139,25 @@ func NewSparseMerkleTree(hasher *Hasher, db database.TreeDB, maxDepth uint8, has
 func NewBNBSparseMerkleTree(hasher *Hasher, db database.TreeDB, maxDepth uint8, nilHash []byte,
 	opts ...Option) (SparseMerkleTree, error) {
 
-	if maxDepth == 0 || maxDepth%4 != 0 {
+	if maxDepth == 0 || maxDepth%4 != 0 || maxDepth > maxTreeDepth {
 		return nil, ErrInvalidDepth
 	}
+	smt, err := newBNBSparseMerkleTree(hasher, db, uint16(maxDepth), constructNilHashes(uint16(maxDepth), nilHash, hasher), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return smt, nil
+}
+
+// newBNBSparseMerkleTree creates the tree with the nil hashes, which may be shared by other trees.
+func newBNBSparseMerkleTree(hasher *Hasher, db database.TreeDB, maxDepth uint16, nilHashes *nilHashes,
+	opts ...Option) (*BNBSparseMerkleTree, error) {
 
 	smt := &BNBSparseMerkleTree{
 		maxDepth:       maxDepth,
 		journal:        newJournal(),
-		nilHashes:      constructNilHashes(maxDepth, nilHash, hasher),
+		snapshots:      newSnapshotRefs(),
+		nilHashes:      nilHashes,
 		hasher:         hasher,
 		batchSizeLimit: 100 * 1024,
 		dbCacheSize:    2048,
@@ -110,24 +165,35 @@ func NewBNBSparseMerkleTree(hasher *Hasher, db database.TreeDB, maxDepth uint8,
 			threshold: sysMemory.TotalMemory() / 8,
 			segment:   sysMemory.TotalMemory() / 8 / 10,
 		},
+		now: time.Now,
 	}
 
 	for _, opt := range opts {
 		opt(smt)
 	}
+	if err := smt.applyWideDepth(); err != nil {
+		return nil, err
+	}
+	if err := smt.applyHashTruncation(); err != nil {
+		return nil, err
+	}
+	smt.applyChildOrder()
 
 	if db == nil {
 		smt.db = memory.NewMemoryDB()
-		smt.root = NewTreeNode(0, 0, smt.nilHashes, smt.hasher)
+		smt.root = smt.profiled(newTreeNode(0, nodePath{}, smt.nilHashes, smt.hasher))
+		smt.latestRoot = smt.root.Root()
+		smt.leafCountKnown = true
 		return smt, nil
 	}
 
-	smt.db = db
+	smt.db = smt.deferWrites(db)
 	err := smt.initFromStorage()
 	if err != nil {
 		return nil, err
 	}
 	smt.lastSaveRoot = smt.root
+	smt.latestRoot = smt.root.Root()
 
 	if smt.metrics != nil {
 		smt.metrics.GCThreshold(smt.gcStatus.threshold)
@@ -138,32 +204,71 @@ func NewBNBSparseMerkleTree(hasher *Hasher, db database.TreeDB, maxDepth uint8,
 		return nil, err
 	}
 
-	if smt.goroutinePool == nil {
-		smt.goroutinePool, err = ants.NewPool(128)
-		if err != nil {
-			return nil, err
-		}
+	if err := smt.initPools(); err != nil {
+		return nil, err
 	}
 
 	return smt, nil
 }
 
-func constructNilHashes(maxDepth uint8, nilHash []byte, hasher *Hasher) *nilHashes {
+func constructNilHashes(maxDepth uint16, nilHash []byte, hasher *Hasher) *nilHashes {
 	hashes := make([][]byte, maxDepth+1)
 	hashes[maxDepth] = nilHash
 	for i := 1; i <= int(maxDepth); i++ {
-		nHash := hasher.Hash(nilHash, nilHash)
-		hashes[maxDepth-uint8(i)] = nHash
+		nHash := hasher.HashChildren(nilHash, nilHash)
+		hashes[maxDepth-uint16(i)] = nHash
 		nilHash = nHash
 	}
 	return &nilHashes{hashes}
 }
 
+// applyWideDepth deepens the tree to the depth set by WideDepth, the nil hashes are derived again
+// from the nil hash of the leaves.
+func (tree *BNBSparseMerkleTree) applyWideDepth() error {
+	if tree.wideDepth == 0 || tree.wideDepth == tree.maxDepth {
+		return nil
+	}
+	if tree.wideDepth%4 != 0 || tree.wideDepth > maxWideDepth {
+		return fmt.Errorf("%w: wide depth %d", ErrInvalidDepth, tree.wideDepth)
+	}
+	nilHash := tree.nilHashes.Get(tree.maxDepth)
+	tree.maxDepth = tree.wideDepth
+	tree.nilHashes = constructNilHashes(tree.maxDepth, nilHash, tree.hasher)
+	return nil
+}
+
+// applyHashTruncation truncates the hashes of the tree to the width set by HashTruncation,
+// the nil hashes are derived again from the truncated nil hash of the leaves.
+func (tree *BNBSparseMerkleTree) applyHashTruncation() error {
+	if tree.hashTruncation == 0 {
+		return nil
+	}
+	// the paths of the raw keys are read from the leading 8 bytes of their hashes
+	if tree.hashTruncation < 8 || tree.hashTruncation >= tree.hasher.Size() {
+		return fmt.Errorf("%w: %d bytes, hash size %d", ErrInvalidTruncation, tree.hashTruncation, tree.hasher.Size())
+	}
+	tree.hasher = tree.hasher.Truncate(tree.hashTruncation)
+	nilHash := tree.nilHashes.Get(tree.maxDepth)
+	if len(nilHash) > tree.hashTruncation {
+		nilHash = nilHash[:tree.hashTruncation]
+	}
+	tree.nilHashes = constructNilHashes(tree.maxDepth, nilHash, tree.hasher)
+	return nil
+}
+
+// applyChildOrder switches the hasher of the tree to the order set by ChildOrdering,
+// the nil hashes are kept as both children of a nil node are the same.
+func (tree *BNBSparseMerkleTree) applyChildOrder() {
+	if tree.childOrder != tree.hasher.order {
+		tree.hasher = tree.hasher.Ordered(tree.childOrder)
+	}
+}
+
 type nilHashes struct {
 	hashes [][]byte
 }
 
-func (h *nilHashes) Get(depth uint8) []byte {
+func (h *nilHashes) Get(depth uint16) []byte {
 	if len(h.hashes)-1 < int(depth) {
 		return nil
 	}
@@ -171,8 +276,8 @@ func (h *nilHashes) Get(depth uint8) []byte {
 }
 
 type journalKey struct {
-	depth uint8
-	path  uint64
+	depth uint16
+	path  nodePath
 }
 
 func newJournal() *journal {
@@ -232,8 +337,8 @@ func (j *journal) setIfNotExist(jk journalKey, target *TreeNode) *TreeNode {
 	node, exist := j.data[jk]
 	if !exist {
 		j.data[jk] = target.Copy()
-		if p, e := j.data[journalKey{depth: target.depth - 4, path: target.path >> 4}]; e {
-			p.Children[target.path&0xf] = j.data[jk]
+		if p, e := j.data[journalKey{depth: target.depth - 4, path: target.path.rsh(4)}]; e {
+			p.Children[target.path.nibble()] = j.data[jk]
 		}
 		return j.data[jk]
 	} else {
@@ -303,14 +408,47 @@ func (stat *gcStatus) clean(index int) {
 }
 
 type BNBSparseMerkleTree struct {
+	// the counters of walking to the children in memory and in storage,
+	// they are accessed atomically so kept at the head to be 64-bit aligned.
+	hydrationHits   uint64
+	hydrationMisses uint64
+
+	// the number of rollbacks, accessed atomically
+	rollbacks uint64
+	// the number of nodes archived by the SpillToDisk option, accessed atomically
+	spilledNodes uint64
+	// set between Prepare and Commit or Abort, accessed atomically
+	commitPending uint32
+	// set once the tree is sealed at sealedVersion, accessed atomically
+	sealed        uint32
+	sealedVersion Version
+
+	// commitMu serializes the writes of commits and rollbacks with the switch of the database
+	commitMu sync.Mutex
+	// the time a commit waits for commitMu, unbounded if it is not positive
+	commitTimeout time.Duration
+	// viewMu guards the switch of the root served to the proofs during rollbacks
+	viewMu sync.RWMutex
+	pinned *pinnedRoot
+	// the asynchronous commits waited for by Close
+	inflight     sync.WaitGroup
+	closeTimeout time.Duration
+
+	// writeMu serializes the setters staging changes on the root, mu only guards the latest version and root
+	writeMu sync.Mutex
+	// dbMu guards db against the switch of MigrateTo, the readers take it through storage
+	dbMu sync.RWMutex
+
+	mu               sync.RWMutex
 	version          Version
+	latestRoot       []byte
 	recentVersion    Version
 	root             *TreeNode
 	rootSize         uint64
 	lastSaveRoot     *TreeNode
 	lastSaveRootSize uint64
-	journal          *journal
-	maxDepth         uint8
+	journal          Journal
+	maxDepth         uint16
 	nilHashes        *nilHashes
 	hasher           *Hasher
 	db               database.TreeDB
@@ -320,13 +458,86 @@ type BNBSparseMerkleTree struct {
 	gcStatus         *gcStatus
 	goroutinePool    *ants.Pool
 	metrics          metrics.Metrics
+	maxProofSize     int
+	maxLeafSize      int
+	latestIndex      bool
+	hashTruncation   int
+	lockProfile      *lockProfile
+	deferredWrites   bool
+	childOrder       ChildOrder
+	verifyOnLoad     bool
+	strictLoad       bool
+	subtreeCounts    bool
+	// the internal hashes of the nodes are not persisted if set
+	noInternalStorage bool
+	snapshots         *snapshotRefs
+	accessHistory     *lru.Cache
+	// the nodes resolved by the historical reads by version, if enabled
+	versionCache *lru.Cache
+	coalescer    *commitCoalescer
+	// the depth set by the WideDepth option, it overrides the depth passed to the constructor if set
+	wideDepth uint16
+
+	parallelThreshold  int
+	checkpointInterval Version
+	// the version of the latest checkpoint, pinned against pruning
+	checkpointVersion Version
+	checkpointPinned  bool
+
+	// the semaphore capping the concurrent loads from storage
+	hydrations chan struct{}
+
+	evictionCallback func(depth uint8, path uint64)
+	proofOrder       Order
+	nilValuePolicy   NilValuePolicy
+
+	// the coldest subtrees are archived after the commits once the resident nodes exceed the limit, if it is positive
+	spillLimit uint64
+
+	// the nodes loaded from storage are re-read after the TTL if it is positive
+	readCacheTTL time.Duration
+	now          func() time.Time
+
+	// the number of non-nil leaves at the latest version, valid if known
+	leafCount      uint64
+	leafCountKnown bool
+
+	// the storage bound tasks run in the storage pool if configured
+	storageParallelism int
+	storagePool        *ants.Pool
+	ownedPools         []*ants.Pool
+
+	compressor           Compressor
+	versionCodec         VersionCodec
+	compressionThreshold int
+
+	// the storage keys of the nodes are salted by their latest versions if configured
+	storageSalt func(version Version) []byte
+
+	// the raw keys set by SetKey since the last commit, if the raw keys are retained
+	keyRetention bool
+	stagedKeys   map[uint64][]byte
+
+	// the prefixes cleared by DeletePrefix in the committed versions, and since the last commit
+	clearedMu       sync.RWMutex
+	clearedPrefixes []clearedPrefix
+	clearedIndex    clearedIndex
+	stagedClears    []clearedPrefix
 }
 
 func (tree *BNBSparseMerkleTree) initFromStorage() error {
-	tree.root = NewTreeNode(0, 0, tree.nilHashes, tree.hasher)
+	tree.root = tree.profiled(newTreeNode(0, nodePath{}, tree.nilHashes, tree.hasher))
+	if err := tree.loadSealed(); err != nil {
+		return err
+	}
+	if err := tree.loadCheckpointPin(); err != nil {
+		return err
+	}
 	// recovery version info
-	buf, err := tree.db.Get(latestVersionKey)
+	buf, err := tree.storage().Get(latestVersionKey)
 	if errors.Is(err, database.ErrDatabaseNotFound) {
+		// an empty tree has no leaves
+		tree.leafCountKnown = true
 		return nil
 	}
 	if err != nil {
@@ -336,28 +547,29 @@ func (tree *BNBSparseMerkleTree) initFromStorage() error {
 		tree.version = Version(binary.BigEndian.Uint64(buf))
 	}
 
-	buf, err = tree.db.Get(recentVersionNumberKey)
+	buf, err = tree.storage().Get(recentVersionNumberKey)
 	if err != nil && !errors.Is(err, database.ErrDatabaseNotFound) {
 		return err
 	}
 	if len(buf) > 0 {
 		tree.recentVersion = Version(binary.BigEndian.Uint64(buf))
 	}
+	if err := tree.resetLeafCount(); err != nil {
+		return err
+	}
+	if err := tree.loadClearedPrefixes(); err != nil {
+		return err
+	}
 
 	// recovery root node from storage
-	rlpBytes, err := tree.db.Get(storageFullTreeNodeKey(0, 0))
+	storageTreeNode, err := tree.loadStorageTreeNode(0, nodePath{}, 0)
 	if errors.Is(err, database.ErrDatabaseNotFound) {
 		return nil
 	}
 	if err != nil {
 		return err
 	}
-	storageTreeNode := &StorageTreeNode{}
-	err = rlp.DecodeBytes(rlpBytes, storageTreeNode)
-	if err != nil {
-		return err
-	}
-	tree.root = storageTreeNode.ToTreeNode(0, tree.nilHashes, tree.hasher)
+	tree.root = tree.profiled(storageTreeNode.toTreeNode(0, tree.nilHashes, tree.hasher))
 
 	tree.rootSize = tree.root.Size()
 	for i := 0; i < len(tree.root.Children); i++ {
@@ -369,16 +581,27 @@ func (tree *BNBSparseMerkleTree) initFromStorage() error {
 	return nil
 }
 
-func (tree *BNBSparseMerkleTree) extendNode(node *TreeNode, nibble, path uint64, depth uint8, isCreated bool) error {
-	if node.Children[nibble] != nil &&
-		!node.Children[nibble].IsTemporary() {
+func (tree *BNBSparseMerkleTree) extendNode(node *TreeNode, nibble uint64, path nodePath, depth uint16, isCreated bool) error {
+	// the slot is read and linked under the node lock, as the goroutines of MultiSet extend the same nodes
+	placeholder := node.getChild(int(nibble))
+	if placeholder != nil && !placeholder.IsTemporary() && !tree.expired(placeholder) {
+		atomic.AddUint64(&tree.hydrationHits, 1)
+		return nil
+	}
+	// the changed nodes spilled by the journal are decoded from it rather than loaded from storage
+	if spilled, err := tree.loadSpilled(placeholder); err != nil {
+		return err
+	} else if spilled != nil {
+		node.linkChild(int(nibble), placeholder, spilled)
 		return nil
 	}
+	atomic.AddUint64(&tree.hydrationMisses, 1)
 
-	rlpBytes, err := tree.db.Get(storageFullTreeNodeKey(depth, path))
+	// the salt of the storage key is derived from the latest version recorded in the parent
+	storageTreeNode, err := tree.loadChild(depth, path, placeholder)
 	if errors.Is(err, database.ErrDatabaseNotFound) {
 		if isCreated {
-			node.Children[nibble] = NewTreeNode(depth, path, tree.nilHashes, tree.hasher)
+			node.linkChild(int(nibble), placeholder, tree.profiled(newTreeNode(depth, path, tree.nilHashes, tree.hasher)))
 		}
 		return nil
 	}
@@ -386,14 +609,170 @@ func (tree *BNBSparseMerkleTree) extendNode(node *TreeNode, nibble, path uint64,
 		return err
 	}
 
+	child := tree.hydrate(storageTreeNode.toTreeNode(depth, tree.nilHashes, tree.hasher))
+	if err := tree.applyClears(child, placeholder); err != nil {
+		return err
+	}
+	if tree.verifyOnLoad {
+		if err := tree.verifyLoadedNode(placeholder, child); err != nil {
+			return err
+		}
+	}
+	node.linkChild(int(nibble), placeholder, child)
+
+	return nil
+}
+
+// hydrate stamps the node loaded from storage, so it expires after the read cache TTL.
+func (tree *BNBSparseMerkleTree) hydrate(node *TreeNode) *TreeNode {
+	tree.profiled(node)
+	if tree.readCacheTTL > 0 {
+		node.hydratedAt = tree.now().UnixNano()
+	}
+	return node
+}
+
+// expired returns whether the node loaded from storage has been cached longer than the read cache TTL,
+// the nodes with uncommitted changes never expire.
+func (tree *BNBSparseMerkleTree) expired(node *TreeNode) bool {
+	return tree.readCacheTTL > 0 && node.hydratedAt > 0 && !node.isDirty() &&
+		tree.now().UnixNano()-node.hydratedAt > int64(tree.readCacheTTL)
+}
+
+// cachedLeaf returns the leaf cached by the path, the expired leaf is removed from the cache.
+func (tree *BNBSparseMerkleTree) cachedLeaf(path nodePath) (*TreeNode, bool) {
+	cached, ok := tree.dbCache.Get(path)
+	if !ok {
+		return nil, false
+	}
+	node := cached.(*TreeNode)
+	if tree.expired(node) {
+		tree.dbCache.Remove(path)
+		return nil, false
+	}
+	return node, true
+}
+
+// loadStorageTreeNode reads and decodes the node persisted at the given depth and path,
+// the version is the latest version of the node which the storage key may be salted by.
+func (tree *BNBSparseMerkleTree) loadStorageTreeNode(depth uint16, path nodePath, version Version) (*StorageTreeNode, error) {
+	if tree.hydrations != nil {
+		tree.hydrations <- struct{}{}
+		defer func() { <-tree.hydrations }()
+	}
+	rlpBytes, err := tree.storage().Get(tree.nodeKey(depth, path, version))
+	if err != nil {
+		return nil, err
+	}
 	storageTreeNode := &StorageTreeNode{}
 	err = rlp.DecodeBytes(rlpBytes, storageTreeNode)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if err := tree.decodeStorageTreeNode(storageTreeNode); err != nil {
+		return nil, err
+	}
+	err = tree.decompressStorageTreeNode(storageTreeNode, depth)
+	if err != nil {
+		return nil, err
+	}
+	if err := tree.checkNilHashes(storageTreeNode, depth, path); err != nil {
+		return nil, err
+	}
+	if tree.strictLoad {
+		if err := checkVersionOrder(storageTreeNode, depth, path); err != nil {
+			return nil, err
+		}
+	}
+	return storageTreeNode, nil
+}
+
+// checkVersionOrder checks that the versions of the node loaded from storage and of its children
+// are strictly increasing, which RootAt and Prune rely on.
+func checkVersionOrder(node *StorageTreeNode, depth uint16, path nodePath) error {
+	isIncreasing := func(versions []*VersionInfo) bool {
+		for i := 1; i < len(versions); i++ {
+			if versions[i].Ver <= versions[i-1].Ver {
+				return false
+			}
+		}
+		return true
+	}
+	if !isIncreasing(node.Versions) {
+		return fmt.Errorf("%w: depth %d, path %v", ErrNonMonotonicVersions, depth, path)
+	}
+	for i, child := range node.Children {
+		if child != nil && !isIncreasing(child.Versions) {
+			return fmt.Errorf("%w: depth %d, path %v, child %d", ErrNonMonotonicVersions, depth, path, i)
+		}
+	}
+	return nil
+}
+
+// checkNilHashes checks that the node loaded from storage belongs to the depth and path it is loaded at,
+// the internal hashes of its empty child pairs must be the nil hash of the depth,
+// otherwise the nil hashes derived from the depth break the proofs silently.
+func (tree *BNBSparseMerkleTree) checkNilHashes(node *StorageTreeNode, depth uint16, path nodePath) error {
+	if stored := uint64Path(node.Path).withHigh(node.PathHigh); stored != path {
+		return fmt.Errorf("%w: path %v loaded at depth %d, path %v", ErrDepthMismatched, stored, depth, path)
+	}
+	if depth >= tree.maxDepth {
+		return nil
+	}
+	nilHash := tree.nilHashes.Get(depth + 3)
+	isEmpty := func(child *StorageLeafNode) bool {
+		return child == nil || len(child.Versions) == 0
+	}
+	for i := 0; i < len(node.Children); i += 2 {
+		internal := node.Internals[6+i/2]
+		if isEmpty(node.Children[i]) && isEmpty(node.Children[i+1]) &&
+			len(internal) > 0 && !bytes.Equal(internal, nilHash) {
+			return fmt.Errorf("%w: depth %d, path %v", ErrDepthMismatched, depth, path)
+		}
+	}
+	return nil
+}
+
+// encodeTreeNode encodes the node into the storage format.
+func (tree *BNBSparseMerkleTree) encodeTreeNode(node *TreeNode) ([]byte, error) {
+	storageTreeNode := node.ToStorageTreeNode()
+	if tree.noInternalStorage {
+		// the internal hashes are recomputed from the children when the node is loaded
+		storageTreeNode.Internals = [14]InternalNode{}
+	}
+	if tree.compressor != nil {
+		if err := tree.compressStorageTreeNode(storageTreeNode, node.depth); err != nil {
+			return nil, err
+		}
 	}
-	node.Children[nibble] = storageTreeNode.ToTreeNode(
-		depth, tree.nilHashes, tree.hasher)
+	if tree.versionCodec != nil {
+		tree.encodeStorageTreeNode(storageTreeNode)
+	}
+	return rlp.EncodeToBytes(storageTreeNode)
+}
 
+// verifyLoadedNode checks that the internal hashes and the root of a node loaded from storage are
+// recomputed from the hashes of its children, and that the root is the child hash recorded in its parent.
+func (tree *BNBSparseMerkleTree) verifyLoadedNode(recorded, loaded *TreeNode) error {
+	root := loaded.root()
+	if loaded.depth < tree.maxDepth && len(loaded.Versions) > 0 {
+		recomputed := loaded.Copy()
+		recomputed.ComputeInternalHash()
+		for i := range recomputed.Internals {
+			if !bytes.Equal(recomputed.Internals[i], loaded.Internals[i]) {
+				return fmt.Errorf("%w: depth %d, path %v", ErrNodeMismatched, loaded.depth, loaded.path)
+			}
+		}
+		if !bytes.Equal(root, tree.hasher.HashChildren(recomputed.Internals[0], recomputed.Internals[1])) {
+			return fmt.Errorf("%w: depth %d, path %v", ErrNodeMismatched, loaded.depth, loaded.path)
+		}
+	}
+	if recorded == nil || len(recorded.Versions) == 0 {
+		return nil
+	}
+	if recorded.latestVersion() != loaded.latestVersion() || !bytes.Equal(recorded.root(), root) {
+		return fmt.Errorf("%w: depth %d, path %v", ErrNodeMismatched, loaded.depth, loaded.path)
+	}
 	return nil
 }
 
@@ -401,15 +780,42 @@ func (tree *BNBSparseMerkleTree) Size() uint64 {
 	return tree.rootSize
 }
 
+// Get returns the value of the key at the version, the value staged by the uncommitted changes
+// is returned when the version is nil. Use GetCommitted for the committed value only.
 func (tree *BNBSparseMerkleTree) Get(key uint64, version *Version) ([]byte, error) {
+	return tree.get(uint64Path(key), version)
+}
+
+func (tree *BNBSparseMerkleTree) get(path nodePath, version *Version) ([]byte, error) {
+	if version == nil && tree.journal.Len() > 0 && path.within(int(tree.maxDepth)) {
+		leaf, err := tree.findLeaf(path)
+		if err != nil {
+			return nil, err
+		}
+		if leaf != nil && leaf.latestVersionWithLock() > tree.version {
+			tree.recordAccess(path)
+			return leaf.Root(), nil
+		}
+	}
+	return tree.getCommitted(path, version)
+}
+
+// GetCommitted returns the value of the key at the version ignoring the uncommitted changes,
+// the latest committed value is returned when the version is nil.
+func (tree *BNBSparseMerkleTree) GetCommitted(key uint64, version *Version) ([]byte, error) {
+	return tree.getCommitted(uint64Path(key), version)
+}
+
+func (tree *BNBSparseMerkleTree) getCommitted(path nodePath, version *Version) ([]byte, error) {
 	if tree.IsEmpty() {
 		return nil, ErrEmptyRoot
 	}
 
-	if key >= 1<<tree.maxDepth {
+	if !path.within(int(tree.maxDepth)) {
 		return nil, ErrInvalidKey
 	}
 
+	latest := version == nil
 	if version == nil {
 		version = &tree.version
 	}
@@ -421,38 +827,45 @@ func (tree *BNBSparseMerkleTree) Get(key uint64, version *Version) ([]byte, erro
 	if *version > tree.version {
 		return nil, ErrVersionTooHigh
 	}
+	tree.recordAccess(path)
 
 	// read from cache
-	cached, ok := tree.dbCache.Get(key)
+	node, ok := tree.cachedLeaf(path)
 	if ok {
-		node := cached.(*TreeNode)
-		for i := len(node.Versions) - 1; i >= 0; i-- {
-			if node.Versions[i].Ver <= *version {
-				return node.Versions[i].Hash, nil
+		versions := tree.withClears(path, node.Versions)
+		for i := len(versions) - 1; i >= 0; i-- {
+			if versions[i].Ver <= *version {
+				return versions[i].Hash, nil
 			}
 		}
 	}
 
+	// read from the latest index before walking the tree
+	if latest {
+		if indexed, hash, ok, err := tree.indexedLeaf(path); err != nil {
+			return nil, err
+		} else if ok {
+			versions := tree.withClears(path, []*VersionInfo{{Ver: indexed, Hash: hash}})
+			return versions[len(versions)-1].Hash, nil
+		}
+	}
+
 	// read from db if cache miss
-	rlpBytes, err := tree.db.Get(storageFullTreeNodeKey(tree.maxDepth, key))
+	storageTreeNode, err := tree.loadLeaf(path)
 	if errors.Is(err, database.ErrDatabaseNotFound) {
 		return nil, ErrNodeNotFound
 	}
 	if err != nil {
 		return nil, err
 	}
-	storageTreeNode := &StorageTreeNode{}
-	err = rlp.DecodeBytes(rlpBytes, storageTreeNode)
-	if err != nil {
-		return nil, err
-	}
 
 	// cache node that read from db
-	tree.dbCache.Add(key, storageTreeNode.ToTreeNode(tree.maxDepth, tree.nilHashes, tree.hasher))
+	tree.dbCache.Add(path, tree.hydrate(storageTreeNode.toTreeNode(tree.maxDepth, tree.nilHashes, tree.hasher)))
 
-	for i := len(storageTreeNode.Versions) - 1; i >= 0; i-- {
-		if storageTreeNode.Versions[i].Ver <= *version {
-			return storageTreeNode.Versions[i].Hash, nil
+	versions := tree.withClears(path, storageTreeNode.Versions)
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Ver <= *version {
+			return versions[i].Hash, nil
 		}
 	}
 
@@ -463,23 +876,83 @@ func (tree *BNBSparseMerkleTree) Set(key uint64, val []byte) error {
 	return tree.SetWithVersion(key, val, tree.version+1)
 }
 
+// NilValuePolicy is how the nil or empty values set to the keys are stored.
+type NilValuePolicy uint8
+
+const (
+	// TreatAsDelete reverts the leaf to the nil hash, as if the key is deleted, it is the default policy.
+	TreatAsDelete NilValuePolicy = iota
+	// StoreEmpty stores the hash of the empty value in the leaf, so the key remains present.
+	StoreEmpty
+)
+
+// leafValue returns the value stored in the leaf for val under the NilValueHandling option.
+func (tree *BNBSparseMerkleTree) leafValue(val []byte) []byte {
+	if len(val) > 0 {
+		return val
+	}
+	if tree.nilValuePolicy == StoreEmpty {
+		return tree.hasher.Hash()
+	}
+	return tree.nilHashes.Get(tree.maxDepth)
+}
+
+// checkLeafSize checks the value against the MaxLeafSize limit.
+func (tree *BNBSparseMerkleTree) checkLeafSize(val []byte) error {
+	if tree.maxLeafSize > 0 && len(val) > tree.maxLeafSize {
+		return fmt.Errorf("%w: got %d bytes, limit %d", ErrLeafTooLarge, len(val), tree.maxLeafSize)
+	}
+	return nil
+}
+
+// SetHash sets the precomputed hash as the leaf commitment of the key, it is the same as Set
+// except that the hash is checked against the output size of the hasher.
+func (tree *BNBSparseMerkleTree) SetHash(key uint64, leafHash []byte) error {
+	if len(leafHash) != tree.hasher.Size() {
+		return fmt.Errorf("%w: got %d bytes, want %d", ErrInvalidHash, len(leafHash), tree.hasher.Size())
+	}
+	return tree.SetWithVersion(key, leafHash, tree.version+1)
+}
+
 // SetWithVersion sets key, value pair with a specific version.
 func (tree *BNBSparseMerkleTree) SetWithVersion(key uint64, val []byte, newVersion Version) error {
-	if key >= 1<<tree.maxDepth {
+	return tree.setWithVersion(uint64Path(key), val, newVersion)
+}
+
+func (tree *BNBSparseMerkleTree) setWithVersion(key nodePath, val []byte, newVersion Version) error {
+	tree.writeMu.Lock()
+	defer tree.writeMu.Unlock()
+	return tree.stageLeaf(key, val, newVersion)
+}
+
+// stageLeaf sets the value of the leaf on copies of the nodes on its path, the caller holds writeMu.
+func (tree *BNBSparseMerkleTree) stageLeaf(key nodePath, val []byte, newVersion Version) error {
+	if err := tree.checkSealed(); err != nil {
+		return err
+	}
+	if err := tree.checkPending(); err != nil {
+		return err
+	}
+	if !key.within(int(tree.maxDepth)) {
 		return ErrInvalidKey
 	}
+	val = tree.leafValue(val)
+	if err := tree.checkLeafSize(val); err != nil {
+		return err
+	}
 	if newVersion <= tree.version {
 		return ErrVersionTooLow
 	}
+	tree.recordAccess(key)
 
 	targetNode := tree.root
-	var depth uint8 = 4
+	var depth uint16 = 4
 	var parentNodes = make([]*TreeNode, 0, tree.maxDepth/4)
 	for i := 0; i < int(tree.maxDepth)/4; i++ {
 		// path <= 2^maxDepth - 1
-		path := key >> (int(tree.maxDepth) - (i+1)*4)
+		path := key.rsh(int(tree.maxDepth) - (i+1)*4)
 		// position in treeNode, nibble <= 0xf
-		nibble := path & 0x000000000000000f
+		nibble := path.nibble()
 		parentNodes = append(parentNodes, targetNode.Copy())
 		if err := tree.extendNode(targetNode, nibble, path, depth, true); err != nil {
 			return err
@@ -490,118 +963,444 @@ func (tree *BNBSparseMerkleTree) SetWithVersion(key uint64, val []byte, newVersi
 	}
 	targetNode = targetNode.Copy()
 	targetNode.Set(val, newVersion) // update hash of leaf node
-	tree.journal.set(journalKey{targetNode.depth, targetNode.path}, targetNode)
+	linked, err := tree.journalNode(targetNode)
+	if err != nil {
+		return err
+	}
 	// recompute root hash of middle nodes
 	for i := len(parentNodes) - 1; i >= 0; i-- {
-		childNibble := key >> (int(tree.maxDepth) - (i+1)*4) & 0x000000000000000f
-		parentNodes[i].SetChildren(targetNode, int(childNibble), newVersion)
+		childNibble := key.rsh(int(tree.maxDepth) - (i+1)*4).nibble()
+		parentNodes[i].SetChildren(linked, int(childNibble), newVersion)
 
-		targetNode = parentNodes[i]
-		tree.journal.set(journalKey{targetNode.depth, targetNode.path}, targetNode)
+		if linked, err = tree.journalNode(parentNodes[i]); err != nil {
+			return err
+		}
 	}
-	tree.root = targetNode
+	tree.root = parentNodes[0]
 	return nil
 }
 
-// MultiSet sets k,v pairs in parallel
-func (tree *BNBSparseMerkleTree) MultiSet(items []Item) error {
-	return tree.MultiSetWithVersion(items, tree.version+1)
-}
+// SetIfAbsent sets key, value pair only when the key has no value in the
+// current tree, including the uncommitted changes. It is serialized with the other
+// setters, so only one of concurrent SetIfAbsent calls inserts the key.
+func (tree *BNBSparseMerkleTree) SetIfAbsent(key uint64, val []byte) (bool, error) {
+	tree.writeMu.Lock()
+	defer tree.writeMu.Unlock()
 
-// MultiSetWithVersion sets k,v pairs in parallel with a specific version.
-//
-// 1. generate all intermediate nodes, with lock;
-// 2. set all leaves, without lock;
-// 3. re-compute hash, from leaves to root
-func (tree *BNBSparseMerkleTree) MultiSetWithVersion(items []Item, newVersion Version) error {
-	size := len(items)
-	if size == 0 {
-		return nil
+	if key>>tree.maxDepth != 0 {
+		return false, ErrInvalidKey
 	}
-	// also check len(items) not exceed 2^maxDepth - 1
-	// also check no duplicated keys
+	leaf, err := tree.findLeaf(uint64Path(key))
+	if err != nil {
+		return false, err
+	}
+	if leaf != nil && !bytes.Equal(leaf.Root(), tree.nilHashes.Get(tree.maxDepth)) {
+		return false, nil
+	}
+	if err := tree.stageLeaf(uint64Path(key), val, tree.version+1); err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
-	tmpJournal := newJournal()
-	leavesJournal := newJournal()
-	// should we initialize all intermediate nodes when New SMT? so we can skip this step
-	maxKey := uint64(1 << tree.maxDepth)
-	errCh := make(chan error, len(items))
-	wg := sync.WaitGroup{}
-	for _, item := range items {
-		it := item
-		if it.Key >= maxKey {
-			return ErrInvalidKey
+// findLeaf returns the leaf node of the key in the current tree,
+// nil if the leaf node does not exist.
+func (tree *BNBSparseMerkleTree) findLeaf(key nodePath) (*TreeNode, error) {
+	targetNode := tree.root
+	var depth uint16 = 4
+	for i := 0; i < int(tree.maxDepth)/4; i++ {
+		path := key.rsh(int(tree.maxDepth) - (i+1)*4)
+		nibble := path.nibble()
+		if err := tree.extendNode(targetNode, nibble, path, depth, false); err != nil {
+			return nil, err
 		}
-		wg.Add(1)
-		tree.goroutinePool.Submit(func() {
-			defer wg.Done()
-			if leaf, err := tree.setIntermediateAndLeaves(tmpJournal, it, newVersion); err != nil {
-				errCh <- err
-			} else {
-				if _, exist := leavesJournal.get(journalKey{leaf.depth, leaf.path}); !exist {
-					leavesJournal.set(journalKey{leaf.depth, leaf.path}, leaf)
-				}
-			}
-		})
+		targetNode = targetNode.getChild(int(nibble))
+		if targetNode == nil {
+			return nil, nil
+		}
+		depth += 4
 	}
+	return targetNode, nil
+}
 
-	wg.Wait()
-	close(errCh)
-	for err := range errCh {
-		if err != nil {
-			return err
-		}
+// NodeRootAt returns the hash of the node at the given depth and path at the version,
+// the node is loaded from storage when it has been released from memory.
+func (tree *BNBSparseMerkleTree) NodeRootAt(depth uint8, path uint64, version Version) ([]byte, error) {
+	if depth%4 != 0 || uint16(depth) > tree.maxDepth {
+		return nil, ErrInvalidDepth
+	}
+	if path>>depth != 0 {
+		return nil, ErrInvalidKey
+	}
+	if tree.recentVersion > version {
+		return nil, ErrVersionTooOld
+	}
+	if version > tree.version {
+		return nil, ErrVersionTooHigh
 	}
 
-	wg.Add(leavesJournal.len())
-	// For treeNode, the concurrency set to the number of leaf nodes
-	err := leavesJournal.iterate(func(k journalKey, v *TreeNode) error {
-		err := tree.goroutinePool.Submit(func() {
-			defer wg.Done()
-			tree.recompute(v, tmpJournal)
-		})
+	targetNode := tree.root
+	for d := uint16(4); d <= uint16(depth); d += 4 {
+		childPath := uint64Path(path >> (uint16(depth) - d))
+		nibble := childPath.nibble()
+		child, err := tree.childAt(targetNode, nibble, childPath, d, version)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		targetNode = child
+		if targetNode == nil {
+			return tree.nilHashes.Get(uint16(depth)), nil
 		}
-		return nil
-	})
-	if err != nil {
-		return ErrUnexpected
 	}
-	wg.Wait()
+	return targetNode.RootAt(version), nil
+}
 
-	// point root node to the new one
-	newRoot, exist := tmpJournal.get(journalKey{tree.root.depth, tree.root.path})
-	if !exist {
-		return ErrUnexpected
+// SiblingAt returns the hash of the sibling at the level on the path of the key at the version,
+// the level 0 is the children of the root and the level maxDepth-1 is the leaves.
+func (tree *BNBSparseMerkleTree) SiblingAt(key uint64, level uint8, version Version) ([]byte, error) {
+	if uint16(level) >= tree.maxDepth {
+		return nil, ErrInvalidDepth
+	}
+	if err := tree.checkKeyVersion(key, version); err != nil {
+		return nil, err
 	}
-	tree.root = newRoot
 
-	// flush into journal
-	err = tmpJournal.iterate(func(key journalKey, val *TreeNode) error {
-		tree.journal.set(key, val)
+	// walk to the node holding the level
+	targetNode := tree.root
+	for d := uint16(4); d <= uint16(level)/4*4; d += 4 {
+		path := uint64Path(key).rsh(int(tree.maxDepth - d))
+		nibble := path.nibble()
+		if err := tree.extendNode(targetNode, nibble, path, d, false); err != nil {
+			return nil, err
+		}
+		targetNode = targetNode.getChild(int(nibble))
+		if targetNode == nil {
+			return tree.nilHashes.Get(uint16(level) + 1), nil
+		}
+	}
+	nibble := uint64Path(key).rsh(int(tree.maxDepth - targetNode.depth - 4)).nibble()
+	return tree.siblingAt(targetNode, nibble, level%4, version), nil
+}
+
+// GetProofAt returns the proof of the key at the version, the proof of exclusion is
+// returned if the key has no value at the version, even though it is set later.
+func (tree *BNBSparseMerkleTree) GetProofAt(key uint64, version Version) (Proof, error) {
+	proof, err := tree.getProofAt(uint64Path(key), version)
+	if err != nil {
+		return nil, err
+	}
+	return tree.orderProof(proof), nil
+}
+
+// getProofAt returns the proof of the key at the version from the leaf to the root.
+func (tree *BNBSparseMerkleTree) getProofAt(key nodePath, version Version) (Proof, error) {
+	if tree.maxProofSize > 0 &&
+		int(tree.maxDepth)*len(tree.nilHashes.Get(0)) > tree.maxProofSize {
+		return nil, ErrProofTooLarge
+	}
+	if err := tree.checkPathVersion(key, version); err != nil {
+		return nil, err
+	}
+	// the version is referenced during the walk, so it is not pruned meanwhile
+	if !tree.snapshots.acquire(version) {
+		return nil, ErrVersionTooOld
+	}
+	defer tree.snapshots.release(version)
+
+	proofs := make([][]byte, 0, tree.maxDepth)
+	targetNode := tree.root
+	for depth := uint16(4); targetNode != nil; depth += 4 {
+		path := key.rsh(int(tree.maxDepth - depth))
+		nibble := path.nibble()
+		for inner := uint8(0); inner < 4; inner++ {
+			proofs = append(proofs, tree.siblingAt(targetNode, nibble, inner, version))
+		}
+		if depth == tree.maxDepth {
+			break
+		}
+		child, err := tree.childAt(targetNode, nibble, path, depth, version)
+		if err != nil {
+			return nil, err
+		}
+		targetNode = child
+	}
+	// the rest of the path is in an empty subtree
+	for level := uint16(len(proofs)); level < tree.maxDepth; level++ {
+		proofs = append(proofs, tree.nilHashes.Get(level+1))
+	}
+
+	tree.collectProofMetrics(proofs)
+	return utils.ReverseBytes(proofs), nil
+}
+
+// VerifyAgainstHistory verifies the proof of the value of the key against the root at the version,
+// the historical roots are kept by the root node since RecentVersion. The siblings are expected
+// in the order configured by the ProofOrder option like VerifyProof.
+func (tree *BNBSparseMerkleTree) VerifyAgainstHistory(proof Proof, key uint64, value []byte, version Version) (bool, error) {
+	if err := tree.checkKeyVersion(key, version); err != nil {
+		return false, err
+	}
+	if err := checkProofLength(proof, int(tree.maxDepth)); err != nil {
+		return false, err
+	}
+	if tree.proofOrder == RootToLeaf {
+		proof = utils.ReverseBytes(append(Proof{}, proof...))
+	}
+
+	// the siblings are hashed along the path rather than by ProofItem, which is limited to 64 levels
+	return bytes.Equal(tree.hashPath(uint64Path(key), value, proof), tree.root.RootAt(version)), nil
+}
+
+// GetCommitmentProof returns the leaf hash stored at the path at the version and its proof,
+// so the binding of the leaf hash can be verified without revealing the value behind it.
+// The nil hash of the leaves is returned for an absent path.
+func (tree *BNBSparseMerkleTree) GetCommitmentProof(path uint64, version Version) ([]byte, Proof, error) {
+	proof, err := tree.GetProofAt(path, version)
+	if err != nil {
+		return nil, nil, err
+	}
+	leafHash, err := tree.Get(path, &version)
+	if errors.Is(err, ErrNodeNotFound) || errors.Is(err, ErrEmptyRoot) {
+		return tree.nilHashes.Get(tree.maxDepth), proof, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return leafHash, proof, nil
+}
+
+// Frontier returns the siblings of the empty slot at the path at the version, which are all the hashes needed
+// to compute the root after appending a leaf at the slot without the rest of the tree.
+func (tree *BNBSparseMerkleTree) Frontier(path uint64, version Version) (Proof, error) {
+	leafHash, proof, err := tree.GetCommitmentProof(path, version)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(leafHash, tree.nilHashes.Get(tree.maxDepth)) {
+		return nil, fmt.Errorf("%w: path %d", ErrSlotOccupied, path)
+	}
+	return proof, nil
+}
+
+func (tree *BNBSparseMerkleTree) checkKeyVersion(key uint64, version Version) error {
+	return tree.checkPathVersion(uint64Path(key), version)
+}
+
+func (tree *BNBSparseMerkleTree) checkPathVersion(path nodePath, version Version) error {
+	if !path.within(int(tree.maxDepth)) {
+		return ErrInvalidKey
+	}
+	if tree.RecentVersion() > version {
+		return ErrVersionTooOld
+	}
+	if version > tree.LatestVersion() {
+		return ErrVersionTooHigh
+	}
+	return nil
+}
+
+// siblingAt hashes the children under the sibling at the inner level of the node on the path
+// of the nibble, the internal hashes cannot be used as they only keep the latest version.
+func (tree *BNBSparseMerkleTree) siblingAt(node *TreeNode, nibble uint64, inner uint8, version Version) []byte {
+	sibling := nibble>>(3-inner) ^ 1
+	hashes := make([][]byte, 1<<(3-inner))
+	for i := range hashes {
+		hashes[i] = node.nilChildHash
+		if child := node.getChild(int(sibling<<(3-inner)) + i); child != nil {
+			hashes[i] = child.RootAt(version)
+		}
+	}
+	for len(hashes) > 1 {
+		for i := 0; i < len(hashes)/2; i++ {
+			hashes[i] = tree.hasher.HashChildren(hashes[2*i], hashes[2*i+1])
+		}
+		hashes = hashes[:len(hashes)/2]
+	}
+	return hashes[0]
+}
+
+// MultiSet sets k,v pairs in parallel
+func (tree *BNBSparseMerkleTree) MultiSet(items []Item) error {
+	return tree.MultiSetWithVersion(items, tree.version+1)
+}
+
+// MultiSetWithVersion sets k,v pairs in parallel with a specific version.
+//
+// 1. generate all intermediate nodes, with lock;
+// 2. set all leaves, without lock;
+// 3. re-compute hash, from leaves to root
+func (tree *BNBSparseMerkleTree) MultiSetWithVersion(items []Item, newVersion Version) error {
+	tree.writeMu.Lock()
+	defer tree.writeMu.Unlock()
+
+	if err := tree.checkSealed(); err != nil {
+		return err
+	}
+	if err := tree.checkPending(); err != nil {
+		return err
+	}
+	size := len(items)
+	if size == 0 {
 		return nil
+	}
+	// also check len(items) not exceed 2^maxDepth - 1
+	// also check no duplicated keys
+
+	newRoot, tmpJournal, err := tree.stageItems(tree.root, items, newVersion)
+	if err != nil {
+		return err
+	}
+
+	// flush into journal, the spilled nodes are linked into their copied parents before the root is switched
+	var spilled []*TreeNode
+	err = tmpJournal.iterate(func(key journalKey, val *TreeNode) error {
+		linked, err := tree.journalNode(val)
+		if linked != val {
+			spilled = append(spilled, linked)
+		}
+		return err
 	})
 	if err != nil {
-		return ErrUnexpected
+		return err
+	}
+	for _, placeholder := range spilled {
+		if parent, exist := tmpJournal.get(journalKey{placeholder.depth - 4, placeholder.path.rsh(4)}); exist {
+			parent.Children[placeholder.path.nibble()] = placeholder
+		}
+	}
+	tree.root = newRoot
+	return nil
+}
+
+// stageItems sets the items on copies of the nodes under the root, and returns the new root
+// and the journal of the copied nodes, the nodes under the root are left unchanged.
+func (tree *BNBSparseMerkleTree) stageItems(root *TreeNode, items []Item, newVersion Version) (*TreeNode, *journal, error) {
+	tmpJournal := newJournal()
+	leavesJournal := newJournal()
+	// should we initialize all intermediate nodes when New SMT? so we can skip this step
+	errCh := make(chan error, len(items))
+	wg := sync.WaitGroup{}
+	parallel := len(items) > tree.parallelThreshold
+	for _, item := range items {
+		it := item
+		if it.Key>>tree.maxDepth != 0 {
+			return nil, nil, ErrInvalidKey
+		}
+		it.Val = tree.leafValue(it.Val)
+		if err := tree.checkLeafSize(it.Val); err != nil {
+			return nil, nil, err
+		}
+		tree.recordAccess(uint64Path(it.Key))
+		wg.Add(1)
+		// the intermediate nodes are loaded from storage
+		tree.runStorage(parallel, func() {
+			defer wg.Done()
+			if leaf, err := tree.setIntermediateAndLeaves(root, tmpJournal, it, newVersion); err != nil {
+				errCh <- err
+			} else {
+				if _, exist := leavesJournal.get(journalKey{leaf.depth, leaf.path}); !exist {
+					leavesJournal.set(journalKey{leaf.depth, leaf.path}, leaf)
+				}
+			}
+		})
+	}
+
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	tree.recompute(tmpJournal, newVersion, leavesJournal.len() > tree.parallelThreshold)
+
+	newRoot, exist := tmpJournal.get(journalKey{root.depth, root.path})
+	if !exist {
+		return nil, nil, ErrUnexpected
+	}
+	return newRoot, tmpJournal, nil
+}
+
+// initPools creates the goroutine pools not supplied by the options, they are released on Close.
+func (tree *BNBSparseMerkleTree) initPools() error {
+	var err error
+	if tree.goroutinePool == nil {
+		tree.goroutinePool, err = ants.NewPool(128)
+		if err != nil {
+			return err
+		}
+		tree.ownedPools = append(tree.ownedPools, tree.goroutinePool)
+	}
+	if tree.storageParallelism > 0 {
+		tree.storagePool, err = ants.NewPool(tree.storageParallelism)
+		if err != nil {
+			return err
+		}
+		tree.ownedPools = append(tree.ownedPools, tree.storagePool)
 	}
 	return nil
 }
 
+// Close releases the goroutine pools created by the tree, the pools supplied by the options are left to their owners.
+// The in-flight asynchronous commits are waited for, the pools are kept if they do not finish within the close timeout.
+// The commits buffered by the DeferredWrites option are synced to storage.
+func (tree *BNBSparseMerkleTree) Close() error {
+	if err := tree.waitInflight(); err != nil {
+		return err
+	}
+	if err := tree.Sync(); err != nil {
+		return err
+	}
+	for _, pool := range tree.ownedPools {
+		pool.Release()
+	}
+	tree.ownedPools = nil
+	return nil
+}
+
+// run submits the task to the goroutine pool if parallel, otherwise runs it inline.
+func (tree *BNBSparseMerkleTree) run(parallel bool, task func()) {
+	if !parallel {
+		task()
+		return
+	}
+	tree.submit(task)
+}
+
+// runStorage runs the storage bound task like run, but in the storage pool if it is configured.
+func (tree *BNBSparseMerkleTree) runStorage(parallel bool, task func()) {
+	if !parallel || tree.storagePool == nil {
+		tree.run(parallel, task)
+		return
+	}
+	if err := tree.storagePool.Submit(task); err != nil {
+		task()
+	}
+}
+
+// submit runs the task in the goroutine pool. The task runs synchronously
+// when the pool is overloaded or closed, so the callers waiting for it never hang.
+func (tree *BNBSparseMerkleTree) submit(task func()) {
+	if err := tree.goroutinePool.Submit(task); err != nil {
+		task()
+	}
+}
+
 // return leaf node
-func (tree *BNBSparseMerkleTree) setIntermediateAndLeaves(tmpJournal *journal, item Item, newVer Version) (*TreeNode, error) {
+func (tree *BNBSparseMerkleTree) setIntermediateAndLeaves(root *TreeNode, tmpJournal *journal, item Item, newVer Version) (*TreeNode, error) {
 	var (
-		key         = item.Key
-		val         = item.Val
-		depth uint8 = 4
+		key          = uint64Path(item.Key)
+		val          = item.Val
+		depth uint16 = 4
 	)
-	targetNode := tree.root
+	targetNode := root
 	// find middle nodes
 	for i := 0; i < int(tree.maxDepth)/4; i++ {
 		// path <= 2^maxDepth - 1
-		path := key >> (int(tree.maxDepth) - (i+1)*4)
+		path := key.rsh(int(tree.maxDepth) - (i+1)*4)
 		// position in treeNode, nibble <= 0xf
-		nibble := path & 0x000000000000000f
+		nibble := path.nibble()
 
 		// skip existed node
 		jk := journalKey{targetNode.depth, targetNode.path}
@@ -612,47 +1411,166 @@ func (tree *BNBSparseMerkleTree) setIntermediateAndLeaves(tmpJournal *journal, i
 		if err := tree.extendNode(targetNode, nibble, path, depth, true); err != nil {
 			return nil, fmt.Errorf("%w: %s", ErrExtendNode, err.Error())
 		}
-		targetNode = targetNode.Children[nibble]
+		targetNode = targetNode.getChild(int(nibble))
 		depth += 4
 	}
 	targetNode = targetNode.Copy()
 	// update hash of leaf node
 	targetNode.Set(val, newVer)
 	tmpJournal.set(journalKey{targetNode.depth, targetNode.path}, targetNode)
-	if p, e := tmpJournal.get(journalKey{depth: targetNode.depth - 4, path: targetNode.path >> 4}); e {
-		p.Children[targetNode.path&0xf] = targetNode
+	if p, e := tmpJournal.get(journalKey{depth: targetNode.depth - 4, path: targetNode.path.rsh(4)}); e {
+		p.Children[targetNode.path.nibble()] = targetNode
 	}
 	return targetNode, nil
 }
 
+// KeyHistory returns the committed versions at which the value of the key changed in ascending order.
+// The changes older than RecentVersion are excluded except the latest of them, which holds the value at RecentVersion.
+func (tree *BNBSparseMerkleTree) KeyHistory(key uint64) ([]Version, error) {
+	if key>>tree.maxDepth != 0 {
+		return nil, ErrInvalidKey
+	}
+
+	var versions []*VersionInfo
+	if node, ok := tree.cachedLeaf(uint64Path(key)); ok {
+		node.rlock()
+		versions = node.Versions
+		node.mu.RUnlock()
+	} else {
+		storageTreeNode, err := tree.loadLeaf(uint64Path(key))
+		if errors.Is(err, database.ErrDatabaseNotFound) {
+			return nil, ErrNodeNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		versions = storageTreeNode.Versions
+	}
+	versions = tree.withClears(uint64Path(key), versions)
+
+	history := make([]Version, 0, len(versions))
+	var latest []byte
+	for i, v := range versions {
+		// the versions superseded before the recent version may have been pruned
+		if i+1 < len(versions) && versions[i+1].Ver <= tree.recentVersion {
+			continue
+		}
+		// setting the same value again is not a change
+		if len(history) > 0 && bytes.Equal(latest, v.Hash) {
+			continue
+		}
+		history = append(history, v.Ver)
+		latest = v.Hash
+	}
+	return history, nil
+}
+
+// Stats is the statistics of a tree.
+type Stats struct {
+	// the number of children found in memory when walking the tree
+	HydrationHits uint64
+	// the number of children loaded from storage when walking the tree
+	HydrationMisses uint64
+	// the number of subtrees archived to keep the memory within the SpillToDisk limit
+	SpilledNodes uint64
+}
+
+func (tree *BNBSparseMerkleTree) Stats() Stats {
+	return Stats{
+		HydrationHits:   atomic.LoadUint64(&tree.hydrationHits),
+		HydrationMisses: atomic.LoadUint64(&tree.hydrationMisses),
+		SpilledNodes:    atomic.LoadUint64(&tree.spilledNodes),
+	}
+}
+
 func (tree *BNBSparseMerkleTree) IsEmpty() bool {
 	return bytes.Equal(tree.root.Root(), tree.nilHashes.Get(0))
 }
 
+// Root returns the root including the uncommitted changes, the same as PendingRoot but not
+// synchronized with the setters, while Latest returns the root of the latest commit.
 func (tree *BNBSparseMerkleTree) Root() []byte {
 	return tree.root.Root()
 }
 
+var fingerprintProbe = []byte(`bsmt:fingerprint`)
+
+// Fingerprint returns a deterministic digest of the tree configuration: the depth,
+// the hash function, the order of the children and the nil hashes of all levels. Trees with different fingerprints
+// produce different roots for the same items, so the fingerprints should be compared first.
+func (tree *BNBSparseMerkleTree) Fingerprint() string {
+	digest := sha256.New()
+	write := func(data []byte) {
+		lenBuf := make([]byte, 4)
+		binary.BigEndian.PutUint32(lenBuf, uint32(len(data)))
+		digest.Write(lenBuf)
+		digest.Write(data)
+	}
+	// the depths beyond 255 of the trees created with WideDepth take 2 bytes
+	if tree.maxDepth <= 0xff {
+		write([]byte{byte(tree.maxDepth)})
+	} else {
+		write([]byte{byte(tree.maxDepth >> 8), byte(tree.maxDepth)})
+	}
+	// the hash of a fixed probe identifies the hash function
+	write(tree.hasher.Hash(fingerprintProbe))
+	// the default order is left out, so the fingerprints of the existing trees are kept
+	if tree.hasher.order != LeftRight {
+		write([]byte{byte(tree.hasher.order)})
+	}
+	for depth := 0; depth <= int(tree.maxDepth); depth++ {
+		write(tree.nilHashes.Get(uint16(depth)))
+	}
+	return hex.EncodeToString(digest.Sum(nil))
+}
+
+// GetProof returns the proof of the key in the latest tree, the siblings are ordered by the ProofOrder option.
 func (tree *BNBSparseMerkleTree) GetProof(key uint64) (Proof, error) {
+	proof, err := tree.getProof(uint64Path(key))
+	if err != nil {
+		return nil, err
+	}
+	return tree.orderProof(proof), nil
+}
+
+// orderProof reorders the proof from the leaf to the root into the configured order.
+func (tree *BNBSparseMerkleTree) orderProof(proof Proof) Proof {
+	if tree.proofOrder == RootToLeaf {
+		return utils.ReverseBytes(proof)
+	}
+	return proof
+}
+
+// getProof returns the proof of the key in the latest tree from the leaf to the root.
+func (tree *BNBSparseMerkleTree) getProof(key nodePath) (Proof, error) {
+	// the proof always holds one hash for each level, so the size can be
+	// checked before walking the tree.
+	if tree.maxProofSize > 0 &&
+		int(tree.maxDepth)*len(tree.nilHashes.Get(0)) > tree.maxProofSize {
+		return nil, ErrProofTooLarge
+	}
+
+	root := tree.proofRoot()
 	proofs := make([][]byte, 0, tree.maxDepth)
-	if tree.IsEmpty() {
+	if bytes.Equal(root.Root(), tree.nilHashes.Get(0)) {
 		for i := tree.maxDepth; i > 0; i-- {
 			proofs = append(proofs, tree.nilHashes.Get(i))
 		}
+		tree.collectProofMetrics(proofs)
 		return proofs, nil
 	}
 
-	if key >= 1<<tree.maxDepth {
+	if !key.within(int(tree.maxDepth)) {
 		return nil, ErrInvalidKey
 	}
 
-	targetNode := tree.root
+	targetNode := root
 	var neighborNode *TreeNode
-	var depth uint8 = 4
+	var depth uint16 = 4
 
 	for i := 0; i < int(tree.maxDepth)/4; i++ {
-		path := key >> (int(tree.maxDepth) - (i+1)*4)
-		nibble := path & 0x000000000000000f
+		path := key.rsh(int(tree.maxDepth) - (i+1)*4)
+		nibble := path.nibble()
 		if err := tree.extendNode(targetNode, nibble, path, depth, true); err != nil {
 			return nil, err
 		}
@@ -662,12 +1580,13 @@ func (tree *BNBSparseMerkleTree) GetProof(key uint64) (Proof, error) {
 			// nibble / 4
 			// nibble / 2
 			inc := int(nibble) / (1 << (3 - j))
-			proofs = append(proofs, targetNode.Internals[(index+inc)^1])
+			// copy the internal hash, it is a view of the backing array of the node
+			proofs = append(proofs, utils.CopyBytes(targetNode.Internals[(index+inc)^1]))
 			index += 1 << (j + 1)
 		}
 
-		neighborNode = targetNode.Children[nibble^1]
-		targetNode = targetNode.Children[nibble]
+		neighborNode = targetNode.getChild(int(nibble ^ 1))
+		targetNode = targetNode.getChild(int(nibble))
 		if neighborNode == nil {
 			proofs = append(proofs, tree.nilHashes.Get(depth))
 		} else {
@@ -677,51 +1596,116 @@ func (tree *BNBSparseMerkleTree) GetProof(key uint64) (Proof, error) {
 		depth += 4
 	}
 
+	tree.collectProofMetrics(proofs)
 	return utils.ReverseBytes(proofs[:]), nil
 }
 
+func (tree *BNBSparseMerkleTree) collectProofMetrics(proof Proof) {
+	if tree.metrics == nil {
+		return
+	}
+	size := 0
+	for _, p := range proof {
+		size += len(p)
+	}
+	tree.metrics.ProofSize(size)
+}
+
+// GetMultiProof returns the proofs of the keys along with their latest values.
+func (tree *BNBSparseMerkleTree) GetMultiProof(keys []uint64) (*MultiProof, error) {
+	multiProof := &MultiProof{
+		Keys:   keys,
+		Values: make([][]byte, 0, len(keys)),
+		Proofs: make([]Proof, 0, len(keys)),
+	}
+	for _, key := range keys {
+		val, err := tree.Get(key, nil)
+		if errors.Is(err, ErrNodeNotFound) || errors.Is(err, ErrEmptyRoot) {
+			val = tree.nilHashes.Get(tree.maxDepth)
+		} else if err != nil {
+			return nil, err
+		}
+		// the multi proof is always verified from the leaf to the root
+		proof, err := tree.getProof(uint64Path(key))
+		if err != nil {
+			return nil, err
+		}
+		multiProof.Values = append(multiProof.Values, val)
+		multiProof.Proofs = append(multiProof.Proofs, proof)
+	}
+	return multiProof, nil
+}
+
+// VerifyProof verifies the proof of the key against the latest tree,
+// the siblings are expected in the order configured by the ProofOrder option.
 func (tree *BNBSparseMerkleTree) VerifyProof(key uint64, proof Proof) bool {
-	if key >= 1<<tree.maxDepth {
+	return tree.verifyProof(uint64Path(key), proof)
+}
+
+func (tree *BNBSparseMerkleTree) verifyProof(key nodePath, proof Proof) bool {
+	if !key.within(int(tree.maxDepth)) || checkProofLength(proof, int(tree.maxDepth)) != nil {
 		return false
 	}
+	if tree.proofOrder == RootToLeaf {
+		proof = utils.ReverseBytes(append(Proof{}, proof...))
+	}
 
-	keyVal, err := tree.Get(key, nil)
+	keyVal, err := tree.get(key, nil)
 	if err != nil && !errors.Is(err, ErrNodeNotFound) && !errors.Is(err, ErrEmptyRoot) {
 		return false
 	}
 	if len(keyVal) == 0 {
 		keyVal = tree.nilHashes.Get(tree.maxDepth)
 	}
+	return bytes.Equal(tree.Root(), tree.hashPath(key, keyVal, proof))
+}
 
-	path := key
-	root := tree.Root()
-	node := keyVal
-	for i := 0; i < len(proof); i++ {
-		switch path & 0x0000000000000001 {
-		case 0:
-			node = tree.hasher.Hash(node, proof[i])
-		case 1:
-			node = tree.hasher.Hash(proof[i], node)
-		default:
-			return false
-		}
+func (tree *BNBSparseMerkleTree) LatestVersion() Version {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+	return tree.version
+}
 
-		path >>= 1
-	}
+// PendingRoot returns the root that the next commit produces from the staged changes, the staged
+// changes are hashed as they are set, so it is read from the staged root without committing.
+// It is the same root as Root, but it is read under writeMu, so it is safe to call while
+// the changes are staged concurrently and never observes the root being swapped by a setter.
+func (tree *BNBSparseMerkleTree) PendingRoot() []byte {
+	tree.writeMu.Lock()
+	defer tree.writeMu.Unlock()
+	return tree.root.Root()
+}
 
-	return bytes.Equal(root, node)
+// Latest returns the latest committed version and its root,
+// they are read under one lock so that both belong to the same commit.
+func (tree *BNBSparseMerkleTree) Latest() (Version, []byte) {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+	return tree.version, tree.latestRoot
 }
 
-func (tree *BNBSparseMerkleTree) LatestVersion() Version {
-	return tree.version
+func (tree *BNBSparseMerkleTree) setLatest(version Version, root []byte) {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+	tree.version = version
+	tree.latestRoot = root
 }
 
 func (tree *BNBSparseMerkleTree) RecentVersion() Version {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
 	return tree.recentVersion
 }
 
+// setRecent sets the oldest readable version.
+func (tree *BNBSparseMerkleTree) setRecent(version Version) {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+	tree.recentVersion = version
+}
+
 func (tree *BNBSparseMerkleTree) Versions() []Version {
-	tree.root.mu.RLock()
+	tree.root.rlock()
 	defer tree.root.mu.RUnlock()
 	var versions []Version
 	for _, v := range tree.root.Versions {
@@ -731,9 +1715,84 @@ func (tree *BNBSparseMerkleTree) Versions() []Version {
 }
 
 func (tree *BNBSparseMerkleTree) Reset() {
-	tree.journal.flush()
+	// the stale spilled nodes are unreachable once the journal is flushed
+	_ = tree.journal.Flush()
 	tree.root = tree.lastSaveRoot
 	tree.rootSize = tree.lastSaveRootSize
+	tree.stagedKeys = nil
+	tree.stagedClears = nil
+	tree.clearPending()
+}
+
+// PruneParallel prunes the versions older than oldestVersion of all nodes in memory,
+// the subtrees are pruned concurrently by the goroutine pool. The pruned versions are no longer
+// readable, RecentVersion is raised to the oldest retained version and persisted.
+// It returns the number of bytes released.
+func (tree *BNBSparseMerkleTree) PruneParallel(oldestVersion Version) (uint64, error) {
+	tree.commitMu.Lock()
+	defer tree.commitMu.Unlock()
+	if oldestVersion > tree.version {
+		return 0, ErrVersionTooHigh
+	}
+	// the versions referenced by snapshots are retained
+	oldestVersion = tree.snapshots.retain(oldestVersion)
+	if oldestVersion > tree.recentVersion {
+		if db := tree.storage(); db != nil {
+			buf := make([]byte, 8)
+			binary.BigEndian.PutUint64(buf, uint64(oldestVersion))
+			if err := db.Set(recentVersionNumberKey, buf); err != nil {
+				return 0, err
+			}
+		}
+		tree.setRecent(oldestVersion)
+		if err := tree.pruneClearedPrefixes(tree.storage(), oldestVersion); err != nil {
+			return 0, err
+		}
+	}
+
+	var (
+		freed = tree.root.Prune(oldestVersion)
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < len(tree.root.Children); i++ {
+		child := tree.root.getChild(i)
+		if child == nil {
+			continue
+		}
+		wg.Add(1)
+		tree.submit(func() {
+			defer wg.Done()
+			atomic.AddUint64(&freed, tree.prune(child, oldestVersion))
+		})
+	}
+	wg.Wait()
+
+	tree.rootSize -= freed
+	return freed, nil
+}
+
+// PruneKeepLast prunes the versions of all nodes in memory except the latest n versions,
+// it is the same as PruneParallel with the oldest of the retained versions.
+func (tree *BNBSparseMerkleTree) PruneKeepLast(n int) (uint64, error) {
+	if n <= 0 {
+		return 0, fmt.Errorf("%w: %d", ErrInvalidRetention, n)
+	}
+	latest := tree.LatestVersion()
+	if latest <= Version(n) {
+		return 0, nil
+	}
+	return tree.PruneParallel(latest - Version(n) + 1)
+}
+
+// prune prunes the versions older than oldestVersion of the subtree sequentially.
+func (tree *BNBSparseMerkleTree) prune(node *TreeNode, oldestVersion Version) uint64 {
+	freed := node.Prune(oldestVersion)
+	for i := 0; i < len(node.Children); i++ {
+		if child := node.getChild(i); child != nil {
+			freed += tree.prune(child, oldestVersion)
+		}
+	}
+	return freed
 }
 
 func (tree *BNBSparseMerkleTree) writeNode(db database.Batcher, fullNode *TreeNode, version Version, recentVersion *Version) (uint64, error) {
@@ -745,17 +1804,21 @@ func (tree *BNBSparseMerkleTree) writeNode(db database.Batcher, fullNode *TreeNo
 	} else {
 		changed = fullNode.Size()
 	}
+	// the previous version is kept by the prune of the last commit, the node was stored under its salt
+	if err := tree.deleteStaleKey(db, fullNode, fullNode.PreviousVersion()); err != nil {
+		return changed, err
+	}
 	// prune versions
 	if recentVersion != nil {
 		changed -= fullNode.Prune(*recentVersion)
 	}
 
 	// persist tree
-	rlpBytes, err := rlp.EncodeToBytes(fullNode.ToStorageTreeNode())
+	rlpBytes, err := tree.encodeTreeNode(fullNode)
 	if err != nil {
 		return changed, err
 	}
-	err = db.Set(storageFullTreeNodeKey(fullNode.depth, fullNode.path), rlpBytes)
+	err = db.Set(tree.nodeKey(fullNode.depth, fullNode.path, fullNode.latestVersion()), rlpBytes)
 	if err != nil {
 		return changed, err
 	}
@@ -770,12 +1833,136 @@ func (tree *BNBSparseMerkleTree) writeNode(db database.Batcher, fullNode *TreeNo
 }
 
 func (tree *BNBSparseMerkleTree) Commit(recentVersion *Version) (Version, error) {
+	if tree.coalescer != nil {
+		return tree.coalescer.commit(recentVersion, func(recentVersion *Version) (Version, error) {
+			return tree.CommitWithNewVersion(recentVersion, nil)
+		})
+	}
 	return tree.CommitWithNewVersion(recentVersion, nil)
 }
 
+// CommitVersion commits the staged changes as the version and returns the root, it is idempotent
+// for the committed versions: re-committing one of them with the same changes is a no-op returning
+// its committed root, while the different changes are discarded with ErrVersionConflict.
+// The changes redelivered for a committed version are applied on top of the version before it,
+// so the versions at or below RecentVersion cannot be redelivered except the latest one.
+func (tree *BNBSparseMerkleTree) CommitVersion(version Version) ([]byte, error) {
+	if err := tree.lockCommit(); err != nil {
+		return nil, err
+	}
+	defer tree.commitMu.Unlock()
+	if version > tree.LatestVersion() {
+		if _, err := tree.commitWithNewVersion(nil, &version); err != nil {
+			return nil, err
+		}
+		_, root := tree.Latest()
+		return root, nil
+	}
+
+	// the setters wait until the redelivered changes are checked and discarded
+	tree.writeMu.Lock()
+	defer tree.writeMu.Unlock()
+	var replayed []byte
+	switch {
+	case version > tree.recentVersion:
+		var err error
+		if replayed, err = tree.stagedRootAt(tree.root, version-1); err != nil {
+			return nil, err
+		}
+	case version == tree.version:
+		// the version before is pruned, so the replayed changes must leave the latest root unchanged
+		replayed = tree.root.Root()
+	default:
+		return nil, ErrVersionTooLow
+	}
+	root := tree.root.RootAt(version)
+	tree.Reset()
+	if !bytes.Equal(replayed, root) {
+		return nil, fmt.Errorf("%w: version %d", ErrVersionConflict, version)
+	}
+	return root, nil
+}
+
+// stagedRootAt returns the root of the node with the staged changes applied on top of the version
+// instead of the latest version: the staged children are hashed again and the others are read at the version.
+func (tree *BNBSparseMerkleTree) stagedRootAt(node *TreeNode, version Version) ([]byte, error) {
+	if node.latestVersionWithLock() <= tree.version {
+		return node.RootAt(version), nil
+	}
+	if node.depth == tree.maxDepth {
+		return node.Root(), nil
+	}
+	spilled, err := tree.loadSpilled(node)
+	if err != nil {
+		return nil, err
+	}
+	if spilled != nil {
+		node = spilled
+	}
+	hashes := make([][]byte, 16)
+	for i := range hashes {
+		hashes[i] = node.nilChildHash
+		if child := node.getChild(i); child != nil {
+			if hashes[i], err = tree.stagedRootAt(child, version); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for len(hashes) > 1 {
+		for i := 0; i < len(hashes)/2; i++ {
+			hashes[i] = tree.hasher.HashChildren(hashes[2*i], hashes[2*i+1])
+		}
+		hashes = hashes[:len(hashes)/2]
+	}
+	return hashes[0], nil
+}
+
+// lockCommit acquires the commit lock, at most the commit timeout if it is positive.
+func (tree *BNBSparseMerkleTree) lockCommit() error {
+	if tree.commitTimeout <= 0 {
+		tree.commitMu.Lock()
+		return nil
+	}
+	if tree.commitMu.TryLock() {
+		return nil
+	}
+	acquired := make(chan struct{})
+	go func() {
+		tree.commitMu.Lock()
+		close(acquired)
+	}()
+	timer := time.NewTimer(tree.commitTimeout)
+	defer timer.Stop()
+	select {
+	case <-acquired:
+		return nil
+	case <-timer.C:
+		// the lock is released as soon as it is acquired by the abandoned attempt
+		go func() {
+			<-acquired
+			tree.commitMu.Unlock()
+		}()
+		return ErrCommitTimeout
+	}
+}
+
 // CommitWithNewVersion commits SMT with specified version.
 func (tree *BNBSparseMerkleTree) CommitWithNewVersion(recentVersion *Version, newVersion *Version) (Version, error) {
+	if err := tree.lockCommit(); err != nil {
+		return tree.LatestVersion(), err
+	}
+	defer tree.commitMu.Unlock()
+	return tree.commitWithNewVersion(recentVersion, newVersion)
+}
+
+// commitWithNewVersion commits the staged changes with commitMu held.
+func (tree *BNBSparseMerkleTree) commitWithNewVersion(recentVersion *Version, newVersion *Version) (Version, error) {
+	if err := tree.checkSealed(); err != nil {
+		return tree.version, err
+	}
+
 	var newVer Version
+	prevVer := tree.version
 	if newVersion == nil {
 		newVer = tree.version + 1
 	} else {
@@ -790,26 +1977,67 @@ func (tree *BNBSparseMerkleTree) CommitWithNewVersion(recentVersion *Version, ne
 	if recentVersion == nil && newVer <= tree.version {
 		return tree.version, ErrVersionTooLow
 	}
+	// the versions referenced by snapshots are retained
+	if recentVersion != nil {
+		retained := tree.snapshots.retain(*recentVersion)
+		// the versions pruned before are never readable again
+		if retained < tree.recentVersion {
+			retained = tree.recentVersion
+		}
+		recentVersion = &retained
+	}
+	// the oldest version readable after the commit
+	oldest := tree.recentVersion
+	if recentVersion != nil {
+		oldest = *recentVersion
+	}
 
 	size := uint64(0)
-	journalSize := tree.journal.len()
-	if tree.db != nil {
+	journalSize := tree.journal.Len()
+	leafCount := int64(tree.leafCount)
+	var subtreeCounts map[journalKey]uint64
+	if tree.subtreeCounts {
+		var err error
+		if subtreeCounts, err = tree.computeSubtreeCounts(); err != nil {
+			return tree.version, err
+		}
+		tree.applySubtreeCountsInMemory(tree.root, subtreeCounts)
+	}
+	if db := tree.storage(); db != nil {
 		// write tree nodes, prune old version
-		batch := tree.db.NewBatch()
-		err := tree.journal.iterate(func(key journalKey, node *TreeNode) error {
+		batch := db.NewBatch()
+		err := tree.journal.Iterate(func(node *TreeNode) error {
+			// skip the nodes that have not been changed since persisted
+			if !node.isDirty() {
+				return nil
+			}
+			if subtreeCounts != nil {
+				tree.applySubtreeCounts(node, subtreeCounts)
+			}
+			leafCount += int64(tree.leafCountDelta(node))
 			changed, err := tree.writeNode(batch, node, newVer, recentVersion)
 			if err != nil {
 				return err
 			}
+			node.clearDirty()
 			size += changed
 			if node.depth == tree.maxDepth { // leaf node
 				tree.dbCache.Add(node.path, node)
+				if err := tree.indexLeaf(batch, node); err != nil {
+					return err
+				}
 			}
 			return nil
 		})
 		if err != nil {
 			return tree.version, err
 		}
+		if err := tree.writeRetainedKeys(batch); err != nil {
+			return tree.version, err
+		}
+		if err := tree.writeClearedPrefixes(batch, oldest); err != nil {
+			return tree.version, err
+		}
 		buf := make([]byte, 8)
 		binary.BigEndian.PutUint64(buf, uint64(newVer))
 		err = batch.Set(latestVersionKey, buf)
@@ -825,6 +2053,15 @@ func (tree *BNBSparseMerkleTree) CommitWithNewVersion(recentVersion *Version, ne
 				return tree.version, err
 			}
 		}
+		// the count is unknown until the leaves are walked if it was never persisted
+		if tree.leafCountKnown {
+			buf = make([]byte, 8)
+			binary.BigEndian.PutUint64(buf, uint64(leafCount))
+			err = batch.Set(leafCountKey(newVer), buf)
+			if err != nil {
+				return tree.version, err
+			}
+		}
 
 		err = batch.Write()
 		if err != nil {
@@ -833,20 +2070,38 @@ func (tree *BNBSparseMerkleTree) CommitWithNewVersion(recentVersion *Version, ne
 		batch.Reset()
 	}
 
-	tree.version = newVer
+	tree.setLatest(newVer, tree.root.Root())
+	tree.leafCount = uint64(leafCount)
 	if recentVersion != nil {
-		tree.recentVersion = *recentVersion
+		tree.setRecent(*recentVersion)
 	}
 	originSize := tree.rootSize
 	currentSize := tree.rootSize + size
 	if releaseVersion := tree.gcStatus.pop(currentSize); releaseVersion > 0 {
-		currentSize = tree.root.Release(releaseVersion)
+		currentSize = tree.release(releaseVersion)
+	}
+	if tree.spillLimit > 0 {
+		if freed := tree.spill(); freed < currentSize {
+			currentSize -= freed
+		} else {
+			currentSize = 0
+		}
 	}
 	tree.gcStatus.add(tree.version, currentSize)
-	tree.journal.flush()
+	if err := tree.journal.Flush(); err != nil {
+		return tree.version, err
+	}
 	tree.lastSaveRoot = tree.root
 	tree.lastSaveRootSize = originSize
 	tree.rootSize = currentSize
+	tree.stagedKeys = nil
+	tree.commitClearedPrefixes(oldest)
+	tree.clearPending()
+	// prepare the hot paths for the next batch
+	tree.preload()
+	if err := tree.checkpoint(prevVer); err != nil {
+		return newVer, err
+	}
 
 	if tree.metrics != nil {
 		tree.metrics.CommitNum(journalSize)
@@ -854,61 +2109,93 @@ func (tree *BNBSparseMerkleTree) CommitWithNewVersion(recentVersion *Version, ne
 		tree.metrics.CurrentSize(currentSize)
 		tree.metrics.Version(uint64(tree.version))
 		tree.metrics.PrunedVersion(uint64(tree.recentVersion))
+		stats := tree.Stats()
+		tree.metrics.HydrationHits(stats.HydrationHits)
+		tree.metrics.HydrationMisses(stats.HydrationMisses)
 		tree.collectGCMetrics()
 	}
 
 	return newVer, nil
 }
 
-func (tree *BNBSparseMerkleTree) rollback(child *TreeNode, oldVersion Version, db database.Batcher) (uint64, error) {
+// rollback rolls back the node and its subtree on copies and returns the rolled back node,
+// the nodes without versions newer than oldVersion are shared, so the original tree is left intact.
+func (tree *BNBSparseMerkleTree) rollback(node *TreeNode, oldVersion Version, db database.Batcher) (*TreeNode, uint64, error) {
+	if node.latestVersionWithLock() <= oldVersion {
+		return node, 0, nil
+	}
 	// remove value nodes
+	child := node.Copy()
 	next, changed := child.Rollback(oldVersion)
 	if !next {
-		return changed, nil
+		return node, changed, nil
+	}
+	if err := tree.deleteStaleKey(db, child, node.latestVersionWithLock()); err != nil {
+		return node, changed, err
 	}
 
 	// re-cache the rollback node
 	if child.depth == tree.maxDepth && tree.dbCache.Contains(child.path) {
 		tree.dbCache.Add(child.path, child)
 	}
+	if child.depth == tree.maxDepth {
+		if err := tree.indexLeaf(db, child); err != nil {
+			return node, changed, err
+		}
+	}
 
+	dirty := false
 	for nibble, subChild := range child.Children {
 		if subChild != nil {
 			subDepth := child.depth + 4
 			err := tree.extendNode(child, uint64(nibble), subChild.path, subDepth, false)
 			if err != nil {
-				return changed, err
+				return node, changed, err
 			}
 
-			subChanged, err := tree.rollback(child.Children[nibble], oldVersion, db)
+			rolledBack, subChanged, err := tree.rollback(child.Children[nibble], oldVersion, db)
 			if err != nil {
-				return changed, err
+				return node, changed, err
 			}
+			child.Children[nibble] = rolledBack
 			changed += subChanged
+			if rolledBack.isDirty() {
+				dirty = true
+				rolledBack.clearDirty()
+			}
 		}
+	}
+	// the internal hashes only need to be recomputed when any child is rolled back
+	if dirty {
 		child.ComputeInternalHash()
 	}
 
 	// persist tree
-	rlpBytes, err := rlp.EncodeToBytes(child.ToStorageTreeNode())
+	rlpBytes, err := tree.encodeTreeNode(child)
 	if err != nil {
-		return changed, err
+		return node, changed, err
 	}
-	err = db.Set(storageFullTreeNodeKey(child.depth, child.path), rlpBytes)
+	err = db.Set(tree.nodeKey(child.depth, child.path, child.latestVersion()), rlpBytes)
 	if err != nil {
-		return changed, err
+		return node, changed, err
 	}
 	if db.ValueSize() > tree.batchSizeLimit {
 		if err := db.Write(); err != nil {
-			return changed, err
+			return node, changed, err
 		}
 		db.Reset()
 	}
 
-	return changed, nil
+	return child, changed, nil
 }
 
 func (tree *BNBSparseMerkleTree) Rollback(version Version) error {
+	tree.commitMu.Lock()
+	defer tree.commitMu.Unlock()
+	// checked under commitMu, so a commit, prune or seal that finished while waiting is seen
+	if err := tree.checkSealed(); err != nil {
+		return err
+	}
 	if tree.recentVersion > version {
 		return ErrVersionTooOld
 	}
@@ -917,17 +2204,27 @@ func (tree *BNBSparseMerkleTree) Rollback(version Version) error {
 		return ErrVersionTooHigh
 	}
 
+	atomic.AddUint64(&tree.rollbacks, 1)
+	// the proofs are served from the root before the rollback until the rolled back root is switched in
+	pinned := tree.pin()
+	defer tree.unpin(pinned)
 	tree.Reset()
+	tree.purgeVersionCache()
 
 	newVersion := version
 	originSize := tree.rootSize
 	size := tree.rootSize
-	if tree.db != nil {
-		batch := tree.db.NewBatch()
-		changed, err := tree.rollback(tree.root, version, batch)
+	if db := tree.storage(); db != nil {
+		batch := db.NewBatch()
+		// the clears after the version are dropped first, so the leaves read after the rollback are not cleared
+		if err := tree.rollbackClearedPrefixes(batch, version); err != nil {
+			return err
+		}
+		root, changed, err := tree.rollback(tree.root, version, batch)
 		if err != nil {
 			return err
 		}
+		root.clearDirty()
 		size -= changed
 		buf := make([]byte, 8)
 		binary.BigEndian.PutUint64(buf, uint64(newVersion))
@@ -941,10 +2238,14 @@ func (tree *BNBSparseMerkleTree) Rollback(version Version) error {
 			return err
 		}
 		batch.Reset()
+		tree.switchRoot(root)
 	}
 
-	tree.version = newVersion
+	tree.setLatest(newVersion, tree.root.Root())
 	tree.rootSize = size
+	if err := tree.resetLeafCount(); err != nil {
+		return err
+	}
 
 	if tree.metrics != nil {
 		tree.metrics.ChangeSize(originSize - size)
@@ -955,6 +2256,28 @@ func (tree *BNBSparseMerkleTree) Rollback(version Version) error {
 	return nil
 }
 
+// release releases the nodes older than the version from memory, the eviction callback
+// is invoked for each archived node after all the node locks are released.
+func (tree *BNBSparseMerkleTree) release(oldestVersion Version) uint64 {
+	if tree.evictionCallback == nil {
+		return tree.root.Release(oldestVersion)
+	}
+	var archived []*TreeNode
+	size := tree.root.release(oldestVersion, &archived)
+	tree.notifyEvicted(archived)
+	return size
+}
+
+// notifyEvicted invokes the eviction callback for the archived nodes, except the nodes deeper than 64 levels
+// of the trees created with WideDepth, whose paths exceed 64 bits.
+func (tree *BNBSparseMerkleTree) notifyEvicted(archived []*TreeNode) {
+	for _, node := range archived {
+		if node.depth <= maxTreeDepth {
+			tree.evictionCallback(uint8(node.depth), node.path.low())
+		}
+	}
+}
+
 func (tree *BNBSparseMerkleTree) collectGCMetrics() {
 	tree.metrics.LatestGCVersion(uint64(tree.gcStatus.latestGCVersion))
 	var gcVersions [10]*metrics.GCVersion
@@ -967,23 +2290,52 @@ func (tree *BNBSparseMerkleTree) collectGCMetrics() {
 	tree.metrics.GCVersions(gcVersions)
 }
 
-func (tree *BNBSparseMerkleTree) recompute(node *TreeNode, journals *journal) {
-	version := node.latestVersion()
-	child := node
-	for child != nil {
-		parentKey := journalKey{depth: child.depth - 4, path: child.path >> 4}
-		parent, exist := journals.get(parentKey)
-		if !exist {
-			return
+// recompute recomputes the hashes of the nodes in the journal bottom-up. The nodes are processed by depth
+// descending then by path, so a parent is only recomputed after all of its changed children, and the children
+// of a parent are recomputed in the order of their paths. Only the children of different parents are
+// recomputed in parallel, so which child completes a parent never depends on the schedule.
+func (tree *BNBSparseMerkleTree) recompute(journals *journal, version Version, parallel bool) {
+	levels := make(map[uint16]map[nodePath][]*TreeNode)
+	_ = journals.iterate(func(key journalKey, node *TreeNode) error {
+		if key.depth == 0 {
+			return nil
 		}
-		// we got child hash now, move to compute parent's hash
-		if !parent.recompute(child, journals, version) {
-			return
+		if levels[key.depth] == nil {
+			levels[key.depth] = make(map[nodePath][]*TreeNode)
 		}
-		if child.depth == 0 {
-			return
-		} else {
-			child = parent
+		parentPath := key.path.rsh(4)
+		levels[key.depth][parentPath] = append(levels[key.depth][parentPath], node)
+		return nil
+	})
+
+	wg := sync.WaitGroup{}
+	for depth := tree.maxDepth; depth > 0; depth -= 4 {
+		parentPaths := make([]nodePath, 0, len(levels[depth]))
+		for path, children := range levels[depth] {
+			sort.Slice(children, func(i, j int) bool {
+				return children[i].path.less(children[j].path)
+			})
+			parentPaths = append(parentPaths, path)
+		}
+		sort.Slice(parentPaths, func(i, j int) bool {
+			return parentPaths[i].less(parentPaths[j])
+		})
+		for _, path := range parentPaths {
+			parent, exist := journals.get(journalKey{depth: depth - 4, path: path})
+			if !exist {
+				continue
+			}
+			children := levels[depth][path]
+			wg.Add(1)
+			tree.run(parallel, func() {
+				defer wg.Done()
+				for _, child := range children {
+					if parent.recompute(child, journals, version) {
+						return
+					}
+				}
+			})
 		}
+		wg.Wait()
 	}
 }
@@ -7,16 +7,28 @@ package bsmt
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
 	"github.com/alicebob/miniredis/v2"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/go-redis/redis/v8"
+	"github.com/panjf2000/ants/v2"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/storage"
 	"hash"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -24,6 +36,8 @@ import (
 	wrappedLevelDB "github.com/bnb-chain/zkbnb-smt/database/leveldb"
 	"github.com/bnb-chain/zkbnb-smt/database/memory"
 	wrappedRedis "github.com/bnb-chain/zkbnb-smt/database/redis"
+	"github.com/bnb-chain/zkbnb-smt/metrics"
+	"github.com/bnb-chain/zkbnb-smt/utils"
 )
 
 var (
@@ -1172,3 +1186,5422 @@ func benchmarkMultiset(b *testing.B, env testEnv, depth uint8, items []Item) {
 		}
 	}
 }
+
+var _ metrics.Metrics = (*testMetrics)(nil)
+
+// testMetrics records the metrics reported by the tree.
+type testMetrics struct {
+	proofSize       int
+	hydrationHits   uint64
+	hydrationMisses uint64
+}
+
+func (m *testMetrics) Version(uint64)                    {}
+func (m *testMetrics) PrunedVersion(uint64)              {}
+func (m *testMetrics) CurrentSize(uint64)                {}
+func (m *testMetrics) ChangeSize(uint64)                 {}
+func (m *testMetrics) CommitNum(int)                     {}
+func (m *testMetrics) LatestGCVersion(uint64)            {}
+func (m *testMetrics) GCThreshold(uint64)                {}
+func (m *testMetrics) GCVersions([10]*metrics.GCVersion) {}
+
+func (m *testMetrics) ProofSize(size int) {
+	m.proofSize = size
+}
+
+func (m *testMetrics) HydrationHits(hits uint64) {
+	m.hydrationHits = hits
+}
+
+func (m *testMetrics) HydrationMisses(misses uint64) {
+	m.hydrationMisses = misses
+}
+
+func Test_BNBSparseMerkleTree_MaxProofSize(t *testing.T) {
+	hasher := NewHasherPool(func() hash.Hash { return sha256.New() })
+	tests := []struct {
+		name     string
+		limit    int
+		expected error
+	}{
+		{
+			name:     "unlimited",
+			limit:    0,
+			expected: nil,
+		},
+		{
+			name:     "within the limit",
+			limit:    8 * 32,
+			expected: nil,
+		},
+		{
+			name:     "exceeds the limit",
+			limit:    8*32 - 1,
+			expected: ErrProofTooLarge,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := &testMetrics{}
+			smt, err := NewBNBSparseMerkleTree(hasher, memory.NewMemoryDB(), 8, nilHash,
+				MaxProofSize(test.limit), EnableMetrics(m))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.NoError(t, smt.Set(1, hasher.Hash([]byte("test1"))))
+			_, err = smt.Commit(nil)
+			assert.NoError(t, err)
+
+			proof, err := smt.GetProof(1)
+			assert.ErrorIs(t, err, test.expected)
+			if test.expected != nil {
+				assert.Nil(t, proof)
+				assert.Equal(t, 0, m.proofSize)
+				return
+			}
+			assert.True(t, smt.VerifyProof(1, proof))
+			assert.Equal(t, 8*32, m.proofSize)
+		})
+	}
+}
+
+func Test_BNBSparseMerkleTree_MaxLeafSize(t *testing.T) {
+	hasher := NewHasherPool(func() hash.Hash { return sha256.New() })
+	tests := []struct {
+		name     string
+		limit    int
+		expected error
+	}{
+		{
+			name:     "unlimited",
+			limit:    0,
+			expected: nil,
+		},
+		{
+			name:     "within the limit",
+			limit:    32,
+			expected: nil,
+		},
+		{
+			name:     "exceeds the limit",
+			limit:    31,
+			expected: ErrLeafTooLarge,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			smt, err := NewBNBSparseMerkleTree(hasher, memory.NewMemoryDB(), 8, nilHash,
+				MaxLeafSize(test.limit))
+			if err != nil {
+				t.Fatal(err)
+			}
+			val := hasher.Hash([]byte("test1"))
+			assert.ErrorIs(t, smt.Set(1, val), test.expected)
+			assert.ErrorIs(t, smt.MultiSet([]Item{{Key: 2, Val: val}}), test.expected)
+			assert.ErrorIs(t, smt.NewBatchWriter().Set(3, val), test.expected)
+			if test.expected != nil {
+				assert.True(t, smt.IsEmpty())
+				return
+			}
+			value, err := smt.Get(1, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, val, value)
+		})
+	}
+}
+
+func Test_BNBSparseMerkleTree_VerifyOnLoad(t *testing.T) {
+	hasher := NewHasherPool(func() hash.Hash { return sha256.New() })
+	key := uint64(0x12)
+	tests := []struct {
+		name    string
+		depth   uint8
+		path    uint64
+		corrupt func(node *StorageTreeNode)
+	}{
+		{
+			name:  "corrupted internal hash",
+			depth: 4,
+			path:  key >> 4,
+			corrupt: func(node *StorageTreeNode) {
+				node.Internals[0] = hasher.Hash([]byte("corrupted"))
+			},
+		},
+		{
+			name:  "corrupted lower internal hash",
+			depth: 4,
+			path:  key >> 4,
+			corrupt: func(node *StorageTreeNode) {
+				// the hash of the children 2 and 3, the leaf and its sibling
+				node.Internals[7] = hasher.Hash([]byte("corrupted"))
+			},
+		},
+		{
+			name:  "corrupted child hash",
+			depth: 4,
+			path:  key >> 4,
+			corrupt: func(node *StorageTreeNode) {
+				// the sibling of the leaf, which is not loaded by the proof
+				versions := node.Children[3].Versions
+				versions[len(versions)-1].Hash = hasher.Hash([]byte("corrupted"))
+			},
+		},
+		{
+			name:  "corrupted leaf",
+			depth: 8,
+			path:  key,
+			corrupt: func(node *StorageTreeNode) {
+				node.Versions[len(node.Versions)-1].Hash = hasher.Hash([]byte("corrupted"))
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := memory.NewMemoryDB()
+			smt, err := NewBNBSparseMerkleTree(hasher, db, 8, nilHash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.NoError(t, smt.Set(key, hasher.Hash([]byte("test1"))))
+			assert.NoError(t, smt.Set(key+1, hasher.Hash([]byte("test2"))))
+			_, err = smt.Commit(nil)
+			assert.NoError(t, err)
+
+			storageKey := storageFullTreeNodeKey(test.depth, test.path)
+			buf, err := db.Get(storageKey)
+			assert.NoError(t, err)
+			storageTreeNode := &StorageTreeNode{}
+			assert.NoError(t, rlp.DecodeBytes(buf, storageTreeNode))
+			test.corrupt(storageTreeNode)
+			buf, err = rlp.EncodeToBytes(storageTreeNode)
+			assert.NoError(t, err)
+			assert.NoError(t, db.Set(storageKey, buf))
+
+			// the corruption goes unnoticed without verification
+			smt, err = NewBNBSparseMerkleTree(hasher, db, 8, nilHash)
+			assert.NoError(t, err)
+			_, err = smt.GetProof(key)
+			assert.NoError(t, err)
+
+			smt, err = NewBNBSparseMerkleTree(hasher, db, 8, nilHash, EnableVerifyOnLoad())
+			assert.NoError(t, err)
+			_, err = smt.GetProof(key)
+			assert.ErrorIs(t, err, ErrNodeMismatched)
+		})
+	}
+}
+
+func Test_BNBSparseMerkleTree_SetIfAbsent(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Logf("test [%s]", env.tag)
+		db, err := env.db()
+		if err != nil {
+			t.Fatal(err)
+		}
+		smt := newSMT(t, env.hasher, db, 8)
+		val1 := env.hasher.Hash([]byte("test1"))
+		val2 := env.hasher.Hash([]byte("test2"))
+
+		inserted, err := smt.SetIfAbsent(1, val1)
+		assert.NoError(t, err)
+		assert.True(t, inserted)
+		inserted, err = smt.SetIfAbsent(1, val2)
+		assert.NoError(t, err)
+		assert.False(t, inserted)
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+
+		inserted, err = smt.SetIfAbsent(1, val2)
+		assert.NoError(t, err)
+		assert.False(t, inserted)
+		val, err := smt.Get(1, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, val1, val)
+
+		var (
+			wg    sync.WaitGroup
+			count int32
+		)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				inserted, err := smt.SetIfAbsent(2, val2)
+				assert.NoError(t, err)
+				if inserted {
+					atomic.AddInt32(&count, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int32(1), count)
+
+		// the setters are serialized with each other, so no concurrent change is lost
+		for i := uint64(0); i < 10; i++ {
+			wg.Add(2)
+			go func(key uint64) {
+				defer wg.Done()
+				assert.NoError(t, smt.Set(key, val1))
+			}(16 + i)
+			go func(key uint64) {
+				defer wg.Done()
+				_, err := smt.SetIfAbsent(key, val2)
+				assert.NoError(t, err)
+			}(32 + i)
+		}
+		wg.Wait()
+		for i := uint64(0); i < 10; i++ {
+			val, err := smt.Get(16+i, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, val1, val)
+			val, err = smt.Get(32+i, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, val2, val)
+		}
+		db.Close()
+	}
+
+	// the latest version is readable while SetIfAbsent waits for storage
+	env := prepareEnv()[0]
+	db := memory.NewMemoryDB()
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+	assert.NoError(t, err)
+	assert.NoError(t, smt.Set(1, env.hasher.Hash([]byte("test1"))))
+	version, err := smt.Commit(nil)
+	assert.NoError(t, err)
+	const delay = 200 * time.Millisecond
+	smt, err = NewBNBSparseMerkleTree(env.hasher, &slowDB{TreeDB: db, delay: delay}, 8, nilHash)
+	assert.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		inserted, err := smt.SetIfAbsent(1, env.hasher.Hash([]byte("test2")))
+		assert.NoError(t, err)
+		assert.False(t, inserted)
+	}()
+	time.Sleep(delay / 4)
+	start := time.Now()
+	assert.Equal(t, version, smt.LatestVersion())
+	assert.Less(t, time.Since(start), delay/4)
+	<-done
+}
+
+func preparePruneTree(t testing.TB, env testEnv, items []Item) *BNBSparseMerkleTree {
+	db, err := env.db()
+	if err != nil {
+		t.Fatal(err)
+	}
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		for j, item := range items {
+			if j%(i+1) != 0 {
+				continue
+			}
+			if err := smt.Set(item.Key, env.hasher.Hash(item.Val, []byte{byte(i)})); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := smt.Commit(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return smt.(*BNBSparseMerkleTree)
+}
+
+func Test_BNBSparseMerkleTree_PruneParallel(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			testPruneParallel(t, env)
+		})
+	}
+}
+
+func testPruneParallel(t *testing.T, env testEnv) {
+	items := prepareKVData(env.hasher)
+	smt1 := preparePruneTree(t, env, items)
+	smt2 := preparePruneTree(t, env, items)
+
+	_, err := smt2.PruneParallel(smt2.LatestVersion() + 1)
+	assert.ErrorIs(t, err, ErrVersionTooHigh)
+
+	sequential := smt1.prune(smt1.root, 5)
+	parallel, err := smt2.PruneParallel(5)
+	assert.NoError(t, err)
+	assert.NotZero(t, parallel)
+	assert.Equal(t, sequential, parallel)
+	assert.Equal(t, smt1.Versions(), smt2.Versions())
+	assert.Equal(t, []Version{5, 6, 7, 8, 9, 10}, smt2.Versions())
+
+	for _, item := range items {
+		leaf1, err := smt1.findLeaf(uint64Path(item.Key))
+		assert.NoError(t, err)
+		leaf2, err := smt2.findLeaf(uint64Path(item.Key))
+		assert.NoError(t, err)
+		assert.Equal(t, leaf1.Versions, leaf2.Versions)
+
+		proof, err := smt2.GetProof(item.Key)
+		assert.NoError(t, err)
+		assert.True(t, smt2.VerifyProof(item.Key, proof))
+	}
+}
+
+func Test_BNBSparseMerkleTree_PruneParallelFloor(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			testPruneParallelFloor(t, env)
+		})
+	}
+}
+
+func testPruneParallelFloor(t *testing.T, env testEnv) {
+	db, err := env.db()
+	assert.NoError(t, err)
+	defer db.Close()
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+	assert.NoError(t, err)
+	for i := 1; i <= 3; i++ {
+		assert.NoError(t, smt.Set(uint64(i), env.hasher.Hash([]byte{byte(i)})))
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+	}
+	root3 := smt.Root()
+	_, err = smt.PruneParallel(3)
+	assert.NoError(t, err)
+	assert.Equal(t, Version(3), smt.RecentVersion())
+
+	// the versions below the pruned floor are not readable
+	_, err = smt.NodeRootAt(0, 0, 1)
+	assert.ErrorIs(t, err, ErrVersionTooOld)
+	_, err = smt.GetProofAt(1, 2)
+	assert.ErrorIs(t, err, ErrVersionTooOld)
+	root, err := smt.NodeRootAt(0, 0, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, root3, root)
+
+	// the floor is not lowered by a later commit and survives reopening
+	assert.NoError(t, smt.Set(4, env.hasher.Hash([]byte{4})))
+	recent := Version(1)
+	_, err = smt.Commit(&recent)
+	assert.NoError(t, err)
+	assert.Equal(t, Version(3), smt.RecentVersion())
+	reopened, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+	assert.NoError(t, err)
+	assert.Equal(t, Version(3), reopened.RecentVersion())
+	_, err = reopened.NodeRootAt(0, 0, 2)
+	assert.ErrorIs(t, err, ErrVersionTooOld)
+}
+
+func Test_BNBSparseMerkleTree_PruneKeepLast(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			testPruneKeepLast(t, env)
+		})
+	}
+}
+
+func testPruneKeepLast(t *testing.T, env testEnv) {
+	db, err := env.db()
+	assert.NoError(t, err)
+	defer db.Close()
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+	assert.NoError(t, err)
+
+	_, err = smt.PruneKeepLast(0)
+	assert.ErrorIs(t, err, ErrInvalidRetention)
+	for i := 1; i <= 200; i++ {
+		assert.NoError(t, smt.Set(uint64(i%4), env.hasher.Hash([]byte{byte(i)})))
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+	}
+	freed, err := smt.PruneKeepLast(300)
+	assert.NoError(t, err)
+	assert.Zero(t, freed)
+	assert.Len(t, smt.Versions(), 200)
+
+	freed, err = smt.PruneKeepLast(100)
+	assert.NoError(t, err)
+	assert.NotZero(t, freed)
+	versions := smt.Versions()
+	assert.Len(t, versions, 100)
+	assert.Equal(t, Version(101), versions[0])
+	assert.Equal(t, Version(200), versions[99])
+
+	// the dropped versions are not readable
+	assert.Equal(t, Version(101), smt.RecentVersion())
+	_, err = smt.NodeRootAt(0, 0, 100)
+	assert.ErrorIs(t, err, ErrVersionTooOld)
+	_, err = smt.GetProofAt(1, 100)
+	assert.ErrorIs(t, err, ErrVersionTooOld)
+	proof, err := smt.GetProofAt(1, 101)
+	assert.NoError(t, err)
+	root, err := smt.NodeRootAt(0, 0, 101)
+	assert.NoError(t, err)
+	item := &ProofItem{Key: 1, Value: env.hasher.Hash([]byte{101}), Root: root, Proof: proof}
+	assert.NoError(t, item.Verify(env.hasher))
+}
+
+func Benchmark_SparseMerkleTree_Prune(b *testing.B) {
+	env := prepareEnv()[0]
+	items := prepareKVData(env.hasher)
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		smt := preparePruneTree(b, env, items)
+		b.StartTimer()
+		smt.prune(smt.root, 5)
+	}
+}
+
+func Benchmark_SparseMerkleTree_PruneParallel(b *testing.B) {
+	env := prepareEnv()[0]
+	items := prepareKVData(env.hasher)
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		smt := preparePruneTree(b, env, items)
+		b.StartTimer()
+		if _, err := smt.PruneParallel(5); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Test_BNBSparseMerkleTree_VersionCache(t *testing.T) {
+	env := prepareEnv()[0]
+	db := &countingDB{TreeDB: memory.NewMemoryDB()}
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash, VersionCache(2))
+	assert.NoError(t, err)
+	reference, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash)
+	assert.NoError(t, err)
+	keys := []uint64{0x0012, 0x1234, 0x8001, 0xfff0}
+	for version := 1; version <= 5; version++ {
+		for _, tree := range []SparseMerkleTree{smt, reference} {
+			for i, key := range keys[:version%len(keys)+1] {
+				assert.NoError(t, tree.Set(key, env.hasher.Hash([]byte{byte(version), byte(i)})))
+			}
+			_, err = tree.Commit(nil)
+			assert.NoError(t, err)
+		}
+	}
+
+	tree := smt.(*BNBSparseMerkleTree)
+	verify := func(version Version) {
+		for _, key := range keys {
+			expected, err := reference.GetProofAt(key, version)
+			assert.NoError(t, err)
+			proof, err := smt.GetProofAt(key, version)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, proof)
+		}
+		expected, err := reference.NodeRootAt(8, 0x12, version)
+		assert.NoError(t, err)
+		root, err := smt.NodeRootAt(8, 0x12, version)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, root)
+	}
+	for _, version := range []Version{1, 2, 3} {
+		verify(version)
+	}
+
+	// the hot versions are served from the cache after the nodes are released from the tree
+	tree.root.Release(tree.version + 1)
+	gets := atomic.LoadInt32(&db.gets)
+	verify(2)
+	verify(3)
+	assert.Equal(t, gets, atomic.LoadInt32(&db.gets))
+	// the cold version is evicted
+	verify(1)
+	assert.Greater(t, atomic.LoadInt32(&db.gets), gets)
+
+	// the cached nodes of the rolled back versions are dropped
+	assert.NoError(t, smt.Rollback(2))
+	assert.NoError(t, reference.Rollback(2))
+	for _, tree := range []SparseMerkleTree{smt, reference} {
+		assert.NoError(t, tree.Set(keys[0], env.hasher.Hash([]byte("new"))))
+		_, err = tree.Commit(nil)
+		assert.NoError(t, err)
+	}
+	verify(3)
+}
+
+func Benchmark_BNBSparseMerkleTree_HistoricalProofs(b *testing.B) {
+	env := prepareEnv()[0]
+	for _, tc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"uncached", nil},
+		{"cached", []Option{VersionCache(4)}},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			smt, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash, tc.opts...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for version := 0; version < 16; version++ {
+				for key := uint64(0); key < 64; key++ {
+					if err := smt.Set(key*1021, env.hasher.Hash([]byte{byte(version), byte(key)})); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if _, err := smt.Commit(nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+			tree := smt.(*BNBSparseMerkleTree)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// the nodes are released between the queries, as under the memory pressure
+				tree.root.Release(tree.version + 1)
+				version := Version(i%4 + 1)
+				for key := uint64(0); key < 64; key++ {
+					if _, err := smt.GetProofAt(key*1021, version); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func Test_BNBSparseMerkleTree_NodeRootAt(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Logf("test [%s]", env.tag)
+		db, err := env.db()
+		if err != nil {
+			t.Fatal(err)
+		}
+		smt := newSMT(t, env.hasher, db, 8).(*BNBSparseMerkleTree)
+
+		assert.NoError(t, smt.Set(0x12, env.hasher.Hash([]byte("test1"))))
+		version1, err := smt.Commit(nil)
+		assert.NoError(t, err)
+		root1 := smt.root.Children[1].Root()
+		assert.NoError(t, smt.Set(0x13, env.hasher.Hash([]byte("test2"))))
+		version2, err := smt.Commit(nil)
+		assert.NoError(t, err)
+		root2 := smt.root.Children[1].Root()
+		assert.NoError(t, smt.Set(0xf0, env.hasher.Hash([]byte("test3"))))
+		version3, err := smt.Commit(nil)
+		assert.NoError(t, err)
+
+		// release the subtree of path 1 from memory
+		smt.root.Release(version3)
+		assert.True(t, smt.root.Children[1].IsTemporary())
+
+		hash, err := smt.NodeRootAt(4, 1, version1)
+		assert.NoError(t, err)
+		assert.Equal(t, root1, hash)
+		hash, err = smt.NodeRootAt(4, 1, version3)
+		assert.NoError(t, err)
+		assert.Equal(t, root2, hash)
+		hash, err = smt.NodeRootAt(8, 0x13, version1)
+		assert.NoError(t, err)
+		assert.Equal(t, smt.nilHashes.Get(8), hash)
+		hash, err = smt.NodeRootAt(8, 0x13, version2)
+		assert.NoError(t, err)
+		assert.Equal(t, env.hasher.Hash([]byte("test2")), hash)
+		hash, err = smt.NodeRootAt(4, 2, version3)
+		assert.NoError(t, err)
+		assert.Equal(t, smt.nilHashes.Get(4), hash)
+		hash, err = smt.NodeRootAt(0, 0, version3)
+		assert.NoError(t, err)
+		assert.Equal(t, smt.Root(), hash)
+
+		_, err = smt.NodeRootAt(5, 1, version1)
+		assert.ErrorIs(t, err, ErrInvalidDepth)
+		_, err = smt.NodeRootAt(4, 16, version1)
+		assert.ErrorIs(t, err, ErrInvalidKey)
+		_, err = smt.NodeRootAt(4, 1, version3+1)
+		assert.ErrorIs(t, err, ErrVersionTooHigh)
+		db.Close()
+	}
+}
+
+func Test_BNBSparseMerkleTree_ExhaustedPool(t *testing.T) {
+	env := prepareEnv()[0]
+	items := prepareKVData(env.hasher)
+
+	overloaded, err := ants.NewPool(1, ants.WithNonblocking(true))
+	assert.NoError(t, err)
+	defer overloaded.Release()
+	released, err := ants.NewPool(1)
+	assert.NoError(t, err)
+	released.Release()
+
+	for _, pool := range []*ants.Pool{overloaded, released} {
+		smt1, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 8, nilHash,
+			GoRoutinePool(pool))
+		assert.NoError(t, err)
+		smt2 := newSMT(t, env.hasher, memory.NewMemoryDB(), 8)
+
+		done := make(chan error)
+		go func() {
+			if err := smt1.MultiSet(items); err != nil {
+				done <- err
+				return
+			}
+			_, err := smt1.Commit(nil)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("commit with an exhausted pool hangs")
+		}
+
+		for _, item := range items {
+			assert.NoError(t, smt2.Set(item.Key, item.Val))
+		}
+		_, err = smt2.Commit(nil)
+		assert.NoError(t, err)
+		verifyItems(t, smt1, smt2, items)
+	}
+}
+
+func Test_BNBSparseMerkleTree_ValueCompression(t *testing.T) {
+	hasher := NewHasherPool(func() hash.Hash { return sha256.New() })
+	items := []Item{
+		{1, bytes.Repeat([]byte("large value"), 100)},
+		{2, hasher.Hash([]byte("small value"))},
+		{0x31, bytes.Repeat([]byte("another large value"), 100)},
+	}
+
+	storedSizes := func(opts ...Option) (database.TreeDB, []int) {
+		db := memory.NewMemoryDB()
+		smt, err := NewBNBSparseMerkleTree(hasher, db, 8, nilHash, opts...)
+		assert.NoError(t, err)
+		assert.NoError(t, smt.MultiSet(items))
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+
+		var sizes []int
+		for _, item := range items {
+			buf, err := db.Get(storageFullTreeNodeKey(8, item.Key))
+			assert.NoError(t, err)
+			sizes = append(sizes, len(buf))
+		}
+		return db, sizes
+	}
+
+	_, rawSizes := storedSizes()
+	db, compressedSizes := storedSizes(ValueCompression(SnappyCompressor{}, 64))
+	assert.Less(t, compressedSizes[0], rawSizes[0])
+	assert.Equal(t, compressedSizes[1], rawSizes[1])
+	assert.Less(t, compressedSizes[2], rawSizes[2])
+
+	// the values are decompressed transparently when reading from storage
+	smt1, err := NewBNBSparseMerkleTree(hasher, db, 8, nilHash, ValueCompression(SnappyCompressor{}, 64))
+	assert.NoError(t, err)
+	smt2, err := NewBNBSparseMerkleTree(hasher, memory.NewMemoryDB(), 8, nilHash)
+	assert.NoError(t, err)
+	assert.NoError(t, smt2.MultiSet(items))
+	_, err = smt2.Commit(nil)
+	assert.NoError(t, err)
+	verifyItems(t, smt1, smt2, items)
+
+	smt3, err := NewBNBSparseMerkleTree(hasher, db, 8, nilHash)
+	assert.NoError(t, err)
+	_, err = smt3.Get(1, nil)
+	assert.ErrorIs(t, err, ErrNoCompressor)
+}
+
+func Test_BNBSparseMerkleTree_Snapshot(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Logf("test [%s]", env.tag)
+		db, err := env.db()
+		if err != nil {
+			t.Fatal(err)
+		}
+		smt := newSMT(t, env.hasher, db, 8)
+		val1 := env.hasher.Hash([]byte("test1"))
+		val2 := env.hasher.Hash([]byte("test2"))
+
+		assert.NoError(t, smt.Set(1, val1))
+		version1, err := smt.Commit(nil)
+		assert.NoError(t, err)
+		root1 := smt.Root()
+		snapshot, err := smt.SnapshotAt(version1)
+		assert.NoError(t, err)
+
+		assert.NoError(t, smt.Set(1, val2))
+		version2, err := smt.Commit(nil)
+		assert.NoError(t, err)
+		assert.NoError(t, smt.Set(2, val2))
+		_, err = smt.Commit(&version2)
+		assert.NoError(t, err)
+
+		// the version of the snapshot is retained
+		assert.Equal(t, version1, smt.RecentVersion())
+		assert.Contains(t, smt.Versions(), version1)
+		val, err := snapshot.Get(1)
+		assert.NoError(t, err)
+		assert.Equal(t, val1, val)
+		root, err := snapshot.Root()
+		assert.NoError(t, err)
+		assert.Equal(t, root1, root)
+
+		snapshot.Close()
+		snapshot.Close()
+		assert.NoError(t, smt.Set(3, val2))
+		version4, err := smt.Commit(&version2)
+		assert.NoError(t, err)
+		assert.Equal(t, version2, smt.RecentVersion())
+		assert.NotContains(t, smt.Versions(), version1)
+		_, err = smt.Get(1, &version1)
+		assert.ErrorIs(t, err, ErrVersionTooOld)
+
+		_, err = smt.SnapshotAt(version1)
+		assert.ErrorIs(t, err, ErrVersionTooOld)
+		_, err = smt.SnapshotAt(version4 + 1)
+		assert.ErrorIs(t, err, ErrVersionTooHigh)
+		db.Close()
+	}
+}
+
+// countingHash counts the hashes computed.
+type countingHash struct {
+	hash.Hash
+	count *int64
+}
+
+func (h *countingHash) Sum(b []byte) []byte {
+	atomic.AddInt64(h.count, 1)
+	return h.Hash.Sum(b)
+}
+
+func Test_BNBSparseMerkleTree_DirtyTracking(t *testing.T) {
+	var count int64
+	hasher := NewHasherPool(func() hash.Hash {
+		return &countingHash{Hash: sha256.New(), count: &count}
+	})
+	smt, err := NewBNBSparseMerkleTree(hasher, memory.NewMemoryDB(), 16, nilHash)
+	assert.NoError(t, err)
+	items := make([]Item, 0, 2000)
+	for i := uint64(0); i < 2000; i++ {
+		items = append(items, Item{Key: i * 31, Val: hasher.Hash([]byte{byte(i), byte(i >> 8)})})
+	}
+	assert.NoError(t, smt.MultiSet(items))
+	version1, err := smt.Commit(nil)
+	assert.NoError(t, err)
+	root1 := smt.Root()
+
+	// only the nodes on the path of the key are recomputed, 4 hashes for each level
+	changed := hasher.Hash([]byte("changed"))
+	atomic.StoreInt64(&count, 0)
+	assert.NoError(t, smt.Set(items[0].Key, changed))
+	assert.Equal(t, int64(4*4), atomic.LoadInt64(&count))
+	atomic.StoreInt64(&count, 0)
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+	assert.Zero(t, atomic.LoadInt64(&count))
+
+	// clean subtrees are skipped when rolling back, 14 internal hashes for each level
+	atomic.StoreInt64(&count, 0)
+	assert.NoError(t, smt.Rollback(version1))
+	assert.Equal(t, int64(4*14), atomic.LoadInt64(&count))
+	assert.Equal(t, root1, smt.Root())
+	for _, item := range items[:10] {
+		proof, err := smt.GetProof(item.Key)
+		assert.NoError(t, err)
+		assert.True(t, smt.VerifyProof(item.Key, proof))
+	}
+}
+
+func Benchmark_SparseMerkleTree_CommitFewChanges(b *testing.B) {
+	env := prepareEnv()[0]
+	smt, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash)
+	if err != nil {
+		b.Fatal(err)
+	}
+	items := make([]Item, 0, 10000)
+	for i := uint64(0); i < 10000; i++ {
+		items = append(items, Item{Key: i * 6, Val: env.hasher.Hash([]byte{byte(i), byte(i >> 8)})})
+	}
+	if err := smt.MultiSet(items); err != nil {
+		b.Fatal(err)
+	}
+	if _, err := smt.Commit(nil); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := smt.Set(items[i%len(items)].Key, env.hasher.Hash([]byte{byte(i)})); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := smt.Commit(nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Test_BNBSparseMerkleTree_ExtractSubtree(t *testing.T) {
+	env := prepareEnv()[0]
+	smt, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash)
+	assert.NoError(t, err)
+	tree := smt.(*BNBSparseMerkleTree)
+
+	var items []Item
+	for i := uint64(0); i < 100; i++ {
+		items = append(items, Item{Key: i * 197, Val: env.hasher.Hash([]byte{byte(i)})})
+	}
+	assert.NoError(t, smt.MultiSet(items))
+	version1, err := smt.Commit(nil)
+	assert.NoError(t, err)
+	assert.NoError(t, smt.Set(0x3001, env.hasher.Hash([]byte("changed"))))
+	version2, err := smt.Commit(nil)
+	assert.NoError(t, err)
+
+	for _, version := range []Version{version1, version2} {
+		subtree, err := tree.ExtractSubtree(0x3, 4, version)
+		assert.NoError(t, err)
+		expected, err := tree.NodeRootAt(4, 0x3, version)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, subtree.Root())
+
+		for _, item := range items {
+			if item.Key>>12 != 0x3 {
+				continue
+			}
+			val, err := smt.Get(item.Key, &version)
+			assert.NoError(t, err)
+			subVal, err := subtree.Get(item.Key&0xfff, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, val, subVal)
+			proof, err := subtree.GetProof(item.Key & 0xfff)
+			assert.NoError(t, err)
+			assert.True(t, subtree.VerifyProof(item.Key&0xfff, proof))
+		}
+	}
+
+	subtree, err := tree.ExtractSubtree(0x3a, 8, version2)
+	assert.NoError(t, err)
+	expected, err := tree.NodeRootAt(8, 0x3a, version2)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, subtree.Root())
+
+	// empty subtree
+	subtree, err = tree.ExtractSubtree(0xff, 8, version2)
+	assert.NoError(t, err)
+	assert.True(t, subtree.IsEmpty())
+
+	_, err = tree.ExtractSubtree(0x3, 3, version2)
+	assert.ErrorIs(t, err, ErrInvalidDepth)
+	_, err = tree.ExtractSubtree(0x10, 4, version2)
+	assert.ErrorIs(t, err, ErrInvalidKey)
+}
+
+func Test_MergeTrees(t *testing.T) {
+	env := prepareEnv()[0]
+	full, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash)
+	assert.NoError(t, err)
+
+	subtrees := make(map[uint64]*BNBSparseMerkleTree)
+	for _, prefix := range []uint64{0x3, 0xa} {
+		subtree, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 12, nilHash)
+		assert.NoError(t, err)
+		for i := uint64(0); i < 50; i++ {
+			key := i * 79 % (1 << 12)
+			val := env.hasher.Hash([]byte{byte(prefix), byte(i)})
+			assert.NoError(t, subtree.Set(key, val))
+			assert.NoError(t, full.Set(prefix<<12|key, val))
+		}
+		_, err = subtree.Commit(nil)
+		assert.NoError(t, err)
+		subtrees[prefix] = subtree.(*BNBSparseMerkleTree)
+	}
+	_, err = full.Commit(nil)
+	assert.NoError(t, err)
+
+	merged, err := MergeTrees(subtrees, 16, env.hasher)
+	assert.NoError(t, err)
+	assert.Equal(t, full.Root(), merged.Root())
+	for _, key := range []uint64{0x3000, 0x304f, 0xa09e} {
+		proof, err := merged.GetProof(key)
+		assert.NoError(t, err)
+		assert.True(t, merged.VerifyProof(key, proof))
+	}
+	// the merged subtree is extracted as it is
+	extracted, err := merged.ExtractSubtree(0xa, 4, merged.LatestVersion())
+	assert.NoError(t, err)
+	assert.Equal(t, subtrees[0xa].Root(), extracted.Root())
+
+	otherNilHash, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 12, env.hasher.Hash([]byte("nil")))
+	assert.NoError(t, err)
+	shallow, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 8, nilHash)
+	assert.NoError(t, err)
+	tests := []struct {
+		name     string
+		subtrees map[uint64]*BNBSparseMerkleTree
+		depth    uint8
+		expected error
+	}{
+		{
+			name:     "different nil hash",
+			subtrees: map[uint64]*BNBSparseMerkleTree{0x3: subtrees[0x3], 0x4: otherNilHash.(*BNBSparseMerkleTree)},
+			depth:    16,
+			expected: ErrIncompatibleTrees,
+		},
+		{
+			name:     "different depth",
+			subtrees: map[uint64]*BNBSparseMerkleTree{0x3: subtrees[0x3], 0x40: shallow.(*BNBSparseMerkleTree)},
+			depth:    16,
+			expected: ErrIncompatibleTrees,
+		},
+		{
+			name:     "prefix out of range",
+			subtrees: map[uint64]*BNBSparseMerkleTree{0x13: subtrees[0x3]},
+			depth:    16,
+			expected: ErrInvalidKey,
+		},
+		{
+			name:     "subtree not shallower",
+			subtrees: map[uint64]*BNBSparseMerkleTree{0: subtrees[0x3]},
+			depth:    12,
+			expected: ErrInvalidDepth,
+		},
+		{
+			name:     "no subtrees",
+			depth:    16,
+			expected: ErrIncompatibleTrees,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := MergeTrees(test.subtrees, test.depth, env.hasher)
+			assert.ErrorIs(t, err, test.expected)
+		})
+	}
+}
+
+func Test_BNBSparseMerkleTree_SpillJournal(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			testSpillJournal(t, env)
+		})
+	}
+}
+
+func testSpillJournal(t *testing.T, env testEnv) {
+	const threshold = 16
+	spillDB, err := env.db()
+	assert.NoError(t, err)
+	defer spillDB.Close()
+	db, err := env.db()
+	assert.NoError(t, err)
+	defer db.Close()
+	smt1, err := NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash, SpillJournal(spillDB, threshold))
+	assert.NoError(t, err)
+	smt2, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash)
+	assert.NoError(t, err)
+
+	var items []Item
+	for i := uint64(0); i < 300; i++ {
+		items = append(items, Item{Key: i * 211, Val: env.hasher.Hash([]byte{byte(i), byte(i >> 8)})})
+	}
+	for _, smt := range []SparseMerkleTree{smt1, smt2} {
+		assert.NoError(t, smt.MultiSet(items[:200]))
+		for _, item := range items[200:] {
+			assert.NoError(t, smt.Set(item.Key, item.Val))
+		}
+	}
+
+	journal := smt1.(*BNBSparseMerkleTree).journal.(*spillJournal)
+	assert.Greater(t, journal.Len(), threshold)
+	assert.NotEmpty(t, journal.spilled)
+	var spilledKey journalKey
+	for key := range journal.spilled {
+		spilledKey = key
+		break
+	}
+
+	// the journal retains at most threshold nodes, and the tree links the spilled ones as placeholders
+	var journaled uint64
+	assert.NoError(t, smt2.(*BNBSparseMerkleTree).journal.Iterate(func(node *TreeNode) error {
+		journaled += node.Size()
+		return nil
+	}))
+	assert.Len(t, journal.memory, threshold)
+	assert.Less(t, journal.retainedSize(), journaled/4)
+	assert.Less(t, residentSize(smt1.(*BNBSparseMerkleTree).root), residentSize(smt2.(*BNBSparseMerkleTree).root)/4)
+	assert.Equal(t, smt2.Root(), smt1.Root())
+
+	// the spilled nodes are decoded from the journal when they are read or changed again
+	for i := 0; i < len(items); i += 5 {
+		val, err := smt1.Get(items[i].Key, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, items[i].Val, val)
+		proof, err := smt1.GetProof(items[i].Key)
+		assert.NoError(t, err)
+		assert.True(t, smt1.VerifyProof(items[i].Key, proof))
+	}
+	for _, smt := range []SparseMerkleTree{smt1, smt2} {
+		for i := 1; i < len(items); i += 5 {
+			assert.NoError(t, smt.Set(items[i].Key, env.hasher.Hash([]byte("again"))))
+		}
+		assert.NoError(t, smt.MultiSet([]Item{{Key: items[2].Key, Val: env.hasher.Hash([]byte("multi"))}}))
+	}
+	assert.Equal(t, smt2.Root(), smt1.Root())
+	assert.Less(t, residentSize(smt1.(*BNBSparseMerkleTree).root), residentSize(smt2.(*BNBSparseMerkleTree).root)/2)
+
+	version1, err := smt1.Commit(nil)
+	assert.NoError(t, err)
+	version2, err := smt2.Commit(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, version2, version1)
+	assert.Equal(t, smt2.Root(), smt1.Root())
+	assert.Equal(t, 0, journal.Len())
+	_, err = spillDB.Get(spillJournalKey(spilledKey.depth, spilledKey.path))
+	assert.ErrorIs(t, err, database.ErrDatabaseNotFound)
+
+	// the spilled nodes are persisted as the nodes in memory
+	for _, smt := range []SparseMerkleTree{smt1, smt2} {
+		for i := 0; i < len(items); i += 3 {
+			assert.NoError(t, smt.Set(items[i].Key, env.hasher.Hash(items[i].Val)))
+		}
+		_, err = smt.Commit(&version1)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, smt2.Root(), smt1.Root())
+
+	reloaded, err := NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash)
+	assert.NoError(t, err)
+	assert.Equal(t, smt2.Root(), reloaded.Root())
+	for _, item := range items {
+		val1, err := reloaded.Get(item.Key, nil)
+		assert.NoError(t, err)
+		val2, err := smt2.Get(item.Key, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, val2, val1)
+		proof, err := reloaded.GetProof(item.Key)
+		assert.NoError(t, err)
+		assert.True(t, reloaded.VerifyProof(item.Key, proof))
+	}
+}
+
+func Test_BNBSparseMerkleTree_Fingerprint(t *testing.T) {
+	hasher := NewHasherPool(func() hash.Hash { return sha256.New() })
+	newTree := func(hasher *Hasher, depth uint8, nilHash []byte) SparseMerkleTree {
+		smt, err := NewBNBSparseMerkleTree(hasher, memory.NewMemoryDB(), depth, nilHash)
+		assert.NoError(t, err)
+		return smt
+	}
+
+	smt := newTree(hasher, 8, nilHash)
+	assert.NoError(t, smt.Set(1, hasher.Hash([]byte("val"))))
+	_, err := smt.Commit(nil)
+	assert.NoError(t, err)
+
+	// the fingerprint only depends on the configuration
+	assert.Equal(t, smt.Fingerprint(), newTree(hasher, 8, nilHash).Fingerprint())
+	sameHasher := NewHasherPool(func() hash.Hash { return sha256.New() })
+	assert.Equal(t, smt.Fingerprint(), newTree(sameHasher, 8, nilHash).Fingerprint())
+	tree := smt.(*BNBSparseMerkleTree)
+	custom, err := NewSparseMerkleTree(hasher, memory.NewMemoryDB(), 8, tree.nilHashes.hashes)
+	assert.NoError(t, err)
+	assert.Equal(t, smt.Fingerprint(), custom.Fingerprint())
+
+	fingerprints := map[string]struct{}{smt.Fingerprint(): {}}
+	for _, other := range []SparseMerkleTree{
+		newTree(hasher, 16, nilHash),
+		newTree(hasher, 8, hasher.Hash(nilHash)),
+		newTree(NewHasherPool(func() hash.Hash { return sha512.New() }), 8, nilHash),
+	} {
+		fingerprints[other.Fingerprint()] = struct{}{}
+	}
+	assert.Len(t, fingerprints, 4)
+}
+
+func Test_BNBSparseMerkleTree_Latest(t *testing.T) {
+	env := prepareEnv()[0]
+	smt, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 8, nilHash)
+	assert.NoError(t, err)
+	version, root := smt.Latest()
+	assert.Equal(t, Version(0), version)
+	assert.Equal(t, smt.Root(), root)
+
+	var roots sync.Map
+	roots.Store(version, root)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if err := smt.Set(uint64(i), env.hasher.Hash([]byte{byte(i)})); err != nil {
+				t.Error(err)
+				return
+			}
+			// the root is recorded before it is committed
+			roots.Store(smt.LatestVersion()+1, smt.Root())
+			if _, err := smt.Commit(nil); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	observed := 0
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		version, root := smt.Latest()
+		expected, exist := roots.Load(version)
+		assert.True(t, exist)
+		assert.Equal(t, expected, root)
+		observed++
+	}
+	assert.Greater(t, observed, 0)
+
+	version, root = smt.Latest()
+	assert.Equal(t, Version(100), version)
+	assert.Equal(t, smt.Root(), root)
+
+	assert.NoError(t, smt.Rollback(50))
+	version, root = smt.Latest()
+	assert.Equal(t, Version(50), version)
+	expected, _ := roots.Load(Version(50))
+	assert.Equal(t, expected, root)
+}
+
+type countingDB struct {
+	database.TreeDB
+	writes int32
+	gets   int32
+}
+
+func (db *countingDB) Get(key []byte) ([]byte, error) {
+	atomic.AddInt32(&db.gets, 1)
+	return db.TreeDB.Get(key)
+}
+
+func (db *countingDB) NewBatch() database.Batcher {
+	return &countingBatch{db.TreeDB.NewBatch(), db}
+}
+
+type countingBatch struct {
+	database.Batcher
+	db *countingDB
+}
+
+func (b *countingBatch) Write() error {
+	atomic.AddInt32(&b.db.writes, 1)
+	return b.Batcher.Write()
+}
+
+func Test_BNBSparseMerkleTree_CommitCoalescing(t *testing.T) {
+	env := prepareEnv()[0]
+	db := &countingDB{TreeDB: memory.NewMemoryDB()}
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash, CommitCoalescing(100*time.Millisecond))
+	assert.NoError(t, err)
+
+	const commits = 5
+	var (
+		wg       sync.WaitGroup
+		versions [commits]Version
+	)
+	for i := 0; i < commits; i++ {
+		assert.NoError(t, smt.Set(uint64(i), env.hasher.Hash([]byte{byte(i)})))
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			version, err := smt.Commit(nil)
+			assert.NoError(t, err)
+			versions[i] = version
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&db.writes))
+	for _, version := range versions {
+		assert.Equal(t, Version(1), version)
+	}
+	reloaded, err := NewBNBSparseMerkleTree(env.hasher, db.TreeDB, 8, nilHash)
+	assert.NoError(t, err)
+	assert.Equal(t, Version(1), reloaded.LatestVersion())
+	assert.Equal(t, smt.Root(), reloaded.Root())
+
+	// the commits after the window are not coalesced
+	assert.NoError(t, smt.Set(10, env.hasher.Hash([]byte("val"))))
+	version, err := smt.Commit(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, Version(2), version)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&db.writes))
+}
+
+func Test_BNBSparseMerkleTree_DeleteLastLeaf(t *testing.T) {
+	env := prepareEnv()[0]
+	items := []Item{
+		{0x1234, env.hasher.Hash([]byte("val1"))},
+		{0x1235, env.hasher.Hash([]byte("val2"))},
+		{0x8000, env.hasher.Hash([]byte("val3"))},
+	}
+	expected, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash)
+	assert.NoError(t, err)
+	assert.NoError(t, expected.Set(items[2].Key, items[2].Val))
+
+	for _, batch := range []bool{false, true} {
+		smt, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash)
+		assert.NoError(t, err)
+		tree := smt.(*BNBSparseMerkleTree)
+		assert.NoError(t, smt.MultiSet(items))
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+
+		// clear the only leaves of the subtree 0x123
+		deleted := []Item{
+			{items[0].Key, tree.nilHashes.Get(16)},
+			{items[1].Key, tree.nilHashes.Get(16)},
+		}
+		if batch {
+			assert.NoError(t, smt.MultiSet(deleted))
+		} else {
+			for _, item := range deleted {
+				assert.NoError(t, smt.Set(item.Key, item.Val))
+			}
+		}
+		version, err := smt.Commit(nil)
+		assert.NoError(t, err)
+		for _, depth := range []uint8{4, 8, 12} {
+			root, err := tree.NodeRootAt(depth, items[0].Key>>(16-depth), version)
+			assert.NoError(t, err)
+			assert.Equalf(t, tree.nilHashes.Get(uint16(depth)), root, "depth %d", depth)
+		}
+		assert.Equal(t, expected.Root(), smt.Root())
+
+		assert.NoError(t, smt.MultiSet([]Item{{items[2].Key, tree.nilHashes.Get(16)}}))
+		assert.True(t, smt.IsEmpty())
+	}
+}
+
+func Test_BNBSparseMerkleTree_SiblingAt(t *testing.T) {
+	env := prepareEnv()[0]
+	smt, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash)
+	assert.NoError(t, err)
+	var items []Item
+	for i := uint64(0); i < 50; i++ {
+		items = append(items, Item{Key: i * 1031, Val: env.hasher.Hash([]byte{byte(i)})})
+	}
+	assert.NoError(t, smt.MultiSet(items))
+	version1, err := smt.Commit(nil)
+	assert.NoError(t, err)
+
+	keys := []uint64{0, 1031, 0x1234, 0xffff}
+	proofs := make([]Proof, len(keys))
+	for i, key := range keys {
+		proofs[i], err = smt.GetProof(key)
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, smt.Set(1, env.hasher.Hash([]byte("changed"))))
+	assert.NoError(t, smt.Set(0xfffe, env.hasher.Hash([]byte("changed"))))
+	version2, err := smt.Commit(nil)
+	assert.NoError(t, err)
+
+	for i, key := range keys {
+		proof, err := smt.GetProof(key)
+		assert.NoError(t, err)
+		for level := uint8(0); level < 16; level++ {
+			sibling, err := smt.SiblingAt(key, level, version2)
+			assert.NoError(t, err)
+			assert.Equalf(t, proof[15-level], sibling, "key %d, level %d", key, level)
+
+			// the siblings of the previous version
+			sibling, err = smt.SiblingAt(key, level, version1)
+			assert.NoError(t, err)
+			assert.Equalf(t, proofs[i][15-level], sibling, "key %d, level %d", key, level)
+		}
+	}
+
+	_, err = smt.SiblingAt(0, 16, version2)
+	assert.ErrorIs(t, err, ErrInvalidDepth)
+	_, err = smt.SiblingAt(0x10000, 0, version2)
+	assert.ErrorIs(t, err, ErrInvalidKey)
+	_, err = smt.SiblingAt(0, 0, version2+1)
+	assert.ErrorIs(t, err, ErrVersionTooHigh)
+}
+
+func Test_BNBSparseMerkleTree_AdaptivePreload(t *testing.T) {
+	env := prepareEnv()[0]
+	var items []Item
+	for i := uint64(0); i < 300; i++ {
+		items = append(items, Item{Key: i * 211, Val: env.hasher.Hash([]byte{byte(i)})})
+	}
+
+	// the batches access 3 groups of keys in turn, the groups not accessed
+	// in the latest 2 batches are released by GC
+	loads := func(opts ...Option) []int32 {
+		db := &countingDB{TreeDB: memory.NewMemoryDB()}
+		smt, err := NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash, append(opts, GCThreshold(10))...)
+		assert.NoError(t, err)
+		assert.NoError(t, smt.MultiSet(items))
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+
+		var loads []int32
+		for round := 0; round < 9; round++ {
+			group := round % 3
+			var batch []Item
+			for i := group * 10; i < group*10+10; i++ {
+				batch = append(batch, Item{Key: items[i*10].Key, Val: env.hasher.Hash([]byte{byte(round), byte(i)})})
+			}
+			before := atomic.LoadInt32(&db.gets)
+			assert.NoError(t, smt.MultiSet(batch))
+			loads = append(loads, atomic.LoadInt32(&db.gets)-before)
+			_, err = smt.Commit(nil)
+			assert.NoError(t, err)
+		}
+		return loads
+	}
+
+	withoutPreload := loads()
+	withPreload := loads(AdaptivePreload(64))
+	// warm up with the first round of each group
+	for round := 3; round < 9; round++ {
+		assert.Greater(t, withoutPreload[round], int32(0))
+		assert.Equal(t, int32(0), withPreload[round])
+	}
+}
+
+func Test_BNBSparseMerkleTree_MarshalState(t *testing.T) {
+	env := prepareEnv()[0]
+	db := memory.NewMemoryDB()
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash)
+	assert.NoError(t, err)
+	var items []Item
+	for i := uint64(0); i < 100; i++ {
+		items = append(items, Item{Key: i * 523, Val: env.hasher.Hash([]byte{byte(i)})})
+	}
+	assert.NoError(t, smt.MultiSet(items[:50]))
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+	assert.NoError(t, smt.MultiSet(items[50:]))
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+	// the uncommitted changes are not included
+	assert.NoError(t, smt.Set(1, env.hasher.Hash([]byte("uncommitted"))))
+
+	state, err := smt.MarshalState()
+	assert.NoError(t, err)
+	size := smt.Size()
+	smt.Reset()
+
+	restored, err := RestoreState(state, db, env.hasher)
+	assert.NoError(t, err)
+	assert.Equal(t, smt.Root(), restored.Root())
+	assert.Equal(t, smt.LatestVersion(), restored.LatestVersion())
+	assert.Equal(t, smt.Versions(), restored.Versions())
+	assert.Equal(t, size, restored.Size())
+	// the nodes are restored in memory rather than loaded from storage
+	root := restored.(*BNBSparseMerkleTree).root
+	assert.False(t, root.Children[items[1].Key>>12].IsTemporary())
+
+	for _, item := range items {
+		expected, err := smt.GetProof(item.Key)
+		assert.NoError(t, err)
+		proof, err := restored.GetProof(item.Key)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, proof)
+		assert.True(t, restored.VerifyProof(item.Key, proof))
+	}
+
+	// the restored tree keeps working
+	for _, tree := range []SparseMerkleTree{smt, restored} {
+		assert.NoError(t, tree.Set(2, env.hasher.Hash([]byte("val"))))
+	}
+	assert.Equal(t, smt.Root(), restored.Root())
+
+	hasher := NewHasherPool(func() hash.Hash { return sha512.New() })
+	_, err = RestoreState(state, memory.NewMemoryDB(), hasher)
+	assert.ErrorIs(t, err, ErrStateMismatched)
+}
+
+func Test_BNBSparseMerkleTree_GetProofAt(t *testing.T) {
+	env := prepareEnv()[0]
+	smt, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash)
+	assert.NoError(t, err)
+	tree := smt.(*BNBSparseMerkleTree)
+	key := uint64(0x1234)
+	val := env.hasher.Hash([]byte("val"))
+	for version := Version(1); version <= 10; version++ {
+		assert.NoError(t, smt.Set(uint64(version)*0x1000+1, env.hasher.Hash([]byte{byte(version)})))
+		if version == 10 {
+			assert.NoError(t, smt.Set(key, val))
+		}
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+	}
+
+	verify := func(key uint64, leaf []byte, proof Proof, version Version) bool {
+		verifier := NewProofVerifier(env.hasher)
+		verifier.Init(leaf, key, 16)
+		for _, sibling := range proof {
+			assert.NoError(t, verifier.Feed(sibling))
+		}
+		root, err := smt.NodeRootAt(0, 0, version)
+		assert.NoError(t, err)
+		return bytes.Equal(root, verifier.Root())
+	}
+
+	// the key is absent at version 5
+	proof, err := smt.GetProofAt(key, 5)
+	assert.NoError(t, err)
+	assert.True(t, verify(key, tree.nilHashes.Get(16), proof, 5))
+	assert.False(t, verify(key, val, proof, 5))
+	assert.False(t, verify(key, tree.nilHashes.Get(16), proof, 10))
+
+	// the key is present at version 10
+	proof, err = smt.GetProofAt(key, 10)
+	assert.NoError(t, err)
+	assert.True(t, verify(key, val, proof, 10))
+	expected, err := smt.GetProof(key)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, proof)
+
+	// the key in an empty subtree at the version
+	proof, err = smt.GetProofAt(0x9001, 5)
+	assert.NoError(t, err)
+	assert.True(t, verify(0x9001, tree.nilHashes.Get(16), proof, 5))
+
+	_, err = smt.GetProofAt(key, 11)
+	assert.ErrorIs(t, err, ErrVersionTooHigh)
+}
+
+func Test_BNBSparseMerkleTree_GetProofAtWhilePruning(t *testing.T) {
+	env := prepareEnv()[0]
+	smt, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash)
+	assert.NoError(t, err)
+	const versions = 40
+	keys := []uint64{0x0001, 0x1234, 0x1235, 0x8000, 0xffff}
+	value := func(version Version, i int) []byte {
+		return env.hasher.Hash([]byte{byte(version), byte(i)})
+	}
+	roots := make(map[Version][]byte, versions)
+	for version := Version(1); version <= versions; version++ {
+		for i, key := range keys {
+			assert.NoError(t, smt.Set(key, value(version, i)))
+		}
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+		roots[version] = smt.Root()
+	}
+
+	var (
+		wg       sync.WaitGroup
+		verified int64
+	)
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for n := 0; n < 200; n++ {
+				version := Version(versions - (n*7+g)%versions)
+				i := (n + g) % len(keys)
+				proof, err := smt.GetProofAt(keys[i], version)
+				if errors.Is(err, ErrVersionTooOld) {
+					continue
+				}
+				if !assert.NoError(t, err) {
+					return
+				}
+				item := &ProofItem{Key: keys[i], Value: value(version, i), Root: roots[version], Proof: proof}
+				assert.NoError(t, item.Verify(env.hasher), "version %d, key %d", version, keys[i])
+				atomic.AddInt64(&verified, 1)
+			}
+		}(g)
+	}
+	for version := Version(1); version < versions; version++ {
+		_, err := smt.PruneParallel(version)
+		assert.NoError(t, err)
+	}
+	wg.Wait()
+	assert.Greater(t, verified, int64(0))
+
+	// the pruned versions are rejected instead of walked
+	_, err = smt.GetProofAt(keys[0], 1)
+	assert.ErrorIs(t, err, ErrVersionTooOld)
+	proof, err := smt.GetProofAt(keys[0], versions)
+	assert.NoError(t, err)
+	assert.True(t, smt.VerifyProof(keys[0], proof))
+}
+
+func Test_BNBSparseMerkleTree_GetPartialProof(t *testing.T) {
+	env := prepareEnv()[0]
+	smt, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash)
+	assert.NoError(t, err)
+	key := uint64(0x1234)
+	val := env.hasher.Hash([]byte("val"))
+	for version := Version(1); version <= 3; version++ {
+		assert.NoError(t, smt.Set(uint64(version)*0x1000+1, env.hasher.Hash([]byte{byte(version)})))
+		if version == 3 {
+			assert.NoError(t, smt.Set(key, val))
+		}
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+	}
+
+	for _, version := range []Version{2, 3} {
+		for _, stopDepth := range []uint8{0, 4, 8, 12, 16} {
+			subtreeRoot, proof, err := smt.GetPartialProof(key, stopDepth, version)
+			assert.NoError(t, err)
+			assert.Len(t, proof, int(stopDepth))
+			expected, err := smt.NodeRootAt(stopDepth, key>>(16-stopDepth), version)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, subtreeRoot)
+
+			ok, err := smt.VerifyPartialProof(key, stopDepth, subtreeRoot, proof, version)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			if stopDepth > 0 {
+				ok, err = smt.VerifyPartialProof(key, stopDepth, env.hasher.Hash([]byte("forged")), proof, version)
+				assert.NoError(t, err)
+				assert.False(t, ok)
+			}
+		}
+	}
+
+	// the partial proof at the depth of the tree is the full proof
+	subtreeRoot, proof, err := smt.GetPartialProof(key, 16, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, val, subtreeRoot)
+	expected, err := smt.GetProofAt(key, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, proof)
+
+	// the proof of a sibling subtree does not verify the subtree of the key
+	_, proof, err = smt.GetPartialProof(key, 8, 3)
+	assert.NoError(t, err)
+	other, err := smt.NodeRootAt(8, key>>8+1, 3)
+	assert.NoError(t, err)
+	ok, err := smt.VerifyPartialProof(key, 8, other, proof, 3)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	_, _, err = smt.GetPartialProof(key, 17, 3)
+	assert.ErrorIs(t, err, ErrInvalidDepth)
+	var mismatch ErrProofLengthMismatch
+	_, err = smt.VerifyPartialProof(key, 8, subtreeRoot, proof[1:], 3)
+	assert.ErrorAs(t, err, &mismatch)
+}
+
+func Test_BNBSparseMerkleTree_GetNonMembershipProof(t *testing.T) {
+	env := prepareEnv()[0]
+	smt, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash)
+	assert.NoError(t, err)
+
+	// the tree is empty
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+	proof, err := smt.GetNonMembershipProof(0x1234, 1)
+	assert.NoError(t, err)
+	assert.Nil(t, proof.Left)
+	assert.Nil(t, proof.Right)
+	assert.NoError(t, proof.Verify(env.hasher, nilHash))
+
+	for _, key := range []uint64{0x0101, 0x1200, 0x12f0, 0x8000} {
+		assert.NoError(t, smt.Set(key, env.hasher.Hash([]byte{byte(key)})))
+	}
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+
+	proof, err = smt.GetNonMembershipProof(0x1234, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0x1200), proof.Left.Key)
+	assert.Equal(t, uint64(0x12f0), proof.Right.Key)
+	assert.Equal(t, smt.Root(), proof.Root)
+	assert.NoError(t, proof.Verify(env.hasher, nilHash))
+
+	// the neighbors are missing at the edges
+	proof, err = smt.GetNonMembershipProof(0x0001, 2)
+	assert.NoError(t, err)
+	assert.Nil(t, proof.Left)
+	assert.NoError(t, proof.Verify(env.hasher, nilHash))
+	proof, err = smt.GetNonMembershipProof(0xffff, 2)
+	assert.NoError(t, err)
+	assert.Nil(t, proof.Right)
+	assert.NoError(t, proof.Verify(env.hasher, nilHash))
+
+	// the proof of the key before it is set still holds at the old version
+	proof, err = smt.GetNonMembershipProof(0x8000, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, proof.Verify(env.hasher, nilHash))
+	_, err = smt.GetNonMembershipProof(0x8000, 2)
+	assert.ErrorIs(t, err, ErrKeyOccupied)
+
+	// the neighbors must be adjacent and bound the key
+	proof, err = smt.GetNonMembershipProof(0x1234, 2)
+	assert.NoError(t, err)
+	farther, err := smt.GetNonMembershipProof(0x1100, 2)
+	assert.NoError(t, err)
+	proof.Left = farther.Left
+	assert.ErrorIs(t, proof.Verify(env.hasher, nilHash), ErrInvalidProof)
+	proof, err = smt.GetNonMembershipProof(0x1234, 2)
+	assert.NoError(t, err)
+	proof.Key = 0x1300
+	assert.ErrorIs(t, proof.Verify(env.hasher, nilHash), ErrInvalidProof)
+	proof.Key = 0x1234
+	proof.Right.Value = env.hasher.Hash([]byte("forged"))
+	assert.ErrorIs(t, proof.Verify(env.hasher, nilHash), ErrRootMismatched)
+
+	// the neighbors are found by descending the tree reloaded from storage, only the nodes
+	// on the paths of the key and its neighbors are loaded rather than the whole tree
+	db := memory.NewMemoryDB()
+	smt, err = NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash)
+	assert.NoError(t, err)
+	occupied := make(map[uint64]bool)
+	for i := uint64(0); i < 512; i++ {
+		key := i * 127
+		occupied[key] = true
+		assert.NoError(t, smt.Set(key, env.hasher.Hash([]byte{byte(i)})))
+	}
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+	// an emptied key is not a neighbor
+	assert.NoError(t, smt.Set(127*300, nil))
+	delete(occupied, 127*300)
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+	for _, key := range []uint64{1, 127*300 + 1, 0x7777, 127*511 + 1, 0xffff} {
+		reloaded, err := NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash)
+		assert.NoError(t, err)
+		proof, err := reloaded.GetNonMembershipProof(key, 2)
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, reloaded.Stats().HydrationMisses, uint64(12), "key %d", key)
+		assert.NoError(t, proof.Verify(env.hasher, nilHash))
+
+		left, right := int64(key)-1, int64(key)+1
+		for left >= 0 && !occupied[uint64(left)] {
+			left--
+		}
+		for right <= 0xffff && !occupied[uint64(right)] {
+			right++
+		}
+		if left < 0 {
+			assert.Nil(t, proof.Left)
+		} else {
+			assert.Equal(t, uint64(left), proof.Left.Key)
+		}
+		if right > 0xffff {
+			assert.Nil(t, proof.Right)
+		} else {
+			assert.Equal(t, uint64(right), proof.Right.Key)
+		}
+	}
+}
+
+func Test_BNBSparseMerkleTree_ParallelThreshold(t *testing.T) {
+	env := prepareEnv()[0]
+	var items []Item
+	for i := uint64(0); i < 64; i++ {
+		items = append(items, Item{Key: i * 769, Val: env.hasher.Hash([]byte{byte(i)})})
+	}
+
+	var roots [][]byte
+	for _, threshold := range []int{0, 1, 8, 32, 1024} {
+		smt, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash, ParallelThreshold(threshold))
+		assert.NoError(t, err)
+		for _, size := range []int{1, 4, 16, 64} {
+			assert.NoError(t, smt.MultiSet(items[:size]))
+			_, err = smt.Commit(nil)
+			assert.NoError(t, err)
+		}
+		roots = append(roots, smt.Root())
+	}
+	for _, root := range roots[1:] {
+		assert.Equal(t, roots[0], root)
+	}
+}
+
+func Test_BNBSparseMerkleTree_DeterministicRecompute(t *testing.T) {
+	env := prepareEnv()[0]
+	leaves := make(map[uint64][]byte)
+	var items []Item
+	for i := uint64(0); i < 256; i++ {
+		// the keys share parents at every depth
+		key := i*i*7 + i%3
+		leaves[key] = env.hasher.Hash([]byte{byte(i), byte(i >> 8)})
+		items = append(items, Item{Key: key, Val: leaves[key]})
+	}
+	expected, err := ComputeRoot(leaves, 20, nilHash, env.hasher)
+	assert.NoError(t, err)
+
+	for run := 0; run < 20; run++ {
+		smt, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 20, nilHash)
+		assert.NoError(t, err)
+		assert.NoError(t, smt.MultiSet(items))
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, smt.Root(), "run %d", run)
+		assert.NoError(t, smt.Close())
+	}
+}
+func Benchmark_SparseMerkleTree_ParallelThreshold(b *testing.B) {
+	env := prepareEnv()[0]
+	for _, changes := range []int{1, 4, 16, 64, 256} {
+		for mode, threshold := range map[string]int{"pool": 0, "inline": math.MaxInt} {
+			b.Run(fmt.Sprintf("changes=%d/%s", changes, mode), func(b *testing.B) {
+				smt, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash, ParallelThreshold(threshold))
+				if err != nil {
+					b.Fatal(err)
+				}
+				items := make([]Item, changes)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					for j := range items {
+						items[j] = Item{Key: uint64(j * 251), Val: env.hasher.Hash([]byte{byte(i), byte(j)})}
+					}
+					if err := smt.MultiSet(items); err != nil {
+						b.Fatal(err)
+					}
+					smt.Reset()
+				}
+			})
+		}
+	}
+}
+
+func Test_BNBSparseMerkleTree_KeyHistory(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			db, err := env.db()
+			assert.NoError(t, err)
+			smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+			assert.NoError(t, err)
+			key := uint64(0x12)
+			for version := Version(1); version <= 10; version++ {
+				assert.NoError(t, smt.Set(0x34, env.hasher.Hash([]byte{byte(version)})))
+				switch version {
+				case 2, 5, 9:
+					assert.NoError(t, smt.Set(key, env.hasher.Hash([]byte{byte(version)})))
+				case 7:
+					// the same value is not a change
+					assert.NoError(t, smt.Set(key, env.hasher.Hash([]byte{5})))
+				}
+				_, err = smt.Commit(nil)
+				assert.NoError(t, err)
+			}
+
+			history, err := smt.KeyHistory(key)
+			assert.NoError(t, err)
+			assert.Equal(t, []Version{2, 5, 9}, history)
+
+			// read from storage
+			reloaded, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+			assert.NoError(t, err)
+			history, err = reloaded.KeyHistory(key)
+			assert.NoError(t, err)
+			assert.Equal(t, []Version{2, 5, 9}, history)
+
+			// the pruned history is excluded
+			assert.NoError(t, smt.Set(0x34, env.hasher.Hash([]byte("val"))))
+			recent := Version(6)
+			_, err = smt.Commit(&recent)
+			assert.NoError(t, err)
+			history, err = smt.KeyHistory(key)
+			assert.NoError(t, err)
+			assert.Equal(t, []Version{5, 9}, history)
+
+			_, err = smt.KeyHistory(0x56)
+			assert.ErrorIs(t, err, ErrNodeNotFound)
+			_, err = smt.KeyHistory(0x100)
+			assert.ErrorIs(t, err, ErrInvalidKey)
+		})
+	}
+}
+
+func Test_BNBSparseMerkleTree_BatchWriter(t *testing.T) {
+	var count int64
+	hasher := NewHasherPool(func() hash.Hash {
+		return &countingHash{Hash: sha256.New(), count: &count}
+	})
+	var items []Item
+	// the keys share the paths in pairs
+	for i := uint64(0); i < 100; i++ {
+		items = append(items, Item{Key: i/2*1031 + i%2, Val: hasher.Hash([]byte{byte(i)})})
+	}
+	expected, err := NewBNBSparseMerkleTree(hasher, memory.NewMemoryDB(), 16, nilHash)
+	assert.NoError(t, err)
+	assert.NoError(t, expected.MultiSet(items))
+	_, err = expected.Commit(nil)
+	assert.NoError(t, err)
+
+	smt, err := NewBNBSparseMerkleTree(hasher, memory.NewMemoryDB(), 16, nilHash)
+	assert.NoError(t, err)
+	writer := smt.NewBatchWriter()
+	var wg sync.WaitGroup
+	for _, item := range items {
+		wg.Add(1)
+		go func(item Item) {
+			defer wg.Done()
+			// the latest value wins
+			assert.NoError(t, writer.Set(item.Key, hasher.Hash([]byte("overwritten"))))
+		}(item)
+	}
+	wg.Wait()
+	for _, item := range items {
+		assert.NoError(t, writer.Set(item.Key, item.Val))
+	}
+	assert.ErrorIs(t, writer.Set(1<<16, nil), ErrInvalidKey)
+
+	tree := smt.(*BNBSparseMerkleTree)
+	journal := tree.journal.(*journal)
+	atomic.StoreInt64(&count, 0)
+	root, err := tree.setBatch(tree.root, items, 1)
+	assert.NoError(t, err)
+	// every changed node is hashed exactly once: 14 internals and the root for each
+	// intermediate node, the value hashes of the leaves are computed in advance.
+	intermediates := int64(journal.len() - len(items))
+	assert.Equal(t, intermediates*15, atomic.LoadInt64(&count))
+	assert.Equal(t, expected.Root(), root.Root())
+	smt.Reset()
+
+	version, err := writer.Commit()
+	assert.NoError(t, err)
+	assert.Equal(t, Version(1), version)
+	assert.Equal(t, expected.Root(), smt.Root())
+	verifyItems(t, expected, smt, items)
+
+	// nothing buffered
+	version, err = writer.Commit()
+	assert.NoError(t, err)
+	assert.Equal(t, Version(2), version)
+	assert.Equal(t, expected.Root(), smt.Root())
+
+	// through the public API, every changed node is locked once to set its version, and the
+	// intermediate nodes once more to compute their internal hashes, the created nodes except the root
+	// are also linked once into their parents, fewer than the single sets
+	batched, err := NewBNBSparseMerkleTree(hasher, memory.NewMemoryDB(), 16, nilHash, LockProfiling())
+	assert.NoError(t, err)
+	writer = batched.NewBatchWriter()
+	for _, item := range items {
+		assert.NoError(t, writer.Set(item.Key, item.Val))
+	}
+	_, err = writer.Commit()
+	assert.NoError(t, err)
+	assert.Equal(t, expected.Root(), batched.Root())
+	changed := make(map[journalKey]struct{})
+	for _, item := range items {
+		for depth := uint16(0); depth <= 16; depth += 4 {
+			changed[journalKey{depth, uint64Path(item.Key >> (16 - depth))}] = struct{}{}
+		}
+	}
+	locks := atomic.LoadInt64(&batched.(*BNBSparseMerkleTree).lockProfile.locks)
+	assert.Equal(t, int64(3*len(changed)-len(items)-1), locks)
+
+	single, err := NewBNBSparseMerkleTree(hasher, memory.NewMemoryDB(), 16, nilHash, LockProfiling())
+	assert.NoError(t, err)
+	for _, item := range items {
+		assert.NoError(t, single.Set(item.Key, item.Val))
+	}
+	_, err = single.Commit(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, expected.Root(), single.Root())
+	assert.Less(t, locks, atomic.LoadInt64(&single.(*BNBSparseMerkleTree).lockProfile.locks))
+
+	// the nodes spilled by the journal are linked as placeholders, and loaded again after the commit
+	spilled, err := NewBNBSparseMerkleTree(hasher, memory.NewMemoryDB(), 16, nilHash,
+		SpillJournal(memory.NewMemoryDB(), 8))
+	assert.NoError(t, err)
+	spilledTree := spilled.(*BNBSparseMerkleTree)
+	root, err = spilledTree.setBatch(spilledTree.root, items, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, expected.Root(), root.Root())
+	assert.Less(t, residentSize(root), residentSize(tree.root)/4)
+	spilled.Reset()
+	writer = spilled.NewBatchWriter()
+	for _, item := range items {
+		assert.NoError(t, writer.Set(item.Key, item.Val))
+	}
+	_, err = writer.Commit()
+	assert.NoError(t, err)
+	verifyItems(t, expected, spilled, items)
+}
+
+func Test_BNBSparseMerkleTree_DeletePrefix(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			testDeletePrefix(t, env)
+		})
+	}
+}
+
+func testDeletePrefix(t *testing.T, env testEnv) {
+	var items []Item
+	for i := uint64(0); i < 200; i++ {
+		items = append(items, Item{Key: i * 317 % (1 << 16), Val: env.hasher.Hash([]byte{byte(i)})})
+	}
+
+	for _, test := range []struct {
+		prefix     uint64
+		prefixBits uint8
+	}{
+		{0x3, 4},
+		{0x5, 3},
+		{0x3a, 8},
+		{0x1f, 6},
+		{items[7].Key, 16},
+		{0, 0},
+	} {
+		smt, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash)
+		assert.NoError(t, err)
+		tree := smt.(*BNBSparseMerkleTree)
+		assert.NoError(t, smt.MultiSet(items))
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+
+		var (
+			retained []Item
+			deleted  []Item
+		)
+		for _, item := range items {
+			if item.Key>>(16-test.prefixBits) == test.prefix {
+				deleted = append(deleted, item)
+			} else {
+				retained = append(retained, item)
+			}
+		}
+		expected, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash)
+		assert.NoError(t, err)
+		if len(retained) > 0 {
+			assert.NoError(t, expected.MultiSet(retained))
+		}
+		_, err = expected.Commit(nil)
+		assert.NoError(t, err)
+
+		assert.NoError(t, smt.DeletePrefix(test.prefix, test.prefixBits))
+		_, err = smt.Commit(nil)
+		assert.NoErrorf(t, err, "prefix %x/%d", test.prefix, test.prefixBits)
+		assert.Equalf(t, expected.Root(), smt.Root(), "prefix %x/%d", test.prefix, test.prefixBits)
+		for _, item := range deleted {
+			val, err := smt.Get(item.Key, nil)
+			if err == nil {
+				assert.Equal(t, tree.nilHashes.Get(16), val)
+			}
+		}
+		for _, item := range retained {
+			val, err := smt.Get(item.Key, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, item.Val, val)
+		}
+	}
+
+	smt, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, smt.DeletePrefix(0, 17), ErrInvalidDepth)
+	assert.ErrorIs(t, smt.DeletePrefix(0x10, 4), ErrInvalidKey)
+
+	// the changes staged under the prefix are cleared when the journal spilled them
+	spilled, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash,
+		SpillJournal(memory.NewMemoryDB(), 2))
+	assert.NoError(t, err)
+	expected, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash)
+	assert.NoError(t, err)
+	for _, smt := range []SparseMerkleTree{spilled, expected} {
+		assert.NoError(t, smt.MultiSet(items))
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+	}
+	for _, item := range items[:50] {
+		assert.NoError(t, spilled.Set(item.Key, env.hasher.Hash(item.Val)))
+		if item.Key>>12 != 0x3 {
+			assert.NoError(t, expected.Set(item.Key, env.hasher.Hash(item.Val)))
+		}
+	}
+	assert.NotEmpty(t, spilled.(*BNBSparseMerkleTree).journal.(*spillJournal).spilled)
+	assert.NoError(t, spilled.DeletePrefix(0x3, 4))
+	assert.NoError(t, expected.DeletePrefix(0x3, 4))
+	assert.Equal(t, expected.Root(), spilled.Root())
+	for _, smt := range []SparseMerkleTree{spilled, expected} {
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+	}
+	verifyItems(t, expected, spilled, nil)
+	for _, item := range items {
+		val, err := spilled.Get(item.Key, nil)
+		assert.NoError(t, err)
+		val2, err := expected.Get(item.Key, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, val2, val)
+	}
+
+	// the cleared subtree is persisted without rewriting its leaves, which read as empty after reloading
+	salt := func(version Version) []byte {
+		return []byte{byte(version)}
+	}
+	for _, opts := range [][]Option{nil, {LatestIndex()}, {StorageSalt(salt)}} {
+		db, err := env.db()
+		assert.NoError(t, err)
+		smt, err := NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash, opts...)
+		assert.NoError(t, err)
+		assert.NoError(t, smt.MultiSet(items))
+		version1, err := smt.Commit(nil)
+		assert.NoError(t, err)
+		root1 := smt.Root()
+
+		// the change staged under the prefix is cleared too
+		staged := uint64(0x3abc)
+		assert.NoError(t, smt.Set(staged, env.hasher.Hash([]byte("staged"))))
+		assert.NoError(t, smt.DeletePrefix(0x3, 4))
+		// only the nodes on the path of the staged change are journaled
+		assert.Equal(t, 5, smt.(*BNBSparseMerkleTree).journal.Len())
+		version2, err := smt.Commit(nil)
+		assert.NoError(t, err)
+
+		var retained, deleted []Item
+		for _, item := range items {
+			if item.Key>>12 == 0x3 {
+				deleted = append(deleted, item)
+			} else {
+				retained = append(retained, item)
+			}
+		}
+		assert.NotEmpty(t, deleted)
+		expected, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash)
+		assert.NoError(t, err)
+		assert.NoError(t, expected.MultiSet(retained))
+		_, err = expected.Commit(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, expected.Root(), smt.Root())
+
+		reloaded, err := NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash, opts...)
+		assert.NoError(t, err)
+		assert.Equal(t, expected.Root(), reloaded.Root())
+		for _, item := range append(deleted, Item{Key: staged}) {
+			val, err := reloaded.Get(item.Key, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, reloaded.(*BNBSparseMerkleTree).nilHashes.Get(16), val)
+			proof, err := reloaded.GetProof(item.Key)
+			assert.NoError(t, err)
+			assert.True(t, reloaded.VerifyProof(item.Key, proof))
+		}
+		for _, item := range deleted {
+			val, err := reloaded.Get(item.Key, &version1)
+			assert.NoError(t, err)
+			assert.Equal(t, item.Val, val)
+			history, err := reloaded.KeyHistory(item.Key)
+			assert.NoError(t, err)
+			assert.Equal(t, []Version{version1, version2}, history)
+		}
+		verifyItems(t, expected, reloaded, retained)
+		count, err := reloaded.LeafCount(version2)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(len(retained)), count)
+
+		// the replicas receive the cleared leaves
+		replica, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash)
+		assert.NoError(t, err)
+		assert.NoError(t, replica.MultiSet(items))
+		_, err = replica.Commit(nil)
+		assert.NoError(t, err)
+		records, err := reloaded.CommitLog(context.Background(), version1)
+		assert.NoError(t, err)
+		for record := range records {
+			assert.NoError(t, replica.ApplyCommitRecord(record))
+		}
+		assert.Equal(t, expected.Root(), replica.Root())
+
+		// a leaf set again under the cleared prefix is hashed with the nil siblings
+		val := env.hasher.Hash([]byte("again"))
+		for _, smt := range []SparseMerkleTree{reloaded, expected} {
+			assert.NoError(t, smt.Set(deleted[0].Key, val))
+			_, err = smt.Commit(nil)
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, expected.Root(), reloaded.Root())
+		got, err := reloaded.Get(deleted[0].Key, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, val, got)
+
+		// the clear is rolled back with its version
+		assert.NoError(t, reloaded.Rollback(version1))
+		assert.Equal(t, root1, reloaded.Root())
+		reloaded, err = NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash, opts...)
+		assert.NoError(t, err)
+		assert.Equal(t, root1, reloaded.Root())
+		for _, item := range items {
+			val, err := reloaded.Get(item.Key, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, item.Val, val)
+		}
+	}
+
+	// the clears superseded at the oldest readable version are dropped, and the reads
+	// only look up the prefixes of their key rather than every clear
+	db, err := env.db()
+	assert.NoError(t, err)
+	defer db.Close()
+	smt, err = NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash)
+	assert.NoError(t, err)
+	tree := smt.(*BNBSparseMerkleTree)
+	val := env.hasher.Hash([]byte("value"))
+	for i := uint64(0); i < 20; i++ {
+		assert.NoError(t, smt.Set(0x3000+i, val))
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+		assert.NoError(t, smt.DeletePrefix(0x30, 8))
+		recent := smt.LatestVersion()
+		_, err = smt.Commit(&recent)
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, len(tree.clearedPrefixes), 2)
+	}
+	for i := uint64(0); i < 20; i++ {
+		assert.NoError(t, smt.Set((0x31+i%3)<<8|i, val))
+		assert.NoError(t, smt.DeletePrefix(0x31+i%3, 8))
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+	}
+	assert.Len(t, tree.clearedPrefixes, 22)
+	assert.Len(t, tree.clearedIndex[8], 4)
+	// a shorter prefix supersedes the longer ones under it
+	assert.NoError(t, smt.Set(0x3f00, val))
+	assert.NoError(t, smt.DeletePrefix(0x3, 4))
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+	_, err = smt.PruneParallel(smt.LatestVersion())
+	assert.NoError(t, err)
+	assert.Len(t, tree.clearedPrefixes, 1)
+	assert.NoError(t, smt.Set(0x3001, val))
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+
+	reloaded, err := NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash)
+	assert.NoError(t, err)
+	assert.Len(t, reloaded.(*BNBSparseMerkleTree).clearedPrefixes, 1)
+	for i := uint64(0); i < 20; i++ {
+		got, err := reloaded.Get(0x3000+i, nil)
+		assert.NoError(t, err)
+		if i == 1 {
+			assert.Equal(t, val, got)
+		} else {
+			assert.Equal(t, tree.nilHashes.Get(16), got)
+		}
+	}
+}
+
+func Test_BNBSparseMerkleTree_DumpDOT(t *testing.T) {
+	env := prepareEnv()[0]
+	db := memory.NewMemoryDB()
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+	assert.NoError(t, err)
+	assert.NoError(t, smt.MultiSet([]Item{
+		{0x12, env.hasher.Hash([]byte("val1"))},
+		{0x13, env.hasher.Hash([]byte("val2"))},
+	}))
+	version1, err := smt.Commit(nil)
+	assert.NoError(t, err)
+	assert.NoError(t, smt.Set(0x45, env.hasher.Hash([]byte("val3"))))
+	version2, err := smt.Commit(nil)
+	assert.NoError(t, err)
+
+	count := func(smt SparseMerkleTree, version Version) (nodes, edges, dashed int) {
+		var buf bytes.Buffer
+		assert.NoError(t, smt.DumpDOT(&buf, version))
+		dot := buf.String()
+		assert.True(t, strings.HasPrefix(dot, "digraph smt {\n"))
+		assert.True(t, strings.HasSuffix(dot, "}\n"))
+		return strings.Count(dot, "[label="), strings.Count(dot, "->"), strings.Count(dot, "style=dashed")
+	}
+
+	// root -> 0x1 -> 0x12, 0x13 and root -> 0x4 -> 0x45
+	nodes, edges, dashed := count(smt, version2)
+	assert.Equal(t, 6, nodes)
+	assert.Equal(t, 5, edges)
+	assert.Equal(t, 0, dashed)
+	nodes, edges, _ = count(smt, version1)
+	assert.Equal(t, 4, nodes)
+	assert.Equal(t, 3, edges)
+
+	// the children of the root are not loaded
+	reloaded, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+	assert.NoError(t, err)
+	nodes, edges, dashed = count(reloaded, version2)
+	assert.Equal(t, 3, nodes)
+	assert.Equal(t, 2, edges)
+	assert.Equal(t, 2, dashed)
+
+	assert.ErrorIs(t, smt.DumpDOT(io.Discard, version2+1), ErrVersionTooHigh)
+}
+
+// slowDB delays the reads to simulate the latency of a remote storage.
+type slowDB struct {
+	database.TreeDB
+	delay time.Duration
+}
+
+func (db *slowDB) Get(key []byte) ([]byte, error) {
+	time.Sleep(db.delay)
+	return db.TreeDB.Get(key)
+}
+
+func Test_BNBSparseMerkleTree_StorageParallelism(t *testing.T) {
+	env := prepareEnv()[0]
+	var items []Item
+	for i := uint64(0); i < 200; i++ {
+		items = append(items, Item{Key: i * 317, Val: env.hasher.Hash([]byte{byte(i)})})
+	}
+	expected, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash)
+	assert.NoError(t, err)
+	assert.NoError(t, expected.MultiSet(items))
+	assert.NoError(t, expected.Close())
+
+	goroutines := runtime.NumGoroutine()
+	db := memory.NewMemoryDB()
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash, StorageParallelism(16))
+	assert.NoError(t, err)
+	assert.NotNil(t, smt.(*BNBSparseMerkleTree).storagePool)
+	assert.NoError(t, smt.MultiSet(items))
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, expected.Root(), smt.Root())
+	assert.NoError(t, smt.Close())
+
+	// the supplied pool is not released
+	pool, err := ants.NewPool(4)
+	assert.NoError(t, err)
+	defer pool.Release()
+	smt, err = NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash, GoRoutinePool(pool), StorageParallelism(16))
+	assert.NoError(t, err)
+	assert.NoError(t, smt.Close())
+	assert.False(t, pool.IsClosed())
+	assert.Equal(t, expected.Root(), smt.Root())
+
+	// the workers of the released pools exit
+	assert.Eventually(t, func() bool {
+		return runtime.NumGoroutine() <= goroutines
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func Benchmark_SparseMerkleTree_StorageParallelism(b *testing.B) {
+	env := prepareEnv()[0]
+	db := &slowDB{TreeDB: memory.NewMemoryDB()}
+	var items []Item
+	for i := uint64(0); i < 300; i++ {
+		items = append(items, Item{Key: i * 211, Val: env.hasher.Hash([]byte{byte(i), byte(i >> 8)})})
+	}
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err = smt.MultiSet(items); err != nil {
+		b.Fatal(err)
+	}
+	if _, err = smt.Commit(nil); err != nil {
+		b.Fatal(err)
+	}
+	db.delay = 100 * time.Microsecond
+
+	for name, opts := range map[string][]Option{
+		"shared": nil,
+		"split":  {StorageParallelism(128)},
+	} {
+		b.Run(name, func(b *testing.B) {
+			pool, err := ants.NewPool(runtime.NumCPU())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer pool.Release()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// the reloaded tree loads the nodes from storage while hashing
+				smt, err := NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash, append(opts, GoRoutinePool(pool))...)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err = smt.MultiSet(items); err != nil {
+					b.Fatal(err)
+				}
+				smt.Close()
+			}
+		})
+	}
+}
+
+func Test_BNBSparseMerkleTree_GetCommitmentProof(t *testing.T) {
+	env := prepareEnv()[0]
+	smt, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash)
+	assert.NoError(t, err)
+	tree := smt.(*BNBSparseMerkleTree)
+
+	// the commitment of a value kept off-chain
+	commitment := env.hasher.Hash([]byte("secret value"), []byte("salt"))
+	path := uint64(0xbeef)
+	assert.NoError(t, smt.Set(path, commitment))
+	assert.NoError(t, smt.Set(0x1234, env.hasher.Hash([]byte("val"))))
+	version1, err := smt.Commit(nil)
+	assert.NoError(t, err)
+	assert.NoError(t, smt.Set(path, env.hasher.Hash([]byte("changed"))))
+	version2, err := smt.Commit(nil)
+	assert.NoError(t, err)
+
+	reconstruct := func(leafHash []byte, proof Proof) []byte {
+		verifier := NewProofVerifier(env.hasher)
+		verifier.Init(leafHash, path, 16)
+		for _, sibling := range proof {
+			assert.NoError(t, verifier.Feed(sibling))
+		}
+		return verifier.Root()
+	}
+
+	leafHash, proof, err := smt.GetCommitmentProof(path, version1)
+	assert.NoError(t, err)
+	assert.Equal(t, commitment, leafHash)
+	root, err := smt.NodeRootAt(0, 0, version1)
+	assert.NoError(t, err)
+	assert.Equal(t, root, reconstruct(leafHash, proof))
+
+	leafHash, proof, err = smt.GetCommitmentProof(path, version2)
+	assert.NoError(t, err)
+	assert.NotEqual(t, commitment, leafHash)
+	assert.Equal(t, smt.Root(), reconstruct(leafHash, proof))
+
+	// the absent path is bound to the nil hash
+	path = 0xbeee
+	leafHash, proof, err = smt.GetCommitmentProof(path, version2)
+	assert.NoError(t, err)
+	assert.Equal(t, tree.nilHashes.Get(16), leafHash)
+	assert.Equal(t, smt.Root(), reconstruct(leafHash, proof))
+
+	_, _, err = smt.GetCommitmentProof(1<<16, version2)
+	assert.ErrorIs(t, err, ErrInvalidKey)
+}
+
+func Test_BNBSparseMerkleTree_CommitVersion(t *testing.T) {
+	env := prepareEnv()[0]
+	db := &countingDB{TreeDB: memory.NewMemoryDB()}
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+	assert.NoError(t, err)
+	apply := func(items []Item) {
+		for _, item := range items {
+			assert.NoError(t, smt.Set(item.Key, item.Val))
+		}
+	}
+	items := []Item{
+		{1, env.hasher.Hash([]byte("val1"))},
+		{2, env.hasher.Hash([]byte("val2"))},
+	}
+
+	apply(items)
+	root1, err := smt.CommitVersion(1)
+	assert.NoError(t, err)
+	assert.Equal(t, smt.Root(), root1)
+	writes := atomic.LoadInt32(&db.writes)
+
+	// replaying the same changes is a no-op
+	apply(items)
+	root, err := smt.CommitVersion(1)
+	assert.NoError(t, err)
+	assert.Equal(t, root1, root)
+	assert.Equal(t, writes, atomic.LoadInt32(&db.writes))
+	assert.Equal(t, Version(1), smt.LatestVersion())
+	assert.Equal(t, []Version{1}, smt.Versions())
+
+	// the conflicting changes are rejected and discarded
+	apply([]Item{{1, env.hasher.Hash([]byte("conflict"))}})
+	_, err = smt.CommitVersion(1)
+	assert.ErrorIs(t, err, ErrVersionConflict)
+	assert.Equal(t, root1, smt.Root())
+	assert.Equal(t, writes, atomic.LoadInt32(&db.writes))
+
+	_, err = smt.CommitVersion(0)
+	assert.ErrorIs(t, err, ErrVersionTooLow)
+
+	apply([]Item{{3, env.hasher.Hash([]byte("val3"))}})
+	root2, err := smt.CommitVersion(2)
+	assert.NoError(t, err)
+	assert.NotEqual(t, root1, root2)
+	version, root := smt.Latest()
+	assert.Equal(t, Version(2), version)
+	assert.Equal(t, root2, root)
+
+	apply([]Item{{1, env.hasher.Hash([]byte("val4"))}})
+	root3, err := smt.CommitVersion(3)
+	assert.NoError(t, err)
+	writes = atomic.LoadInt32(&db.writes)
+
+	// the earlier versions are redelivered on top of the version before them
+	apply(items)
+	root, err = smt.CommitVersion(1)
+	assert.NoError(t, err)
+	assert.Equal(t, root1, root)
+	apply([]Item{{3, env.hasher.Hash([]byte("val3"))}})
+	root, err = smt.CommitVersion(2)
+	assert.NoError(t, err)
+	assert.Equal(t, root2, root)
+	for _, conflicting := range [][]Item{
+		items[:1],
+		{{3, env.hasher.Hash([]byte("conflict"))}},
+		{{3, env.hasher.Hash([]byte("val3"))}, {4, env.hasher.Hash([]byte("val4"))}},
+	} {
+		apply(conflicting)
+		_, err = smt.CommitVersion(Version(len(conflicting)))
+		assert.ErrorIs(t, err, ErrVersionConflict)
+		assert.Equal(t, root3, smt.Root())
+	}
+	assert.Equal(t, writes, atomic.LoadInt32(&db.writes))
+	assert.Equal(t, []Version{1, 2, 3}, smt.Versions())
+
+	// the changes of the pruned versions cannot be checked
+	recent := Version(3)
+	_, err = smt.Commit(&recent)
+	assert.NoError(t, err)
+	apply([]Item{{1, env.hasher.Hash([]byte("val4"))}})
+	_, err = smt.CommitVersion(3)
+	assert.ErrorIs(t, err, ErrVersionTooLow)
+	root, err = smt.CommitVersion(4)
+	assert.NoError(t, err)
+	_, latestRoot := smt.Latest()
+	assert.Equal(t, latestRoot, root)
+}
+
+func Test_BNBSparseMerkleTree_HydrationStats(t *testing.T) {
+	env := prepareEnv()[0]
+	var items []Item
+	for i := uint64(0); i < 300; i++ {
+		items = append(items, Item{Key: i * 211, Val: env.hasher.Hash([]byte{byte(i)})})
+	}
+
+	// the batches access 3 groups of keys in turn like the adaptive preload test
+	batchStats := func(opts ...Option) (hits, misses uint64, m *testMetrics) {
+		m = &testMetrics{}
+		smt, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash,
+			append(opts, GCThreshold(10), EnableMetrics(m))...)
+		assert.NoError(t, err)
+		assert.NoError(t, smt.MultiSet(items))
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+
+		for round := 0; round < 9; round++ {
+			group := round % 3
+			var batch []Item
+			for i := group * 10; i < group*10+10; i++ {
+				batch = append(batch, Item{Key: items[i*10].Key, Val: env.hasher.Hash([]byte{byte(round), byte(i)})})
+			}
+			before := smt.Stats()
+			assert.NoError(t, smt.MultiSet(batch))
+			after := smt.Stats()
+			// skip the warm up
+			if round >= 3 {
+				hits += after.HydrationHits - before.HydrationHits
+				misses += after.HydrationMisses - before.HydrationMisses
+			}
+			_, err = smt.Commit(nil)
+			assert.NoError(t, err)
+		}
+		stats := smt.Stats()
+		assert.Equal(t, stats.HydrationHits, m.hydrationHits)
+		assert.Equal(t, stats.HydrationMisses, m.hydrationMisses)
+		return hits, misses, m
+	}
+
+	hits, misses, _ := batchStats()
+	assert.Greater(t, misses, uint64(0))
+	preloadHits, preloadMisses, _ := batchStats(AdaptivePreload(64))
+	assert.Equal(t, uint64(0), preloadMisses)
+	assert.Equal(t, hits+misses, preloadHits)
+}
+
+func Test_ComputeRoot(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			leaves := make(map[uint64][]byte)
+			var items []Item
+			for i := uint64(0); i < 100; i++ {
+				key := i * i * 37 % 65536
+				val := env.hasher.Hash([]byte{byte(i), byte(i >> 8)})
+				leaves[key] = val
+				items = append(items, Item{Key: key, Val: val})
+			}
+
+			smt, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash)
+			assert.NoError(t, err)
+			root, err := ComputeRoot(nil, 16, nilHash, env.hasher)
+			assert.NoError(t, err)
+			assert.Equal(t, smt.Root(), root)
+
+			assert.NoError(t, smt.MultiSet(items))
+			_, err = smt.Commit(nil)
+			assert.NoError(t, err)
+			root, err = ComputeRoot(leaves, 16, nilHash, env.hasher)
+			assert.NoError(t, err)
+			assert.Equal(t, smt.Root(), root)
+
+			_, err = ComputeRoot(map[uint64][]byte{65536: nilHash}, 16, nilHash, env.hasher)
+			assert.ErrorIs(t, err, ErrInvalidKey)
+			_, err = ComputeRoot(leaves, 6, nilHash, env.hasher)
+			assert.ErrorIs(t, err, ErrInvalidDepth)
+		})
+	}
+}
+
+func Test_BNBSparseMerkleTree_Checkpoint(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			db, err := env.db()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash, CheckpointInterval(3))
+			assert.NoError(t, err)
+			_, err = RestoreCheckpoint(db, env.hasher)
+			assert.ErrorIs(t, err, database.ErrDatabaseNotFound)
+
+			batches := make([][]Item, 11)
+			roots := make([][]byte, 11)
+			for version := 1; version <= 10; version++ {
+				for i := 0; i < 20; i++ {
+					key := uint64(version*37+i*13) % 256
+					batches[version] = append(batches[version], Item{Key: key, Val: env.hasher.Hash([]byte{byte(version), byte(i)})})
+				}
+				assert.NoError(t, smt.MultiSet(batches[version]))
+				_, err = smt.Commit(nil)
+				assert.NoError(t, err)
+				roots[version] = smt.Root()
+			}
+
+			// the restore never rolls back the versions committed after the checkpoint
+			_, err = RestoreCheckpoint(db, env.hasher)
+			assert.ErrorIs(t, err, ErrStaleCheckpoint)
+			assert.Equal(t, Version(10), smt.LatestVersion())
+			assert.NoError(t, smt.Rollback(9))
+			assert.NoError(t, smt.Close())
+
+			restored, err := RestoreCheckpoint(db, env.hasher)
+			assert.NoError(t, err)
+			assert.Equal(t, Version(9), restored.LatestVersion())
+			assert.Equal(t, roots[9], restored.Root())
+			for _, item := range batches[9] {
+				val, err := restored.Get(item.Key, nil)
+				assert.NoError(t, err)
+				assert.NotNil(t, val)
+			}
+
+			// replay the versions after the checkpoint
+			assert.NoError(t, restored.MultiSet(batches[10]))
+			root, err := restored.CommitVersion(10)
+			assert.NoError(t, err)
+			assert.Equal(t, roots[10], root)
+		})
+	}
+}
+
+func Test_BNBSparseMerkleTree_CheckpointWithPruning(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			testCheckpointWithPruning(t, env)
+		})
+	}
+}
+
+func testCheckpointWithPruning(t *testing.T, env testEnv) {
+	db, err := env.db()
+	assert.NoError(t, err)
+	defer db.Close()
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash, CheckpointInterval(5))
+	assert.NoError(t, err)
+	roots := make(map[Version][]byte)
+	for version := Version(1); version <= 7; version++ {
+		assert.NoError(t, smt.Set(uint64(version), env.hasher.Hash([]byte{byte(version)})))
+		recent := version - 1
+		_, err = smt.Commit(&recent)
+		assert.NoError(t, err)
+		roots[version] = smt.Root()
+	}
+	// the checkpoint at version 5 is not pruned
+	assert.Equal(t, Version(5), smt.RecentVersion())
+	_, err = smt.PruneParallel(7)
+	assert.NoError(t, err)
+	assert.Equal(t, Version(5), smt.RecentVersion())
+	assert.NoError(t, smt.Close())
+
+	// the pin survives reopening
+	smt, err = NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash, CheckpointInterval(5))
+	assert.NoError(t, err)
+	assert.NoError(t, smt.Set(8, env.hasher.Hash([]byte{8})))
+	recent := Version(7)
+	_, err = smt.Commit(&recent)
+	assert.NoError(t, err)
+	assert.Equal(t, Version(5), smt.RecentVersion())
+
+	_, err = RestoreCheckpoint(db, env.hasher)
+	assert.ErrorIs(t, err, ErrStaleCheckpoint)
+	assert.NoError(t, smt.Rollback(5))
+	assert.NoError(t, smt.Close())
+	restored, err := RestoreCheckpoint(db, env.hasher, CheckpointInterval(5))
+	assert.NoError(t, err)
+	assert.Equal(t, Version(5), restored.LatestVersion())
+	assert.Equal(t, roots[5], restored.Root())
+
+	// the next checkpoint releases the previous one
+	for version := Version(6); version <= 11; version++ {
+		assert.NoError(t, restored.Set(uint64(version), env.hasher.Hash([]byte{byte(version)})))
+		recent := version - 1
+		_, err = restored.Commit(&recent)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, Version(10), restored.RecentVersion())
+}
+
+func Test_BNBSparseMerkleTree_SetHash(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			smt1, err := NewBNBSparseMerkleTree(env.hasher, nil, 8, nilHash)
+			assert.NoError(t, err)
+			smt2, err := NewBNBSparseMerkleTree(env.hasher, nil, 8, nilHash)
+			assert.NoError(t, err)
+
+			for i := uint64(0); i < 20; i++ {
+				leafHash := env.hasher.Hash([]byte{byte(i)})
+				assert.NoError(t, smt1.Set(i*7, leafHash))
+				assert.NoError(t, smt2.SetHash(i*7, leafHash))
+			}
+			assert.Equal(t, smt1.Root(), smt2.Root())
+
+			assert.ErrorIs(t, smt2.SetHash(1, []byte{1, 2, 3}), ErrInvalidHash)
+			assert.ErrorIs(t, smt2.SetHash(1<<8, env.hasher.Hash(nil)), ErrInvalidKey)
+		})
+	}
+}
+
+func Test_BNBSparseMerkleTree_ReadYourWrites(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			db, err := env.db()
+			assert.NoError(t, err)
+			defer db.Close()
+			smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+			assert.NoError(t, err)
+
+			committed := env.hasher.Hash([]byte("committed"))
+			staged := env.hasher.Hash([]byte("staged"))
+			assert.NoError(t, smt.Set(1, committed))
+			_, err = smt.Commit(nil)
+			assert.NoError(t, err)
+
+			assert.NoError(t, smt.Set(1, staged))
+			assert.NoError(t, smt.Set(2, staged))
+			val, err := smt.Get(1, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, staged, val)
+			val, err = smt.Get(2, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, staged, val)
+
+			val, err = smt.GetCommitted(1, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, committed, val)
+			_, err = smt.GetCommitted(2, nil)
+			assert.ErrorIs(t, err, ErrNodeNotFound)
+			version := smt.LatestVersion()
+			val, err = smt.Get(1, &version)
+			assert.NoError(t, err)
+			assert.Equal(t, committed, val)
+
+			smt.Reset()
+			val, err = smt.Get(1, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, committed, val)
+		})
+	}
+}
+
+// peakDB records the peak number of the concurrent reads.
+type peakDB struct {
+	database.TreeDB
+	delay   time.Duration
+	running int32
+	peak    int32
+}
+
+func (db *peakDB) Get(key []byte) ([]byte, error) {
+	running := atomic.AddInt32(&db.running, 1)
+	defer atomic.AddInt32(&db.running, -1)
+	for {
+		peak := atomic.LoadInt32(&db.peak)
+		if running <= peak || atomic.CompareAndSwapInt32(&db.peak, peak, running) {
+			break
+		}
+	}
+	time.Sleep(db.delay)
+	return db.TreeDB.Get(key)
+}
+
+func Test_BNBSparseMerkleTree_MaxConcurrentHydrations(t *testing.T) {
+	env := prepareEnv()[0]
+	db := &peakDB{TreeDB: memory.NewMemoryDB()}
+	var items []Item
+	for i := uint64(0); i < 200; i++ {
+		items = append(items, Item{Key: i * 317, Val: env.hasher.Hash([]byte{byte(i)})})
+	}
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash)
+	assert.NoError(t, err)
+	assert.NoError(t, smt.MultiSet(items))
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+	expected := smt.Root()
+	db.delay = time.Millisecond
+
+	for _, limit := range []int{0, 3} {
+		atomic.StoreInt32(&db.peak, 0)
+		// the reloaded tree loads the nodes from storage concurrently
+		smt, err := NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash,
+			StorageParallelism(32), MaxConcurrentHydrations(limit))
+		assert.NoError(t, err)
+		for i := range items {
+			items[i].Val = env.hasher.Hash(items[i].Val)
+		}
+		assert.NoError(t, smt.MultiSet(items))
+		if limit == 0 {
+			assert.Greater(t, atomic.LoadInt32(&db.peak), int32(3))
+		} else {
+			assert.LessOrEqual(t, atomic.LoadInt32(&db.peak), int32(limit))
+		}
+		assert.NotEqual(t, expected, smt.Root())
+		assert.NoError(t, smt.Close())
+	}
+}
+
+func Test_BNBSparseMerkleTree_StrictLoad(t *testing.T) {
+	hasher := NewHasherPool(func() hash.Hash { return sha256.New() })
+	db := memory.NewMemoryDB()
+	smt, err := NewBNBSparseMerkleTree(hasher, db, 8, nilHash)
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, smt.Set(0x12, hasher.Hash([]byte{byte(i)})))
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+	}
+
+	// swap the versions of the leaf
+	buf, err := db.Get(storageFullTreeNodeKey(8, 0x12))
+	assert.NoError(t, err)
+	leaf := &StorageTreeNode{}
+	assert.NoError(t, rlp.DecodeBytes(buf, leaf))
+	assert.Len(t, leaf.Versions, 3)
+	leaf.Versions[0], leaf.Versions[1] = leaf.Versions[1], leaf.Versions[0]
+	buf, err = rlp.EncodeToBytes(leaf)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Set(storageFullTreeNodeKey(8, 0x12), buf))
+
+	smt, err = NewBNBSparseMerkleTree(hasher, db, 8, nilHash)
+	assert.NoError(t, err)
+	_, err = smt.GetProof(0x12)
+	assert.NoError(t, err)
+
+	smt, err = NewBNBSparseMerkleTree(hasher, db, 8, nilHash, StrictLoad())
+	assert.NoError(t, err)
+	_, err = smt.GetProof(0x13)
+	assert.NoError(t, err)
+	_, err = smt.GetCommitted(0x12, nil)
+	assert.ErrorIs(t, err, ErrNonMonotonicVersions)
+}
+
+func Test_BNBSparseMerkleTree_DepthMismatched(t *testing.T) {
+	hasher := NewHasherPool(func() hash.Hash { return sha256.New() })
+	tests := []struct {
+		name  string
+		depth uint8
+		path  uint64
+	}{
+		{name: "node of a wrong depth", depth: 0, path: 0},
+		{name: "node of a wrong path", depth: 4, path: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := memory.NewMemoryDB()
+			smt, err := NewBNBSparseMerkleTree(hasher, db, 8, nilHash)
+			assert.NoError(t, err)
+			assert.NoError(t, smt.Set(0x02, hasher.Hash([]byte("test1"))))
+			assert.NoError(t, smt.Set(0x12, hasher.Hash([]byte("test2"))))
+			_, err = smt.Commit(nil)
+			assert.NoError(t, err)
+
+			// persist the node at the depth 4, path 0 instead
+			buf, err := db.Get(storageFullTreeNodeKey(test.depth, test.path))
+			assert.NoError(t, err)
+			assert.NoError(t, db.Set(storageFullTreeNodeKey(4, 0), buf))
+
+			smt, err = NewBNBSparseMerkleTree(hasher, db, 8, nilHash)
+			assert.NoError(t, err)
+			_, err = smt.GetProof(0x02)
+			assert.ErrorIs(t, err, ErrDepthMismatched)
+			_, err = smt.GetProof(0x12)
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func Test_BNBSparseMerkleTree_LeafCount(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			db, err := env.db()
+			assert.NoError(t, err)
+			defer db.Close()
+			smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+			assert.NoError(t, err)
+			count, err := smt.LeafCount(0)
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(0), count)
+
+			// version 1: 10 leaves
+			var items []Item
+			for i := uint64(0); i < 10; i++ {
+				items = append(items, Item{Key: i * 3, Val: env.hasher.Hash([]byte{byte(i)})})
+			}
+			assert.NoError(t, smt.MultiSet(items))
+			_, err = smt.Commit(nil)
+			assert.NoError(t, err)
+
+			// version 2: 2 inserted, 1 updated, 3 deleted, 1 deleted twice
+			assert.NoError(t, smt.Set(100, env.hasher.Hash([]byte("a"))))
+			assert.NoError(t, smt.Set(100, env.hasher.Hash([]byte("b"))))
+			assert.NoError(t, smt.Set(101, env.hasher.Hash([]byte("c"))))
+			assert.NoError(t, smt.Set(0, env.hasher.Hash([]byte("d"))))
+			assert.NoError(t, smt.MultiSet([]Item{{Key: 3, Val: nilHash}, {Key: 6, Val: nilHash}}))
+			assert.NoError(t, smt.Set(9, nilHash))
+			assert.NoError(t, smt.Set(9, nilHash))
+			assert.NoError(t, smt.Set(102, nilHash))
+			_, err = smt.Commit(nil)
+			assert.NoError(t, err)
+
+			// version 3: the deleted leaf is set again and another is staged then deleted
+			assert.NoError(t, smt.Set(3, env.hasher.Hash([]byte("e"))))
+			assert.NoError(t, smt.Set(103, env.hasher.Hash([]byte("f"))))
+			assert.NoError(t, smt.Set(103, nilHash))
+			_, err = smt.Commit(nil)
+			assert.NoError(t, err)
+
+			expected := map[Version]uint64{0: 0, 1: 10, 2: 9, 3: 10}
+			for version, want := range expected {
+				count, err := smt.LeafCount(version)
+				assert.NoError(t, err)
+				assert.Equal(t, want, count, "version %d", version)
+			}
+			_, err = smt.LeafCount(4)
+			assert.ErrorIs(t, err, ErrVersionTooHigh)
+
+			// the counts are persisted
+			smt, err = NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+			assert.NoError(t, err)
+			count, err = smt.LeafCount(3)
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(10), count)
+
+			assert.NoError(t, smt.Rollback(2))
+			count, err = smt.LeafCount(2)
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(9), count)
+
+			// the leaves are walked without the persisted counts
+			for version := range expected {
+				assert.NoError(t, db.Delete(leafCountKey(version)))
+			}
+			smt, err = NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+			assert.NoError(t, err)
+			for _, version := range []Version{1, 2} {
+				count, err := smt.LeafCount(version)
+				assert.NoError(t, err)
+				assert.Equal(t, expected[version], count, "version %d", version)
+			}
+			assert.NoError(t, smt.Set(200, env.hasher.Hash([]byte("g"))))
+			_, err = smt.Commit(nil)
+			assert.NoError(t, err)
+			count, err = smt.LeafCount(3)
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(10), count)
+		})
+	}
+}
+
+func Test_BNBSparseMerkleTree_EvictionCallback(t *testing.T) {
+	env := prepareEnv()[0]
+	type evicted struct {
+		depth uint8
+		path  uint64
+	}
+	var (
+		smt      *BNBSparseMerkleTree
+		evictees []evicted
+	)
+	tree, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 8, nilHash,
+		EvictionCallback(func(depth uint8, path uint64) {
+			// the node locks are not held, so the tree is accessible
+			assert.NotNil(t, smt.root.Root())
+			evictees = append(evictees, evicted{depth, path})
+		}))
+	assert.NoError(t, err)
+	smt = tree.(*BNBSparseMerkleTree)
+
+	assert.NoError(t, smt.Set(0x12, env.hasher.Hash([]byte("test1"))))
+	assert.NoError(t, smt.Set(0x34, env.hasher.Hash([]byte("test2"))))
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+	assert.NoError(t, smt.Set(0x35, env.hasher.Hash([]byte("test3"))))
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+	assert.NoError(t, smt.Set(0xf0, env.hasher.Hash([]byte("test4"))))
+	version3, err := smt.Commit(nil)
+	assert.NoError(t, err)
+
+	// the subtrees of path 1 and 3 are not updated in the latest version
+	smt.release(version3)
+	assert.Equal(t, []evicted{{4, 1}, {4, 3}}, evictees)
+	assert.True(t, smt.root.Children[1].IsTemporary())
+	assert.True(t, smt.root.Children[3].IsTemporary())
+	assert.False(t, smt.root.Children[0xf].IsTemporary())
+
+	// the leaves are archived in the subtrees still in memory
+	evictees = nil
+	assert.NoError(t, smt.Set(0xf1, env.hasher.Hash([]byte("test5"))))
+	version4, err := smt.Commit(nil)
+	assert.NoError(t, err)
+	smt.release(version4)
+	assert.Equal(t, []evicted{{8, 0xf0}}, evictees)
+}
+
+func Test_BNBSparseMerkleTree_ProofOrder(t *testing.T) {
+	env := prepareEnv()[0]
+	leafToRoot, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 8, nilHash)
+	assert.NoError(t, err)
+	rootToLeaf, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 8, nilHash, ProofOrder(RootToLeaf))
+	assert.NoError(t, err)
+	for _, smt := range []SparseMerkleTree{leafToRoot, rootToLeaf} {
+		assert.NoError(t, smt.Set(0x12, env.hasher.Hash([]byte("test1"))))
+		assert.NoError(t, smt.Set(0x34, env.hasher.Hash([]byte("test2"))))
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+	}
+
+	for _, key := range []uint64{0x12, 0x34, 0x56} {
+		proof1, err := leafToRoot.GetProof(key)
+		assert.NoError(t, err)
+		proof2, err := rootToLeaf.GetProof(key)
+		assert.NoError(t, err)
+		assert.Equal(t, proof1[0], proof2[len(proof2)-1])
+		assert.Equal(t, leafToRoot.(*BNBSparseMerkleTree).nilHashes.Get(1), proof1[len(proof1)-1])
+		assert.Equal(t, proof1, Proof(utils.ReverseBytes(append(Proof{}, proof2...))))
+
+		assert.True(t, leafToRoot.VerifyProof(key, proof1))
+		assert.True(t, rootToLeaf.VerifyProof(key, proof2))
+		assert.False(t, leafToRoot.VerifyProof(key, proof2))
+		assert.False(t, rootToLeaf.VerifyProof(key, proof1))
+
+		proof2, err = rootToLeaf.GetProofAt(key, 1)
+		assert.NoError(t, err)
+		assert.True(t, rootToLeaf.VerifyProof(key, proof2))
+	}
+
+	// the multi proofs are always from the leaf to the root
+	multiProof, err := rootToLeaf.GetMultiProof([]uint64{0x12, 0x34})
+	assert.NoError(t, err)
+	assert.NoError(t, VerifyMultiProof(env.hasher, rootToLeaf.Root(), multiProof))
+}
+
+func Test_BNBSparseMerkleTree_ReadCacheTTL(t *testing.T) {
+	env := prepareEnv()[0]
+	db := &countingDB{TreeDB: memory.NewMemoryDB()}
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+	assert.NoError(t, err)
+	assert.NoError(t, smt.Set(0x12, env.hasher.Hash([]byte("test1"))))
+	assert.NoError(t, smt.Set(0x34, env.hasher.Hash([]byte("test2"))))
+	version, err := smt.Commit(nil)
+	assert.NoError(t, err)
+
+	clock := time.Unix(1000, 0)
+	smt, err = NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash, ReadCacheTTL(time.Minute))
+	assert.NoError(t, err)
+	smt.(*BNBSparseMerkleTree).now = func() time.Time { return clock }
+
+	read := func(f func()) int32 {
+		before := atomic.LoadInt32(&db.gets)
+		f()
+		return atomic.LoadInt32(&db.gets) - before
+	}
+	getProof := func() {
+		_, err := smt.GetProof(0x12)
+		assert.NoError(t, err)
+	}
+	get := func() {
+		_, err := smt.Get(0x12, nil)
+		assert.NoError(t, err)
+	}
+	// the nodes of depth 4 and 8 are loaded
+	assert.Equal(t, int32(2), read(getProof))
+	assert.Equal(t, int32(1), read(get))
+	clock = clock.Add(30 * time.Second)
+	assert.Equal(t, int32(0), read(getProof))
+	assert.Equal(t, int32(0), read(get))
+
+	// the leaf is mutated in storage by others
+	storageKey := storageFullTreeNodeKey(8, 0x12)
+	buf, err := db.TreeDB.Get(storageKey)
+	assert.NoError(t, err)
+	storageTreeNode := &StorageTreeNode{}
+	assert.NoError(t, rlp.DecodeBytes(buf, storageTreeNode))
+	mutated := env.hasher.Hash([]byte("mutated"))
+	storageTreeNode.Versions[len(storageTreeNode.Versions)-1].Hash = mutated
+	buf, err = rlp.EncodeToBytes(storageTreeNode)
+	assert.NoError(t, err)
+	assert.NoError(t, db.TreeDB.Set(storageKey, buf))
+
+	val, err := smt.Get(0x12, &version)
+	assert.NoError(t, err)
+	assert.Equal(t, env.hasher.Hash([]byte("test1")), val)
+
+	// the nodes are re-read after the TTL
+	clock = clock.Add(31 * time.Second)
+	assert.Equal(t, int32(2), read(getProof))
+	assert.Equal(t, int32(0), read(getProof))
+	val, err = smt.Get(0x12, &version)
+	assert.NoError(t, err)
+	assert.Equal(t, mutated, val)
+}
+
+func Test_StorageKey(t *testing.T) {
+	assert.Equal(t, []byte("t:\x04:\x00\x00\x00\x00\x00\x00\x01\x23"), StorageKey(TreeNodePrefix, 4, 0x123))
+
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			testStorageKey(t, env)
+		})
+	}
+}
+
+func testStorageKey(t *testing.T, env testEnv) {
+	db, err := env.db()
+	assert.NoError(t, err)
+	defer db.Close()
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+	assert.NoError(t, err)
+	assert.NoError(t, smt.Set(0x12, env.hasher.Hash([]byte("test1"))))
+	version, err := smt.Commit(nil)
+	assert.NoError(t, err)
+
+	for _, node := range []struct {
+		depth uint8
+		path  uint64
+	}{{0, 0}, {4, 0x1}, {8, 0x12}} {
+		buf, err := db.Get(StorageKey(TreeNodePrefix, node.depth, node.path))
+		assert.NoError(t, err)
+		storageTreeNode := &StorageTreeNode{}
+		assert.NoError(t, rlp.DecodeBytes(buf, storageTreeNode))
+		assert.Equal(t, node.path, storageTreeNode.Path)
+		root, err := smt.NodeRootAt(node.depth, node.path, version)
+		assert.NoError(t, err)
+		assert.Equal(t, root, storageTreeNode.Versions[len(storageTreeNode.Versions)-1].Hash)
+	}
+}
+
+func Test_BNBSparseMerkleTree_VerifyAgainstHistory(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			db, err := env.db()
+			assert.NoError(t, err)
+			defer db.Close()
+			smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+			assert.NoError(t, err)
+
+			val1 := env.hasher.Hash([]byte("test1"))
+			assert.NoError(t, smt.Set(0x12, val1))
+			version1, err := smt.Commit(nil)
+			assert.NoError(t, err)
+			proof1, err := smt.GetProofAt(0x12, version1)
+			assert.NoError(t, err)
+
+			val2 := env.hasher.Hash([]byte("test2"))
+			assert.NoError(t, smt.Set(0x12, val2))
+			assert.NoError(t, smt.Set(0x34, val2))
+			version2, err := smt.Commit(nil)
+			assert.NoError(t, err)
+			assert.NoError(t, smt.Set(0x56, val2))
+			_, err = smt.Commit(nil)
+			assert.NoError(t, err)
+
+			// the old inclusion is verified against the root of its version only
+			ok, err := smt.VerifyAgainstHistory(proof1, 0x12, val1, version1)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			ok, err = smt.VerifyAgainstHistory(proof1, 0x12, val1, version2)
+			assert.NoError(t, err)
+			assert.False(t, ok)
+			ok, err = smt.VerifyAgainstHistory(proof1, 0x12, val2, version1)
+			assert.NoError(t, err)
+			assert.False(t, ok)
+
+			proof2, err := smt.GetProofAt(0x34, version2)
+			assert.NoError(t, err)
+			ok, err = smt.VerifyAgainstHistory(proof2, 0x34, val2, version2)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+
+			_, err = smt.VerifyAgainstHistory(proof1, 0x12, val1, smt.LatestVersion()+1)
+			assert.ErrorIs(t, err, ErrVersionTooHigh)
+			_, err = smt.VerifyAgainstHistory(proof1[1:], 0x12, val1, version1)
+			assert.ErrorIs(t, err, ErrInvalidProof)
+			_, err = smt.PruneParallel(version2)
+			assert.NoError(t, err)
+			_, err = smt.Commit(&version2)
+			assert.NoError(t, err)
+			_, err = smt.VerifyAgainstHistory(proof1, 0x12, val1, version1)
+			assert.ErrorIs(t, err, ErrVersionTooOld)
+		})
+	}
+}
+
+func Test_BNBSparseMerkleTree_ProofLengthMismatch(t *testing.T) {
+	env := prepareEnv()[0]
+	smt, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash)
+	assert.NoError(t, err)
+	val := env.hasher.Hash([]byte("val"))
+	assert.NoError(t, smt.Set(0x12, val))
+	version, err := smt.Commit(nil)
+	assert.NoError(t, err)
+	proof, err := smt.GetProof(0x12)
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		name  string
+		proof Proof
+	}{
+		{"too short", proof[:12]},
+		{"too long", append(append(Proof{}, proof...), nilHash)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := smt.VerifyAgainstHistory(tc.proof, 0x12, val, version)
+			var mismatch ErrProofLengthMismatch
+			assert.True(t, errors.As(err, &mismatch))
+			assert.Equal(t, ErrProofLengthMismatch{Got: len(tc.proof), Want: 16}, mismatch)
+			assert.ErrorIs(t, err, ErrInvalidProof)
+			assert.False(t, smt.VerifyProof(0x12, tc.proof))
+
+			err = VerifyMultiProof(env.hasher, smt.Root(), &MultiProof{
+				Keys:   []uint64{0x12, 0x34},
+				Values: [][]byte{val, nilHash},
+				Proofs: []Proof{proof, tc.proof},
+			})
+			assert.Equal(t, ErrProofLengthMismatch{Got: len(tc.proof), Want: 16}, err)
+		})
+	}
+}
+func Test_BNBSparseMerkleTree_PreparedCommit(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			db, err := env.db()
+			assert.NoError(t, err)
+			defer db.Close()
+			smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+			assert.NoError(t, err)
+
+			val := env.hasher.Hash([]byte("val"))
+			assert.NoError(t, smt.Set(1, val))
+			root := smt.Prepare()
+			assert.Equal(t, smt.Root(), root)
+
+			// the mutations are rejected in the prepared window
+			assert.ErrorIs(t, smt.Set(2, val), ErrCommitPending)
+			assert.ErrorIs(t, smt.MultiSet([]Item{{Key: 2, Val: val}}), ErrCommitPending)
+			assert.ErrorIs(t, smt.DeletePrefix(0, 4), ErrCommitPending)
+			_, err = smt.NewBatchWriter().Commit()
+			assert.ErrorIs(t, err, ErrCommitPending)
+			assert.Equal(t, root, smt.Root())
+
+			// and allowed again after Abort
+			smt.Abort()
+			assert.True(t, smt.IsEmpty())
+			assert.NoError(t, smt.Set(2, val))
+			root = smt.Prepare()
+			assert.ErrorIs(t, smt.Set(3, val), ErrCommitPending)
+
+			// and after Commit
+			_, err = smt.Commit(nil)
+			assert.NoError(t, err)
+			_, latest := smt.Latest()
+			assert.Equal(t, root, latest)
+			assert.NoError(t, smt.Set(3, val))
+		})
+	}
+}
+
+func Test_BNBSparseMerkleTree_StorageSalt(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			db, err := env.db()
+			assert.NoError(t, err)
+			defer db.Close()
+			// the versions 1, 2 are in the epoch 1, the later ones are in the epoch 2
+			salt := func(version Version) []byte {
+				if version <= 2 {
+					return []byte("e1")
+				}
+				return []byte("e2")
+			}
+			smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash, StorageSalt(salt))
+			assert.NoError(t, err)
+
+			values := make([][]byte, 5)
+			for i := range values {
+				values[i] = env.hasher.Hash([]byte{byte(i)})
+			}
+			for _, key := range []uint64{1, 2, 3, 1} {
+				assert.NoError(t, smt.Set(key, values[smt.LatestVersion()+1]))
+				_, err = smt.Commit(nil)
+				assert.NoError(t, err)
+			}
+
+			// the leaves are stored under the salt of the epoch they were last written in
+			epoch1 := bytes.Join([][]byte{TreeNodePrefix, []byte("e1")}, sep)
+			epoch2 := bytes.Join([][]byte{TreeNodePrefix, []byte("e2")}, sep)
+			_, err = db.Get(StorageKey(epoch1, 8, 2))
+			assert.NoError(t, err)
+			_, err = db.Get(StorageKey(epoch2, 8, 2))
+			assert.ErrorIs(t, err, database.ErrDatabaseNotFound)
+			_, err = db.Get(StorageKey(epoch1, 8, 3))
+			assert.ErrorIs(t, err, database.ErrDatabaseNotFound)
+			_, err = db.Get(StorageKey(epoch2, 8, 3))
+			assert.NoError(t, err)
+			_, err = db.Get(StorageKey(TreeNodePrefix, 8, 3))
+			assert.ErrorIs(t, err, database.ErrDatabaseNotFound)
+
+			// the reopened tree reads the nodes with the matching salts
+			smt2, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash, StorageSalt(salt))
+			assert.NoError(t, err)
+			assert.Equal(t, smt.Root(), smt2.Root())
+			version := Version(1)
+			val, err := smt2.Get(1, &version)
+			assert.NoError(t, err)
+			assert.Equal(t, values[1], val)
+			for key, ver := range map[uint64]Version{1: 4, 2: 2, 3: 3} {
+				val, err = smt2.Get(key, nil)
+				assert.NoError(t, err)
+				assert.Equal(t, values[ver], val)
+			}
+			history, err := smt2.KeyHistory(1)
+			assert.NoError(t, err)
+			assert.Equal(t, []Version{1, 4}, history)
+			proof, err := smt2.GetProof(2)
+			assert.NoError(t, err)
+			assert.True(t, smt2.VerifyProof(2, proof))
+
+			// rewriting the last node of the epoch 1 supersedes it, the nodes rewritten
+			// in the epoch 2 have left their keys of the epoch 1
+			assert.NoError(t, smt2.Set(2, values[0]))
+			_, err = smt2.Commit(nil)
+			assert.NoError(t, err)
+			epoch1Keys := [][]byte{StorageKey(epoch1, 4, 0)}
+			for key := uint64(1); key <= 3; key++ {
+				epoch1Keys = append(epoch1Keys, StorageKey(epoch1, 8, key))
+			}
+			for _, key := range epoch1Keys {
+				_, err = db.Get(key)
+				assert.ErrorIs(t, err, database.ErrDatabaseNotFound)
+			}
+
+			// the superseded epoch is deleted, the latest tree and the versions carried by the
+			// rewritten nodes are read from the epoch 2
+			for _, key := range epoch1Keys {
+				assert.NoError(t, db.Delete(key))
+			}
+			smt3, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash, StorageSalt(salt))
+			assert.NoError(t, err)
+			assert.Equal(t, smt2.Root(), smt3.Root())
+			for key, val := range map[uint64][]byte{1: values[4], 2: values[0], 3: values[3]} {
+				got, err := smt3.Get(key, nil)
+				assert.NoError(t, err)
+				assert.Equal(t, val, got)
+				proof, err := smt3.GetProof(key)
+				assert.NoError(t, err)
+				assert.True(t, smt3.VerifyProof(key, proof))
+			}
+			val, err = smt3.Get(2, &version)
+			assert.NoError(t, err)
+			assert.Equal(t, nilHash, val)
+			version = 2
+			val, err = smt3.Get(2, &version)
+			assert.NoError(t, err)
+			assert.Equal(t, values[2], val)
+		})
+	}
+}
+
+func Test_TreeFactory(t *testing.T) {
+	env := prepareEnv()[0]
+	_, err := NewTreeFactory(env.hasher, 7, nilHash)
+	assert.ErrorIs(t, err, ErrInvalidDepth)
+	factory, err := NewTreeFactory(env.hasher, 8, nilHash, BatchSizeLimit(1024))
+	assert.NoError(t, err)
+
+	trees := make([]*BNBSparseMerkleTree, 0, 32)
+	for i := 0; i < 32; i++ {
+		db, err := env.db()
+		assert.NoError(t, err)
+		defer db.Close()
+		tree, err := factory.New(db)
+		assert.NoError(t, err)
+		trees = append(trees, tree.(*BNBSparseMerkleTree))
+	}
+	expected, err := NewBNBSparseMerkleTree(env.hasher, nil, 8, nilHash)
+	assert.NoError(t, err)
+	assert.NoError(t, expected.Set(1, env.hasher.Hash([]byte{1})))
+	for i, tree := range trees {
+		assert.Same(t, factory.hasher, tree.hasher)
+		assert.Same(t, factory.nilHashes, tree.nilHashes)
+		assert.Same(t, factory.pool, tree.goroutinePool)
+		assert.Equal(t, 1024, tree.batchSizeLimit)
+
+		// the trees are independent
+		assert.NoError(t, tree.Set(uint64(i), env.hasher.Hash([]byte{1})))
+		_, err = tree.Commit(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, i == 1, bytes.Equal(expected.Root(), tree.Root()))
+	}
+
+	// the shared pool is released only by the factory
+	for _, tree := range trees {
+		assert.NoError(t, tree.Close())
+	}
+	assert.False(t, factory.pool.IsClosed())
+	assert.NoError(t, factory.Close())
+	assert.True(t, factory.pool.IsClosed())
+}
+
+// collidingHash clears the leading bytes of the hashes, so all the raw keys collide at the path 0.
+type collidingHash struct {
+	hash.Hash
+}
+
+func (h *collidingHash) Sum(b []byte) []byte {
+	sum := h.Hash.Sum(b)
+	copy(sum[len(b):len(b)+8], make([]byte, 8))
+	return sum
+}
+
+func Test_BNBSparseMerkleTree_PathCollision(t *testing.T) {
+	hasher := NewHasherPool(func() hash.Hash { return &collidingHash{Hash: sha256.New()} })
+	db := memory.NewMemoryDB()
+	smt, err := NewBNBSparseMerkleTree(hasher, db, 8, nilHash, KeyRetention())
+	assert.NoError(t, err)
+	assert.Equal(t, smt.KeyPath([]byte("alice")), smt.KeyPath([]byte("bob")))
+
+	val := hasher.Hash([]byte("val"))
+	assert.NoError(t, smt.SetKey([]byte("alice"), val))
+	assert.ErrorIs(t, smt.SetKey([]byte("bob"), val), ErrPathCollision)
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+
+	// the retained keys are persisted on commit
+	smt, err = NewBNBSparseMerkleTree(hasher, db, 8, nilHash, KeyRetention())
+	assert.NoError(t, err)
+	assert.ErrorIs(t, smt.SetKey([]byte("bob"), val), ErrPathCollision)
+	assert.NoError(t, smt.SetKey([]byte("alice"), hasher.Hash([]byte("new val"))))
+
+	// the keys are not checked without retention
+	smt, err = NewBNBSparseMerkleTree(hasher, db, 8, nilHash)
+	assert.NoError(t, err)
+	assert.NoError(t, smt.SetKey([]byte("bob"), val))
+}
+
+func Test_BNBSparseMerkleTree_Frontier(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			db, err := env.db()
+			assert.NoError(t, err)
+			defer db.Close()
+			smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+			assert.NoError(t, err)
+
+			// append the leaves at the next empty slots
+			for next := uint64(0); next < 20; next++ {
+				version := smt.LatestVersion()
+				frontier, err := smt.Frontier(next, version)
+				assert.NoError(t, err)
+				assert.Len(t, frontier, 8)
+
+				leaf := env.hasher.Hash([]byte{byte(next)})
+				verifier := NewProofVerifier(env.hasher)
+				verifier.Init(leaf, next, 8)
+				for _, sibling := range frontier {
+					assert.NoError(t, verifier.Feed(sibling))
+				}
+				assert.NoError(t, smt.Set(next, leaf))
+				_, err = smt.Commit(nil)
+				assert.NoError(t, err)
+				assert.Equal(t, smt.Root(), verifier.Root())
+			}
+
+			_, err = smt.Frontier(3, smt.LatestVersion())
+			assert.ErrorIs(t, err, ErrSlotOccupied)
+			_, err = smt.Frontier(1<<8, smt.LatestVersion())
+			assert.ErrorIs(t, err, ErrInvalidKey)
+		})
+	}
+}
+
+func Test_ReplayChanges(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			db, err := env.db()
+			assert.NoError(t, err)
+			defer db.Close()
+			smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+			assert.NoError(t, err)
+
+			// record the changes of the versions, some of them are skipped
+			var log []ChangeSet
+			roots := make(map[Version][]byte)
+			for i := 1; i <= 10; i++ {
+				version := Version(i * 2)
+				changes := []Item{
+					{Key: uint64(i), Val: env.hasher.Hash([]byte{byte(i)})},
+					{Key: uint64(i * 7 % 256), Val: env.hasher.Hash([]byte{byte(i), 1})},
+				}
+				for _, item := range changes {
+					assert.NoError(t, smt.SetWithVersion(item.Key, item.Val, version))
+				}
+				_, err = smt.CommitWithNewVersion(nil, &version)
+				assert.NoError(t, err)
+				log = append(log, ChangeSet{Version: version, Changes: changes})
+				roots[version] = smt.Root()
+			}
+
+			replayDB, err := env.db()
+			assert.NoError(t, err)
+			defer replayDB.Close()
+			replayed, err := ReplayChanges(log[:5], replayDB, env.hasher, 8, nilHash)
+			assert.NoError(t, err)
+			assert.Equal(t, Version(10), replayed.LatestVersion())
+
+			// the replay resumes after the latest version of the db
+			replayed, err = ReplayChanges(log, replayDB, env.hasher, 8, nilHash)
+			assert.NoError(t, err)
+			assert.Equal(t, smt.LatestVersion(), replayed.LatestVersion())
+			for version, root := range roots {
+				replayedRoot, err := replayed.NodeRootAt(0, 0, version)
+				assert.NoError(t, err)
+				assert.Equal(t, root, replayedRoot)
+			}
+		})
+	}
+}
+
+func Test_BNBSparseMerkleTree_KeySetDigest(t *testing.T) {
+	env := prepareEnv()[0]
+	newTree := func(keys []uint64, val byte) SparseMerkleTree {
+		db, err := env.db()
+		assert.NoError(t, err)
+		smt, err := NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash)
+		assert.NoError(t, err)
+		for _, key := range keys {
+			assert.NoError(t, smt.Set(key, env.hasher.Hash([]byte{val, byte(key)})))
+		}
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+		return smt
+	}
+	digest := func(smt SparseMerkleTree) []byte {
+		d, err := smt.KeySetDigest(smt.LatestVersion())
+		assert.NoError(t, err)
+		return d
+	}
+
+	// the same keys with different values in different orders
+	smt1 := newTree([]uint64{1, 0x1234, 0xffff}, 1)
+	smt2 := newTree([]uint64{0xffff, 1, 0x1234}, 2)
+	assert.NotEqual(t, smt1.Root(), smt2.Root())
+	assert.Equal(t, digest(smt1), digest(smt2))
+
+	smt3 := newTree([]uint64{1, 0x1235, 0xffff}, 1)
+	assert.NotEqual(t, digest(smt1), digest(smt3))
+
+	// deleting the key changes the digest of the later version only
+	assert.NoError(t, smt1.Set(0x1234, nilHash))
+	_, err := smt1.Commit(nil)
+	assert.NoError(t, err)
+	before, err := smt1.KeySetDigest(1)
+	assert.NoError(t, err)
+	assert.Equal(t, digest(smt2), before)
+	assert.Equal(t, digest(newTree([]uint64{1, 0xffff}, 3)), digest(smt1))
+
+	_, err = smt1.KeySetDigest(3)
+	assert.ErrorIs(t, err, ErrVersionTooHigh)
+}
+
+func Test_BNBSparseMerkleTree_ProofStream(t *testing.T) {
+	env := prepareEnv()[0]
+	db, err := env.db()
+	assert.NoError(t, err)
+	defer db.Close()
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash)
+	assert.NoError(t, err)
+
+	keys := []uint64{0, 1, 0x10, 0x1234, 0x1235, 0xabcd, 0xffff}
+	for i, key := range keys[:5] {
+		assert.NoError(t, smt.Set(key, env.hasher.Hash([]byte{byte(i)})))
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+	}
+	// reload the tree, so the nodes are read from storage
+	smt, err = NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash)
+	assert.NoError(t, err)
+
+	for _, version := range []Version{2, 5} {
+		for _, key := range keys {
+			expected, err := smt.GetProofAt(key, version)
+			assert.NoError(t, err)
+			stream, err := smt.ProofStream(key, version)
+			assert.NoError(t, err)
+			var siblings Proof
+			for sibling, ok := stream.Next(); ok; sibling, ok = stream.Next() {
+				siblings = append(siblings, sibling)
+			}
+			assert.NoError(t, stream.Err())
+			assert.Equal(t, expected, siblings)
+		}
+	}
+
+	// the nodes on the path are loaded by Next, not by ProofStream
+	smt, err = NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash)
+	assert.NoError(t, err)
+	misses := smt.Stats().HydrationMisses
+	stream, err := smt.ProofStream(0x1234, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, misses, smt.Stats().HydrationMisses)
+	_, ok := stream.Next()
+	assert.True(t, ok)
+	assert.Greater(t, smt.Stats().HydrationMisses, misses)
+
+	// the failure to load a node stops the stream
+	failing, err := NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash)
+	assert.NoError(t, err)
+	stream, err = failing.ProofStream(0x1234, 5)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Set(StorageKey(TreeNodePrefix, 4, 1), []byte("corrupted")))
+	_, ok = stream.Next()
+	assert.False(t, ok)
+	assert.Error(t, stream.Err())
+
+	_, err = smt.ProofStream(1<<16, 5)
+	assert.ErrorIs(t, err, ErrInvalidKey)
+}
+
+func Test_BNBSparseMerkleTree_ProofSizeStats(t *testing.T) {
+	env := prepareEnv()[0]
+	db, err := env.db()
+	assert.NoError(t, err)
+	defer db.Close()
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash)
+	assert.NoError(t, err)
+	for i := uint64(0); i < 64; i++ {
+		assert.NoError(t, smt.Set(i*i*31%(1<<16), env.hasher.Hash([]byte{byte(i)})))
+	}
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+
+	stats, err := smt.ProofSizeStats(nil, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, ProofStats{}, stats)
+
+	// measure the proofs individually
+	keys := []uint64{0, 31, 124, 0x1234, 0xffff}
+	tree := smt.(*BNBSparseMerkleTree)
+	var sizes, compressedSizes []int
+	for _, key := range keys {
+		proof, err := smt.GetProofAt(key, 1)
+		assert.NoError(t, err)
+		size, compressed := 0, 2
+		for i, sibling := range proof {
+			size += len(sibling)
+			if !bytes.Equal(sibling, tree.nilHashes.Get(16-uint16(i))) {
+				compressed += len(sibling)
+			}
+		}
+		sizes = append(sizes, size)
+		compressedSizes = append(compressedSizes, compressed)
+	}
+	summary := func(values []int) (int, int, float64) {
+		min, max, total := values[0], values[0], 0
+		for _, v := range values {
+			if v < min {
+				min = v
+			}
+			if v > max {
+				max = v
+			}
+			total += v
+		}
+		return min, max, float64(total) / float64(len(values))
+	}
+
+	stats, err = smt.ProofSizeStats(keys, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, len(keys), stats.Count)
+	min, max, mean := summary(sizes)
+	assert.Equal(t, 16*32, max)
+	assert.Equal(t, min, stats.MinSize)
+	assert.Equal(t, max, stats.MaxSize)
+	assert.Equal(t, mean, stats.MeanSize)
+	min, max, mean = summary(compressedSizes)
+	assert.Less(t, min, max)
+	assert.Equal(t, min, stats.MinCompressedSize)
+	assert.Equal(t, max, stats.MaxCompressedSize)
+	assert.Equal(t, mean, stats.MeanCompressedSize)
+
+	_, err = smt.ProofSizeStats([]uint64{1 << 16}, 1)
+	assert.ErrorIs(t, err, ErrInvalidKey)
+}
+
+func Test_BNBSparseMerkleTree_MigrateTo(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			testMigrateTo(t, env.hasher, env.db)
+		})
+	}
+}
+
+func testMigrateTo(t *testing.T, hasher *Hasher, dbInitializer func() (database.TreeDB, error)) {
+	src, err := dbInitializer()
+	assert.NoError(t, err)
+	defer src.Close()
+	dst, err := dbInitializer()
+	assert.NoError(t, err)
+	defer dst.Close()
+	smt, err := NewBNBSparseMerkleTree(hasher, src, 16, nilHash, KeyRetention())
+	assert.NoError(t, err)
+	for i := uint64(0); i < 100; i++ {
+		assert.NoError(t, smt.Set(i*i*31%(1<<16), hasher.Hash([]byte{byte(i)})))
+		if i%10 == 9 {
+			_, err = smt.Commit(nil)
+			assert.NoError(t, err)
+		}
+	}
+	assert.NoError(t, smt.SetKey([]byte("key"), hasher.Hash([]byte("key"))))
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+	// the leaves cleared by DeletePrefix stay persisted, they are read as empty on dst too
+	assert.NoError(t, smt.DeletePrefix(0xf, 4))
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+	deleted := func(key uint64) bool {
+		return key>>12 == 0xf
+	}
+	count, err := smt.LeafCount(smt.LatestVersion())
+	assert.NoError(t, err)
+
+	// the reads run against the database switched under them
+	done := make(chan struct{})
+	started := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			if i == 1 {
+				close(started)
+			}
+			select {
+			case <-done:
+				return
+			default:
+			}
+			// the leaves missed by the cache are read from the database
+			if _, err := smt.Get(uint64(i), nil); err != nil {
+				assert.ErrorIs(t, err, ErrNodeNotFound)
+			}
+			runtime.Gosched()
+		}
+	}()
+	<-started
+	assert.NoError(t, smt.MigrateTo(dst))
+	close(done)
+	wg.Wait()
+	for i := uint64(0); i < 100; i += 7 {
+		key := i * i * 31 % (1 << 16)
+		val, err := smt.Get(key, nil)
+		assert.NoError(t, err)
+		if deleted(key) {
+			assert.Equal(t, smt.(*BNBSparseMerkleTree).nilHashes.Get(16), val)
+		} else {
+			assert.Equal(t, hasher.Hash([]byte{byte(i)}), val)
+		}
+		proof, err := smt.GetProof(key)
+		assert.NoError(t, err)
+		assert.True(t, smt.VerifyProof(key, proof))
+	}
+
+	// the commits after the switch are written to dst only
+	assert.NoError(t, smt.Set(1, hasher.Hash([]byte("new"))))
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+	migrated, err := NewBNBSparseMerkleTree(hasher, dst, 16, nilHash, KeyRetention())
+	assert.NoError(t, err)
+	assert.Equal(t, smt.LatestVersion(), migrated.LatestVersion())
+	assert.Equal(t, smt.Root(), migrated.Root())
+	migratedCount, err := migrated.LeafCount(migrated.LatestVersion() - 1)
+	assert.NoError(t, err)
+	assert.Equal(t, count, migratedCount)
+	var cleared int
+	for i := uint64(0); i < 100; i++ {
+		key := i * i * 31 % (1 << 16)
+		if !deleted(key) {
+			continue
+		}
+		cleared++
+		val, err := migrated.Get(key, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, migrated.(*BNBSparseMerkleTree).nilHashes.Get(16), val)
+	}
+	assert.NotZero(t, cleared)
+	version := Version(5)
+	val, err := migrated.Get(0, &version)
+	assert.NoError(t, err)
+	assert.Equal(t, hasher.Hash([]byte{0}), val)
+	rawKey, err := dst.Get(rawKeyKey(smt.KeyPath([]byte("key"))))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("key"), rawKey)
+	old, err := NewBNBSparseMerkleTree(hasher, src, 16, nilHash)
+	assert.NoError(t, err)
+	assert.Equal(t, smt.LatestVersion()-1, old.LatestVersion())
+}
+
+func Test_BNBSparseMerkleTree_BackupTo(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			testBackupTo(t, env.hasher, env.db)
+		})
+	}
+}
+
+func testBackupTo(t *testing.T, hasher *Hasher, dbInitializer func() (database.TreeDB, error)) {
+	src, err := dbInitializer()
+	assert.NoError(t, err)
+	defer src.Close()
+	smt, err := NewBNBSparseMerkleTree(hasher, src, 16, nilHash, LatestIndex())
+	assert.NoError(t, err)
+	roots := make(map[Version][]byte)
+	for i := uint64(0); i < 100; i++ {
+		assert.NoError(t, smt.Set(i*i*31%(1<<16), hasher.Hash([]byte{byte(i)})))
+		if i%10 == 9 {
+			version, err := smt.Commit(nil)
+			assert.NoError(t, err)
+			roots[version] = smt.Root()
+		}
+	}
+	// the leaves cleared by DeletePrefix are read as empty after the restore
+	assert.NoError(t, smt.DeletePrefix(0xf, 4))
+	version, err := smt.Commit(nil)
+	assert.NoError(t, err)
+	roots[version] = smt.Root()
+	proofs := make(map[uint64]Proof)
+	for i := uint64(0); i < 100; i += 7 {
+		key := i * i * 31 % (1 << 16)
+		proofs[key], err = smt.GetProof(key)
+		assert.NoError(t, err)
+	}
+	// the uncommitted changes are not included
+	assert.NoError(t, smt.Set(1, hasher.Hash([]byte("uncommitted"))))
+
+	path := filepath.Join(t.TempDir(), "tree.backup")
+	assert.NoError(t, smt.BackupTo(path))
+	_, err = os.Stat(path + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+
+	db, err := dbInitializer()
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.NoError(t, RestoreFrom(path, db))
+	assert.ErrorIs(t, RestoreFrom(path, db), ErrDatabaseNotEmpty)
+	restored, err := NewBNBSparseMerkleTree(hasher, db, 16, nilHash, LatestIndex())
+	assert.NoError(t, err)
+	assert.Equal(t, smt.LatestVersion(), restored.LatestVersion())
+	assert.Equal(t, roots[restored.LatestVersion()], restored.Root())
+	for version := range roots {
+		v := version
+		val, err := restored.Get(0, &v)
+		assert.NoError(t, err)
+		assert.Equal(t, hasher.Hash([]byte{0}), val)
+	}
+	for key, expected := range proofs {
+		proof, err := restored.GetProof(key)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, proof)
+		assert.True(t, restored.VerifyProof(key, proof))
+	}
+	var cleared int
+	for i := uint64(0); i < 100; i++ {
+		key := i * i * 31 % (1 << 16)
+		expected, err := smt.GetCommitted(key, nil)
+		assert.NoError(t, err)
+		val, err := restored.Get(key, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, val)
+		if key>>12 == 0xf {
+			cleared++
+			assert.Equal(t, restored.(*BNBSparseMerkleTree).nilHashes.Get(16), val)
+			has, err := db.Has(latestIndexKey(uint64Path(key)))
+			assert.NoError(t, err)
+			assert.True(t, has)
+		}
+	}
+	assert.NotZero(t, cleared)
+
+	// a truncated file is rejected before anything is written
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	truncated := filepath.Join(t.TempDir(), "truncated.backup")
+	assert.NoError(t, os.WriteFile(truncated, data[:len(data)/2], 0600))
+	empty, err := dbInitializer()
+	assert.NoError(t, err)
+	defer empty.Close()
+	assert.ErrorIs(t, RestoreFrom(truncated, empty), ErrInvalidBackup)
+	has, err := empty.Has(latestVersionKey)
+	assert.NoError(t, err)
+	assert.False(t, has)
+}
+
+func Test_BNBSparseMerkleTree_SubtreeCounts(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			db, err := env.db()
+			assert.NoError(t, err)
+			defer db.Close()
+			smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash, SubtreeCounts())
+			assert.NoError(t, err)
+			tree := smt.(*BNBSparseMerkleTree)
+
+			// 0x00-0x0f under the child 0, 0x10-0x17 under the child 1
+			var items []Item
+			for i := uint64(0); i < 0x18; i++ {
+				items = append(items, Item{Key: i, Val: env.hasher.Hash([]byte{byte(i)})})
+			}
+			assert.NoError(t, smt.MultiSet(items[:0x10]))
+			_, err = smt.Commit(nil)
+			assert.NoError(t, err)
+			for _, item := range items[0x10:] {
+				assert.NoError(t, smt.Set(item.Key, item.Val))
+			}
+			_, err = smt.Commit(nil)
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(0x18), tree.root.LeafCount())
+			assert.Equal(t, uint64(0x10), tree.root.Children[0].LeafCount())
+			assert.Equal(t, uint64(0x08), tree.root.Children[1].LeafCount())
+
+			// delete the leaves
+			assert.NoError(t, smt.Set(0x01, nilHash))
+			assert.NoError(t, smt.Set(0x11, nilHash))
+			assert.NoError(t, smt.Set(0x12, nilHash))
+			_, err = smt.Commit(nil)
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(0x15), tree.root.LeafCount())
+			assert.Equal(t, uint64(0x0f), tree.root.Children[0].LeafCount())
+			assert.Equal(t, uint64(0x06), tree.root.Children[1].LeafCount())
+			for version, expected := range map[Version]uint64{1: 0x10, 2: 0x18, 3: 0x15} {
+				count, err := smt.LeafCount(version)
+				assert.NoError(t, err)
+				assert.Equal(t, expected, count)
+			}
+
+			// the counts are persisted
+			reopened, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash, SubtreeCounts())
+			assert.NoError(t, err)
+			count, err := reopened.LeafCount(3)
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(0x15), count)
+			assert.NoError(t, reopened.Set(0x20, items[0].Val))
+			_, err = reopened.Commit(nil)
+			assert.NoError(t, err)
+			count, err = reopened.LeafCount(4)
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(0x16), count)
+
+			// and rolled back
+			assert.NoError(t, smt.Rollback(2))
+			assert.Equal(t, uint64(0x18), tree.root.LeafCount())
+			assert.Equal(t, uint64(0x08), tree.root.Children[1].LeafCount())
+			reopened, err = NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash, SubtreeCounts())
+			assert.NoError(t, err)
+			count, err = reopened.LeafCount(2)
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(0x18), count)
+		})
+	}
+}
+
+func Test_BNBSparseMerkleTree_PendingRoot(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			db, err := env.db()
+			assert.NoError(t, err)
+			defer db.Close()
+			smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+			assert.NoError(t, err)
+			_, committed := smt.Latest()
+			assert.Equal(t, committed, smt.PendingRoot())
+
+			assert.NoError(t, smt.Set(1, env.hasher.Hash([]byte{1})))
+			assert.NoError(t, smt.MultiSet([]Item{
+				{Key: 2, Val: env.hasher.Hash([]byte{2})},
+				{Key: 0x30, Val: env.hasher.Hash([]byte{3})},
+			}))
+			pending := smt.PendingRoot()
+			assert.NotEqual(t, committed, pending)
+			_, latest := smt.Latest()
+			assert.Equal(t, committed, latest)
+			assert.Equal(t, Version(0), smt.LatestVersion())
+
+			_, err = smt.Commit(nil)
+			assert.NoError(t, err)
+			_, latest = smt.Latest()
+			assert.Equal(t, pending, latest)
+			assert.Equal(t, pending, smt.PendingRoot())
+
+			// it is read safely while the changes are staged concurrently
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for key := uint64(0); key < 64; key++ {
+					assert.NoError(t, smt.Set(key, env.hasher.Hash([]byte{byte(key)})))
+				}
+			}()
+			for i := 0; i < 64; i++ {
+				assert.NotEmpty(t, smt.PendingRoot())
+			}
+			wg.Wait()
+			assert.Equal(t, smt.Root(), smt.PendingRoot())
+		})
+	}
+}
+
+func Test_BNBSparseMerkleTree_MaxDepth(t *testing.T) {
+	env := prepareEnv()[0]
+	for _, depth := range []uint8{68, 128, 252} {
+		_, err := NewBNBSparseMerkleTree(env.hasher, nil, depth, nilHash)
+		assert.ErrorIs(t, err, ErrInvalidDepth)
+		_, err = NewTreeFactory(env.hasher, depth, nilHash)
+		assert.ErrorIs(t, err, ErrInvalidDepth)
+	}
+
+	// the full 64-bit key space
+	db, err := env.db()
+	assert.NoError(t, err)
+	defer db.Close()
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 64, nilHash)
+	assert.NoError(t, err)
+	keys := []uint64{0, 1, 1 << 63, math.MaxUint64}
+	for i, key := range keys {
+		assert.NoError(t, smt.Set(key, env.hasher.Hash([]byte{byte(i)})))
+	}
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+	expected, err := ComputeRoot(map[uint64][]byte{
+		0:              env.hasher.Hash([]byte{0}),
+		1:              env.hasher.Hash([]byte{1}),
+		1 << 63:        env.hasher.Hash([]byte{2}),
+		math.MaxUint64: env.hasher.Hash([]byte{3}),
+	}, 64, nilHash, env.hasher)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, smt.Root())
+	for i, key := range keys {
+		val, err := smt.Get(key, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, env.hasher.Hash([]byte{byte(i)}), val)
+		proof, err := smt.GetProof(key)
+		assert.NoError(t, err)
+		assert.Len(t, proof, 64)
+		assert.True(t, smt.VerifyProof(key, proof))
+	}
+}
+
+// wideRoot computes the root of a tree of the depth holding the leaves level by level,
+// a missing sibling is the nil hash of its depth.
+func wideRoot(hasher *Hasher, leaves map[WideKey][]byte, depth uint16) []byte {
+	nilHashes := constructNilHashes(depth, nilHash, hasher)
+	level := make(map[nodePath][]byte, len(leaves))
+	for key, val := range leaves {
+		level[key.path()] = val
+	}
+	for d := depth; d > 0; d-- {
+		parents := make(map[nodePath][]byte, len(level))
+		for path, hash := range level {
+			sibling, ok := level[path.sibling()]
+			if !ok {
+				sibling = nilHashes.Get(d)
+			}
+			if path.bit(0) == 0 {
+				parents[path.rsh(1)] = hasher.HashChildren(hash, sibling)
+			} else {
+				parents[path.rsh(1)] = hasher.HashChildren(sibling, hash)
+			}
+		}
+		level = parents
+	}
+	if root, ok := level[nodePath{}]; ok {
+		return root
+	}
+	return nilHashes.Get(0)
+}
+
+func Test_BNBSparseMerkleTree_WideDepth(t *testing.T) {
+	maxKey := WideKey{}
+	for i := range maxKey {
+		maxKey[i] = 0xff
+	}
+	topKey := WideKey{0: 0x80}
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			db, err := env.db()
+			assert.NoError(t, err)
+			defer db.Close()
+			smt, err := NewBNBSparseMerkleTree(env.hasher, db, 64, nilHash, WideDepth(256))
+			assert.NoError(t, err)
+			tree := smt.(*BNBSparseMerkleTree)
+			assert.Equal(t, uint16(256), tree.maxDepth)
+			assert.Equal(t, constructNilHashes(256, nilHash, env.hasher).Get(0), smt.Root())
+
+			hashKey := WideKey{}
+			copy(hashKey[:], env.hasher.Hash([]byte("wide")))
+			leaves := map[WideKey][]byte{
+				{}:                    env.hasher.Hash([]byte{0}),
+				maxKey:                env.hasher.Hash([]byte{1}),
+				topKey:                env.hasher.Hash([]byte{2}),
+				WideKeyFromUint64(7):  env.hasher.Hash([]byte{3}),
+				hashKey:               env.hasher.Hash([]byte{4}),
+				WideKeyFromUint64(15): env.hasher.Hash([]byte{5}),
+			}
+			// a single leaf hashes up 256 levels of nil siblings
+			assert.NoError(t, smt.SetWide(topKey, leaves[topKey]))
+			node := leaves[topKey]
+			for level := 0; level < 256; level++ {
+				sibling := tree.nilHashes.Get(uint16(256 - level))
+				if level == 255 {
+					node = env.hasher.HashChildren(sibling, node)
+				} else {
+					node = env.hasher.HashChildren(node, sibling)
+				}
+			}
+			assert.Equal(t, node, smt.Root())
+
+			for key, val := range leaves {
+				assert.NoError(t, smt.SetWide(key, val))
+			}
+			version, err := smt.Commit(nil)
+			assert.NoError(t, err)
+			assert.Equal(t, Version(1), version)
+			root1 := smt.Root()
+			assert.Equal(t, wideRoot(env.hasher, leaves, 256), root1)
+
+			verify := func(key WideKey, val []byte, proof Proof, root []byte) {
+				assert.Len(t, proof, 256)
+				node := val
+				for level, sibling := range proof {
+					if key[31-level/8]>>(level%8)&1 == 0 {
+						node = env.hasher.HashChildren(node, sibling)
+					} else {
+						node = env.hasher.HashChildren(sibling, node)
+					}
+				}
+				assert.Equal(t, root, node)
+			}
+			for key, val := range leaves {
+				got, err := smt.GetWide(key, nil)
+				assert.NoError(t, err)
+				assert.Equal(t, val, got)
+				proof, err := smt.GetWideProof(key)
+				assert.NoError(t, err)
+				verify(key, val, proof, root1)
+				assert.True(t, smt.VerifyWideProof(key, proof))
+				proof[128] = env.hasher.Hash([]byte("tampered"))
+				assert.False(t, smt.VerifyWideProof(key, proof))
+			}
+			// the proof of exclusion of an empty leaf next to the occupied ones
+			absent := maxKey
+			absent[31] = 0xfe
+			proof, err := smt.GetWideProof(absent)
+			assert.NoError(t, err)
+			verify(absent, nilHash, proof, root1)
+
+			// the uint64 keys address the lowest leaves
+			val, err := smt.Get(7, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, leaves[WideKeyFromUint64(7)], val)
+			proof, err = smt.GetProof(15)
+			assert.NoError(t, err)
+			assert.True(t, smt.VerifyProof(15, proof))
+			ok, err := smt.VerifyAgainstHistory(proof, 15, leaves[WideKeyFromUint64(15)], 1)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+
+			leaves[maxKey] = env.hasher.Hash([]byte{6})
+			assert.NoError(t, smt.SetWide(maxKey, leaves[maxKey]))
+			assert.NoError(t, smt.Set(7, nil))
+			delete(leaves, WideKeyFromUint64(7))
+			_, err = smt.Commit(nil)
+			assert.NoError(t, err)
+			assert.Equal(t, wideRoot(env.hasher, leaves, 256), smt.Root())
+			proof, err = smt.GetWideProofAt(maxKey, 1)
+			assert.NoError(t, err)
+			verify(maxKey, env.hasher.Hash([]byte{1}), proof, root1)
+			val, err = smt.GetWide(maxKey, &version)
+			assert.NoError(t, err)
+			assert.Equal(t, env.hasher.Hash([]byte{1}), val)
+
+			// the nodes within 64 levels keep their storage keys, the deeper ones are keyed by 32-byte paths
+			_, err = db.Get(storageFullTreeNodeKey(4, 0xf))
+			assert.NoError(t, err)
+			_, err = db.Get(nodeStorageKey(TreeNodePrefix, 256, maxKey.path()))
+			assert.NoError(t, err)
+
+			// reload from storage
+			root2 := smt.Root()
+			reloaded, err := NewBNBSparseMerkleTree(env.hasher, db, 64, nilHash, WideDepth(256))
+			assert.NoError(t, err)
+			assert.Equal(t, root2, reloaded.Root())
+			assert.Equal(t, smt.Fingerprint(), reloaded.Fingerprint())
+			for key, val := range leaves {
+				got, err := reloaded.GetWide(key, nil)
+				assert.NoError(t, err)
+				assert.Equal(t, val, got)
+				proof, err := reloaded.GetWideProof(key)
+				assert.NoError(t, err)
+				verify(key, val, proof, root2)
+			}
+
+			assert.NoError(t, reloaded.Rollback(1))
+			assert.Equal(t, root1, reloaded.Root())
+			val, err = reloaded.GetWide(maxKey, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, env.hasher.Hash([]byte{1}), val)
+
+			// the operations enumerating the leaves by uint64 keys are rejected
+			assert.ErrorIs(t, smt.SetKey([]byte("raw"), []byte{1}), ErrInvalidDepth)
+			assert.ErrorIs(t, smt.DeletePrefix(0, 4), ErrInvalidDepth)
+		})
+	}
+
+	env := prepareEnv()[0]
+	for _, depth := range []uint16{130, 260} {
+		_, err := NewBNBSparseMerkleTree(env.hasher, nil, 64, nilHash, WideDepth(depth))
+		assert.ErrorIs(t, err, ErrInvalidDepth)
+	}
+	smt, err := NewBNBSparseMerkleTree(env.hasher, nil, 64, nilHash, WideDepth(128))
+	assert.NoError(t, err)
+	assert.ErrorIs(t, smt.SetWide(topKey, []byte{1}), ErrInvalidKey)
+	key := WideKey{16: 0x80}
+	assert.NoError(t, smt.SetWide(key, env.hasher.Hash([]byte{1})))
+	assert.Equal(t, wideRoot(env.hasher, map[WideKey][]byte{key: env.hasher.Hash([]byte{1})}, 128), smt.Root())
+	proof, err := smt.GetWideProof(key)
+	assert.NoError(t, err)
+	assert.Len(t, proof, 128)
+	assert.True(t, smt.VerifyWideProof(key, proof))
+}
+
+// slowBatchDB delays the writes of its batches.
+type slowBatchDB struct {
+	database.TreeDB
+	delay time.Duration
+}
+
+func (db *slowBatchDB) NewBatch() database.Batcher {
+	return &slowBatch{Batcher: db.TreeDB.NewBatch(), delay: db.delay}
+}
+
+type slowBatch struct {
+	database.Batcher
+	delay time.Duration
+}
+
+func (b *slowBatch) Write() error {
+	time.Sleep(b.delay)
+	return b.Batcher.Write()
+}
+
+func Test_BNBSparseMerkleTree_CloseWaitsCommitAsync(t *testing.T) {
+	env := prepareEnv()[0]
+	db := &slowBatchDB{TreeDB: memory.NewMemoryDB(), delay: 50 * time.Millisecond}
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+	assert.NoError(t, err)
+	assert.NoError(t, smt.Set(1, env.hasher.Hash([]byte{1})))
+	result := smt.CommitAsync(nil)
+	assert.NoError(t, smt.Close())
+	// the commit has completed before Close returns
+	select {
+	case res := <-result:
+		assert.NoError(t, res.Err)
+		assert.Equal(t, Version(1), res.Version)
+	default:
+		t.Fatal("the commit is still in flight")
+	}
+	reopened, err := NewBNBSparseMerkleTree(env.hasher, db.TreeDB, 8, nilHash)
+	assert.NoError(t, err)
+	assert.Equal(t, Version(1), reopened.LatestVersion())
+
+	// the pools are kept if the commit does not finish in time
+	smt, err = NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash, CloseTimeout(time.Millisecond))
+	assert.NoError(t, err)
+	assert.NoError(t, smt.Set(2, env.hasher.Hash([]byte{2})))
+	result = smt.CommitAsync(nil)
+	assert.ErrorIs(t, smt.Close(), ErrCloseTimeout)
+	assert.False(t, smt.(*BNBSparseMerkleTree).goroutinePool.IsClosed())
+	res := <-result
+	assert.NoError(t, res.Err)
+	assert.NoError(t, smt.Close())
+	assert.True(t, smt.(*BNBSparseMerkleTree).goroutinePool.IsClosed())
+}
+
+func Test_BNBSparseMerkleTree_NoInternalStorage(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			testNoInternalStorage(t, env)
+		})
+	}
+}
+
+func testNoInternalStorage(t *testing.T, env testEnv) {
+	var items []Item
+	for i := uint64(0); i < 100; i++ {
+		items = append(items, Item{Key: i * 613 % (1 << 16), Val: env.hasher.Hash([]byte{byte(i)})})
+	}
+	build := func(db database.TreeDB, opts ...Option) SparseMerkleTree {
+		smt, err := NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash, opts...)
+		assert.NoError(t, err)
+		assert.NoError(t, smt.MultiSet(items[:50]))
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+		return smt
+	}
+	fullDB, err := env.db()
+	assert.NoError(t, err)
+	defer fullDB.Close()
+	db, err := env.db()
+	assert.NoError(t, err)
+	defer db.Close()
+	expected := build(fullDB)
+	build(db, NoInternalStorage())
+
+	// the internals are omitted in storage
+	for _, key := range [][]byte{storageFullTreeNodeKey(0, 0), storageFullTreeNodeKey(8, items[1].Key>>8)} {
+		full, err := fullDB.Get(key)
+		assert.NoError(t, err)
+		buf, err := db.Get(key)
+		assert.NoError(t, err)
+		assert.Less(t, len(buf)+14*32, len(full)+1)
+		node := &StorageTreeNode{}
+		assert.NoError(t, rlp.DecodeBytes(buf, node))
+		for _, internal := range node.Internals {
+			assert.Empty(t, internal)
+		}
+	}
+
+	// the internals are recomputed on load
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash, NoInternalStorage())
+	assert.NoError(t, err)
+	assert.Equal(t, expected.Root(), smt.Root())
+	for i := 0; i < 50; i += 5 {
+		item := items[i]
+		proof, err := smt.GetProof(item.Key)
+		assert.NoError(t, err)
+		expectedProof, err := expected.GetProof(item.Key)
+		assert.NoError(t, err)
+		assert.Equal(t, expectedProof, proof)
+	}
+	for _, tree := range []SparseMerkleTree{expected, smt} {
+		assert.NoError(t, tree.MultiSet(items[50:80]))
+		for _, item := range items[80:] {
+			assert.NoError(t, tree.Set(item.Key, item.Val))
+		}
+		_, err = tree.Commit(nil)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, expected.Root(), smt.Root())
+}
+
+func Test_BNBSparseMerkleTree_RepairDirtyNodes(t *testing.T) {
+	env := prepareEnv()[0]
+	smt, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 8, nilHash)
+	assert.NoError(t, err)
+	for i := uint64(0); i < 8; i++ {
+		assert.NoError(t, smt.Set(i*31, env.hasher.Hash([]byte{byte(i)})))
+	}
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+	root := smt.Root()
+	tree := smt.(*BNBSparseMerkleTree)
+
+	// the commit is aborted after the nodes are marked
+	tree.root.mark(3)
+	tree.root.Children[1].mark(15)
+	smt.Reset()
+	assert.False(t, tree.root.isInternalPresent(0))
+	assert.False(t, tree.root.Children[1].isInternalPresent(13))
+
+	assert.NoError(t, smt.RepairDirtyNodes())
+	for i := 0; i < 14; i++ {
+		assert.True(t, tree.root.isInternalPresent(i))
+		assert.True(t, tree.root.Children[1].isInternalPresent(i))
+	}
+	assert.False(t, tree.root.isDirty())
+	assert.Equal(t, root, smt.Root())
+	for i := uint64(0); i < 8; i++ {
+		proof, err := smt.GetProof(i * 31)
+		assert.NoError(t, err)
+		assert.True(t, smt.VerifyProof(i*31, proof))
+	}
+
+	// the children do not produce the root of the node any more
+	tree.root.Children[1].Children[15].Versions[0].Hash = env.hasher.Hash([]byte("corrupted"))
+	tree.root.Children[1].mark(15)
+	assert.ErrorIs(t, smt.RepairDirtyNodes(), ErrRepairMismatched)
+}
+
+func Test_BNBSparseMerkleTree_ProofsDuringRollback(t *testing.T) {
+	env := prepareEnv()[0]
+	db := &slowBatchDB{TreeDB: memory.NewMemoryDB()}
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+	assert.NoError(t, err)
+	values := make([][][]byte, 2)
+	roots := make([][]byte, 2)
+	for v := range values {
+		for key := uint64(0); key < 32; key++ {
+			values[v] = append(values[v], env.hasher.Hash([]byte{byte(v), byte(key)}))
+			assert.NoError(t, smt.Set(key*7, values[v][key]))
+		}
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+		roots[v] = smt.Root()
+	}
+	postRoot, preRoot := roots[0], roots[1]
+
+	var (
+		done    = make(chan struct{})
+		served  int64
+		invalid int64
+		wg      sync.WaitGroup
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for key := uint64(0); key < 32; key++ {
+				proof, err := smt.GetProof(key * 7)
+				if err != nil {
+					atomic.AddInt64(&invalid, 1)
+					continue
+				}
+				// the proof is either of the tree before or after the rollback
+				pre := ProofItem{Key: key * 7, Value: values[1][key], Root: preRoot, Proof: proof}
+				post := ProofItem{Key: key * 7, Value: values[0][key], Root: postRoot, Proof: proof}
+				if pre.Verify(env.hasher) != nil && post.Verify(env.hasher) != nil {
+					atomic.AddInt64(&invalid, 1)
+				}
+				atomic.AddInt64(&served, 1)
+			}
+		}
+	}()
+
+	// the proofs are served while the rollback is writing
+	db.delay = 100 * time.Millisecond
+	for atomic.LoadInt64(&served) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	before := atomic.LoadInt64(&served)
+	assert.NoError(t, smt.Rollback(1))
+	// the proofs are not blocked by the rollback
+	assert.Greater(t, atomic.LoadInt64(&served), before)
+	close(done)
+	wg.Wait()
+	assert.Zero(t, atomic.LoadInt64(&invalid))
+
+	assert.Equal(t, postRoot, smt.Root())
+	for key := uint64(0); key < 32; key++ {
+		proof, err := smt.GetProof(key * 7)
+		assert.NoError(t, err)
+		item := ProofItem{Key: key * 7, Value: values[0][key], Root: postRoot, Proof: proof}
+		assert.NoError(t, item.Verify(env.hasher))
+	}
+
+	// a rollback waiting for commitMu sees the tree sealed meanwhile
+	tree := smt.(*BNBSparseMerkleTree)
+	db.delay = 0
+	tree.commitMu.Lock()
+	errCh := make(chan error)
+	go func() {
+		errCh <- smt.Rollback(0)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	tree.sealedVersion = tree.version
+	atomic.StoreUint32(&tree.sealed, 1)
+	tree.commitMu.Unlock()
+	assert.ErrorIs(t, <-errCh, ErrTreeSealed)
+	assert.Equal(t, postRoot, smt.Root())
+}
+
+func Test_BNBSparseMerkleTree_VersionStorageDelta(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			testVersionStorageDelta(t, env)
+		})
+	}
+}
+
+func testVersionStorageDelta(t *testing.T, env testEnv) {
+	db, err := env.db()
+	assert.NoError(t, err)
+	defer db.Close()
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+	assert.NoError(t, err)
+
+	// the storage size of the nodes on the paths of the keys
+	keys := make(map[uint64]bool)
+	storageSize := func() uint64 {
+		nodes := map[string]bool{string(storageFullTreeNodeKey(0, 0)): true}
+		for key := range keys {
+			nodes[string(storageFullTreeNodeKey(4, key>>4))] = true
+			nodes[string(storageFullTreeNodeKey(8, key))] = true
+		}
+		size := uint64(0)
+		for node := range nodes {
+			buf, err := db.Get([]byte(node))
+			if err == nil {
+				size += uint64(len(buf))
+			}
+		}
+		return size
+	}
+
+	changes := [][]uint64{
+		{1, 2, 0x31},
+		{3},
+		{1, 0x32, 0xf0},
+		{0x31},
+	}
+	var deltas []uint64
+	for i, change := range changes {
+		before := storageSize()
+		for _, key := range change {
+			keys[key] = true
+			assert.NoError(t, smt.Set(key, env.hasher.Hash([]byte{byte(i), byte(key)})))
+		}
+		_, err := smt.Commit(nil)
+		assert.NoError(t, err)
+		deltas = append(deltas, storageSize()-before)
+	}
+
+	for i, expected := range deltas {
+		delta, err := smt.VersionStorageDelta(Version(i + 1))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, delta, "version %d", i+1)
+	}
+	// updating a leaf only appends versions, while creating a leaf adds its node
+	assert.Less(t, deltas[3], deltas[1])
+
+	_, err = smt.VersionStorageDelta(Version(len(changes) + 1))
+	assert.ErrorIs(t, err, ErrVersionTooHigh)
+}
+
+func Test_BNBSparseMerkleTree_LatestIndex(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			testLatestIndex(t, env)
+		})
+	}
+}
+
+func testLatestIndex(t *testing.T, env testEnv) {
+	db, err := env.db()
+	assert.NoError(t, err)
+	defer db.Close()
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash, LatestIndex())
+	assert.NoError(t, err)
+	tree := smt.(*BNBSparseMerkleTree)
+	nilLeaf := tree.nilHashes.Get(8)
+
+	// the index matches the leaves walked from the root
+	verifyIndex := func(t *testing.T) {
+		latest := smt.LatestVersion()
+		for key := uint64(0); key < 256; key++ {
+			version, hash, ok, err := tree.indexedLeaf(uint64Path(key))
+			assert.NoError(t, err)
+			walked, err := smt.Get(key, &latest)
+			if !ok {
+				// the keys never set are not indexed
+				if err == nil {
+					assert.Equal(t, nilLeaf, walked, "key %d", key)
+				} else {
+					assert.ErrorIs(t, err, ErrNodeNotFound)
+				}
+				continue
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, walked, hash, "key %d", key)
+			history, err := smt.KeyHistory(key)
+			assert.NoError(t, err)
+			assert.Equal(t, history[len(history)-1], version, "key %d", key)
+
+			value, err := smt.Get(key, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, walked, value)
+		}
+	}
+
+	for key := uint64(0); key < 32; key++ {
+		assert.NoError(t, smt.Set(key*7, env.hasher.Hash([]byte{1, byte(key)})))
+	}
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+	verifyIndex(t)
+
+	// updates, deletes and new keys
+	for key := uint64(0); key < 32; key += 3 {
+		assert.NoError(t, smt.Set(key*7, env.hasher.Hash([]byte{2, byte(key)})))
+		assert.NoError(t, smt.Set(key*7+1, env.hasher.Hash([]byte{2, byte(key)})))
+	}
+	for key := uint64(1); key < 32; key += 5 {
+		assert.NoError(t, smt.Set(key*7, nilLeaf))
+	}
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+	verifyIndex(t)
+
+	// the entries of the keys set after the version are rolled back
+	assert.NoError(t, smt.Rollback(1))
+	verifyIndex(t)
+	_, _, ok, err := tree.indexedLeaf(uint64Path(1))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func Test_BNBSparseMerkleTree_HashTruncation(t *testing.T) {
+	hasher := NewHasherPool(func() hash.Hash { return sha256.New() })
+	truncated := hasher.Truncate(31)
+	assert.Equal(t, 31, truncated.Size())
+
+	var items []Item
+	for i := uint64(0); i < 50; i++ {
+		items = append(items, Item{Key: i * 97 % (1 << 16), Val: truncated.Hash([]byte{byte(i)})})
+	}
+	build := func(db database.TreeDB, hasher *Hasher, nilHash []byte, opts ...Option) SparseMerkleTree {
+		smt, err := NewBNBSparseMerkleTree(hasher, db, 16, nilHash, opts...)
+		assert.NoError(t, err)
+		assert.NoError(t, smt.MultiSet(items))
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+		return smt
+	}
+	db, fullDB := memory.NewMemoryDB(), memory.NewMemoryDB()
+	smt := build(db, hasher, nilHash, HashTruncation(31))
+	full := build(fullDB, hasher, nilHash)
+
+	// the same as the tree of the truncated hasher
+	expected := build(memory.NewMemoryDB(), truncated, nilHash[:31])
+	assert.Len(t, smt.Root(), 31)
+	assert.Equal(t, expected.Root(), smt.Root())
+	assert.NotEqual(t, full.Root()[:31], smt.Root())
+
+	for _, item := range items[:10] {
+		proof, err := smt.GetProof(item.Key)
+		assert.NoError(t, err)
+		for _, sibling := range proof {
+			assert.Len(t, sibling, 31)
+		}
+		assert.True(t, smt.VerifyProof(item.Key, proof))
+		proofItem := ProofItem{Key: item.Key, Value: item.Val, Root: smt.Root(), Proof: proof}
+		assert.NoError(t, proofItem.Verify(truncated))
+	}
+
+	// the stored nodes hold the truncated hashes
+	for _, key := range [][]byte{storageFullTreeNodeKey(0, 0), storageFullTreeNodeKey(8, items[1].Key>>8)} {
+		buf, err := db.Get(key)
+		assert.NoError(t, err)
+		fullBuf, err := fullDB.Get(key)
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, len(buf)+14, len(fullBuf))
+		node := &StorageTreeNode{}
+		assert.NoError(t, rlp.DecodeBytes(buf, node))
+		for _, internal := range node.Internals {
+			assert.Len(t, internal, 31)
+		}
+	}
+
+	reopened, err := NewBNBSparseMerkleTree(hasher, db, 16, nilHash, HashTruncation(31))
+	assert.NoError(t, err)
+	assert.Equal(t, smt.Root(), reopened.Root())
+	assert.NoError(t, reopened.Set(items[0].Key, truncated.Hash([]byte("changed"))))
+	assert.NoError(t, expected.Set(items[0].Key, truncated.Hash([]byte("changed"))))
+	assert.Equal(t, expected.Root(), reopened.Root())
+
+	// the raw keys are hashed into paths by the truncated hasher
+	keyed, err := NewBNBSparseMerkleTree(hasher, nil, 64, nilHash, HashTruncation(8))
+	assert.NoError(t, err)
+	assert.NoError(t, keyed.SetKey([]byte("raw"), truncated.Hash([]byte{1})))
+	for _, size := range []int{-1, 4, 7, 32, 33} {
+		_, err := NewBNBSparseMerkleTree(hasher, nil, 16, nilHash, HashTruncation(size))
+		assert.ErrorIs(t, err, ErrInvalidTruncation, "size %d", size)
+		_, err = NewSparseMerkleTree(hasher, memory.NewMemoryDB(), 16, constructNilHashes(16, nilHash, hasher).hashes, HashTruncation(size))
+		assert.ErrorIs(t, err, ErrInvalidTruncation, "size %d", size)
+	}
+}
+
+func Test_BNBSparseMerkleTree_VerifyTransition(t *testing.T) {
+	env := prepareEnv()[0]
+	var items, changes []Item
+	for i := uint64(0); i < 50; i++ {
+		items = append(items, Item{Key: i * 5, Val: env.hasher.Hash([]byte{1, byte(i)})})
+	}
+	for i := uint64(0); i < 20; i++ {
+		changes = append(changes, Item{Key: i * 13, Val: env.hasher.Hash([]byte{2, byte(i)})})
+	}
+	smt, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 8, nilHash)
+	assert.NoError(t, err)
+	assert.NoError(t, smt.MultiSet(items))
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+	_, preRoot := smt.Latest()
+
+	expected, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 8, nilHash)
+	assert.NoError(t, err)
+	assert.NoError(t, expected.MultiSet(items))
+	_, err = expected.Commit(nil)
+	assert.NoError(t, err)
+	assert.NoError(t, expected.MultiSet(changes))
+	postRoot := expected.Root()
+
+	// the uncommitted changes are left intact
+	assert.NoError(t, smt.Set(1, env.hasher.Hash([]byte("pending"))))
+	pendingRoot := smt.PendingRoot()
+
+	ok, err := smt.VerifyTransition(preRoot, changes, postRoot)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = smt.VerifyTransition(preRoot, changes, pendingRoot)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = smt.VerifyTransition(preRoot, nil, preRoot)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	_, err = smt.VerifyTransition(postRoot, changes, postRoot)
+	assert.ErrorIs(t, err, ErrPreRootMismatched)
+
+	assert.Equal(t, pendingRoot, smt.PendingRoot())
+	_, latestRoot := smt.Latest()
+	assert.Equal(t, preRoot, latestRoot)
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, pendingRoot, smt.Root())
+}
+
+func Test_BNBSparseMerkleTree_VersionEncoding(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			testVersionEncoding(t, env)
+		})
+	}
+}
+
+func testVersionEncoding(t *testing.T, env testEnv) {
+	versions := []Version{1000000, 1000001, 1000003, 1000100, 2000000}
+	assert.Equal(t, versions, DeltaVersionCodec{}.Decode(DeltaVersionCodec{}.Encode(versions)))
+
+	build := func(db database.TreeDB, opts ...Option) SparseMerkleTree {
+		smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash, append(opts, InitializeVersion(1000000))...)
+		assert.NoError(t, err)
+		for i := 0; i < 30; i++ {
+			assert.NoError(t, smt.Set(1, env.hasher.Hash([]byte{byte(i)})))
+			if i%3 == 0 {
+				assert.NoError(t, smt.Set(0x12, env.hasher.Hash([]byte{byte(i)})))
+			}
+			_, err := smt.Commit(nil)
+			assert.NoError(t, err)
+		}
+		return smt
+	}
+	db, err := env.db()
+	assert.NoError(t, err)
+	defer db.Close()
+	plainDB, err := env.db()
+	assert.NoError(t, err)
+	defer plainDB.Close()
+	smt := build(db, VersionEncoding(DeltaVersionCodec{}))
+	plain := build(plainDB)
+	assert.Equal(t, plain.Root(), smt.Root())
+
+	// the deltas take fewer bytes than the versions
+	for _, key := range [][]byte{storageFullTreeNodeKey(0, 0), storageFullTreeNodeKey(8, 1)} {
+		buf, err := db.Get(key)
+		assert.NoError(t, err)
+		plainBuf, err := plainDB.Get(key)
+		assert.NoError(t, err)
+		assert.Less(t, len(buf), len(plainBuf))
+	}
+	buf, err := db.Get(storageFullTreeNodeKey(8, 1))
+	assert.NoError(t, err)
+	node := &StorageTreeNode{}
+	assert.NoError(t, rlp.DecodeBytes(buf, node))
+	assert.True(t, node.VersionsEncoded)
+	assert.Equal(t, Version(1000001), node.Versions[0].Ver)
+	assert.Equal(t, Version(1), node.Versions[1].Ver)
+
+	// the versions are decoded exactly
+	reopened, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash, VersionEncoding(DeltaVersionCodec{}))
+	assert.NoError(t, err)
+	assert.Equal(t, plain.Root(), reopened.Root())
+	for _, key := range []uint64{1, 0x12} {
+		history, err := reopened.KeyHistory(key)
+		assert.NoError(t, err)
+		expected, err := plain.KeyHistory(key)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, history)
+		for _, version := range expected {
+			val, err := reopened.Get(key, &version)
+			assert.NoError(t, err)
+			expectedVal, err := plain.Get(key, &version)
+			assert.NoError(t, err)
+			assert.Equal(t, expectedVal, val)
+		}
+	}
+
+	_, err = NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+	assert.ErrorIs(t, err, ErrNoVersionCodec)
+}
+
+func Test_BNBSparseMerkleTree_LockProfile(t *testing.T) {
+	env := prepareEnv()[0]
+	smt, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash)
+	assert.NoError(t, err)
+	assert.NoError(t, smt.Set(1, env.hasher.Hash([]byte{1})))
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, smt.LockProfile())
+
+	smt, err = NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash, LockProfiling())
+	assert.NoError(t, err)
+	tree := smt.(*BNBSparseMerkleTree)
+	assert.NoError(t, smt.Set(1, env.hasher.Hash([]byte{1})))
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+
+	// the commit and the reader contend with the holder of the root lock
+	const hold = 50 * time.Millisecond
+	tree.root.mu.Lock()
+	child := tree.root.Children[0]
+	child.internalMu[0].Lock()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		assert.NoError(t, smt.Set(3, env.hasher.Hash([]byte{3})))
+		_, err := smt.Commit(nil)
+		assert.NoError(t, err)
+	}()
+	go func() {
+		defer wg.Done()
+		child.getInternal(0)
+	}()
+	time.Sleep(hold)
+	child.internalMu[0].Unlock()
+	tree.root.mu.Unlock()
+	wg.Wait()
+
+	// the waiters start waiting some time after the locks are taken
+	profile := smt.LockProfile()
+	assert.Greater(t, profile[0], hold/2)
+	assert.Greater(t, profile[4], hold/2)
+	for depth := range profile {
+		assert.Zero(t, depth%4)
+	}
+}
+
+func Test_BNBSparseMerkleTree_DeferredWrites(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			testDeferredWrites(t, env)
+		})
+	}
+}
+
+func testDeferredWrites(t *testing.T, env testEnv) {
+	db, err := env.db()
+	assert.NoError(t, err)
+	defer db.Close()
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash, DeferredWrites())
+	assert.NoError(t, err)
+	roots := make(map[Version][]byte)
+	for i := uint64(0); i < 5; i++ {
+		assert.NoError(t, smt.Set(i*4099, env.hasher.Hash([]byte{byte(i)})))
+		version, err := smt.Commit(nil)
+		assert.NoError(t, err)
+		roots[version] = smt.Root()
+	}
+
+	// nothing reaches storage before the sync
+	has, err := db.Has(latestVersionKey)
+	assert.NoError(t, err)
+	assert.False(t, has)
+
+	assert.NoError(t, smt.Sync())
+	synced, err := NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash)
+	assert.NoError(t, err)
+	assert.Equal(t, Version(5), synced.LatestVersion())
+	for version, root := range roots {
+		assert.Equal(t, root, synced.(*BNBSparseMerkleTree).root.RootAt(version))
+		v := version
+		val, err := synced.Get(uint64(version-1)*4099, &v)
+		assert.NoError(t, err)
+		assert.Equal(t, env.hasher.Hash([]byte{byte(version - 1)}), val)
+	}
+
+	// the commits after the sync are synced on close
+	assert.NoError(t, smt.Set(1, env.hasher.Hash([]byte{1})))
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+	assert.NoError(t, smt.Close())
+	synced, err = NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash)
+	assert.NoError(t, err)
+	assert.Equal(t, smt.LatestVersion(), synced.LatestVersion())
+	assert.Equal(t, smt.Root(), synced.Root())
+}
+
+func Test_BNBSparseMerkleTree_DeferredWritesBeforeSync(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			testDeferredWritesBeforeSync(t, env)
+		})
+	}
+}
+
+func testDeferredWritesBeforeSync(t *testing.T, env testEnv) {
+	db, err := env.db()
+	assert.NoError(t, err)
+	defer db.Close()
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash, DeferredWrites())
+	assert.NoError(t, err)
+	for i := uint64(0); i < 5; i++ {
+		assert.NoError(t, smt.Set(i*4099, env.hasher.Hash([]byte{byte(i)})))
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+	}
+
+	// the nodes released from memory are read back from the buffer
+	tree := smt.(*BNBSparseMerkleTree)
+	tree.release(smt.LatestVersion())
+	for i := uint64(0); i < 5; i++ {
+		val, err := smt.Get(i*4099, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, env.hasher.Hash([]byte{byte(i)}), val)
+		proof, err := smt.GetProof(i * 4099)
+		assert.NoError(t, err)
+		assert.True(t, smt.VerifyProof(i*4099, proof))
+	}
+	has, err := db.Has(latestVersionKey)
+	assert.NoError(t, err)
+	assert.False(t, has)
+
+	assert.NoError(t, smt.Rollback(3))
+	val, err := smt.Get(4*4099, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, nilHash, val)
+	has, err = db.Has(latestVersionKey)
+	assert.NoError(t, err)
+	assert.False(t, has)
+}
+
+func Test_BNBSparseMerkleTree_VersionWindows(t *testing.T) {
+	env := prepareEnv()[0]
+	smt, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 16, nilHash)
+	assert.NoError(t, err)
+	inMemory, retained := smt.VersionWindows()
+	assert.Equal(t, [2]Version{0, 0}, inMemory)
+	assert.Equal(t, [2]Version{0, 0}, retained)
+
+	// the keys of each version are under a different child of the root
+	for version := uint64(1); version <= 6; version++ {
+		assert.NoError(t, smt.Set(version<<12, env.hasher.Hash([]byte{byte(version)})))
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+	}
+	inMemory, retained = smt.VersionWindows()
+	assert.Equal(t, [2]Version{1, 6}, inMemory)
+	assert.Equal(t, [2]Version{1, 6}, retained)
+
+	// the nodes last changed before version 4 are released
+	tree := smt.(*BNBSparseMerkleTree)
+	tree.root.Release(4)
+	inMemory, retained = smt.VersionWindows()
+	assert.Equal(t, [2]Version{4, 6}, inMemory)
+	assert.Equal(t, [2]Version{1, 6}, retained)
+
+	// the hydrated nodes are resident again
+	for version := uint64(1); version <= 6; version++ {
+		_, err := smt.GetProof(version << 12)
+		assert.NoError(t, err)
+	}
+	inMemory, _ = smt.VersionWindows()
+	assert.Equal(t, [2]Version{1, 6}, inMemory)
+
+	tree.root.Release(7)
+	inMemory, retained = smt.VersionWindows()
+	assert.Equal(t, [2]Version{7, 6}, inMemory)
+	assert.Equal(t, [2]Version{1, 6}, retained)
+}
+
+func Test_BNBSparseMerkleTree_ChildOrdering(t *testing.T) {
+	hasher := NewHasherPool(func() hash.Hash { return sha256.New() })
+	leaves := make(map[uint64][]byte)
+	var items []Item
+	for i := uint64(0); i < 50; i++ {
+		key := i * 97 % (1 << 16)
+		leaves[key] = hasher.Hash([]byte{byte(i)})
+		items = append(items, Item{Key: key, Val: leaves[key]})
+	}
+
+	roots := make(map[ChildOrder][]byte)
+	fingerprints := make(map[ChildOrder]string)
+	for _, order := range []ChildOrder{LeftRight, RightLeft} {
+		smt, err := NewBNBSparseMerkleTree(hasher, memory.NewMemoryDB(), 16, nilHash, ChildOrdering(order))
+		assert.NoError(t, err)
+		assert.NoError(t, smt.MultiSet(items))
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+		roots[order] = smt.Root()
+		fingerprints[order] = smt.Fingerprint()
+
+		ordered := hasher.Ordered(order)
+		expected, err := ComputeRoot(leaves, 16, nilHash, ordered)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, smt.Root())
+		for _, item := range items[:10] {
+			proof, err := smt.GetProof(item.Key)
+			assert.NoError(t, err)
+			assert.True(t, smt.VerifyProof(item.Key, proof))
+			proofItem := ProofItem{Key: item.Key, Value: item.Val, Root: smt.Root(), Proof: proof}
+			assert.NoError(t, proofItem.Verify(ordered))
+		}
+	}
+	assert.NotEqual(t, roots[LeftRight], roots[RightLeft])
+	assert.NotEqual(t, fingerprints[LeftRight], fingerprints[RightLeft])
+
+	// the proofs of one order are rejected in the other
+	smt, err := NewBNBSparseMerkleTree(hasher, memory.NewMemoryDB(), 16, nilHash, ChildOrdering(RightLeft))
+	assert.NoError(t, err)
+	assert.NoError(t, smt.MultiSet(items))
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+	proof, err := smt.GetProof(items[1].Key)
+	assert.NoError(t, err)
+	proofItem := ProofItem{Key: items[1].Key, Value: items[1].Val, Root: smt.Root(), Proof: proof}
+	assert.ErrorIs(t, proofItem.Verify(hasher), ErrRootMismatched)
+}
+
+func Test_BNBSparseMerkleTree_Seal(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			testSeal(t, env)
+		})
+	}
+}
+
+func testSeal(t *testing.T, env testEnv) {
+	db, err := env.db()
+	assert.NoError(t, err)
+	defer db.Close()
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+	assert.NoError(t, err)
+	val := env.hasher.Hash([]byte("val"))
+	assert.NoError(t, smt.Set(1, val))
+	_, err = smt.Commit(nil)
+	assert.NoError(t, err)
+
+	// the uncommitted changes are not sealed silently
+	assert.NoError(t, smt.Set(2, val))
+	assert.ErrorIs(t, smt.Seal(), ErrUncommittedChanges)
+	smt.Reset()
+	// the changes buffered by a batch writer are not staged on the sealed tree
+	writer := smt.(*BNBSparseMerkleTree).NewBatchWriter()
+	assert.NoError(t, writer.Set(3, val))
+
+	_, sealed := smt.SealedVersion()
+	assert.False(t, sealed)
+	assert.NoError(t, smt.Seal())
+	version, sealed := smt.SealedVersion()
+	assert.True(t, sealed)
+	assert.Equal(t, Version(1), version)
+	assert.ErrorIs(t, smt.Seal(), ErrTreeSealed)
+
+	root := smt.Root()
+	assert.ErrorIs(t, smt.Set(2, val), ErrTreeSealed)
+	assert.ErrorIs(t, smt.MultiSet([]Item{{Key: 2, Val: val}}), ErrTreeSealed)
+	assert.ErrorIs(t, smt.DeletePrefix(0, 4), ErrTreeSealed)
+	_, err = smt.Commit(nil)
+	assert.ErrorIs(t, err, ErrTreeSealed)
+	assert.ErrorIs(t, smt.Rollback(0), ErrTreeSealed)
+	_, err = writer.Commit()
+	assert.ErrorIs(t, err, ErrTreeSealed)
+	assert.ErrorIs(t, writer.Set(4, val), ErrTreeSealed)
+	assert.Equal(t, root, smt.Root())
+	assert.Zero(t, smt.(*BNBSparseMerkleTree).journal.Len())
+
+	// the seal is carried by the backups and the migrations
+	backup := filepath.Join(t.TempDir(), "backup")
+	assert.NoError(t, smt.BackupTo(backup))
+	restored, err := env.db()
+	assert.NoError(t, err)
+	defer restored.Close()
+	assert.NoError(t, RestoreFrom(backup, restored))
+	migrated, err := env.db()
+	assert.NoError(t, err)
+	defer migrated.Close()
+	assert.NoError(t, smt.MigrateTo(migrated))
+	for _, copied := range []database.TreeDB{restored, migrated} {
+		reopened, err := NewBNBSparseMerkleTree(env.hasher, copied, 8, nilHash)
+		assert.NoError(t, err)
+		version, sealed := reopened.SealedVersion()
+		assert.True(t, sealed)
+		assert.Equal(t, Version(1), version)
+		assert.ErrorIs(t, reopened.Set(2, val), ErrTreeSealed)
+	}
+	assert.NoError(t, smt.Close())
+
+	// the tree stays sealed after reopening, and still serves the sealed state
+	smt, err = NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash)
+	assert.NoError(t, err)
+	version, sealed = smt.SealedVersion()
+	assert.True(t, sealed)
+	assert.Equal(t, Version(1), version)
+	assert.Equal(t, root, smt.Root())
+	got, err := smt.Get(1, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, val, got)
+	proof, err := smt.GetProof(1)
+	assert.NoError(t, err)
+	assert.True(t, smt.VerifyProof(1, proof))
+	assert.ErrorIs(t, smt.Set(2, val), ErrTreeSealed)
+	_, err = smt.Commit(nil)
+	assert.ErrorIs(t, err, ErrTreeSealed)
+}
+
+func Test_BNBSparseMerkleTree_SpillToDisk(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			testSpillToDisk(t, env)
+		})
+	}
+}
+
+func testSpillToDisk(t *testing.T, env testEnv) {
+	build := func(opts ...Option) *BNBSparseMerkleTree {
+		db, err := env.db()
+		assert.NoError(t, err)
+		smt, err := NewBNBSparseMerkleTree(env.hasher, db, 16, nilHash, opts...)
+		assert.NoError(t, err)
+		// each top-level subtree is changed by its own version, the first ones are the coldest
+		for nibble := uint64(0); nibble < 16; nibble++ {
+			for i := uint64(0); i < 8; i++ {
+				key := nibble<<12 | i<<8 | i
+				assert.NoError(t, smt.Set(key, env.hasher.Hash([]byte{byte(key >> 8), byte(key)})))
+			}
+			_, err = smt.Commit(nil)
+			assert.NoError(t, err)
+		}
+		return smt.(*BNBSparseMerkleTree)
+	}
+	expected := build()
+	total := residentSize(expected.root)
+
+	for _, limit := range []uint64{total / 2, 1} {
+		tree := build(SpillToDisk(limit))
+		assert.Greater(t, tree.Stats().SpilledNodes, uint64(0))
+		assert.Equal(t, expected.Root(), tree.Root())
+		assert.True(t, tree.root.Children[0].IsTemporary())
+		assert.False(t, tree.root.Children[15].IsTemporary())
+		if limit > 1 {
+			assert.LessOrEqual(t, residentSize(tree.root), limit)
+		} else {
+			// only the path changed by the latest version is resident
+			for i := 0; i < 15; i++ {
+				assert.True(t, tree.root.Children[i].IsTemporary())
+			}
+			assert.Greater(t, residentSize(tree.root), limit)
+		}
+
+		// the spilled subtrees are re-read from storage
+		for nibble := uint64(0); nibble < 16; nibble++ {
+			key := nibble<<12 | 3<<8 | 3
+			val, err := tree.Get(key, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, env.hasher.Hash([]byte{byte(key >> 8), byte(key)}), val)
+			proof, err := tree.GetProof(key)
+			assert.NoError(t, err)
+			assert.True(t, tree.VerifyProof(key, proof))
+		}
+
+		// and changed again
+		val := env.hasher.Hash([]byte("val"))
+		assert.NoError(t, tree.Set(0x0101, val))
+		_, err := tree.Commit(nil)
+		assert.NoError(t, err)
+		assert.NoError(t, expected.Set(0x0101, val))
+		_, err = expected.Commit(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, expected.Root(), tree.Root())
+		expected.Reset()
+		assert.NoError(t, expected.Rollback(16))
+	}
+}
+
+func Test_BNBSparseMerkleTree_CommitTimeout(t *testing.T) {
+	env := prepareEnv()[0]
+	db := &slowBatchDB{TreeDB: memory.NewMemoryDB(), delay: 200 * time.Millisecond}
+	smt, err := NewBNBSparseMerkleTree(env.hasher, db, 8, nilHash, CommitTimeout(20*time.Millisecond))
+	assert.NoError(t, err)
+	assert.NoError(t, smt.Set(1, env.hasher.Hash([]byte{1})))
+
+	// the first commit holds the commit lock while its batch is written slowly
+	result := smt.CommitAsync(nil)
+	for smt.(*BNBSparseMerkleTree).commitMu.TryLock() {
+		smt.(*BNBSparseMerkleTree).commitMu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	start := time.Now()
+	_, err = smt.Commit(nil)
+	assert.ErrorIs(t, err, ErrCommitTimeout)
+	assert.Less(t, time.Since(start), 200*time.Millisecond)
+
+	res := <-result
+	assert.NoError(t, res.Err)
+	assert.Equal(t, Version(1), res.Version)
+
+	// the lock is released once the stalled commit finishes
+	assert.NoError(t, smt.Set(2, env.hasher.Hash([]byte{2})))
+	version, err := smt.Commit(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, Version(2), version)
+	assert.NoError(t, smt.Close())
+}
+
+func Test_BNBSparseMerkleTree_NilValueHandling(t *testing.T) {
+	env := prepareEnv()[0]
+	build := func(opts ...Option) SparseMerkleTree {
+		smt, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), 8, nilHash, opts...)
+		assert.NoError(t, err)
+		assert.NoError(t, smt.Set(1, env.hasher.Hash([]byte{1})))
+		assert.NoError(t, smt.Set(2, env.hasher.Hash([]byte{2})))
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+		return smt
+	}
+	emptyValue := env.hasher.Hash()
+
+	// the keys with nil values are deleted by default
+	deleted := build()
+	assert.NoError(t, deleted.Set(1, nil))
+	assert.NoError(t, deleted.MultiSet([]Item{{Key: 2, Val: []byte{}}}))
+	_, err := deleted.Commit(nil)
+	assert.NoError(t, err)
+	assert.True(t, deleted.IsEmpty())
+	count, err := deleted.LeafCount(2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), count)
+
+	stored := build(NilValueHandling(StoreEmpty))
+	assert.NoError(t, stored.Set(1, nil))
+	assert.NoError(t, stored.MultiSet([]Item{{Key: 2, Val: []byte{}}}))
+	_, err = stored.Commit(nil)
+	assert.NoError(t, err)
+	assert.NotEqual(t, deleted.Root(), stored.Root())
+	count, err = stored.LeafCount(2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), count)
+	for _, key := range []uint64{1, 2} {
+		val, err := stored.Get(key, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, emptyValue, val)
+		proof, err := stored.GetProof(key)
+		assert.NoError(t, err)
+		assert.True(t, stored.VerifyProof(key, proof))
+	}
+
+	// the same root as setting the hash of the empty value explicitly
+	explicit := build()
+	assert.NoError(t, explicit.MultiSet([]Item{{Key: 1, Val: emptyValue}, {Key: 2, Val: emptyValue}}))
+	_, err = explicit.Commit(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, explicit.Root(), stored.Root())
+
+	// the batch writer follows the policy as well
+	for _, expected := range []SparseMerkleTree{deleted, stored} {
+		var opts []Option
+		if expected == stored {
+			opts = append(opts, NilValueHandling(StoreEmpty))
+		}
+		batched := build(opts...)
+		writer := batched.(*BNBSparseMerkleTree).NewBatchWriter()
+		assert.NoError(t, writer.Set(1, nil))
+		assert.NoError(t, writer.Set(2, []byte{}))
+		_, err = writer.Commit()
+		assert.NoError(t, err)
+		assert.Equal(t, expected.Root(), batched.Root())
+		assert.Equal(t, expected.IsEmpty(), batched.IsEmpty())
+	}
+}
+
+func TestExpectedNodeCount(t *testing.T) {
+	env := prepareEnv()[0]
+	countNodes := func(node *TreeNode) int {
+		var walk func(node *TreeNode) int
+		walk = func(node *TreeNode) int {
+			count := 1
+			for _, child := range node.Children {
+				if child != nil {
+					count += walk(child)
+				}
+			}
+			return count
+		}
+		return walk(node)
+	}
+
+	count, err := ExpectedNodeCount(nil, 16)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+	count, err = ExpectedNodeCount([]uint64{0x1234, 0x1234}, 16)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, count)
+	count, err = ExpectedNodeCount([]uint64{0x00, 0x10, 0x20, 0x30, 0x40, 0x50, 0x60, 0x70,
+		0x80, 0x90, 0xa0, 0xb0, 0xc0, 0xd0, 0xe0, 0xf0, 0xf1}, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, 1+16+17, count)
+	// the depths rejected by the tree, including those overflowing the levels
+	for _, depth := range []uint8{0, 6, 68, 252, 253, 255} {
+		_, err := ExpectedNodeCount([]uint64{1}, depth)
+		assert.ErrorIs(t, err, ErrInvalidDepth, "depth %d", depth)
+	}
+	for _, depth := range []uint8{8, 16, 24} {
+		var paths []uint64
+		for i := uint64(0); i < 200; i++ {
+			paths = append(paths, (i*i*2654435761)&(1<<depth-1))
+		}
+		smt, err := NewBNBSparseMerkleTree(env.hasher, memory.NewMemoryDB(), depth, nilHash)
+		assert.NoError(t, err)
+		for _, path := range paths {
+			assert.NoError(t, smt.Set(path, env.hasher.Hash([]byte{byte(path), byte(path >> 8)})))
+		}
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+		count, err := ExpectedNodeCount(paths, depth)
+		assert.NoError(t, err)
+		assert.Equal(t, countNodes(smt.(*BNBSparseMerkleTree).root), count, "depth %d", depth)
+	}
+}
+
+func Test_BNBSparseMerkleTree_CommitLog(t *testing.T) {
+	for _, env := range prepareEnv() {
+		t.Run(env.tag, func(t *testing.T) {
+			testCommitLog(t, env)
+		})
+	}
+}
+
+func testCommitLog(t *testing.T, env testEnv) {
+	primaryDB, err := env.db()
+	assert.NoError(t, err)
+	defer primaryDB.Close()
+	replicaDB, err := env.db()
+	assert.NoError(t, err)
+	defer replicaDB.Close()
+	primary, err := NewBNBSparseMerkleTree(env.hasher, primaryDB, 16, nilHash)
+	assert.NoError(t, err)
+	replica, err := NewBNBSparseMerkleTree(env.hasher, replicaDB, 16, nilHash, ParallelThreshold(1<<10))
+	assert.NoError(t, err)
+
+	roots := make(map[Version][]byte)
+	commit := func(version Version, changes ...Item) {
+		for _, change := range changes {
+			assert.NoError(t, primary.SetWithVersion(change.Key, change.Val, version))
+		}
+		_, err := primary.CommitWithNewVersion(nil, &version)
+		assert.NoError(t, err)
+		roots[version] = primary.Root()
+	}
+	val := func(b byte) []byte { return env.hasher.Hash([]byte{b}) }
+	commit(1, Item{Key: 0x0001, Val: val(1)}, Item{Key: 0x1234, Val: val(2)}, Item{Key: 0xffff, Val: val(3)})
+	commit(2, Item{Key: 0x1234, Val: val(4)}, Item{Key: 0x0001, Val: nil})
+	// the versions may be skipped
+	commit(5, Item{Key: 0x1235, Val: val(5)})
+
+	// ship the records encoded as to a remote replica
+	ship := func(from Version) []Version {
+		records, err := primary.CommitLog(context.Background(), from)
+		assert.NoError(t, err)
+		var shipped []Version
+		for record := range records {
+			assert.NoError(t, record.Err)
+			buf, err := rlp.EncodeToBytes(&record)
+			assert.NoError(t, err)
+			var received CommitRecord
+			assert.NoError(t, rlp.DecodeBytes(buf, &received))
+			assert.NoError(t, replica.ApplyCommitRecord(received))
+			assert.Equal(t, roots[received.Version], replica.Root(), "version %d", received.Version)
+			shipped = append(shipped, received.Version)
+		}
+		return shipped
+	}
+	assert.Equal(t, []Version{1, 2, 5}, ship(0))
+	for version, root := range roots {
+		replicated, err := replica.NodeRootAt(0, 0, version)
+		assert.NoError(t, err)
+		assert.Equal(t, root, replicated)
+	}
+	got, err := replica.Get(0x0001, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, primary.(*BNBSparseMerkleTree).nilHashes.Get(16), got)
+
+	// the replica catches up from its latest version
+	commit(6, Item{Key: 0x8000, Val: val(6)})
+	commit(7, Item{Key: 0x8000, Val: val(7)}, Item{Key: 0x0001, Val: val(8)})
+	assert.Equal(t, []Version{6, 7}, ship(replica.LatestVersion()))
+	assert.Equal(t, primary.Root(), replica.Root())
+	assert.Equal(t, primary.LatestVersion(), replica.LatestVersion())
+
+	// the records already applied or producing another root are rejected
+	records, err := primary.CommitLog(context.Background(), 6)
+	assert.NoError(t, err)
+	record := <-records
+	for range records {
+	}
+	assert.ErrorIs(t, replica.ApplyCommitRecord(record), ErrVersionTooLow)
+	commit(8, Item{Key: 0x4000, Val: val(9)})
+	records, err = primary.CommitLog(context.Background(), 7)
+	assert.NoError(t, err)
+	record = <-records
+	record.Changes[0].Val = val(10)
+	assert.ErrorIs(t, replica.ApplyCommitRecord(record), ErrRootMismatched)
+	assert.Equal(t, Version(7), replica.LatestVersion())
+	assert.Equal(t, roots[7], replica.Root())
+
+	_, err = primary.CommitLog(context.Background(), 9)
+	assert.ErrorIs(t, err, ErrVersionTooHigh)
+
+	// the receiver that stops draining the log cancels it, which releases the versions
+	ctx, cancel := context.WithCancel(context.Background())
+	records, err = primary.CommitLog(ctx, 1)
+	assert.NoError(t, err)
+	<-records
+	cancel()
+	assert.Eventually(t, func() bool {
+		_, err := primary.PruneParallel(8)
+		assert.NoError(t, err)
+		return primary.RecentVersion() == 8
+	}, time.Second, time.Millisecond)
+	for range records {
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"sync"
+)
+
+func newSnapshotRefs() *snapshotRefs {
+	return &snapshotRefs{
+		refs: make(map[Version]int),
+	}
+}
+
+// snapshotRefs counts the references of snapshots to versions,
+// the referenced versions are retained when pruning.
+type snapshotRefs struct {
+	mu    sync.Mutex
+	refs  map[Version]int
+	floor Version
+}
+
+// acquire references the version, it fails if the version may have been pruned.
+func (r *snapshotRefs) acquire(version Version) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if version < r.floor {
+		return false
+	}
+	r.refs[version]++
+	return true
+}
+
+func (r *snapshotRefs) release(version Version) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.refs[version]--
+	if r.refs[version] <= 0 {
+		delete(r.refs, version)
+	}
+}
+
+// retain returns the version that can be pruned up to without dropping
+// the referenced versions, and no snapshot can be acquired below it afterwards.
+func (r *snapshotRefs) retain(version Version) Version {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for ref := range r.refs {
+		if ref < version {
+			version = ref
+		}
+	}
+	if version > r.floor {
+		r.floor = version
+	}
+	return version
+}
+
+// Snapshot is a read-only view of the tree at a specific version.
+// The version will not be pruned until the snapshot is closed.
+type Snapshot struct {
+	tree    *BNBSparseMerkleTree
+	version Version
+	once    sync.Once
+}
+
+// SnapshotAt returns a snapshot of the tree at the version,
+// the snapshot must be closed to release the version.
+func (tree *BNBSparseMerkleTree) SnapshotAt(version Version) (*Snapshot, error) {
+	if version > tree.version {
+		return nil, ErrVersionTooHigh
+	}
+	if tree.recentVersion > version || !tree.snapshots.acquire(version) {
+		return nil, ErrVersionTooOld
+	}
+	return &Snapshot{
+		tree:    tree,
+		version: version,
+	}, nil
+}
+
+// Version returns the version of the snapshot.
+func (s *Snapshot) Version() Version {
+	return s.version
+}
+
+// Get returns the value of the key at the version of the snapshot.
+func (s *Snapshot) Get(key uint64) ([]byte, error) {
+	return s.tree.Get(key, &s.version)
+}
+
+// Root returns the root hash of the tree at the version of the snapshot.
+func (s *Snapshot) Root() ([]byte, error) {
+	return s.tree.NodeRootAt(0, 0, s.version)
+}
+
+// Close releases the version of the snapshot, it is safe to call Close multiple times.
+func (s *Snapshot) Close() {
+	s.once.Do(func() {
+		s.tree.snapshots.release(s.version)
+	})
+}
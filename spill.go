@@ -0,0 +1,124 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// spillCandidate is a resident node that can be archived through its parent.
+type spillCandidate struct {
+	parent  *TreeNode
+	node    *TreeNode
+	version Version
+}
+
+// spill archives the coldest subtrees, the ones with the oldest latest versions, until the nodes
+// resident in memory fit in the limit of the SpillToDisk option. It is called after the commit,
+// so the archived nodes are persisted and re-read from storage on demand. The nodes changed
+// by the latest version are never spilled, nor are the nodes with uncommitted changes.
+// It returns the number of bytes released.
+func (tree *BNBSparseMerkleTree) spill() uint64 {
+	var candidates []spillCandidate
+	resident := tree.collectSpillable(tree.root, &candidates)
+	if resident <= tree.spillLimit {
+		return 0
+	}
+
+	// the coldest first, and the ancestor before its descendants of the same version
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].version != candidates[j].version {
+			return candidates[i].version < candidates[j].version
+		}
+		return candidates[i].node.depth < candidates[j].node.depth
+	})
+	var (
+		freed    uint64
+		archived []*TreeNode
+		spilled  = make(map[journalKey]struct{})
+	)
+	for _, candidate := range candidates {
+		if resident-freed <= tree.spillLimit {
+			break
+		}
+		node := candidate.node
+		if spilledAncestor(spilled, node.depth, node.path) {
+			continue
+		}
+		candidate.parent.lock()
+		size := residentSize(node)
+		node.archive()
+		freed += size - node.Size()
+		candidate.parent.mu.Unlock()
+
+		spilled[journalKey{node.depth, node.path}] = struct{}{}
+		archived = append(archived, node)
+	}
+	atomic.AddUint64(&tree.spilledNodes, uint64(len(archived)))
+	if tree.evictionCallback != nil {
+		tree.notifyEvicted(archived)
+	}
+	return freed
+}
+
+// collectSpillable returns the size of the subtree resident in memory, and appends
+// the nodes of the subtree that can be spilled to the candidates.
+func (tree *BNBSparseMerkleTree) collectSpillable(node *TreeNode, candidates *[]spillCandidate) uint64 {
+	node.rlock()
+	defer node.mu.RUnlock()
+
+	size := node.Size()
+	for i := 0; i < len(node.Children); i++ {
+		child := node.Children[i]
+		if child == nil {
+			continue
+		}
+		if child.temporary {
+			size += child.Size()
+			continue
+		}
+		size += tree.collectSpillable(child, candidates)
+		// the leaves are held by their parents
+		if child.depth == tree.maxDepth || child.isDirty() {
+			continue
+		}
+		if version := child.latestVersionWithLock(); version < tree.version {
+			*candidates = append(*candidates, spillCandidate{parent: node, node: child, version: version})
+		}
+	}
+	return size
+}
+
+// residentSize returns the size of the subtree resident in memory.
+func residentSize(node *TreeNode) uint64 {
+	node.rlock()
+	defer node.mu.RUnlock()
+
+	size := node.Size()
+	for i := 0; i < len(node.Children); i++ {
+		if child := node.Children[i]; child != nil {
+			if child.temporary {
+				size += child.Size()
+			} else {
+				size += residentSize(child)
+			}
+		}
+	}
+	return size
+}
+
+// spilledAncestor returns whether an ancestor of the node at the depth and path is spilled.
+func spilledAncestor(spilled map[journalKey]struct{}, depth uint16, path nodePath) bool {
+	for depth > 4 {
+		depth -= 4
+		path = path.rsh(4)
+		if _, exist := spilled[journalKey{depth, path}]; exist {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"fmt"
+
+	"github.com/bnb-chain/zkbnb-smt/database"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// treeState is the memory image of the committed tree.
+type treeState struct {
+	Fingerprint   string
+	MaxDepth      uint16
+	NilHashes     [][]byte
+	Version       Version
+	RecentVersion Version
+	Size          uint64
+	// the nodes in memory in depth-first order, so a parent is always ahead of its children
+	Nodes []*stateNode
+}
+
+type stateNode struct {
+	Depth uint16
+	Node  *StorageTreeNode
+}
+
+// MarshalState serializes the nodes of the latest committed tree in memory,
+// the nodes released from memory are not included and are loaded from storage on demand after restoring.
+func (tree *BNBSparseMerkleTree) MarshalState() ([]byte, error) {
+	tree.mu.RLock()
+	state := &treeState{
+		Fingerprint:   tree.Fingerprint(),
+		MaxDepth:      tree.maxDepth,
+		NilHashes:     tree.nilHashes.hashes,
+		Version:       tree.version,
+		RecentVersion: tree.recentVersion,
+		Size:          tree.rootSize,
+	}
+	root := tree.lastSaveRoot
+	tree.mu.RUnlock()
+	if root == nil {
+		root = tree.profiled(newTreeNode(0, nodePath{}, tree.nilHashes, tree.hasher))
+	}
+
+	var walk func(node *TreeNode)
+	walk = func(node *TreeNode) {
+		state.Nodes = append(state.Nodes, &stateNode{node.depth, node.ToStorageTreeNode()})
+		for i := 0; i < len(node.Children); i++ {
+			if child := node.getChild(i); child != nil && !child.IsTemporary() {
+				walk(child)
+			}
+		}
+	}
+	walk(root)
+	return rlp.EncodeToBytes(state)
+}
+
+// RestoreState restores a tree from the memory image serialized by MarshalState,
+// the db must hold the storage of the tree at the version of the image or later.
+func RestoreState(b []byte, db database.TreeDB, hasher *Hasher, opts ...Option) (SparseMerkleTree, error) {
+	state, err := decodeState(b)
+	if err != nil {
+		return nil, err
+	}
+	return restoreState(state, db, hasher, opts...)
+}
+
+func decodeState(b []byte) (*treeState, error) {
+	state := &treeState{}
+	if err := rlp.DecodeBytes(b, state); err != nil {
+		return nil, err
+	}
+	if len(state.Nodes) == 0 || state.Nodes[0].Depth != 0 {
+		return nil, fmt.Errorf("%w: missing root", ErrStateMismatched)
+	}
+	return state, nil
+}
+
+func restoreState(state *treeState, db database.TreeDB, hasher *Hasher, opts ...Option) (SparseMerkleTree, error) {
+	smt, err := newSparseMerkleTree(hasher, db, state.MaxDepth, state.NilHashes, opts...)
+	if err != nil {
+		return nil, err
+	}
+	tree := smt.(*BNBSparseMerkleTree)
+	if tree.Fingerprint() != state.Fingerprint {
+		return nil, fmt.Errorf("%w: fingerprint %s", ErrStateMismatched, state.Fingerprint)
+	}
+
+	nodes := make(map[journalKey]*TreeNode, len(state.Nodes))
+	for _, sn := range state.Nodes {
+		if sn.Depth%4 != 0 || sn.Depth > state.MaxDepth {
+			return nil, ErrInvalidDepth
+		}
+		node := tree.profiled(sn.Node.toTreeNode(sn.Depth, tree.nilHashes, tree.hasher))
+		nodes[journalKey{node.depth, node.path}] = node
+		if node.depth == 0 {
+			continue
+		}
+		parent, exist := nodes[journalKey{node.depth - 4, node.path.rsh(4)}]
+		if !exist {
+			return nil, fmt.Errorf("%w: missing parent of depth %d, path %v", ErrStateMismatched, node.depth, node.path)
+		}
+		parent.Children[node.path.nibble()] = node
+	}
+
+	root := nodes[journalKey{0, nodePath{}}]
+	tree.root = root
+	tree.lastSaveRoot = root
+	tree.rootSize = state.Size
+	tree.lastSaveRootSize = state.Size
+	tree.recentVersion = state.RecentVersion
+	tree.setLatest(state.Version, root.Root())
+	if err := tree.resetLeafCount(); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+// VersionStorageDelta returns the serialized bytes added to storage by the commit of the version,
+// that is the growth of the encoded nodes changed by the version from their encodings at the previous version.
+// The nodes whose versions before it have been pruned are counted as created by the version.
+func (tree *BNBSparseMerkleTree) VersionStorageDelta(version Version) (uint64, error) {
+	if version > tree.version {
+		return 0, ErrVersionTooHigh
+	}
+	if tree.recentVersion > version {
+		return 0, ErrVersionTooOld
+	}
+	root := tree.lastSaveRoot
+	if root == nil {
+		root = tree.root
+	}
+	var delta uint64
+	err := tree.walkChanged(root, version, func(node *TreeNode) error {
+		after, err := tree.encodedSizeAt(node, version)
+		if err != nil {
+			return err
+		}
+		before, err := tree.encodedSizeAt(node, version-1)
+		if err != nil {
+			return err
+		}
+		if after > before {
+			delta += after - before
+		}
+		return nil
+	})
+	return delta, err
+}
+
+// walkChanged calls the callback with the nodes changed by the version under the node,
+// the subtrees not changed since the version are skipped.
+func (tree *BNBSparseMerkleTree) walkChanged(node *TreeNode, version Version, callback func(node *TreeNode) error) error {
+	if node.latestVersionWithLock() < version {
+		return nil
+	}
+	if len(versionsUpTo(node, version)) > len(versionsUpTo(node, version-1)) {
+		if err := callback(node); err != nil {
+			return err
+		}
+	}
+	if node.depth == tree.maxDepth {
+		return nil
+	}
+	for nibble := 0; nibble < len(node.Children); nibble++ {
+		child := node.getChild(nibble)
+		if child == nil || child.latestVersionWithLock() < version {
+			continue
+		}
+		if err := tree.extendNode(node, uint64(nibble), child.path, child.depth, false); err != nil {
+			return err
+		}
+		if err := tree.walkChanged(node.getChild(nibble), version, callback); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodedSizeAt returns the size of the node encoded with the versions up to the version,
+// zero if the node has no versions up to it.
+func (tree *BNBSparseMerkleTree) encodedSizeAt(node *TreeNode, version Version) (uint64, error) {
+	versions := versionsUpTo(node, version)
+	if len(versions) == 0 {
+		return 0, nil
+	}
+	truncated := &TreeNode{
+		Versions: versions,
+		path:     node.path,
+		depth:    node.depth,
+	}
+	node.rlock()
+	truncated.Internals = node.Internals
+	for i, child := range node.Children {
+		if child == nil {
+			continue
+		}
+		if childVersions := versionsUpTo(child, version); len(childVersions) > 0 {
+			truncated.Children[i] = &TreeNode{Versions: childVersions}
+		}
+	}
+	node.mu.RUnlock()
+
+	buf, err := tree.encodeTreeNode(truncated)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(len(buf)), nil
+}
+
+// versionsUpTo returns the versions of the node not newer than the version.
+func versionsUpTo(node *TreeNode, version Version) []*VersionInfo {
+	node.rlock()
+	defer node.mu.RUnlock()
+	i := len(node.Versions)
+	for i > 0 && node.Versions[i-1].Ver > version {
+		i--
+	}
+	return node.Versions[:i:i]
+}
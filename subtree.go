@@ -0,0 +1,197 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"bytes"
+
+	"github.com/bnb-chain/zkbnb-smt/database/memory"
+)
+
+// ExtractSubtree exports the leaves under the prefix at the version as a standalone tree in memory.
+// The prefix is the highest prefixBits bits of the keys, it must be a multiple of 4.
+// The root of the extracted tree equals the hash of the node at the prefix in the original tree.
+func (tree *BNBSparseMerkleTree) ExtractSubtree(prefix uint64, prefixBits uint8, version Version) (*BNBSparseMerkleTree, error) {
+	if err := tree.checkNarrow(); err != nil {
+		return nil, err
+	}
+	if prefixBits%4 != 0 || uint16(prefixBits) >= tree.maxDepth {
+		return nil, ErrInvalidDepth
+	}
+	if prefix>>prefixBits != 0 {
+		return nil, ErrInvalidKey
+	}
+	if tree.recentVersion > version {
+		return nil, ErrVersionTooOld
+	}
+	if version > tree.version {
+		return nil, ErrVersionTooHigh
+	}
+
+	depth := uint8(tree.maxDepth) - prefixBits
+	subtree, err := NewSparseMerkleTree(tree.hasher, memory.NewMemoryDB(), depth,
+		tree.nilHashes.hashes[prefixBits:], GoRoutinePool(tree.goroutinePool))
+	if err != nil {
+		return nil, err
+	}
+
+	// find the node at the prefix
+	targetNode := tree.root
+	for d := uint16(4); d <= uint16(prefixBits); d += 4 {
+		path := uint64Path(prefix >> (uint16(prefixBits) - d))
+		nibble := path.nibble()
+		if err := tree.extendNode(targetNode, nibble, path, d, false); err != nil {
+			return nil, err
+		}
+		targetNode = targetNode.Children[nibble]
+		if targetNode == nil {
+			return subtree.(*BNBSparseMerkleTree), nil
+		}
+	}
+
+	var items []Item
+	mask := uint64(1)<<depth - 1
+	err = tree.walkLeaves(targetNode, func(leaf *TreeNode) {
+		val := leaf.RootAt(version)
+		if !bytes.Equal(val, tree.nilHashes.Get(tree.maxDepth)) {
+			items = append(items, Item{Key: leaf.path.low() & mask, Val: val})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(items) > 0 {
+		if err := subtree.MultiSetWithVersion(items, version); err != nil {
+			return nil, err
+		}
+		if _, err := subtree.CommitWithNewVersion(nil, &version); err != nil {
+			return nil, err
+		}
+	}
+	return subtree.(*BNBSparseMerkleTree), nil
+}
+
+// DeletePrefix clears all the leaves under the prefix, the prefix is the highest prefixBits bits of the keys.
+// The children at the depth of the prefix rounded up to a multiple of 4 are replaced with the nil subtrees,
+// only their parents up to the root are recomputed, and the leaves under them are not rewritten: the nodes
+// read the nil hashes when they are loaded, and the direct reads of the leaves check the cleared prefixes.
+// The leaf count of the version is counted by walking the leaves when it is requested.
+func (tree *BNBSparseMerkleTree) DeletePrefix(prefix uint64, prefixBits uint8) error {
+	tree.writeMu.Lock()
+	defer tree.writeMu.Unlock()
+
+	if err := tree.checkSealed(); err != nil {
+		return err
+	}
+	if err := tree.checkPending(); err != nil {
+		return err
+	}
+	if err := tree.checkNarrow(); err != nil {
+		return err
+	}
+	if uint16(prefixBits) > tree.maxDepth {
+		return ErrInvalidDepth
+	}
+	if prefix>>prefixBits != 0 {
+		return ErrInvalidKey
+	}
+
+	// the cleared children are at the depth of the prefix rounded up to a multiple of 4
+	depth := (uint16(prefixBits) + 3) / 4 * 4
+	if depth == 0 {
+		depth = 4
+	}
+	shift := depth - uint16(prefixBits)
+
+	// find the parent of the cleared children
+	parents := make([]*TreeNode, 0, depth/4)
+	targetNode := tree.root
+	for d := uint16(4); d < depth; d += 4 {
+		path := uint64Path(prefix >> (uint16(prefixBits) - d))
+		nibble := path.nibble()
+		if err := tree.extendNode(targetNode, nibble, path, d, false); err != nil {
+			return err
+		}
+		parents = append(parents, targetNode)
+		targetNode = targetNode.Children[nibble]
+		if targetNode == nil || bytes.Equal(targetNode.Root(), tree.nilHashes.Get(d)) {
+			return nil
+		}
+	}
+
+	newVersion := tree.version + 1
+	parent := targetNode.Copy()
+	cleared := false
+	for i := uint64(0); i < 1<<shift; i++ {
+		path := uint64Path(prefix<<shift | i)
+		nibble := path.nibble()
+		// the child is loaded, so its versions are kept
+		if err := tree.extendNode(targetNode, nibble, path, depth, false); err != nil {
+			return err
+		}
+		child := targetNode.Children[nibble]
+		if child == nil || bytes.Equal(child.Root(), tree.nilHashes.Get(depth)) {
+			continue
+		}
+		child = child.Copy()
+		if err := tree.clearNode(child, newVersion); err != nil {
+			return err
+		}
+		child.setDirty()
+		linked, err := tree.journalNode(child)
+		if err != nil {
+			return err
+		}
+		parent.SetChildren(linked, int(nibble), newVersion)
+		cleared = true
+	}
+	if !cleared {
+		return nil
+	}
+
+	// recompute the parents up to the root
+	for i := len(parents) - 1; i >= 0; i-- {
+		linked, err := tree.journalNode(parent)
+		if err != nil {
+			return err
+		}
+		copied := parents[i].Copy()
+		copied.SetChildren(linked, int(parent.path.nibble()), newVersion)
+		parent = copied
+	}
+	if err := tree.journal.Set(parent); err != nil {
+		return err
+	}
+	tree.root = parent
+	if depth < tree.maxDepth {
+		tree.stagedClears = append(tree.stagedClears, clearedPrefix{Prefix: prefix, Bits: prefixBits, Version: newVersion})
+	}
+	tree.leafCountKnown = false
+	return nil
+}
+
+// walkLeaves calls the callback for every leaf under the node, the released nodes are loaded from storage.
+func (tree *BNBSparseMerkleTree) walkLeaves(node *TreeNode, callback func(leaf *TreeNode)) error {
+	if node.depth == tree.maxDepth {
+		callback(node)
+		return nil
+	}
+	for nibble := 0; nibble < len(node.Children); nibble++ {
+		child := node.Children[nibble]
+		if child == nil {
+			continue
+		}
+		if child.depth < tree.maxDepth {
+			if err := tree.extendNode(node, uint64(nibble), child.path, child.depth, false); err != nil {
+				return err
+			}
+		}
+		if err := tree.walkLeaves(node.Children[nibble], callback); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"bytes"
+	"sort"
+)
+
+// LeafCount returns the number of the leaves not holding the nil hash under the node at its latest version,
+// it is maintained only with the SubtreeCounts option.
+func (node *TreeNode) LeafCount() uint64 {
+	node.rlock()
+	defer node.mu.RUnlock()
+	return node.leafCount()
+}
+
+func (node *TreeNode) leafCount() uint64 {
+	if len(node.Versions) == 0 {
+		return 0
+	}
+	return node.Versions[len(node.Versions)-1].Count
+}
+
+// LeafCountAt returns the number of the leaves not holding the nil hash under the node at the version.
+func (node *TreeNode) LeafCountAt(version Version) uint64 {
+	node.rlock()
+	defer node.mu.RUnlock()
+
+	for i := len(node.Versions) - 1; i >= 0; i-- {
+		if node.Versions[i].Ver <= version {
+			return node.Versions[i].Count
+		}
+	}
+	return 0
+}
+
+// computeSubtreeCounts computes the leaf counts of the changed nodes from the leaves to the root.
+func (tree *BNBSparseMerkleTree) computeSubtreeCounts() (map[journalKey]uint64, error) {
+	var nodes []*TreeNode
+	err := tree.journal.Iterate(func(node *TreeNode) error {
+		if node.isDirty() {
+			nodes = append(nodes, node)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].depth > nodes[j].depth
+	})
+
+	nilHash := tree.nilHashes.Get(tree.maxDepth)
+	counts := make(map[journalKey]uint64, len(nodes))
+	for _, node := range nodes {
+		count := uint64(0)
+		if node.depth == tree.maxDepth {
+			if !bytes.Equal(node.Root(), nilHash) {
+				count = 1
+			}
+		} else {
+			for nibble := range node.Children {
+				if childCount, ok := counts[journalKey{node.depth + 4, node.path.child(uint64(nibble))}]; ok {
+					count += childCount
+				} else if child := node.getChild(nibble); child != nil {
+					count += child.LeafCount()
+				}
+			}
+		}
+		counts[journalKey{node.depth, node.path}] = count
+	}
+	return counts, nil
+}
+
+// applySubtreeCounts records the computed counts in the latest versions of the node and its children.
+func (tree *BNBSparseMerkleTree) applySubtreeCounts(node *TreeNode, counts map[journalKey]uint64) {
+	node.lock()
+	defer node.mu.Unlock()
+
+	if count, ok := counts[journalKey{node.depth, node.path}]; ok && len(node.Versions) > 0 {
+		node.Versions[len(node.Versions)-1].Count = count
+	}
+	if node.depth == tree.maxDepth {
+		return
+	}
+	// the children reloaded with a spilled node do not share the versions with the changed children
+	for _, child := range node.Children {
+		if child == nil || len(child.Versions) == 0 {
+			continue
+		}
+		if count, ok := counts[journalKey{child.depth, child.path}]; ok {
+			child.Versions[len(child.Versions)-1].Count = count
+		}
+	}
+}
+
+// applySubtreeCountsInMemory records the computed counts in the changed nodes of the tree in memory,
+// which are not the nodes iterated from the journal if they are spilled.
+func (tree *BNBSparseMerkleTree) applySubtreeCountsInMemory(node *TreeNode, counts map[journalKey]uint64) {
+	tree.applySubtreeCounts(node, counts)
+	for nibble := range node.Children {
+		child := node.getChild(nibble)
+		if child == nil || child.depth == tree.maxDepth {
+			continue
+		}
+		if _, ok := counts[journalKey{child.depth, child.path}]; ok {
+			tree.applySubtreeCountsInMemory(child, counts)
+		}
+	}
+}
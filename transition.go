@@ -0,0 +1,33 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// VerifyTransition checks that the latest committed root is preRoot, and that setting the changes on top of it
+// results in postRoot. The changes are neither staged nor committed, and the uncommitted changes are left intact.
+func (tree *BNBSparseMerkleTree) VerifyTransition(preRoot []byte, changes []Item, postRoot []byte) (bool, error) {
+	version, latestRoot := tree.Latest()
+	if !bytes.Equal(latestRoot, preRoot) {
+		return false, fmt.Errorf("%w: got %x, latest %x", ErrPreRootMismatched, preRoot, latestRoot)
+	}
+	if len(changes) == 0 {
+		return bytes.Equal(preRoot, postRoot), nil
+	}
+
+	root := tree.lastSaveRoot
+	if root == nil {
+		root = tree.root
+	}
+	newRoot, _, err := tree.stageItems(root, changes, version+1)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(newRoot.Root(), postRoot), nil
+}
@@ -7,6 +7,7 @@ package bsmt
 
 import (
 	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -15,6 +16,12 @@ const (
 )
 
 func NewTreeNode(depth uint8, path uint64, nilHashes *nilHashes, hasher *Hasher) *TreeNode {
+	return newTreeNode(uint16(depth), uint64Path(path), nilHashes, hasher)
+}
+
+// newTreeNode creates the node like NewTreeNode, the depth and the path may exceed 8 and 64 bits
+// in the trees created with WideDepth.
+func newTreeNode(depth uint16, path nodePath, nilHashes *nilHashes, hasher *Hasher) *TreeNode {
 	treeNode := &TreeNode{
 		nilHash:      nilHashes.Get(depth),
 		nilChildHash: nilHashes.Get(depth + 4),
@@ -24,6 +31,7 @@ func NewTreeNode(depth uint8, path uint64, nilHashes *nilHashes, hasher *Hasher)
 		internalMu:   make([]sync.RWMutex, 14),
 		internalVer:  make([]Version, 14),
 	}
+	treeNode.internalBuf = treeNode.newInternalBuf()
 	for i := 0; i < 2; i++ {
 		treeNode.Internals[i] = nilHashes.Get(depth + 1)
 	}
@@ -33,12 +41,18 @@ func NewTreeNode(depth uint8, path uint64, nilHashes *nilHashes, hasher *Hasher)
 	for i := 6; i < 14; i++ {
 		treeNode.Internals[i] = nilHashes.Get(depth + 3)
 	}
+	treeNode.internalPresent = allInternalsPresent
 
 	return treeNode
 }
 
 type InternalNode []byte
 
+// internalBuf is the contiguous backing array of the internal hashes of a node.
+type internalBuf [14 * hashSize]byte
+
+const allInternalsPresent = 1<<14 - 1
+
 type TreeNode struct {
 	mu        sync.RWMutex
 	Children  [16]*TreeNode
@@ -47,17 +61,27 @@ type TreeNode struct {
 
 	nilHash      []byte
 	nilChildHash []byte
-	path         uint64
-	depth        uint8
+	path         nodePath
+	depth        uint16
 	hasher       *Hasher
 	temporary    bool
 	internalMu   []sync.RWMutex
 	internalVer  []Version
+	// the computed internal hashes are stored in internalBuf, and Internals are views of it.
+	internalBuf *internalBuf
+	// presence bitmap of Internals, accessed atomically
+	internalPresent uint32
+	// whether the node has been changed since it was persisted, accessed atomically
+	dirty uint32
+	// the unix nanoseconds when the node was loaded from storage, only stamped with the read cache TTL
+	hydratedAt int64
+	// the waits on the locks are recorded with the LockProfiling option
+	lockProfile *lockProfile
 }
 
 // Root Get latest hash of a node
 func (node *TreeNode) Root() []byte {
-	node.mu.RLock()
+	node.rlock()
 	defer node.mu.RUnlock()
 
 	if len(node.Versions) == 0 {
@@ -74,30 +98,65 @@ func (node *TreeNode) root() []byte {
 	return node.Versions[len(node.Versions)-1].Hash
 }
 
+// RootAt returns the hash of a node at the given version
+func (node *TreeNode) RootAt(version Version) []byte {
+	node.rlock()
+	defer node.mu.RUnlock()
+
+	for i := len(node.Versions) - 1; i >= 0; i-- {
+		if node.Versions[i].Ver <= version {
+			return node.Versions[i].Hash
+		}
+	}
+	return node.nilHash
+}
+
+// existsAt returns whether the node has any version at or before the version.
+func (node *TreeNode) existsAt(version Version) bool {
+	node.rlock()
+	defer node.mu.RUnlock()
+	return len(node.Versions) > 0 && node.Versions[0].Ver <= version
+}
+
 func (node *TreeNode) Set(hash []byte, version Version) {
-	node.mu.Lock()
+	node.SetVersion(hash, version)
+}
+
+// SetVersion sets the hash of the node at the version like Set, and returns whether
+// it overwrote the hash of the same version rather than appended a new version.
+func (node *TreeNode) SetVersion(hash []byte, version Version) (overwritten bool) {
+	node.lock()
 	defer node.mu.Unlock()
 
-	node.newVersion(&VersionInfo{
+	node.setDirty()
+	return node.newVersion(&VersionInfo{
 		Ver:  version,
 		Hash: hash,
 	})
 }
 
-func (node *TreeNode) newVersion(version *VersionInfo) {
+// newVersion appends the version, or overwrites the latest version if it is the same one
+// and returns true.
+func (node *TreeNode) newVersion(version *VersionInfo) bool {
 	if len(node.Versions) > 0 && node.Versions[len(node.Versions)-1].Ver == version.Ver {
-		// a new version already exists, overwrite it
-		node.Versions[len(node.Versions)-1] = version
-		return
+		// a new version already exists, overwrite it in a new slice,
+		// as the backing array may be shared with the copies of the node
+		versions := make([]*VersionInfo, len(node.Versions))
+		copy(versions, node.Versions)
+		versions[len(versions)-1] = version
+		node.Versions = versions
+		return true
 	}
 	node.Versions = append(node.Versions, version)
+	return false
 }
 
 func (node *TreeNode) SetChildren(child *TreeNode, nibble int, version Version) {
-	node.mu.Lock()
+	node.lock()
 	defer node.mu.Unlock()
 
 	node.Children[nibble] = child
+	node.setDirty()
 
 	left, right := node.nilChildHash, node.nilChildHash
 	switch nibble % 2 {
@@ -119,7 +178,7 @@ func (node *TreeNode) SetChildren(child *TreeNode, nibble int, version Version)
 	prefix := 6
 	for i := 4; i >= 1; i >>= 1 {
 		nibble = nibble / 2
-		node.Internals[prefix+nibble] = node.hasher.Hash(left, right)
+		node.hashInternal(prefix+nibble, left, right)
 		switch nibble % 2 {
 		case 0:
 			left = node.Internals[prefix+nibble]
@@ -133,15 +192,37 @@ func (node *TreeNode) SetChildren(child *TreeNode, nibble int, version Version)
 	// update current root node
 	node.newVersion(&VersionInfo{
 		Ver:  version,
-		Hash: node.hasher.Hash(node.Internals[0], node.Internals[1]),
+		Hash: node.hasher.HashChildren(node.Internals[0], node.Internals[1]),
 	})
 }
 
 // Recompute all internal hashes
 func (node *TreeNode) ComputeInternalHash() {
-	node.mu.Lock()
+	node.lock()
 	defer node.mu.Unlock()
+	node.computeInternalHash()
+}
 
+// RecomputeRoot recomputes all the internal hashes from the roots of the children, regardless of
+// the cached internal hashes, and sets the resulting root as the version of the node.
+// Unlike ComputeInternalHash, which only fills the internal hashes, the root of the node is updated,
+// so it is used after the children are modified directly.
+func (node *TreeNode) RecomputeRoot(version Version) []byte {
+	node.lock()
+	defer node.mu.Unlock()
+
+	node.setDirty()
+	node.computeInternalHash()
+	root := node.hasher.HashChildren(node.Internals[0], node.Internals[1])
+	node.newVersion(&VersionInfo{
+		Ver:  version,
+		Hash: root,
+	})
+	return root
+}
+
+// computeInternalHash recomputes all internal hashes with the node lock held.
+func (node *TreeNode) computeInternalHash() {
 	// leaf node
 	for i := 0; i < 15; i += 2 {
 		left, right := node.nilChildHash, node.nilChildHash
@@ -151,43 +232,113 @@ func (node *TreeNode) ComputeInternalHash() {
 		if node.Children[i+1] != nil {
 			right = node.Children[i+1].Root()
 		}
-		node.Internals[6+i/2] = node.hasher.Hash(left, right)
+		node.hashInternal(6+i/2, left, right)
 	}
 	// internal node
 	for i := 13; i > 1; i -= 2 {
-		node.Internals[i/2-1] = node.hasher.Hash(node.Internals[i-1], node.Internals[i])
+		node.hashInternal(i/2-1, node.Internals[i-1], node.Internals[i])
 	}
 }
 
 func (node *TreeNode) Copy() *TreeNode {
-	node.mu.RLock()
+	node.rlock()
 	defer node.mu.RUnlock()
 
-	return &TreeNode{
-		Children:     node.Children,
-		Internals:    node.Internals,
-		Versions:     node.Versions,
-		nilHash:      node.nilHash,
-		nilChildHash: node.nilChildHash,
-		path:         node.path,
-		depth:        node.depth,
-		hasher:       node.hasher,
-		temporary:    node.temporary,
-		internalMu:   node.internalMu,
-		internalVer:  node.internalVer,
+	// the capacity of the versions is clipped, so appending to the versions
+	// of either node never writes to the shared backing array
+	copied := &TreeNode{
+		Children:        node.Children,
+		Internals:       node.Internals,
+		Versions:        node.Versions[:len(node.Versions):len(node.Versions)],
+		nilHash:         node.nilHash,
+		nilChildHash:    node.nilChildHash,
+		path:            node.path,
+		depth:           node.depth,
+		hasher:          node.hasher,
+		temporary:       node.temporary,
+		internalMu:      node.internalMu,
+		internalVer:     node.internalVer,
+		internalPresent: atomic.LoadUint32(&node.internalPresent),
+		dirty:           atomic.LoadUint32(&node.dirty),
+		lockProfile:     node.lockProfile,
+	}
+	copied.internalBuf = copied.newInternalBuf()
+	if node.internalBuf != nil && copied.internalBuf != nil {
+		// rebase the views of the original backing array,
+		// so that the internal hashes of the copied node are not overwritten.
+		*copied.internalBuf = *node.internalBuf
+		for i := range copied.Internals {
+			if len(copied.Internals[i]) > 0 && &copied.Internals[i][0] == &node.internalBuf[i*hashSize] {
+				copied.Internals[i] = copied.internalBuf[i*hashSize : i*hashSize+len(copied.Internals[i])]
+			}
+		}
 	}
+	return copied
 }
 
 func (node *TreeNode) mark(nibble int) {
-	//node.mu.Lock()
-	//defer node.mu.Unlock()
+	node.setDirty()
 	for _, i := range leafInternalMap[nibble] {
-		node.Internals[i] = nil
+		node.clearInternalPresent(i)
+	}
+}
+
+func (node *TreeNode) isDirty() bool {
+	return atomic.LoadUint32(&node.dirty) == 1
+}
+
+func (node *TreeNode) setDirty() {
+	atomic.StoreUint32(&node.dirty, 1)
+}
+
+func (node *TreeNode) clearDirty() {
+	atomic.StoreUint32(&node.dirty, 0)
+}
+
+// newInternalBuf returns the backing array of internal hashes, leaf nodes have no internal hashes.
+func (node *TreeNode) newInternalBuf() *internalBuf {
+	if node.nilChildHash == nil {
+		return nil
+	}
+	return new(internalBuf)
+}
+
+// hashInternal computes the internal hash at idx from left and right, the hash is
+// written into the backing array to avoid allocations.
+func (node *TreeNode) hashInternal(idx int, left, right []byte) []byte {
+	var dst []byte
+	if node.internalBuf != nil {
+		dst = node.internalBuf[idx*hashSize : idx*hashSize : (idx+1)*hashSize]
+	}
+	node.Internals[idx] = node.hasher.HashChildrenTo(dst, left, right)
+	node.setInternalPresent(idx)
+	return node.Internals[idx]
+}
+
+func (node *TreeNode) isInternalPresent(idx int) bool {
+	return atomic.LoadUint32(&node.internalPresent)&(1<<idx) != 0
+}
+
+func (node *TreeNode) setInternalPresent(idx int) {
+	for {
+		present := atomic.LoadUint32(&node.internalPresent)
+		if atomic.CompareAndSwapUint32(&node.internalPresent, present, present|1<<idx) {
+			return
+		}
+	}
+}
+
+func (node *TreeNode) clearInternalPresent(idx int) {
+	for {
+		present := atomic.LoadUint32(&node.internalPresent)
+		if atomic.CompareAndSwapUint32(&node.internalPresent, present, present&^(1<<idx)) {
+			return
+		}
 	}
 }
 
 func (node *TreeNode) Prune(oldestVersion Version) uint64 {
-	node.mu.Lock()
+	node.lock()
 	defer node.mu.Unlock()
 
 	if len(node.Versions) <= 1 {
@@ -202,16 +353,31 @@ func (node *TreeNode) Prune(oldestVersion Version) uint64 {
 
 	originSize := len(node.Versions) * versionSize
 	if i > 0 && node.Versions[i].Ver > oldestVersion {
-		node.Versions = node.Versions[i-1:]
+		node.Versions = shrinkVersions(node.Versions[i-1:])
 		return uint64(originSize - len(node.Versions)*versionSize)
 	}
 
-	node.Versions = node.Versions[i:]
+	node.Versions = shrinkVersions(node.Versions[i:])
 	return uint64(originSize - len(node.Versions)*versionSize)
 }
 
+// shrinkVersionsThreshold is the minimal capacity of the versions to shrink,
+// the small slices are kept as they are cheap to hold.
+const shrinkVersionsThreshold = 32
+
+// shrinkVersions copies the versions into a right-sized slice when its capacity
+// vastly exceeds the length, so the large backing array can be collected by GC.
+func shrinkVersions(versions []*VersionInfo) []*VersionInfo {
+	if cap(versions) < shrinkVersionsThreshold || cap(versions) <= 4*len(versions) {
+		return versions
+	}
+	shrunk := make([]*VersionInfo, len(versions))
+	copy(shrunk, versions)
+	return shrunk
+}
+
 func (node *TreeNode) Rollback(targetVersion Version) (bool, uint64) {
-	node.mu.Lock()
+	node.lock()
 	defer node.mu.Unlock()
 
 	if len(node.Versions) == 0 {
@@ -226,7 +392,13 @@ func (node *TreeNode) Rollback(targetVersion Version) (bool, uint64) {
 		}
 		next = true
 	}
-	node.Versions = node.Versions[:i+1]
+	if next {
+		node.setDirty()
+	}
+	// the rolled back versions may still be viewed by the copies of the node, clip the capacity
+	// so the versions appended later do not overwrite them
+	versions := shrinkVersions(node.Versions[:i+1])
+	node.Versions = versions[:len(versions):len(versions)]
 	return next, uint64(originSize - len(node.Versions)*versionSize)
 }
 
@@ -239,12 +411,31 @@ func (node *TreeNode) archive() {
 	for i := 0; i < len(node.Children); i++ {
 		node.Children[i] = nil
 	}
+	node.internalBuf = nil
+	atomic.StoreUint32(&node.internalPresent, 0)
 	node.temporary = true
 }
 
+// placeholder returns a temporary node holding the versions of the node, which stands for the node
+// in its parent until it is loaded again.
+func (node *TreeNode) placeholder() *TreeNode {
+	node.rlock()
+	defer node.mu.RUnlock()
+
+	return &TreeNode{
+		Versions:     node.Versions[:len(node.Versions):len(node.Versions)],
+		nilHash:      node.nilHash,
+		nilChildHash: node.nilChildHash,
+		hasher:       node.hasher,
+		temporary:    true,
+		depth:        node.depth,
+		path:         node.path,
+	}
+}
+
 // PreviousVersion returns the previous version number in the current TreeNode
 func (node *TreeNode) PreviousVersion() Version {
-	node.mu.RLock()
+	node.rlock()
 	defer node.mu.RUnlock()
 
 	if len(node.Versions) <= 1 {
@@ -264,7 +455,12 @@ func (node *TreeNode) Size() uint64 {
 // Release nodes that have not been updated for a long time from memory.
 // slowing down memory usage in runtime.
 func (node *TreeNode) Release(oldestVersion Version) uint64 {
-	node.mu.Lock()
+	return node.release(oldestVersion, nil)
+}
+
+// release releases the nodes like Release, and appends the archived nodes to archived if it is not nil.
+func (node *TreeNode) release(oldestVersion Version, archived *[]*TreeNode) uint64 {
+	node.lock()
 	defer node.mu.Unlock()
 
 	size := node.Size()
@@ -273,10 +469,13 @@ func (node *TreeNode) Release(oldestVersion Version) uint64 {
 			length := len(node.Children[i].Versions)
 			if length > 0 && node.Children[i].Versions[length-1].Ver < oldestVersion {
 				// check for the latest version and release it if it is older than the pruned version
+				if archived != nil && !node.Children[i].temporary {
+					*archived = append(*archived, node.Children[i])
+				}
 				node.Children[i].archive()
 				size += node.Children[i].Size()
 			} else {
-				size += node.Children[i].Release(oldestVersion)
+				size += node.Children[i].release(oldestVersion, archived)
 			}
 		}
 	}
@@ -290,7 +489,7 @@ func (node *TreeNode) IsTemporary() bool {
 }
 
 func (node *TreeNode) ToStorageTreeNode() *StorageTreeNode {
-	node.mu.RLock()
+	node.rlock()
 	defer node.mu.RUnlock()
 
 	var children [16]*StorageLeafNode
@@ -303,13 +502,17 @@ func (node *TreeNode) ToStorageTreeNode() *StorageTreeNode {
 		Children:  children,
 		Internals: node.Internals,
 		Versions:  node.Versions,
-		Path:      node.path,
+		Path:      node.path.low(),
+		PathHigh:  node.path.high(),
 	}
 }
 
 type VersionInfo struct {
-	Ver  Version
-	Hash []byte
+	Ver        Version
+	Hash       []byte
+	Compressed bool `rlp:"optional"`
+	// the number of the leaves not holding the nil hash under the node, only with the SubtreeCounts option
+	Count uint64 `rlp:"optional"`
 }
 
 type StorageLeafNode struct {
@@ -321,20 +524,30 @@ type StorageTreeNode struct {
 	Internals [14]InternalNode     `rlp:"optional"`
 	Versions  []*VersionInfo       `rlp:"optional"`
 	Path      uint64               `rlp:"optional"`
+	// whether the version numbers are encoded by the VersionCodec
+	VersionsEncoded bool `rlp:"optional"`
+	// the bits of the path above the lowest 64 bits, only set in the trees created with WideDepth
+	PathHigh [3]uint64 `rlp:"optional"`
 }
 
 func (node *StorageTreeNode) ToTreeNode(depth uint8, nilHashes *nilHashes, hasher *Hasher) *TreeNode {
+	return node.toTreeNode(uint16(depth), nilHashes, hasher)
+}
+
+func (node *StorageTreeNode) toTreeNode(depth uint16, nilHashes *nilHashes, hasher *Hasher) *TreeNode {
 	treeNode := &TreeNode{
 		Internals:    node.Internals,
 		Versions:     node.Versions,
 		nilHash:      nilHashes.Get(depth),
 		nilChildHash: nilHashes.Get(depth + 4),
-		path:         node.Path,
+		path:         uint64Path(node.Path).withHigh(node.PathHigh),
 		depth:        depth,
 		hasher:       hasher,
 		internalMu:   make([]sync.RWMutex, 14),
 		internalVer:  make([]Version, 14),
 	}
+	treeNode.internalBuf = treeNode.newInternalBuf()
+	treeNode.internalPresent = allInternalsPresent
 	for i := 0; i < 16; i++ {
 		if node.Children[i] != nil && len(node.Children[i].Versions) > 0 {
 			treeNode.Children[i] = &TreeNode{
@@ -344,10 +557,14 @@ func (node *StorageTreeNode) ToTreeNode(depth uint8, nilHashes *nilHashes, hashe
 				hasher:       hasher,
 				temporary:    true,
 				depth:        depth + 4,
-				path:         treeNode.path<<4 + uint64(i),
+				path:         treeNode.path.child(uint64(i)),
 			}
 		}
 	}
+	// the internal hashes are not persisted with the NoInternalStorage option
+	if treeNode.internalBuf != nil && len(node.Internals[0]) == 0 {
+		treeNode.ComputeInternalHash()
+	}
 
 	return treeNode
 }
@@ -360,7 +577,7 @@ func (node *TreeNode) latestVersion() Version {
 }
 
 func (node *TreeNode) latestVersionWithLock() Version {
-	node.mu.RLock()
+	node.rlock()
 	defer node.mu.RUnlock()
 	if len(node.Versions) <= 0 {
 		return 0
@@ -370,13 +587,15 @@ func (node *TreeNode) latestVersionWithLock() Version {
 
 // recompute inner node
 func (node *TreeNode) recompute(child *TreeNode, journals *journal, version Version) bool {
-	nibble := int(child.path & 0xf)
+	nibble := int(child.path.nibble())
+	// an absent sibling counts as the nil child hash, so a cleared subtree
+	// recomputes to the nil hash of its region
 	left, right := node.nilChildHash, node.nilChildHash
 	// if sibling haven't finished yet,quit; sibling will be charge for computing
 	switch nibble % 2 {
 	case 0:
 		left = child.root()
-		if sibling, exist := journals.get(journalKey{child.depth, child.path ^ 1}); exist {
+		if sibling, exist := journals.get(journalKey{child.depth, child.path.sibling()}); exist {
 			if sibling.latestVersionWithLock() < version {
 				return false
 			}
@@ -386,7 +605,7 @@ func (node *TreeNode) recompute(child *TreeNode, journals *journal, version Vers
 		}
 	case 1:
 		right = child.root()
-		if sibling, exist := journals.get(journalKey{child.depth, child.path ^ 1}); exist {
+		if sibling, exist := journals.get(journalKey{child.depth, child.path.sibling()}); exist {
 			if sibling.latestVersionWithLock() < version {
 				return false
 			}
@@ -420,35 +639,63 @@ func (node *TreeNode) recompute(child *TreeNode, journals *journal, version Vers
 	// update current root
 	node.newVersion(&VersionInfo{
 		Ver:  version,
-		Hash: node.hasher.Hash(node.Internals[0], node.Internals[1]),
+		Hash: node.hasher.HashChildren(node.Internals[0], node.Internals[1]),
 	})
 	return true
 }
 
 func (node *TreeNode) setInternal(idx int, left []byte, right []byte, version Version) ([]byte, bool) {
-	node.internalMu[idx].Lock()
+	node.lockInternal(idx)
 	defer node.internalMu[idx].Unlock()
-	if node.Internals[idx] != nil {
+	if node.isInternalPresent(idx) {
 		return node.Internals[idx], true
 	}
-	hash := node.hasher.Hash(left, right)
-	node.Internals[idx] = hash
+	hash := node.hashInternal(idx, left, right)
 	node.internalVer[idx] = version
 	return hash, false
 }
 
 func (node *TreeNode) getInternal(idx int) []byte {
-	node.internalMu[idx].RLock()
+	node.rlockInternal(idx)
 	defer node.internalMu[idx].RUnlock()
+	if !node.isInternalPresent(idx) {
+		return nil
+	}
 	return node.Internals[idx]
 }
 
 func (node *TreeNode) getChild(nibble int) *TreeNode {
-	node.mu.RLock()
+	node.rlock()
 	defer node.mu.RUnlock()
 	return node.Children[nibble]
 }
 
+// linkChild links the child hydrated from the placeholder into the slot of the nibble, unless the slot
+// has been linked by another goroutine in the meantime, whose child is kept.
+func (node *TreeNode) linkChild(nibble int, placeholder, child *TreeNode) {
+	node.lock()
+	defer node.mu.Unlock()
+	if node.Children[nibble] == placeholder {
+		node.Children[nibble] = child
+	}
+}
+
+// ChildPaths returns the paths of the children present in the node in the order of their nibbles,
+// the path of a child is the path of the node followed by the nibble of the child. Only the lowest 64 bits
+// of the paths are returned, which are the whole paths in the trees of at most 64 levels.
+func (node *TreeNode) ChildPaths() []uint64 {
+	node.rlock()
+	defer node.mu.RUnlock()
+
+	var paths []uint64
+	for nibble, child := range node.Children {
+		if child != nil {
+			paths = append(paths, node.path.child(uint64(nibble)).low())
+		}
+	}
+	return paths
+}
+
 var leafInternalMap = map[int][]int{
 	0:  {0, 2, 6},
 	1:  {0, 2, 6},
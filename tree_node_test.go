@@ -10,6 +10,11 @@ import (
 	"crypto/sha256"
 	"hash"
 	"testing"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bnb-chain/zkbnb-smt/database/memory"
 )
 
 func TestTreeNode_Copy(t *testing.T) {
@@ -61,3 +66,286 @@ func TestTreeNode_Copy(t *testing.T) {
 		}
 	}
 }
+
+func TestTreeNode_Internals(t *testing.T) {
+	hasher := NewHasherPool(func() hash.Hash {
+		return sha256.New()
+	})
+	nilHashes := constructNilHashes(8, nilHash, hasher)
+	node := NewTreeNode(0, 0, nilHashes, hasher)
+	for i := 0; i < len(node.Children); i++ {
+		child := NewTreeNode(4, uint64(i), nilHashes, hasher)
+		child.Set(hasher.Hash([]byte{byte(i)}), 1)
+		node.SetChildren(child, i, 1)
+	}
+
+	// compute the expected internal hashes without the backing array
+	var expected [14][]byte
+	for i := 0; i < 16; i += 2 {
+		expected[6+i/2] = hasher.Hash(node.Children[i].Root(), node.Children[i+1].Root())
+	}
+	for i := 13; i > 1; i -= 2 {
+		expected[i/2-1] = hasher.Hash(expected[i-1], expected[i])
+	}
+	for i := range expected {
+		assert.Equalf(t, expected[i], []byte(node.Internals[i]), "internal %d", i)
+		assert.True(t, node.isInternalPresent(i))
+	}
+	assert.Equal(t, hasher.Hash(expected[0], expected[1]), node.Root())
+
+	// the copied node owns its backing array
+	copied := node.Copy()
+	copied.ComputeInternalHash()
+	for i := range expected {
+		assert.Equalf(t, expected[i], []byte(copied.Internals[i]), "internal %d", i)
+	}
+	copied.SetChildren(nil, 0, 2)
+	for i := range expected {
+		assert.Equalf(t, expected[i], []byte(node.Internals[i]), "internal %d", i)
+	}
+	assert.NotEqual(t, expected[6], []byte(copied.Internals[6]))
+
+	// marked internals are absent until they are set again
+	copied.mark(5)
+	for _, i := range leafInternalMap[5] {
+		assert.False(t, copied.isInternalPresent(i))
+		assert.Nil(t, copied.getInternal(i))
+		_, setBefore := copied.setInternal(i, expected[i], expected[i], 2)
+		assert.False(t, setBefore)
+		assert.Equal(t, hasher.Hash(expected[i], expected[i]), copied.getInternal(i))
+		_, setBefore = copied.setInternal(i, expected[i], expected[i], 2)
+		assert.True(t, setBefore)
+	}
+	for i := range expected {
+		assert.True(t, node.isInternalPresent(i))
+	}
+
+	copied.archive()
+	for i := range expected {
+		assert.False(t, copied.isInternalPresent(i))
+		assert.Nil(t, copied.Internals[i])
+	}
+}
+
+func BenchmarkTreeNode_ComputeInternalHash(b *testing.B) {
+	hasher := NewHasherPool(func() hash.Hash {
+		return sha256.New()
+	})
+	nilHashes := constructNilHashes(8, nilHash, hasher)
+	node := NewTreeNode(0, 0, nilHashes, hasher)
+	for i := 0; i < len(node.Children); i++ {
+		child := NewTreeNode(4, uint64(i), nilHashes, hasher)
+		child.Set(hasher.Hash([]byte{byte(i)}), 1)
+		node.Children[i] = child
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		node.ComputeInternalHash()
+	}
+}
+
+func TestTreeNode_ShrinkVersions(t *testing.T) {
+	hasher := NewHasherPool(func() hash.Hash {
+		return sha256.New()
+	})
+	nilHashes := constructNilHashes(8, nilHash, hasher)
+	newNode := func() *TreeNode {
+		node := NewTreeNode(8, 0, nilHashes, hasher)
+		for i := 1; i <= 1000; i++ {
+			node.Set(hasher.Hash([]byte{byte(i)}), Version(i))
+		}
+		assert.GreaterOrEqual(t, cap(node.Versions), 1000)
+		return node
+	}
+
+	node := newNode()
+	node.Prune(995)
+	assert.Len(t, node.Versions, 6)
+	assert.Less(t, cap(node.Versions), shrinkVersionsThreshold)
+	assert.Equal(t, Version(995), node.Versions[0].Ver)
+	assert.Equal(t, hasher.Hash([]byte{byte(1000 % 256)}), node.Root())
+
+	node = newNode()
+	node.Rollback(3)
+	assert.Len(t, node.Versions, 3)
+	assert.Less(t, cap(node.Versions), shrinkVersionsThreshold)
+	assert.Equal(t, hasher.Hash([]byte{3}), node.Root())
+
+	// the capacity is kept when most of it is in use
+	node = newNode()
+	capacity := cap(node.Versions)
+	node.Prune(300)
+	assert.Len(t, node.Versions, 701)
+	assert.Equal(t, capacity-299, cap(node.Versions))
+}
+
+// run with -race to detect the copies sharing the versions with the node being committed
+func TestTreeNode_SetVersion(t *testing.T) {
+	hasher := NewHasherPool(func() hash.Hash {
+		return sha256.New()
+	})
+	nilHashes := constructNilHashes(8, nilHash, hasher)
+	node := NewTreeNode(8, 0, nilHashes, hasher)
+
+	assert.False(t, node.SetVersion(hasher.Hash([]byte{1}), 1))
+	assert.False(t, node.SetVersion(hasher.Hash([]byte{2}), 2))
+	assert.True(t, node.SetVersion(hasher.Hash([]byte{3}), 2))
+	assert.Len(t, node.Versions, 2)
+	assert.Equal(t, hasher.Hash([]byte{3}), node.Root())
+	assert.Equal(t, hasher.Hash([]byte{1}), node.Versions[0].Hash)
+
+	// only the latest version is overwritten, the new version is appended
+	assert.False(t, node.SetVersion(hasher.Hash([]byte{4}), 3))
+	assert.Len(t, node.Versions, 3)
+	assert.True(t, node.SetVersion(hasher.Hash([]byte{5}), 3))
+	assert.Len(t, node.Versions, 3)
+	assert.Equal(t, hasher.Hash([]byte{5}), node.Root())
+}
+
+func TestTreeNode_RecomputeRoot(t *testing.T) {
+	hasher := NewHasherPool(func() hash.Hash {
+		return sha256.New()
+	})
+	nilHashes := constructNilHashes(8, nilHash, hasher)
+	node := NewTreeNode(0, 0, nilHashes, hasher)
+	for i := 0; i < 16; i += 3 {
+		child := NewTreeNode(4, uint64(i), nilHashes, hasher)
+		child.Set(hasher.Hash([]byte{byte(i)}), 1)
+		node.SetChildren(child, i, 1)
+	}
+
+	// modify a child directly, the cached internal hashes are stale
+	child := node.Children[3].Copy()
+	child.Set(hasher.Hash([]byte("modified")), 2)
+	node.Children[3] = child
+	stale := node.Root()
+	root := node.RecomputeRoot(2)
+	assert.NotEqual(t, stale, root)
+	assert.Equal(t, root, node.Root())
+	assert.Equal(t, Version(2), node.latestVersion())
+	assert.Len(t, node.Versions, 2)
+
+	// the same root as filling the internal hashes of the modified node
+	expected := node.Copy()
+	expected.ComputeInternalHash()
+	assert.Equal(t, hasher.Hash(expected.Internals[0], expected.Internals[1]), root)
+	assert.Equal(t, expected.Internals, node.Internals)
+
+	// the same root as setting the child through the parent
+	other := NewTreeNode(0, 0, nilHashes, hasher)
+	for i := 0; i < 16; i += 3 {
+		other.SetChildren(node.Children[i], i, 2)
+	}
+	assert.Equal(t, other.Root(), root)
+}
+
+func TestTreeNode_ChildPaths(t *testing.T) {
+	hasher := NewHasherPool(func() hash.Hash {
+		return sha256.New()
+	})
+	nilHashes := constructNilHashes(16, nilHash, hasher)
+	node := NewTreeNode(4, 0xa, nilHashes, hasher)
+	assert.Empty(t, node.ChildPaths())
+
+	for _, nibble := range []int{15, 0, 7} {
+		child := NewTreeNode(8, 0xa0|uint64(nibble), nilHashes, hasher)
+		child.Set(hasher.Hash([]byte{byte(nibble)}), 1)
+		node.SetChildren(child, nibble, 1)
+	}
+	assert.Equal(t, []uint64{0xa0, 0xa7, 0xaf}, node.ChildPaths())
+	for i, path := range node.ChildPaths() {
+		assert.Equal(t, uint64Path(path), node.Children[path&0xf].path, "index %d", i)
+	}
+}
+
+func TestTreeNode_CopyIsolation(t *testing.T) {
+	hasher := NewHasherPool(func() hash.Hash {
+		return sha256.New()
+	})
+	nilHashes := constructNilHashes(8, nilHash, hasher)
+	node := NewTreeNode(8, 0, nilHashes, hasher)
+	node.Set(hasher.Hash([]byte{0}), 1)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 2; i < 2000; i++ {
+			// stage, overwrite and roll back the versions like the commits do
+			node.Set(hasher.Hash([]byte{byte(i)}), Version(i))
+			node.Set(hasher.Hash([]byte{byte(i), 1}), Version(i))
+			if i%10 == 0 {
+				node.Rollback(Version(i - 5))
+			}
+		}
+	}()
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		copied := node.Copy()
+		snapshot := make([]VersionInfo, len(copied.Versions))
+		for i, v := range copied.Versions {
+			snapshot[i] = *v
+		}
+		copied.Set(hasher.Hash([]byte("copied")), 1<<32)
+		copied.Set(hasher.Hash([]byte("copied")), 1<<32)
+
+		// the copy is not affected by the node and vice versa
+		assert.Len(t, copied.Versions, len(snapshot)+1)
+		for i := range snapshot {
+			assert.Equal(t, snapshot[i], *copied.Versions[i])
+		}
+		assert.NotEqual(t, Version(1<<32), node.latestVersionWithLock())
+	}
+}
+
+func TestDiffStorageNodes(t *testing.T) {
+	hasher := NewHasherPool(func() hash.Hash {
+		return sha256.New()
+	})
+	db := memory.NewMemoryDB()
+	codec := NodeCodec{VersionCodec: DeltaVersionCodec{}}
+	smt, err := NewBNBSparseMerkleTree(hasher, db, 8, nilHash, VersionEncoding(codec.VersionCodec))
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, smt.Set(uint64(i*17), hasher.Hash([]byte{byte(i)})))
+		_, err = smt.Commit(nil)
+		assert.NoError(t, err)
+	}
+	blob, err := db.Get(storageFullTreeNodeKey(0, 0))
+	assert.NoError(t, err)
+
+	diff, err := DiffStorageNodes(blob, blob, codec)
+	assert.NoError(t, err)
+	assert.True(t, diff.Empty())
+	_, err = DiffStorageNodes(blob, blob, NodeCodec{})
+	assert.ErrorIs(t, err, ErrNoVersionCodec)
+
+	// the node differs in one internal hash
+	node := &StorageTreeNode{}
+	assert.NoError(t, rlp.DecodeBytes(blob, node))
+	node.Internals[3] = hasher.Hash([]byte("diverged"))
+	diverged, err := rlp.EncodeToBytes(node)
+	assert.NoError(t, err)
+	diff, err = DiffStorageNodes(blob, diverged, codec)
+	assert.NoError(t, err)
+	assert.Equal(t, &NodeDiff{Internals: []int{3}}, diff)
+
+	// the node differs in the hash of a version and in a child
+	node = &StorageTreeNode{}
+	assert.NoError(t, rlp.DecodeBytes(blob, node))
+	node.Versions[len(node.Versions)-1].Hash = hasher.Hash([]byte("diverged"))
+	node.Children[1] = nil
+	diverged, err = rlp.EncodeToBytes(node)
+	assert.NoError(t, err)
+	diff, err = DiffStorageNodes(blob, diverged, codec)
+	assert.NoError(t, err)
+	assert.Equal(t, []Version{3}, diff.Versions)
+	assert.Equal(t, []int{1}, diff.Children)
+	assert.Empty(t, diff.Internals)
+}
@@ -0,0 +1,33 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import "sync/atomic"
+
+// Prepare freezes the staged changes for the coming commit and returns the root they produce,
+// the mutations are rejected with ErrCommitPending until Commit or Abort.
+func (tree *BNBSparseMerkleTree) Prepare() []byte {
+	atomic.StoreUint32(&tree.commitPending, 1)
+	return tree.Root()
+}
+
+// Abort discards the prepared changes and allows the mutations again.
+func (tree *BNBSparseMerkleTree) Abort() {
+	tree.Reset()
+}
+
+// checkPending returns ErrCommitPending if the staged changes are prepared for commit.
+func (tree *BNBSparseMerkleTree) checkPending() error {
+	if atomic.LoadUint32(&tree.commitPending) == 1 {
+		return ErrCommitPending
+	}
+	return nil
+}
+
+// clearPending allows the mutations once the prepared changes are committed or discarded.
+func (tree *BNBSparseMerkleTree) clearPending() {
+	atomic.StoreUint32(&tree.commitPending, 0)
+}
@@ -0,0 +1,85 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"bytes"
+
+	"github.com/bnb-chain/zkbnb-smt/utils"
+)
+
+// VerifierConfig describes the hashing scheme of the tree a proof is produced by, so the proofs
+// of a differently configured tree, e.g. another implementation with domain separation, can be verified.
+type VerifierConfig struct {
+	// Hasher hashes the leaves and the nodes.
+	Hasher *Hasher
+	// LeafPrefix is prepended to the value to hash the leaf, the value is the leaf hash itself
+	// if it is nil, like the values set to the tree.
+	LeafPrefix []byte
+	// InternalPrefix is prepended to the children to hash the nodes.
+	InternalPrefix []byte
+	// ChildOrder is the order the children are hashed in.
+	ChildOrder ChildOrder
+	// ProofOrder is the order of the siblings in the proof.
+	ProofOrder Order
+	// NilLeaf is the hash of the empty leaf, the leaf of a nil value.
+	NilLeaf []byte
+	// Depth is the depth of the tree checked against the length of the proof if it is positive,
+	// otherwise the depth is the length of the proof.
+	Depth uint8
+}
+
+// leaf returns the leaf hash of the value.
+func (cfg *VerifierConfig) leaf(value []byte) []byte {
+	if len(value) == 0 {
+		return cfg.NilLeaf
+	}
+	if cfg.LeafPrefix == nil {
+		return value
+	}
+	return cfg.Hasher.Hash(cfg.LeafPrefix, value)
+}
+
+// node returns the hash of the node of the left and right children.
+func (cfg *VerifierConfig) node(left, right []byte) []byte {
+	if cfg.ChildOrder == RightLeft {
+		left, right = right, left
+	}
+	if cfg.InternalPrefix == nil {
+		return cfg.Hasher.Hash(left, right)
+	}
+	return cfg.Hasher.Hash(cfg.InternalPrefix, left, right)
+}
+
+// VerifyWithConfig verifies the proof of the value of the key against the root of a tree hashed
+// as described by the config, independent of the configuration of any tree in this package.
+// A nil value proves the key is absent. It returns false if the proof leads to another root.
+func VerifyWithConfig(cfg VerifierConfig, proof Proof, root []byte, key uint64, value []byte) (bool, error) {
+	if cfg.Depth > 0 {
+		if err := checkProofLength(proof, int(cfg.Depth)); err != nil {
+			return false, err
+		}
+	}
+	if len(proof) > 64 {
+		return false, ErrInvalidProof
+	}
+	if len(proof) < 64 && key>>len(proof) != 0 {
+		return false, ErrInvalidKey
+	}
+	if cfg.ProofOrder == RootToLeaf {
+		proof = utils.ReverseBytes(append(Proof{}, proof...))
+	}
+
+	node := cfg.leaf(value)
+	for level, sibling := range proof {
+		if (key>>level)&1 == 0 {
+			node = cfg.node(node, sibling)
+		} else {
+			node = cfg.node(sibling, node)
+		}
+	}
+	return bytes.Equal(node, root), nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"sync"
+)
+
+// versionNodes are the nodes resolved by the reads of a version.
+type versionNodes struct {
+	mu    sync.RWMutex
+	nodes map[journalKey]*TreeNode
+}
+
+func (n *versionNodes) get(key journalKey) (*TreeNode, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	node, exist := n.nodes[key]
+	return node, exist
+}
+
+func (n *versionNodes) set(key journalKey, node *TreeNode) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nodes[key] = node
+}
+
+// childAt returns the child at the nibble of the node for the reads of the version, the child is loaded
+// from storage if it is not in memory. With the VersionCache option, the children resolved for the version
+// are reused by the later reads of the version, even if they have been released from the tree since.
+func (tree *BNBSparseMerkleTree) childAt(node *TreeNode, nibble uint64, path nodePath, depth uint16, version Version) (*TreeNode, error) {
+	if tree.versionCache == nil {
+		if err := tree.extendNode(node, nibble, path, depth, false); err != nil {
+			return nil, err
+		}
+		return node.getChild(int(nibble)), nil
+	}
+
+	cached, _ := tree.versionCache.Get(version)
+	if cached == nil {
+		cached = &versionNodes{nodes: make(map[journalKey]*TreeNode)}
+		if exist, _ := tree.versionCache.ContainsOrAdd(version, cached); exist {
+			cached, _ = tree.versionCache.Get(version)
+		}
+	}
+	nodes := cached.(*versionNodes)
+	key := journalKey{depth, path}
+	if child, exist := nodes.get(key); exist {
+		return child, nil
+	}
+	if err := tree.extendNode(node, nibble, path, depth, false); err != nil {
+		return nil, err
+	}
+	child := node.getChild(int(nibble))
+	if child != nil && !child.IsTemporary() {
+		// the nodes of the tree are archived in place when they are released, so a copy is cached
+		child = child.Copy()
+		nodes.set(key, child)
+	}
+	return child, nil
+}
+
+// purgeVersionCache drops the nodes cached for the versions, as the versions are reused after a rollback.
+func (tree *BNBSparseMerkleTree) purgeVersionCache() {
+	if tree.versionCache != nil {
+		tree.versionCache.Purge()
+	}
+}
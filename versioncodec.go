@@ -0,0 +1,105 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+// VersionCodec encodes the ascending versions of a node before they are persisted,
+// the versions are stored as RLP integers, so the smaller encoded numbers take fewer bytes.
+// Decode must restore exactly the versions passed to Encode.
+type VersionCodec interface {
+	Encode(versions []Version) []Version
+	Decode(encoded []Version) []Version
+}
+
+var _ VersionCodec = DeltaVersionCodec{}
+
+// DeltaVersionCodec encodes each version as the delta from the previous one.
+type DeltaVersionCodec struct{}
+
+func (DeltaVersionCodec) Encode(versions []Version) []Version {
+	encoded := make([]Version, len(versions))
+	for i, version := range versions {
+		encoded[i] = version
+		if i > 0 {
+			encoded[i] -= versions[i-1]
+		}
+	}
+	return encoded
+}
+
+func (DeltaVersionCodec) Decode(encoded []Version) []Version {
+	versions := make([]Version, len(encoded))
+	for i, delta := range encoded {
+		versions[i] = delta
+		if i > 0 {
+			versions[i] += versions[i-1]
+		}
+	}
+	return versions
+}
+
+// encodeVersions returns the versions with the version numbers encoded by the codec,
+// the original versions are left untouched.
+func (tree *BNBSparseMerkleTree) encodeVersions(versions []*VersionInfo) []*VersionInfo {
+	if len(versions) == 0 {
+		return versions
+	}
+	numbers := make([]Version, len(versions))
+	for i, version := range versions {
+		numbers[i] = version.Ver
+	}
+	numbers = tree.versionCodec.Encode(numbers)
+	encoded := make([]*VersionInfo, len(versions))
+	for i, version := range versions {
+		copied := *version
+		copied.Ver = numbers[i]
+		encoded[i] = &copied
+	}
+	return encoded
+}
+
+// decodeVersions decodes the version numbers in place.
+func (tree *BNBSparseMerkleTree) decodeVersions(versions []*VersionInfo) {
+	if len(versions) == 0 {
+		return
+	}
+	numbers := make([]Version, len(versions))
+	for i, version := range versions {
+		numbers[i] = version.Ver
+	}
+	numbers = tree.versionCodec.Decode(numbers)
+	for i, version := range versions {
+		version.Ver = numbers[i]
+	}
+}
+
+// encodeStorageTreeNode encodes the version numbers of the node and of its children.
+func (tree *BNBSparseMerkleTree) encodeStorageTreeNode(node *StorageTreeNode) {
+	node.Versions = tree.encodeVersions(node.Versions)
+	for i := range node.Children {
+		if node.Children[i] != nil {
+			node.Children[i] = &StorageLeafNode{tree.encodeVersions(node.Children[i].Versions)}
+		}
+	}
+	node.VersionsEncoded = true
+}
+
+// decodeStorageTreeNode decodes the version numbers of the node encoded by the codec.
+func (tree *BNBSparseMerkleTree) decodeStorageTreeNode(node *StorageTreeNode) error {
+	if !node.VersionsEncoded {
+		return nil
+	}
+	if tree.versionCodec == nil {
+		return ErrNoVersionCodec
+	}
+	tree.decodeVersions(node.Versions)
+	for _, child := range node.Children {
+		if child != nil {
+			tree.decodeVersions(child.Versions)
+		}
+	}
+	node.VersionsEncoded = false
+	return nil
+}
@@ -0,0 +1,44 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+// VersionWindows returns the inclusive ranges of the committed versions served from memory and from storage.
+// The retained window spans the versions that can be queried, from the oldest one kept by pruning to the latest.
+// The in-memory window starts after the latest version of the nodes released from memory, so the nodes changed
+// in the window are all resident and only the older ones have to be hydrated from storage. The in-memory window
+// is empty, with its start after its end, when the nodes of the latest version have been released.
+func (tree *BNBSparseMerkleTree) VersionWindows() (inMemory [2]Version, retained [2]Version) {
+	latest, _ := tree.Latest()
+	recent := tree.RecentVersion()
+	retained = [2]Version{recent, latest}
+	if versions := tree.Versions(); len(versions) > 0 && versions[0] > recent {
+		retained[0] = versions[0]
+	}
+
+	// the released nodes are kept as temporary nodes holding their versions only
+	var released Version
+	var walk func(node *TreeNode)
+	walk = func(node *TreeNode) {
+		if node.IsTemporary() {
+			if version := node.latestVersionWithLock(); version > released {
+				released = version
+			}
+			return
+		}
+		for nibble := range node.Children {
+			if child := node.getChild(nibble); child != nil {
+				walk(child)
+			}
+		}
+	}
+	walk(tree.proofRoot())
+
+	inMemory = retained
+	if released > 0 && released >= inMemory[0] {
+		inMemory[0] = released + 1
+	}
+	return inMemory, retained
+}
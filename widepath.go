@@ -0,0 +1,223 @@
+// Copyright 2022 bnb-chain. All Rights Reserved.
+//
+// Distributed under MIT license.
+// See file LICENSE for detail or copy at https://opensource.org/licenses/MIT
+
+package bsmt
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// WideKey is a key of the trees deeper than 64 levels, created with the WideDepth option.
+// It is the big endian integer of the path of the leaf, so the keys of a tree of depth d
+// are below 2^d, and a uint64 key is the same leaf as the WideKey of its 8 lowest bytes.
+type WideKey [32]byte
+
+// WideKeyFromUint64 returns the WideKey of the uint64 key.
+func WideKeyFromUint64(key uint64) WideKey {
+	var wide WideKey
+	binary.BigEndian.PutUint64(wide[24:], key)
+	return wide
+}
+
+func (key WideKey) path() nodePath {
+	var path nodePath
+	for i := range path {
+		path[i] = binary.BigEndian.Uint64(key[i*8:])
+	}
+	return path
+}
+
+// nodePath is the path of a node from the root as an unsigned integer of 256 bits, the nibble
+// of the node in its parent is the lowest 4 bits. The words are in big endian order,
+// so the paths of the trees of at most 64 levels only occupy the last word.
+type nodePath [4]uint64
+
+// uint64Path returns the path of the uint64 key.
+func uint64Path(key uint64) nodePath {
+	return nodePath{3: key}
+}
+
+// low returns the lowest 64 bits of the path, which is the whole path if it fits in 64 bits.
+func (p nodePath) low() uint64 {
+	return p[3]
+}
+
+// fitsUint64 returns whether the path has no bits above the lowest 64 bits.
+func (p nodePath) fitsUint64() bool {
+	return p[0]|p[1]|p[2] == 0
+}
+
+// nibble returns the position of the node in its parent.
+func (p nodePath) nibble() uint64 {
+	return p[3] & 0xf
+}
+
+// bit returns the bit of the path at the level above the node.
+func (p nodePath) bit(level int) uint64 {
+	return p[3-level/64] >> (level % 64) & 1
+}
+
+// child returns the path of the child at the nibble of the node.
+func (p nodePath) child(nibble uint64) nodePath {
+	child := p.lsh(4)
+	child[3] |= nibble
+	return child
+}
+
+// sibling returns the path of the node whose lowest bit differs.
+func (p nodePath) sibling() nodePath {
+	p[3] ^= 1
+	return p
+}
+
+// rsh returns the path shifted right by n bits.
+func (p nodePath) rsh(n int) nodePath {
+	var shifted nodePath
+	words, offset := n/64, uint(n%64)
+	for i := 3; i-words >= 0; i-- {
+		shifted[i] = p[i-words] >> offset
+		if offset > 0 && i-words-1 >= 0 {
+			shifted[i] |= p[i-words-1] << (64 - offset)
+		}
+	}
+	return shifted
+}
+
+// lsh returns the path shifted left by n bits, the bits shifted beyond 256 bits are dropped.
+func (p nodePath) lsh(n int) nodePath {
+	var shifted nodePath
+	words, offset := n/64, uint(n%64)
+	for i := 0; i+words <= 3; i++ {
+		shifted[i] = p[i+words] << offset
+		if offset > 0 && i+words+1 <= 3 {
+			shifted[i] |= p[i+words+1] >> (64 - offset)
+		}
+	}
+	return shifted
+}
+
+// within returns whether the path has no bits at or above the bits.
+func (p nodePath) within(n int) bool {
+	return n >= maxWideDepth || p.rsh(n) == nodePath{}
+}
+
+func (p nodePath) less(q nodePath) bool {
+	for i := range p {
+		if p[i] != q[i] {
+			return p[i] < q[i]
+		}
+	}
+	return false
+}
+
+// bytes returns the path as 8 big endian bytes if it fits in 64 bits, otherwise as 32 bytes.
+func (p nodePath) bytes() []byte {
+	if p.fitsUint64() {
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, p.low())
+		return buf
+	}
+	buf := make([]byte, 32)
+	for i := range p {
+		binary.BigEndian.PutUint64(buf[i*8:], p[i])
+	}
+	return buf
+}
+
+// high returns the words of the path above the lowest 64 bits.
+func (p nodePath) high() [3]uint64 {
+	return [3]uint64{p[0], p[1], p[2]}
+}
+
+// withHigh returns the path of the lowest 64 bits of p and the higher words.
+func (p nodePath) withHigh(high [3]uint64) nodePath {
+	return nodePath{high[0], high[1], high[2], p[3]}
+}
+
+// hex formats the path in hex with the 0x prefix, the paths beyond 64 bits are padded to 32 bytes.
+func (p nodePath) hex() string {
+	if p.fitsUint64() {
+		return fmt.Sprintf("%#x", p.low())
+	}
+	return fmt.Sprintf("%#x", p.bytes())
+}
+
+// String formats the path in decimal if it fits in 64 bits, otherwise in hex.
+func (p nodePath) String() string {
+	if p.fitsUint64() {
+		return fmt.Sprintf("%d", p.low())
+	}
+	return fmt.Sprintf("%#x", p.bytes())
+}
+
+// encodePath returns the path as 8 big endian bytes in the trees of at most 64 levels, otherwise as 32 bytes,
+// so all the paths of a tree are encoded in the same length.
+func (tree *BNBSparseMerkleTree) encodePath(path nodePath) []byte {
+	if tree.maxDepth <= maxTreeDepth {
+		return uint64Path(path.low()).bytes()
+	}
+	buf := make([]byte, 32)
+	for i := range path {
+		binary.BigEndian.PutUint64(buf[i*8:], path[i])
+	}
+	return buf
+}
+
+// hashPath hashes the leaf up to the root by the siblings of the proof from the leaf to the root,
+// the side of each sibling is taken from the bit of the path at its level.
+func (tree *BNBSparseMerkleTree) hashPath(path nodePath, leaf []byte, proof Proof) []byte {
+	node := leaf
+	for level, sibling := range proof {
+		if path.bit(level) == 0 {
+			node = tree.hasher.HashChildren(node, sibling)
+		} else {
+			node = tree.hasher.HashChildren(sibling, node)
+		}
+	}
+	return node
+}
+
+// checkNarrow rejects the operations addressing the leaves by uint64 keys on the trees deeper than 64 levels,
+// as their results would leave out the bits of the paths above 64 bits.
+func (tree *BNBSparseMerkleTree) checkNarrow() error {
+	if tree.maxDepth > maxTreeDepth {
+		return fmt.Errorf("%w: the keys of the depth %d exceed 64 bits", ErrInvalidDepth, tree.maxDepth)
+	}
+	return nil
+}
+
+// SetWide sets the value of the wide key like Set.
+func (tree *BNBSparseMerkleTree) SetWide(key WideKey, val []byte) error {
+	return tree.setWithVersion(key.path(), val, tree.version+1)
+}
+
+// GetWide returns the value of the wide key at the version like Get.
+func (tree *BNBSparseMerkleTree) GetWide(key WideKey, version *Version) ([]byte, error) {
+	return tree.get(key.path(), version)
+}
+
+// GetWideProof returns the proof of the wide key in the latest tree like GetProof.
+func (tree *BNBSparseMerkleTree) GetWideProof(key WideKey) (Proof, error) {
+	proof, err := tree.getProof(key.path())
+	if err != nil {
+		return nil, err
+	}
+	return tree.orderProof(proof), nil
+}
+
+// GetWideProofAt returns the proof of the wide key at the version like GetProofAt.
+func (tree *BNBSparseMerkleTree) GetWideProofAt(key WideKey, version Version) (Proof, error) {
+	proof, err := tree.getProofAt(key.path(), version)
+	if err != nil {
+		return nil, err
+	}
+	return tree.orderProof(proof), nil
+}
+
+// VerifyWideProof verifies the proof of the wide key against the latest tree like VerifyProof.
+func (tree *BNBSparseMerkleTree) VerifyWideProof(key WideKey, proof Proof) bool {
+	return tree.verifyProof(key.path(), proof)
+}